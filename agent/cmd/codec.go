@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bsed/trace/agent/service"
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/imdevlab/g"
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchRounds  int
+	benchDicts   []string
+	benchSamples string
+)
+
+// codecBenchCmd 使用采集的span数据测试各压缩算法的压缩率和吞吐
+var codecBenchCmd = &cobra.Command{
+	Use:   "codec-bench [files...]",
+	Short: "测试压缩算法，数据为磁盘缓存文件(.spill)或者连续的TracePack报文",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		g.InitLogger("error")
+
+		if err := network.LoadZstdDictFiles(benchDicts...); err != nil {
+			return err
+		}
+
+		payloads := make([][]byte, 0)
+		for _, path := range args {
+			frames, err := readFrames(path)
+			if err != nil {
+				return fmt.Errorf("%s, %v", path, err)
+			}
+			for _, frame := range frames {
+				packet := network.NewTracePack()
+				if err := packet.Decode(bytes.NewReader(frame)); err != nil {
+					return fmt.Errorf("%s, %v", path, err)
+				}
+				// 只统计需要压缩的数据报文
+				if packet.Type == constant.TypeOfCmd || len(packet.Payload) == 0 {
+					continue
+				}
+				payloads = append(payloads, packet.Payload)
+			}
+		}
+		if len(payloads) == 0 {
+			return fmt.Errorf("no payload found")
+		}
+
+		// 导出样本用于 zstd --train 训练字典
+		if len(benchSamples) > 0 {
+			if err := writeSamples(benchSamples, payloads); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("%-24s %10s %14s %14s %8s %14s %14s\n", "codec", "payloads", "raw", "encoded", "ratio", "encode(MB/s)", "decode(MB/s)")
+		for _, name := range network.CodecNames() {
+			codec, _ := network.CodecByName(name)
+			stats, err := benchCodec(codec, payloads, benchRounds)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%-24s %10d %14d %14d %8.3f %14.1f %14.1f\n", stats.Name, stats.Payloads, stats.RawBytes, stats.Bytes, stats.Ratio(), stats.EncodeSpeed(), stats.DecodeSpeed())
+		}
+		return nil
+	},
+}
+
+// codecStats 压缩算法在一批payload上的测试结果
+type codecStats struct {
+	Name       string
+	Payloads   int
+	RawBytes   int64         // 压缩前的字节数
+	Bytes      int64         // 压缩后的字节数
+	EncodeTime time.Duration // 所有轮次的压缩耗时
+	DecodeTime time.Duration // 所有轮次的解压耗时
+	Rounds     int
+}
+
+// Ratio 压缩率，压缩后/压缩前
+func (s *codecStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 0
+	}
+	return float64(s.Bytes) / float64(s.RawBytes)
+}
+
+// EncodeSpeed 压缩吞吐，单位MB/s
+func (s *codecStats) EncodeSpeed() float64 {
+	return throughput(s.RawBytes*int64(s.Rounds), s.EncodeTime)
+}
+
+// DecodeSpeed 解压吞吐，按解压后的字节数计算，单位MB/s
+func (s *codecStats) DecodeSpeed() float64 {
+	return throughput(s.RawBytes*int64(s.Rounds), s.DecodeTime)
+}
+
+func throughput(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / (1 << 20) / d.Seconds()
+}
+
+// benchCodec 对采集的payload重复压缩、解压rounds轮，解压结果与原数据不一致时返回错误
+func benchCodec(codec network.Codec, payloads [][]byte, rounds int) (*codecStats, error) {
+	if rounds <= 0 {
+		rounds = 1
+	}
+	stats := &codecStats{
+		Name:     codec.Name(),
+		Payloads: len(payloads),
+		Rounds:   rounds,
+	}
+
+	encoded := make([][]byte, len(payloads))
+	for _, payload := range payloads {
+		stats.RawBytes += int64(len(payload))
+	}
+
+	start := time.Now()
+	for i := 0; i < rounds; i++ {
+		for j, payload := range payloads {
+			encoded[j] = codec.Encode(payload)
+		}
+	}
+	stats.EncodeTime = time.Since(start)
+
+	for _, b := range encoded {
+		stats.Bytes += int64(len(b))
+	}
+
+	start = time.Now()
+	for i := 0; i < rounds; i++ {
+		for j, b := range encoded {
+			decoded, err := codec.Decode(b)
+			if err != nil {
+				return nil, fmt.Errorf("%s decode payload %d, %v", codec.Name(), j, err)
+			}
+			if i == 0 && !bytes.Equal(decoded, payloads[j]) {
+				return nil, fmt.Errorf("%s decode payload %d, data mismatch", codec.Name(), j)
+			}
+		}
+	}
+	stats.DecodeTime = time.Since(start)
+	return stats, nil
+}
+
+// readFrames 读取文件中的报文
+func readFrames(path string) ([][]byte, error) {
+	if strings.HasSuffix(path, ".spill") {
+		return service.ReadSpillFrames(path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, 0)
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		offset := len(data) - reader.Len()
+		packet := network.NewTracePack()
+		if err := packet.Decode(reader); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		frames = append(frames, data[offset:len(data)-reader.Len()])
+	}
+	return frames, nil
+}
+
+// writeSamples 每个payload写入一个文件
+func writeSamples(dir string, payloads [][]byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, payload := range payloads {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%08d.bin", i)), payload, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	codecBenchCmd.Flags().IntVar(&benchRounds, "rounds", 10, "每个压缩算法重复测试的次数")
+	codecBenchCmd.Flags().StringSliceVar(&benchDicts, "dict", nil, "zstd字典文件，加载后同时测试zstd-dict")
+	codecBenchCmd.Flags().StringVar(&benchSamples, "samples", "", "导出解压后的payload到目录，用于zstd --train训练字典")
+	rootCmd.AddCommand(codecBenchCmd)
+}
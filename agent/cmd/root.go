@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/imdevlab/g"
@@ -33,12 +34,25 @@ var rootCmd = &cobra.Command{
 		}
 
 		// 等待服务器停止信号
-		chSig := make(chan os.Signal)
+		chSig := make(chan os.Signal, 1)
 		signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
 		sig := <-chSig
 
 		g.L.Info("agent received signal", zap.Any("signal", sig))
-		a.Close()
+
+		// 停止接收数据并发送缓存，超时或者再次收到信号时强制退出
+		doneC := make(chan bool)
+		go func() {
+			a.Close()
+			close(doneC)
+		}()
+		select {
+		case <-doneC:
+		case sig := <-chSig:
+			g.L.Warn("agent force exit", zap.Any("signal", sig))
+		case <-time.After(misc.ShutdownTimeout() + time.Second):
+			g.L.Warn("agent close timeout")
+		}
 	},
 }
 
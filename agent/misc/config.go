@@ -3,6 +3,7 @@ package misc
 import (
 	"io/ioutil"
 	"log"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -10,9 +11,10 @@ import (
 // Config ...
 type Config struct {
 	Common struct {
-		Version    string
-		LogLevel   string
-		AdminToken string
+		Version         string
+		LogLevel        string
+		AdminToken      string
+		ShutdownTimeout int // 退出时等待数据发送完成的最长时间，单位秒
 	}
 
 	Agent struct {
@@ -20,6 +22,30 @@ type Config struct {
 
 	Collector struct {
 		Keeplive int
+		Standby  int  // 备用链接数量，主链接异常时立即切换
+		Mirror   bool // 是否同时发送到下一个collector，用于collector灰度发布
+		Auth     bool // 是否发送token认证，token使用common.admintoken
+		// 压缩算法，按优先级排序，与collector协商后使用第一个双方都支持的算法
+		// 可选: zstd-dict、zstd、gzip、snappy，默认snappy
+		Compressions []string
+		ZstdDict     string // zstd字典文件，配置zstd-dict时需要
+		TLS          struct {
+			Enable             bool
+			CertFile           string // agent证书，collector开启双向认证时需要
+			KeyFile            string
+			CAFile             string // 校验collector证书的ca
+			ServerName         string // collector证书中的域名，为空时使用链接地址
+			InsecureSkipVerify bool
+		}
+	}
+
+	Discovery struct {
+		Mode     string   // 服务发现方式: etcd、static、dns
+		Addrs    []string // static模式下的collector地址
+		Domain   string   // dns模式下的域名
+		DNSType  string   // dns记录类型: srv、a
+		Port     int      // a记录对应的collector端口
+		Interval int      // static、dns模式刷新间隔，单位秒
 	}
 
 	Etcd struct {
@@ -34,11 +60,41 @@ type Config struct {
 		SpanAddr           string // udp addr for span
 		SpanReportInterval int    // 全链路信息上报频率 单位毫秒
 		SpanQueueLen       int
+		UDPQueueLen        int    // udp接收队列长度
+		DropPolicy         string // 队列满时的丢弃策略: newest、oldest、sample
+		SampleRatio        int    // sample策略下每N个报文保留1个
+	}
+
+	OTLP struct {
+		Enable          bool   // 是否开启OTLP/HTTP接收
+		Addr            string // 接收地址，路径为/v1/traces
+		InstanceTimeout int    // 服务实例超过该时间没有上报时下线，单位秒
+	}
+
+	Sampling struct {
+		Enable        bool               // 是否开启链路采样，未采样的span只用于统计
+		Rate          float64            // 默认采样率，0-1
+		Apps          map[string]float64 // 按app单独配置的采样率
+		SlowThreshold int32              // 耗时超过该值的span总是保存，单位毫秒
+		ChunkTimeout  int                // spanChunk等待所属span采样结果的时间，单位秒
+	}
+
+	System struct {
+		Enable   bool     // 是否采集主机信息
+		Interval int      // 采集间隔，单位秒
+		Mounts   []string // 统计容量的挂载点
 	}
 
 	Health struct {
 		Addr string
 	}
+
+	Spill struct {
+		Enable  bool   // 无可用collector时是否缓存到磁盘
+		Dir     string // 缓存目录
+		MaxSize int64  // 缓存上限，单位MB
+		MaxAge  int64  // 缓存最长保留时间，单位秒
+	}
 }
 
 // Conf ...
@@ -59,3 +115,11 @@ func InitConfig(path string) {
 	Conf = conf
 	log.Println(Conf)
 }
+
+// ShutdownTimeout 退出时等待数据发送完成的最长时间
+func ShutdownTimeout() time.Duration {
+	if Conf.Common.ShutdownTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(Conf.Common.ShutdownTimeout) * time.Second
+}
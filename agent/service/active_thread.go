@@ -0,0 +1,138 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/pinpoint/proto"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/command"
+	"go.uber.org/zap"
+)
+
+const (
+	// 活跃线程stream租约，web需要在租约内重新下发指令续期，单位秒
+	activeThreadLease = 30
+	// stream心跳间隔，单位秒
+	streamPingInterval = 10
+)
+
+// activeThreadStream 一个agent的活跃线程数stream
+type activeThreadStream struct {
+	id       string // 开启stream的指令ID，上报数据时使用
+	deadline int64  // 租约到期时间
+}
+
+// ActiveThreads 活跃线程数实时stream，每个agent最多打开一个
+type ActiveThreads struct {
+	sync.Mutex
+	streams map[string]*activeThreadStream // key为agentID
+}
+
+func newActiveThreads() *ActiveThreads {
+	return &ActiveThreads{
+		streams: make(map[string]*activeThreadStream),
+	}
+}
+
+// start 打开stream，已经打开时只续期
+func (a *ActiveThreads) start(ss *session, cmd *network.Command) error {
+	deadline := time.Now().Unix() + activeThreadLease
+	a.Lock()
+	if stream, ok := a.streams[ss.agentID]; ok {
+		stream.deadline = deadline
+		a.Unlock()
+		return nil
+	}
+	stream := &activeThreadStream{
+		id:       cmd.ID,
+		deadline: deadline,
+	}
+	a.streams[ss.agentID] = stream
+	a.Unlock()
+
+	channelID, streamC, err := ss.openStream(thrift.Serialize(command.NewTCmdActiveThreadCount()))
+	if err != nil {
+		a.remove(ss.agentID, stream)
+		return err
+	}
+
+	go a.relay(ss, stream, channelID, streamC)
+	return nil
+}
+
+// remove 删除stream
+func (a *ActiveThreads) remove(agentID string, stream *activeThreadStream) {
+	a.Lock()
+	if old, ok := a.streams[agentID]; ok && old == stream {
+		delete(a.streams, agentID)
+	}
+	a.Unlock()
+}
+
+// expired 租约是否到期
+func (a *ActiveThreads) expired(stream *activeThreadStream) bool {
+	a.Lock()
+	defer a.Unlock()
+	return time.Now().Unix() > stream.deadline
+}
+
+// relay 转发jvm每秒返回的活跃线程数，租约到期或者jvm关闭stream时退出
+func (a *ActiveThreads) relay(ss *session, stream *activeThreadStream, channelID int, streamC chan proto.Packet) {
+	ticker := time.NewTicker(time.Duration(streamPingInterval) * time.Second)
+	notify := true
+	defer func() {
+		ticker.Stop()
+		a.remove(ss.agentID, stream)
+		if err := ss.closeStream(channelID, notify); err != nil {
+			logger.Warn("close stream", zap.String("error", err.Error()), zap.Int("channelID", channelID))
+		}
+	}()
+
+	var pingID int
+	for {
+		select {
+		case packet := <-streamC:
+			switch p := packet.(type) {
+			case *proto.ApplicationStreamResponse:
+				if a.expired(stream) {
+					return
+				}
+				result := network.NewCommandResult()
+				result.ID = stream.id
+				result.Type = constant.TypeOfActiveThreadStream
+				result.AppName = ss.appName
+				result.AgentID = ss.agentID
+				result.Success = true
+				result.Payload = p.GetPayload()
+				result.Time = time.Now().UnixNano() / 1e6
+				if err := gAgent.commands.report(result); err != nil {
+					logger.Warn("active thread report", zap.String("error", err.Error()), zap.String("agentID", ss.agentID))
+				}
+			case *proto.ApplicationStreamCreateFail:
+				notify = false
+				logger.Warn("active thread stream create fail", zap.String("agentID", ss.agentID), zap.Int16("code", p.Code))
+				return
+			case *proto.ApplicationStreamClose:
+				notify = false
+				return
+			}
+		case <-ticker.C:
+			if a.expired(stream) {
+				return
+			}
+			pingID++
+			ping := proto.NewApplicationStreamPing()
+			ping.ChannelID = channelID
+			ping.RequestID = pingID
+			if err := ss.write(ping); err != nil {
+				// jvm链接已经断开
+				notify = false
+				logger.Warn("stream ping", zap.String("error", err.Error()), zap.String("agentID", ss.agentID))
+				return
+			}
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package service
 
 import (
-	"sync/atomic"
+	"fmt"
+	"time"
 
+	"github.com/bsed/trace/agent/misc"
+	"github.com/bsed/trace/pkg/constant"
 	"github.com/bsed/trace/pkg/network"
 
 	"go.uber.org/zap"
@@ -10,15 +13,18 @@ import (
 
 // Agent ...
 type Agent struct {
-	appName   string             // 服务名
-	agentID   string             // 服务agent ID
-	etcd      *Etcd              // 服务发现
-	collector *Collector         // 监控指标上报
-	pinpoint  *Pinpoint          // pinpoint采集服务
-	isLive    bool               // app是否存活
-	syncID    uint32             // 同步请求ID
-	syncCall  *SyncCall          // 同步请求
-	agentInfo *network.AgentInfo // 监控上报的agent info原信息
+	discovery     Discovery      // 服务发现
+	collector     *Collector     // 监控指标上报
+	pinpoint      *Pinpoint      // pinpoint采集服务
+	otlp          *OTLP          // opentelemetry OTLP/HTTP接收服务
+	system        *System        // 主机信息采集服务
+	sessions      *Sessions      // 应用会话，一个agent可以服务多个app
+	spill         *Spill         // 无可用collector时的磁盘缓存
+	rpc           *network.RPC   // 与collector之间的同步请求
+	commands      *Commands      // collector下发的pinpoint指令
+	activeThreads *ActiveThreads // 活跃线程数实时stream
+	configs       *Configs       // collector下发的应用配置
+	sampler       *Sampler       // 链路采样结果
 }
 
 var gAgent *Agent
@@ -28,27 +34,60 @@ var logger *zap.Logger
 func New(l *zap.Logger) *Agent {
 	logger = l
 	gAgent = &Agent{
-		etcd:      newEtcd(),
-		collector: newCollector(),
-		pinpoint:  newPinpoint(),
-		syncCall:  NewSyncCall(),
-		agentInfo: network.NewAgentInfo(),
+		discovery:     newDiscovery(),
+		collector:     newCollector(),
+		pinpoint:      newPinpoint(),
+		otlp:          newOTLP(),
+		system:        newSystem(),
+		sessions:      newSessions(),
+		spill:         newSpill(),
+		rpc:           network.NewRPC(),
+		commands:      newCommands(),
+		activeThreads: newActiveThreads(),
+		configs:       newConfigs(),
+		sampler:       newSampler(),
 	}
+	// 日志级别可以由collector下发调整
+	logger = gAgent.configs.wrapLogger(l)
+	// collector通过rpc下发的指令
+	gAgent.rpc.Handle(constant.TypeOfCmd, cmdRequest)
 	return gAgent
 }
 
 // Start 启动
 func (a *Agent) Start() error {
 
-	// etcd 初始化
-	if err := a.etcd.Init(); err != nil {
-		logger.Warn("etcd init", zap.String("error", err.Error()))
+	// 加载磁盘缓存
+	if err := a.spill.Init(); err != nil {
+		logger.Warn("spill init", zap.String("error", err.Error()))
+		return err
+	}
+
+	// 加载zstd字典，检查压缩算法配置
+	if len(misc.Conf.Collector.ZstdDict) > 0 {
+		if err := network.LoadZstdDictFiles(misc.Conf.Collector.ZstdDict); err != nil {
+			logger.Warn("load zstd dict", zap.String("error", err.Error()), zap.String("path", misc.Conf.Collector.ZstdDict))
+			return err
+		}
+	}
+	for _, name := range misc.Conf.Collector.Compressions {
+		if _, ok := network.CodecByName(name); !ok && name != network.CompressZstdDict {
+			return fmt.Errorf("unknow compression %s", name)
+		}
+		if name == network.CompressZstdDict && len(misc.Conf.Collector.ZstdDict) == 0 {
+			return fmt.Errorf("compression %s need zstddict", name)
+		}
+	}
+
+	// 服务发现初始化
+	if err := a.discovery.Init(); err != nil {
+		logger.Warn("discovery init", zap.String("error", err.Error()), zap.String("mode", misc.Conf.Discovery.Mode))
 		return err
 	}
 
 	// 启动服务发现
-	if err := a.etcd.Start(); err != nil {
-		logger.Warn("etcd start", zap.String("error", err.Error()))
+	if err := a.discovery.Start(); err != nil {
+		logger.Warn("discovery start", zap.String("error", err.Error()), zap.String("mode", misc.Conf.Discovery.Mode))
 		return err
 	}
 
@@ -58,6 +97,18 @@ func (a *Agent) Start() error {
 		return err
 	}
 
+	// OTLP接收服务启动
+	if err := a.otlp.Start(); err != nil {
+		logger.Warn("otlp start", zap.String("error", err.Error()))
+		return err
+	}
+
+	// 主机信息采集服务启动
+	if err := a.system.Start(); err != nil {
+		logger.Warn("system start", zap.String("error", err.Error()))
+		return err
+	}
+
 	// 为agentd提供健康检查
 	initHealth()
 	// agent 信息上报服务
@@ -68,11 +119,54 @@ func (a *Agent) Start() error {
 	return nil
 }
 
-// Close 关闭
+// Close 停止接收数据，发送完缓存的数据和下线通知后关闭
 func (a *Agent) Close() error {
+	deadline := time.Now().Add(misc.ShutdownTimeout())
+
+	// 停止接收jvm链接和udp数据
+	a.pinpoint.Close()
+
+	// 停止OTLP接收，服务实例发送下线通知
+	a.otlp.Close(deadline)
+
+	// 断开jvm链接，会话退出时发送下线通知
+	a.sessions.close()
+	if !a.sessions.wait(deadline) {
+		logger.Warn("wait sessions offline timeout")
+	}
+
+	// 发送管道和批量缓存中剩余的数据
+	if err := a.pinpoint.flush(deadline); err != nil {
+		logger.Warn("pinpoint flush", zap.String("error", err.Error()))
+	}
+
+	// 下线通知已经发送，不再等待collector应答
+	a.rpc.Close()
+
+	a.system.Close()
+	a.discovery.Close()
+	a.collector.close()
+	a.spill.Close()
+
+	logger.Info("Agent close ok")
 	return nil
 }
 
+// apps 所有在线的服务名，包括pinpoint会话和OTLP上报的服务
+func (a *Agent) apps() []string {
+	apps := a.sessions.apps()
+	names := make(map[string]struct{}, len(apps))
+	for _, appName := range apps {
+		names[appName] = struct{}{}
+	}
+	for _, appName := range a.otlp.apps() {
+		if _, ok := names[appName]; !ok {
+			apps = append(apps, appName)
+		}
+	}
+	return apps
+}
+
 // // reportAgentInfo 上报agent 信息
 // func reportAgentInfo() {
 // 	for {
@@ -191,8 +285,3 @@ func (a *Agent) Close() error {
 // 		time.Sleep(10 * time.Second)
 // 	}
 // }
-
-// getSyncID ...
-func (a *Agent) getSyncID() uint32 {
-	return atomic.AddUint32(&a.syncID, 1)
-}
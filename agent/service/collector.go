@@ -2,9 +2,10 @@ package service
 
 import (
 	"fmt"
-	"strings"
 	"sync"
 
+	"github.com/bsed/trace/agent/misc"
+	"github.com/bsed/trace/pkg/constant"
 	"github.com/bsed/trace/pkg/network"
 
 	"go.uber.org/zap"
@@ -16,70 +17,24 @@ import (
 type Collector struct {
 	hash *g.Hash
 	sync.RWMutex
-	key     string                // 使用的key
 	clients map[string]*tcpClient // kehuduan
+	ranks   map[string][]string   // 每个app按hash排序的collector key，第一个为主collector
 }
 
 func (c *Collector) add(key, addr string) error {
 	c.RLock()
-	newClient, ok := c.clients[key]
+	_, ok := c.clients[key]
 	c.RUnlock()
 	if !ok {
-		newClient = newtcpClient(addr)
 		c.Lock()
-		c.clients[key] = newClient
+		c.clients[key] = newtcpClient(addr)
 		c.Unlock()
 		// 添加到hash
 		c.hash.Add(key)
-		ruleKey, err := c.hash.Get(gAgent.appName)
-		if err != nil {
-			logger.Warn("hash get", zap.String("error", err.Error()))
-			return err
-		}
-		// 链接
-		if !strings.EqualFold(ruleKey, c.key) {
-			// 查看其他链接，如果有链接就关闭
-			c.RLock()
-			for _, oldClient := range c.clients {
-				oldClient.close()
-			}
-			c.RUnlock()
-			// 新链接启动
-			go newClient.init()
-			logger.Info("new Conn", zap.String("addr", newClient.addr), zap.String("key", ruleKey))
-			// 保存key
-			c.key = ruleKey
-		}
-		return nil
-	}
-
-	// 已经存在的上报的信息也需要检查
-	ruleKey, err := c.hash.Get(gAgent.appName)
-	if err != nil {
-		logger.Warn("hash get", zap.String("error", err.Error()))
-		return err
-	}
-
-	if !strings.EqualFold(ruleKey, c.key) {
-		// 存在并符合链接，检查是否已经建立链接
-		c.RLock()
-		for _, oldClient := range c.clients {
-			oldClient.close()
-		}
-
-		c.RUnlock()
-		go newClient.init()
-		logger.Info("new Conn", zap.String("addr", newClient.addr), zap.String("key", ruleKey))
-		// 保存key
-		c.key = ruleKey
-	} else {
-		// 重连
-		if !newClient.isStart {
-			go newClient.init()
-			logger.Info("client reConn", zap.String("addr", newClient.addr), zap.String("key", ruleKey))
-		}
 	}
 
+	// collector发生变化，重新计算每个app对应的链接
+	c.balance()
 	return nil
 }
 
@@ -95,6 +50,7 @@ func (c *Collector) del(key string) error {
 		delete(c.clients, key)
 		c.Unlock()
 		client.close()
+		c.balance()
 	}
 	return nil
 }
@@ -103,28 +59,277 @@ func newCollector() *Collector {
 	return &Collector{
 		hash:    g.NewHash(),
 		clients: make(map[string]*tcpClient),
+		ranks:   make(map[string][]string),
 	}
 }
 
-// write write.
-func (c *Collector) write(packet *network.TracePack) error {
-	key, err := c.hash.Get(gAgent.appName)
+// close 关闭所有collector链接
+func (c *Collector) close() {
+	c.RLock()
+	defer c.RUnlock()
+	for _, client := range c.clients {
+		client.close()
+	}
+}
+
+// route app上线时检查该app对应的collector是否已经链接，链接在后台建立
+func (c *Collector) route(appName string) error {
+	ranked := c.rank(appName)
+	if len(ranked) == 0 {
+		return fmt.Errorf("no server, appName is %s", appName)
+	}
+
+	for _, key := range ranked[:c.connNum(len(ranked))] {
+		client, ok := c.client(key)
+		if !ok {
+			continue
+		}
+		if client.connect() {
+			logger.Info("new Conn", zap.String("addr", client.addr), zap.String("key", key), zap.String("appName", appName))
+		}
+	}
+	return nil
+}
+
+// selected 获取每个在线app当前使用的collector key
+func (c *Collector) selected() map[string]string {
+	keys := make(map[string]string)
+	for _, appName := range gAgent.apps() {
+		for _, key := range c.rank(appName) {
+			client, ok := c.client(key)
+			if ok && client.ready() {
+				keys[appName] = key
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// balance 根据所有在线app重新分配链接，没有app使用的链接关闭
+func (c *Collector) balance() {
+	c.Lock()
+	c.ranks = make(map[string][]string)
+	c.Unlock()
+
+	used := make(map[string]struct{})
+	for _, appName := range gAgent.apps() {
+		ranked := c.rank(appName)
+		for _, key := range ranked[:c.connNum(len(ranked))] {
+			used[key] = struct{}{}
+		}
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	for key, client := range c.clients {
+		if _, ok := used[key]; ok {
+			// 新链接或者重连
+			if client.connect() {
+				logger.Info("new Conn", zap.String("addr", client.addr), zap.String("key", key))
+			}
+			continue
+		}
+		// 没有app使用，关闭链接
+		if client.ready() {
+			client.close()
+			logger.Info("close Conn", zap.String("addr", client.addr), zap.String("key", key))
+		}
+	}
+}
+
+// connNum 每个app需要保持的链接数: 主链接 + 备用链接 + 镜像链接
+func (c *Collector) connNum(total int) int {
+	num := 1 + misc.Conf.Collector.Standby
+	if misc.Conf.Collector.Mirror {
+		num++
+	}
+	if num > total {
+		return total
+	}
+	return num
+}
+
+// rank 获取app按hash排序的collector列表，依次去掉已选中的collector重新计算hash
+func (c *Collector) rank(appName string) []string {
+	c.RLock()
+	ranked, ok := c.ranks[appName]
+	keys := make([]string, 0, len(c.clients))
+	for key := range c.clients {
+		keys = append(keys, key)
+	}
+	c.RUnlock()
+	if ok {
+		return ranked
+	}
+
+	ranked = make([]string, 0, len(keys))
+	key, err := c.hash.Get(appName)
 	if err != nil {
-		logger.Warn("write", zap.String("error", err.Error()))
-		return err
+		return ranked
 	}
-	// 可优化，去除锁
+	ranked = append(ranked, key)
+
+	selected := map[string]struct{}{key: struct{}{}}
+	for len(ranked) < len(keys) {
+		hash := g.NewHash()
+		for _, key := range keys {
+			if _, ok := selected[key]; !ok {
+				hash.Add(key)
+			}
+		}
+		key, err := hash.Get(appName)
+		if err != nil {
+			break
+		}
+		selected[key] = struct{}{}
+		ranked = append(ranked, key)
+	}
+
+	c.Lock()
+	c.ranks[appName] = ranked
+	c.Unlock()
+	return ranked
+}
+
+func (c *Collector) client(key string) (*tcpClient, bool) {
 	c.RLock()
 	client, ok := c.clients[key]
 	c.RUnlock()
-	if !ok {
-		return fmt.Errorf("no server, key is %s", key)
+	return client, ok
+}
+
+// write write.
+func (c *Collector) write(appName string, packet *network.TracePack) error {
+	packet.Version = network.ProtocolVersion
+	var body []byte
+	if packet.IsCompress == constant.TypeOfCompressNo {
+		body = packet.Encode()
+	} else {
+		body = packet.EncodeWith(c.codec(appName))
+	}
+
+	// 同步报文需要等待回复，不缓存
+	if packet.IsSync == constant.TypeOfSyncYes {
+		return c.writeFrame(appName, body)
 	}
 
-	// 发送
-	if err = client.write(packet); err != nil {
-		logger.Warn("write", zap.String("error", err.Error()))
+	// 存在未重放的缓存时，新数据继续写入缓存，保证顺序
+	if gAgent.spill.pending() {
+		if c.ready(appName) {
+			go c.replay()
+		}
+		return c.spill(appName, body)
+	}
+
+	key, err := c.send(appName, body, "")
+	if err != nil {
+		return c.spill(appName, body)
+	}
+
+	if misc.Conf.Collector.Mirror {
+		c.mirror(appName, body, key)
+	}
+	return nil
+}
+
+// codec app对应的主链接协商的压缩算法，没有可用链接时使用配置的第一个算法，重放时再按链接转换
+func (c *Collector) codec(appName string) network.Codec {
+	for _, key := range c.rank(appName) {
+		client, ok := c.client(key)
+		if !ok {
+			continue
+		}
+		if codec := client.negotiatedCodec(); codec != nil {
+			return codec
+		}
+	}
+	if codec, ok := network.CodecByName(compressions()[0]); ok {
+		return codec
+	}
+	codec, _ := network.CodecByName(network.CompressSnappy)
+	return codec
+}
+
+// writeFrame 发送已经编码的报文到app对应的collector
+func (c *Collector) writeFrame(appName string, body []byte) error {
+	_, err := c.send(appName, body, "")
+	return err
+}
+
+// send 按顺序发送到第一个可用的collector，返回使用的key
+func (c *Collector) send(appName string, body []byte, skip string) (string, error) {
+	ranked := c.rank(appName)
+	if len(ranked) == 0 {
+		return "", fmt.Errorf("no server, appName is %s", appName)
+	}
+
+	for i, key := range ranked {
+		if key == skip {
+			continue
+		}
+		client, ok := c.client(key)
+		if !ok {
+			continue
+		}
+		if !client.ready() {
+			// 尝试重连，下次写入时可用
+			client.connect()
+			continue
+		}
+		// 发送
+		if err := client.writeFrame(body); err != nil {
+			logger.Warn("write", zap.String("error", err.Error()), zap.String("key", key))
+			client.close()
+			continue
+		}
+		if i > 0 && skip == "" {
+			logger.Debug("failover", zap.String("appName", appName), zap.String("key", key))
+		}
+		return key, nil
+	}
+	return "", fmt.Errorf("no healthy server, appName is %s", appName)
+}
+
+// mirror 镜像发送到另一个collector，失败时忽略
+func (c *Collector) mirror(appName string, body []byte, used string) {
+	if _, err := c.send(appName, body, used); err != nil {
+		logger.Debug("mirror", zap.String("error", err.Error()), zap.String("appName", appName))
+	}
+}
+
+// ready app对应的collector链接是否可用
+func (c *Collector) ready(appName string) bool {
+	for _, key := range c.rank(appName) {
+		client, ok := c.client(key)
+		if ok && client.ready() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFeature app当前使用的collector是否支持该功能，没有可用链接时返回false
+func (c *Collector) hasFeature(appName, feature string) bool {
+	for _, key := range c.rank(appName) {
+		client, ok := c.client(key)
+		if ok && client.ready() {
+			return client.hasFeature(feature)
+		}
+	}
+	return false
+}
+
+// spill 无可用collector时写入磁盘缓存
+func (c *Collector) spill(appName string, body []byte) error {
+	if err := gAgent.spill.push(appName, body); err != nil {
+		logger.Warn("spill", zap.String("error", err.Error()), zap.String("appName", appName))
 		return err
 	}
 	return nil
 }
+
+// replay 重放磁盘缓存
+func (c *Collector) replay() {
+	gAgent.spill.replay(c.writeFrame)
+}
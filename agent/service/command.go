@@ -0,0 +1,215 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/pinpoint/proto"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/command"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+// 等待jvm应答超时时间，单位秒
+const commandTimeout = 10
+
+// Commands collector下发的pinpoint指令
+type Commands struct {
+	sync.Mutex
+	handled map[string]int64 // 已处理的指令，开启mirror时多个collector会重复下发
+}
+
+func newCommands() *Commands {
+	return &Commands{
+		handled: make(map[string]int64),
+	}
+}
+
+// handle 处理旧版本collector下发的指令，结果异步上报给collector
+func (c *Commands) handle(payload []byte) {
+	result, err := c.run(payload)
+	if err != nil || result == nil {
+		return
+	}
+	if err := c.report(result); err != nil {
+		logger.Warn("command report", zap.String("error", err.Error()), zap.String("agentID", result.AgentID))
+	}
+}
+
+// call 处理collector通过rpc下发的指令，结果作为应答返回，重复的指令和stream指令应答为空
+func (c *Commands) call(payload []byte) ([]byte, error) {
+	result, err := c.run(payload)
+	if err != nil || result == nil {
+		return nil, err
+	}
+	b, err := msgpack.Marshal(result)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return b, nil
+}
+
+// run 执行指令，不需要返回结果时result为nil
+func (c *Commands) run(payload []byte) (*network.CommandResult, error) {
+	cmd := network.NewCommand()
+	if err := msgpack.Unmarshal(payload, cmd); err != nil {
+		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	if !c.first(cmd.ID) {
+		return nil, nil
+	}
+
+	result := network.NewCommandResult()
+	result.ID = cmd.ID
+	result.Type = cmd.Type
+	result.AppName = cmd.AppName
+	result.AgentID = cmd.AgentID
+
+	body, err := c.execute(cmd)
+	if err == nil && cmd.Type == constant.TypeOfActiveThreadStream {
+		// stream数据由ActiveThreads持续上报
+		return nil, nil
+	}
+	if err != nil {
+		logger.Warn("command execute", zap.String("error", err.Error()), zap.String("agentID", cmd.AgentID), zap.Uint16("type", cmd.Type))
+		result.Message = err.Error()
+	} else {
+		result.Success = true
+		result.Payload = body
+	}
+	result.Time = time.Now().UnixNano() / 1e6
+	return result, nil
+}
+
+// first 是否第一次收到该指令，同时清理过期记录
+func (c *Commands) first(id string) bool {
+	now := time.Now().Unix()
+	c.Lock()
+	defer c.Unlock()
+	for handledID, t := range c.handled {
+		if now-t > 60 {
+			delete(c.handled, handledID)
+		}
+	}
+	if _, ok := c.handled[id]; ok {
+		return false
+	}
+	c.handled[id] = now
+	return true
+}
+
+// execute 转发给jvm并等待应答，返回jvm应答的thrift报文
+func (c *Commands) execute(cmd *network.Command) ([]byte, error) {
+	ss, ok := gAgent.sessions.get(cmd.AgentID)
+	if !ok {
+		return nil, fmt.Errorf("agent not connected")
+	}
+
+	timeout := time.Duration(commandTimeout) * time.Second
+	switch cmd.Type {
+	case constant.TypeOfThreadDump:
+		tCmd := command.NewTCommandThreadDump()
+		tCmd.Type = command.TThreadDumpType_TARGET
+		// 不指定线程名时dump全部线程
+		if len(cmd.ThreadNames) > 0 {
+			tCmd.Name = &cmd.ThreadNames[0]
+		}
+		return ss.request(thrift.Serialize(tCmd), timeout)
+	case constant.TypeOfActiveThreadDump:
+		tCmd := command.NewTCmdActiveThreadDump()
+		if cmd.Limit > 0 {
+			tCmd.Limit = &cmd.Limit
+		}
+		tCmd.ThreadNameList = cmd.ThreadNames
+		return ss.request(thrift.Serialize(tCmd), timeout)
+	case constant.TypeOfActiveThreadLightDump:
+		tCmd := command.NewTCmdActiveThreadLightDump()
+		if cmd.Limit > 0 {
+			tCmd.Limit = &cmd.Limit
+		}
+		tCmd.ThreadNameList = cmd.ThreadNames
+		return ss.request(thrift.Serialize(tCmd), timeout)
+	case constant.TypeOfActiveThreadCount:
+		// 活跃线程数只能通过stream获取，取第一个应答后关闭
+		return c.activeThreadCount(ss, timeout)
+	case constant.TypeOfActiveThreadStream:
+		return nil, gAgent.activeThreads.start(ss, cmd)
+	}
+	return nil, fmt.Errorf("unknow command type %d", cmd.Type)
+}
+
+// activeThreadCount 打开ACTIVE_THREAD_COUNT stream，获取一次活跃线程数
+func (c *Commands) activeThreadCount(ss *session, timeout time.Duration) ([]byte, error) {
+	channelID, streamC, err := ss.openStream(thrift.Serialize(command.NewTCmdActiveThreadCount()))
+	if err != nil {
+		return nil, err
+	}
+
+	notify := true
+	defer func() {
+		if err := ss.closeStream(channelID, notify); err != nil {
+			logger.Warn("close stream", zap.String("error", err.Error()), zap.Int("channelID", channelID))
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case packet := <-streamC:
+			switch p := packet.(type) {
+			case *proto.ApplicationStreamResponse:
+				return p.GetPayload(), nil
+			case *proto.ApplicationStreamCreateFail:
+				notify = false
+				return nil, fmt.Errorf("stream create fail, code is %d", p.Code)
+			case *proto.ApplicationStreamClose:
+				notify = false
+				return nil, fmt.Errorf("stream closed, code is %d", p.Code)
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("stream timeout, agentID is %s", ss.agentID)
+		}
+	}
+}
+
+// report 上报指令结果
+func (c *Commands) report(result *network.CommandResult) error {
+	feature := network.FeatureCommand
+	if result.Type == constant.TypeOfActiveThreadStream {
+		feature = network.FeatureActiveThreadStream
+	}
+	if !gAgent.collector.hasFeature(result.AppName, feature) {
+		return fmt.Errorf("collector not support %s, appName is %s", feature, result.AppName)
+	}
+
+	b, err := msgpack.Marshal(result)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	cmd := network.NewCMD()
+	cmd.Type = constant.TypeOfCommandResult
+	cmd.Payload = b
+	buf, err := msgpack.Marshal(cmd)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	packet := &network.TracePack{
+		Type:       constant.TypeOfCmd,
+		IsSync:     constant.TypeOfSyncNo,
+		IsCompress: constant.TypeOfCompressYes,
+		Payload:    buf,
+	}
+	return gAgent.collector.write(result.AppName, packet)
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/agent/misc"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Configs collector下发的应用配置，未下发的配置项使用agent.yaml
+type Configs struct {
+	sync.RWMutex
+	apps    map[string]*network.AgentConfig // key为appName
+	level   zap.AtomicLevel                 // 当前日志级别
+	changeC chan bool                       // 配置变化通知，udp发送协程据此调整定时器
+}
+
+func newConfigs() *Configs {
+	level := zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(misc.Conf.Common.LogLevel)); err == nil {
+		level.SetLevel(l)
+	}
+	return &Configs{
+		apps:    make(map[string]*network.AgentConfig),
+		level:   level,
+		changeC: make(chan bool, 1),
+	}
+}
+
+// wrapLogger 日志级别可以动态调整，只能在启动时的日志级别之上过滤
+func (c *Configs) wrapLogger(l *zap.Logger) *zap.Logger {
+	return l.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &levelCore{Core: core, level: c.level}
+	}))
+}
+
+// apply 应用collector下发的配置，返回应用结果
+func (c *Configs) apply(payload []byte) ([]byte, error) {
+	conf := network.NewAgentConfig()
+	if err := msgpack.Unmarshal(payload, conf); err != nil {
+		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	ack := network.NewConfigAck()
+	ack.AppName = conf.AppName
+	ack.Version = conf.Version
+	if err := conf.Validate(); err != nil {
+		ack.Message = err.Error()
+	} else {
+		ack.Success = true
+		c.Lock()
+		// 多个collector可能重复下发，只应用更新的版本
+		if old, ok := c.apps[conf.AppName]; !ok || old.Version < conf.Version {
+			c.apps[conf.AppName] = conf
+			c.applyLogLevel()
+			logger.Info("apply config", zap.String("appName", conf.AppName), zap.Int64("version", conf.Version))
+			c.notify()
+		}
+		c.Unlock()
+	}
+
+	b, err := msgpack.Marshal(ack)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return nil, err
+	}
+	return b, nil
+}
+
+// notify 通知配置变化，已有未处理的通知时不再重复发送
+func (c *Configs) notify() {
+	select {
+	case c.changeC <- true:
+	default:
+	}
+}
+
+// applyLogLevel 日志级别是整个agent的配置，取所有app下发级别中最详细的一个，
+// 都没有下发时使用agent.yaml中的级别，需要持有锁
+func (c *Configs) applyLogLevel() {
+	var level zapcore.Level
+	found := false
+	for appName, conf := range c.apps {
+		if len(conf.LogLevel) == 0 {
+			continue
+		}
+		var l zapcore.Level
+		if err := l.UnmarshalText([]byte(conf.LogLevel)); err != nil {
+			logger.Warn("log level", zap.String("error", err.Error()), zap.String("appName", appName), zap.String("level", conf.LogLevel))
+			continue
+		}
+		if !found || l < level {
+			level = l
+			found = true
+		}
+	}
+	if !found {
+		if err := level.UnmarshalText([]byte(misc.Conf.Common.LogLevel)); err != nil {
+			level = zapcore.DebugLevel
+		}
+	}
+	c.level.SetLevel(level)
+}
+
+// get 获取app的下发配置
+func (c *Configs) get(appName string) (*network.AgentConfig, bool) {
+	c.RLock()
+	conf, ok := c.apps[appName]
+	c.RUnlock()
+	return conf, ok
+}
+
+// spanReportInterval span批量发送间隔
+func (c *Configs) spanReportInterval(appName string) time.Duration {
+	if conf, ok := c.get(appName); ok && conf.SpanReportInterval > 0 {
+		return time.Duration(conf.SpanReportInterval) * time.Millisecond
+	}
+	return time.Duration(misc.Conf.Pinpoint.SpanReportInterval) * time.Millisecond
+}
+
+// minReportInterval 所有app中最小的发送间隔，用于批量发送的定时器
+func (c *Configs) minReportInterval() time.Duration {
+	interval := time.Duration(misc.Conf.Pinpoint.SpanReportInterval) * time.Millisecond
+	c.RLock()
+	defer c.RUnlock()
+	for _, conf := range c.apps {
+		if conf.SpanReportInterval > 0 && time.Duration(conf.SpanReportInterval)*time.Millisecond < interval {
+			interval = time.Duration(conf.SpanReportInterval) * time.Millisecond
+		}
+	}
+	return interval
+}
+
+// spanQueueLen span批量发送的条数
+func (c *Configs) spanQueueLen(appName string) int {
+	if conf, ok := c.get(appName); ok && conf.SpanQueueLen > 0 {
+		return conf.SpanQueueLen
+	}
+	return misc.Conf.Pinpoint.SpanQueueLen
+}
+
+// sampling app的采样配置
+func (c *Configs) sampling(appName string) (enable bool, rate float64, slowThreshold int32) {
+	if conf, ok := c.get(appName); ok && conf.Sampling != nil {
+		return conf.Sampling.Enable, conf.Sampling.Rate, conf.Sampling.SlowThreshold
+	}
+	return misc.Conf.Sampling.Enable, sampleRate(appName), misc.Conf.Sampling.SlowThreshold
+}
+
+// levelCore 按动态日志级别过滤
+type levelCore struct {
+	zapcore.Core
+	level zap.AtomicLevel
+}
+
+func (c *levelCore) Enabled(l zapcore.Level) bool {
+	return c.level.Enabled(l) && c.Core.Enabled(l)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(entry.Level) {
+		return ce
+	}
+	return c.Core.Check(entry, ce)
+}
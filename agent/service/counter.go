@@ -0,0 +1,90 @@
+package service
+
+import (
+	"sync/atomic"
+
+	"github.com/bsed/trace/pkg/constant"
+)
+
+// 丢弃策略
+const (
+	DropNewest = "newest" // 队列满时丢弃新数据
+	DropOldest = "oldest" // 队列满时丢弃最早的数据
+	DropSample = "sample" // 队列超过一半时按比例采样，满时丢弃新数据
+)
+
+const maxSpanType = 16
+
+// spanCounter pinpoint报文计数，按报文类型统计
+type spanCounter struct {
+	received  [maxSpanType]uint64 // 接收
+	dropped   [maxSpanType]uint64 // 丢弃
+	forwarded [maxSpanType]uint64 // 发送到collector
+	unsampled [maxSpanType]uint64 // 未被采样，只用于统计
+	malformed uint64              // 无法解析
+}
+
+// SpanCount 单个类型的报文计数
+type SpanCount struct {
+	Received  uint64 `json:"received"`
+	Dropped   uint64 `json:"dropped"`
+	Forwarded uint64 `json:"forwarded"`
+	Unsampled uint64 `json:"unsampled"`
+}
+
+func newSpanCounter() *spanCounter {
+	return &spanCounter{}
+}
+
+func (c *spanCounter) receive(spanType uint16) {
+	if spanType < maxSpanType {
+		atomic.AddUint64(&c.received[spanType], 1)
+	}
+}
+
+func (c *spanCounter) drop(spanType uint16) {
+	if spanType < maxSpanType {
+		atomic.AddUint64(&c.dropped[spanType], 1)
+	}
+}
+
+func (c *spanCounter) forward(spanType uint16) {
+	if spanType < maxSpanType {
+		atomic.AddUint64(&c.forwarded[spanType], 1)
+	}
+}
+
+func (c *spanCounter) unsample(spanType uint16) {
+	if spanType < maxSpanType {
+		atomic.AddUint64(&c.unsampled[spanType], 1)
+	}
+}
+
+func (c *spanCounter) malform() {
+	atomic.AddUint64(&c.malformed, 1)
+}
+
+// snapshot 获取当前计数，key为报文类型名
+func (c *spanCounter) snapshot() (map[string]*SpanCount, uint64) {
+	counts := make(map[string]*SpanCount)
+	for spanType, name := range spanTypeNames {
+		counts[name] = &SpanCount{
+			Received:  atomic.LoadUint64(&c.received[spanType]),
+			Dropped:   atomic.LoadUint64(&c.dropped[spanType]),
+			Forwarded: atomic.LoadUint64(&c.forwarded[spanType]),
+			Unsampled: atomic.LoadUint64(&c.unsampled[spanType]),
+		}
+	}
+	return counts, atomic.LoadUint64(&c.malformed)
+}
+
+var spanTypeNames = map[uint16]string{
+	constant.TypeOfAgentInfo:       "agent_info",
+	constant.TypeOfSQLMetaData:     "sql_meta_data",
+	constant.TypeOfAPIMetaData:     "api_meta_data",
+	constant.TypeOfStringMetaData:  "string_meta_data",
+	constant.TypeOfTSpan:           "span",
+	constant.TypeOfTSpanChunk:      "span_chunk",
+	constant.TypeOfTAgentStat:      "agent_stat",
+	constant.TypeOfTAgentStatBatch: "agent_stat_batch",
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/bsed/trace/agent/misc"
+	"go.uber.org/zap"
+)
+
+// 服务发现方式
+const (
+	DiscoveryEtcd   = "etcd"
+	DiscoveryStatic = "static"
+	DiscoveryDNS    = "dns"
+)
+
+// Discovery collector服务发现，发现结果通过Collector.add/del生效
+type Discovery interface {
+	Init() error
+	Start() error
+	Close()
+}
+
+// newDiscovery 根据配置创建服务发现
+func newDiscovery() Discovery {
+	switch misc.Conf.Discovery.Mode {
+	case DiscoveryStatic:
+		return newStatic()
+	case DiscoveryDNS:
+		return newDNS()
+	default:
+		return newEtcd()
+	}
+}
+
+// discoveryInterval 刷新间隔
+func discoveryInterval() time.Duration {
+	if misc.Conf.Discovery.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(misc.Conf.Discovery.Interval) * time.Second
+}
+
+// Static 静态配置的collector地址
+type Static struct {
+	addrs []string
+	stopC chan bool
+}
+
+func newStatic() *Static {
+	return &Static{
+		stopC: make(chan bool, 1),
+	}
+}
+
+// Init 检查配置
+func (s *Static) Init() error {
+	if len(misc.Conf.Discovery.Addrs) == 0 {
+		return fmt.Errorf("static discovery, addrs is empty")
+	}
+	s.addrs = misc.Conf.Discovery.Addrs
+	return nil
+}
+
+// Start 定时刷新，断开的链接可以重连
+func (s *Static) Start() error {
+	go func() {
+		ticker := time.NewTicker(discoveryInterval())
+		defer ticker.Stop()
+		s.refresh()
+		for {
+			select {
+			case <-ticker.C:
+				s.refresh()
+			case <-s.stopC:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close 停止刷新
+func (s *Static) Close() {
+	close(s.stopC)
+}
+
+func (s *Static) refresh() {
+	for _, addr := range s.addrs {
+		gAgent.collector.add(addr, addr)
+	}
+}
+
+// DNS 通过dns srv或者a记录发现collector
+type DNS struct {
+	addrs map[string]struct{} // 当前的collector地址
+	stopC chan bool
+}
+
+func newDNS() *DNS {
+	return &DNS{
+		addrs: make(map[string]struct{}),
+		stopC: make(chan bool, 1),
+	}
+}
+
+// Init 检查dns是否可以解析
+func (d *DNS) Init() error {
+	if len(misc.Conf.Discovery.Domain) == 0 {
+		return fmt.Errorf("dns discovery, domain is empty")
+	}
+	if _, err := d.resolve(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Start 定时解析
+func (d *DNS) Start() error {
+	go func() {
+		ticker := time.NewTicker(discoveryInterval())
+		defer ticker.Stop()
+		d.refresh()
+		for {
+			select {
+			case <-ticker.C:
+				d.refresh()
+			case <-d.stopC:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close 停止解析
+func (d *DNS) Close() {
+	close(d.stopC)
+}
+
+func (d *DNS) refresh() {
+	addrs, err := d.resolve()
+	if err != nil {
+		// 解析失败时保留已有的collector
+		logger.Warn("dns resolve", zap.String("domain", misc.Conf.Discovery.Domain), zap.String("error", err.Error()))
+		return
+	}
+
+	newAddrs := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		newAddrs[addr] = struct{}{}
+		gAgent.collector.add(addr, addr)
+	}
+
+	for addr := range d.addrs {
+		if _, ok := newAddrs[addr]; !ok {
+			gAgent.collector.del(addr)
+		}
+	}
+	d.addrs = newAddrs
+}
+
+// resolve 获取collector地址列表
+func (d *DNS) resolve() ([]string, error) {
+	domain := misc.Conf.Discovery.Domain
+	addrs := make([]string, 0)
+	switch misc.Conf.Discovery.DNSType {
+	case "srv":
+		_, records, err := net.LookupSRV("", "", domain)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			addrs = append(addrs, net.JoinHostPort(trimDot(record.Target), strconv.Itoa(int(record.Port))))
+		}
+	default:
+		ips, err := net.LookupHost(domain)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, strconv.Itoa(misc.Conf.Discovery.Port)))
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no record, domain is %s", domain)
+	}
+	return addrs, nil
+}
+
+func trimDot(host string) string {
+	if len(host) > 0 && host[len(host)-1] == '.' {
+		return host[:len(host)-1]
+	}
+	return host
+}
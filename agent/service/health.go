@@ -16,6 +16,7 @@ func initHealth() {
 	go func() {
 		h := http.HandlerFunc(health)
 		http.Handle("/health", h)
+		http.Handle("/metrics", http.HandlerFunc(metrics))
 		err := http.ListenAndServe(misc.Conf.Health.Addr, nil)
 		if err != nil {
 			logger.Fatal("init health check error", zap.Error(err))
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// metrics prometheus格式的agent自身监控指标
+func metrics(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+
+	// 队列积压
+	writeHelp(buf, "agent_queue_length", "gauge", "Number of packets waiting in the agent queues.")
+	writeMetric(buf, "agent_queue_length", len(gAgent.pinpoint.tcpChan), "queue", "tcp")
+	writeMetric(buf, "agent_queue_length", len(gAgent.pinpoint.udpChan), "queue", "udp")
+	writeHelp(buf, "agent_queue_capacity", "gauge", "Capacity of the agent queues.")
+	writeMetric(buf, "agent_queue_capacity", cap(gAgent.pinpoint.tcpChan), "queue", "tcp")
+	writeMetric(buf, "agent_queue_capacity", cap(gAgent.pinpoint.udpChan), "queue", "udp")
+
+	// 报文计数
+	counts, malformed := gAgent.pinpoint.counter.snapshot()
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeHelp(buf, "agent_packets_received_total", "counter", "Pinpoint packets received by thrift type.")
+	for _, name := range names {
+		writeMetric(buf, "agent_packets_received_total", counts[name].Received, "type", name)
+	}
+	writeHelp(buf, "agent_packets_dropped_total", "counter", "Pinpoint packets dropped by thrift type.")
+	for _, name := range names {
+		writeMetric(buf, "agent_packets_dropped_total", counts[name].Dropped, "type", name)
+	}
+	writeHelp(buf, "agent_packets_unsampled_total", "counter", "Pinpoint packets not sampled and forwarded for statistics only, by thrift type.")
+	for _, name := range names {
+		writeMetric(buf, "agent_packets_unsampled_total", counts[name].Unsampled, "type", name)
+	}
+	writeHelp(buf, "agent_packets_forwarded_total", "counter", "Pinpoint packets forwarded to collectors by thrift type.")
+	for _, name := range names {
+		writeMetric(buf, "agent_packets_forwarded_total", counts[name].Forwarded, "type", name)
+	}
+	writeHelp(buf, "agent_packets_malformed_total", "counter", "Packets that could not be decoded.")
+	writeMetric(buf, "agent_packets_malformed_total", malformed)
+
+	// collector链接
+	gAgent.collector.RLock()
+	keys := make([]string, 0, len(gAgent.collector.clients))
+	clients := make(map[string]*tcpClient, len(gAgent.collector.clients))
+	for key, client := range gAgent.collector.clients {
+		keys = append(keys, key)
+		clients[key] = client
+	}
+	gAgent.collector.RUnlock()
+	sort.Strings(keys)
+
+	writeHelp(buf, "agent_collector_up", "gauge", "Whether the connection to the collector is established.")
+	for _, key := range keys {
+		up := 0
+		if clients[key].ready() {
+			up = 1
+		}
+		writeMetric(buf, "agent_collector_up", up, "key", key, "addr", clients[key].addr)
+	}
+	writeHelp(buf, "agent_collector_sent_bytes_total", "counter", "Bytes sent to the collector.")
+	for _, key := range keys {
+		writeMetric(buf, "agent_collector_sent_bytes_total", atomic.LoadUint64(&clients[key].sentBytes), "key", key, "addr", clients[key].addr)
+	}
+	writeHelp(buf, "agent_collector_reconnects_total", "counter", "Reconnects to the collector.")
+	for _, key := range keys {
+		writeMetric(buf, "agent_collector_reconnects_total", atomic.LoadUint64(&clients[key].reconnects), "key", key, "addr", clients[key].addr)
+	}
+
+	writeHelp(buf, "agent_collector_selected", "gauge", "Collector currently selected for each application.")
+	selected := gAgent.collector.selected()
+	apps := make([]string, 0, len(selected))
+	for appName := range selected {
+		apps = append(apps, appName)
+	}
+	sort.Strings(apps)
+	for _, appName := range apps {
+		writeMetric(buf, "agent_collector_selected", 1, "app", appName, "key", selected[appName])
+	}
+
+	// OTLP接入
+	writeHelp(buf, "agent_otlp_instances", "gauge", "Service instances reporting through OTLP.")
+	writeMetric(buf, "agent_otlp_instances", gAgent.otlp.count())
+
+	// 同步请求
+	writeHelp(buf, "agent_sync_call_timeouts_total", "counter", "Sync calls to the collector that timed out.")
+	writeMetric(buf, "agent_sync_call_timeouts_total", gAgent.rpc.Timeouts())
+	writeHelp(buf, "agent_sync_call_late_responses_total", "counter", "Responses received after the sync call timed out or was cancelled.")
+	writeMetric(buf, "agent_sync_call_late_responses_total", gAgent.rpc.Lates())
+	writeHelp(buf, "agent_sync_call_pending", "gauge", "Sync calls waiting for a response.")
+	writeMetric(buf, "agent_sync_call_pending", gAgent.rpc.Pending())
+	writeHelp(buf, "agent_collector_requests_rejected_total", "counter", "Collector requests rejected because too many were being served.")
+	writeMetric(buf, "agent_collector_requests_rejected_total", gAgent.rpc.Rejects())
+
+	// 磁盘缓存
+	spill := gAgent.spill.stats()
+	writeHelp(buf, "agent_spill_bytes", "gauge", "Bytes buffered on disk waiting for replay.")
+	writeMetric(buf, "agent_spill_bytes", spill.Size)
+	writeHelp(buf, "agent_spill_pending_frames", "gauge", "Frames buffered on disk waiting for replay.")
+	writeMetric(buf, "agent_spill_pending_frames", spill.Pending)
+	writeHelp(buf, "agent_spill_frames_total", "counter", "Frames handled by the disk buffer.")
+	writeMetric(buf, "agent_spill_frames_total", spill.Spilled, "result", "spilled")
+	writeMetric(buf, "agent_spill_frames_total", spill.Replayed, "result", "replayed")
+	writeMetric(buf, "agent_spill_frames_total", spill.Dropped, "result", "dropped")
+	writeMetric(buf, "agent_spill_frames_total", spill.Expired, "result", "expired")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func writeHelp(buf *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeMetric labels为key、value交替的列表
+func writeMetric(buf *bytes.Buffer, name string, value interface{}, labels ...string) {
+	buf.WriteString(name)
+	if len(labels) > 1 {
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		buf.WriteByte('}')
+	}
+	fmt.Fprintf(buf, " %v\n", value)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelReplacer.Replace(value)
+}
@@ -2,8 +2,13 @@ package service
 
 import (
 	"bufio"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bsed/trace/agent/misc"
@@ -13,12 +18,35 @@ import (
 	"go.uber.org/zap"
 )
 
+// 认证、建立链接超时时间，单位秒
+const authTimeout = 10
+
+// 同步请求等待collector应答超时时间，单位秒
+const syncTimeout = 10
+
+// 协议协商超时时间，超时视为不支持协商的旧版本collector，单位秒
+const helloTimeout = 3
+
+var (
+	tlsOnce   sync.Once
+	tlsConfig *tls.Config
+	tlsErr    error
+)
+
 // tcpClient tcp客户端， 用来和采集器通信
 type tcpClient struct {
-	isStart bool      // 是否启用
-	conn    net.Conn  // 链接conn
-	addr    string    // collector 地址
-	quitC   chan bool // 退出信号
+	sync.RWMutex                // 保护isStart、conn、hello、codec，链接协程写入，发送协程读取
+	isStart      bool           // 是否启用
+	conn         net.Conn       // 链接conn
+	addr         string         // collector 地址
+	quitC        chan bool      // 退出信号
+	dials        uint64         // 链接次数
+	reconnects   uint64         // 重连次数
+	sentBytes    uint64         // 发送字节数
+	lastDial     int64          // 最近一次链接时间
+	running      int32          // 链接协程是否在运行
+	hello        *network.Hello // 协议协商结果
+	codec        network.Codec  // 协商的压缩算法
 }
 
 func newtcpClient(addr string) *tcpClient {
@@ -29,6 +57,41 @@ func newtcpClient(addr string) *tcpClient {
 	}
 }
 
+// connect 异步建立链接，同一个keeplive周期内只尝试一次
+func (t *tcpClient) connect() bool {
+	// 上一个链接协程退出后才能重连
+	if !atomic.CompareAndSwapInt32(&t.running, 0, 1) {
+		return false
+	}
+	now := time.Now().Unix()
+	if now-atomic.LoadInt64(&t.lastDial) < int64(misc.Conf.Collector.Keeplive) {
+		atomic.StoreInt32(&t.running, 0)
+		return false
+	}
+	atomic.StoreInt64(&t.lastDial, now)
+	go t.init()
+	return true
+}
+
+// dial 建立链接，开启tls时使用tls链接
+func dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: time.Duration(authTimeout) * time.Second,
+	}
+	if !misc.Conf.Collector.TLS.Enable {
+		return dialer.Dial("tcp", addr)
+	}
+
+	tlsOnce.Do(func() {
+		conf := misc.Conf.Collector.TLS
+		tlsConfig, tlsErr = network.ClientTLSConfig(conf.CertFile, conf.KeyFile, conf.CAFile, conf.ServerName, conf.InsecureSkipVerify)
+	})
+	if tlsErr != nil {
+		return nil, tlsErr
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
+
 // init 初始化链接
 func (t *tcpClient) init() error {
 	var err error
@@ -37,27 +100,60 @@ func (t *tcpClient) init() error {
 	ticker := time.NewTicker(time.Duration(misc.Conf.Collector.Keeplive) * time.Second)
 
 	defer func() {
+		t.Lock()
 		t.isStart = false
+		t.Unlock()
 		if err := recover(); err != nil {
 			logger.Warn("tcp init", zap.Stack("server"), zap.Any("err", err))
 		}
+		atomic.StoreInt32(&t.running, 0)
 	}()
 
+	var conn net.Conn
 	defer func() {
 		close(quitC)
-		if t.conn != nil {
-			t.conn.Close()
+		if conn != nil {
+			conn.Close()
 		}
 		ticker.Stop()
 	}()
 
-	t.conn, err = net.Dial("tcp", t.addr)
+	conn, err = dial(t.addr)
 	if err != nil {
 		logger.Warn("tcp connect", zap.String("err", err.Error()), zap.String("addr", t.addr))
 		return err
 	}
+	// 握手期间也可以被close中断
+	t.Lock()
+	t.conn = conn
+	t.Unlock()
+
+	reader := bufio.NewReaderSize(conn, constant.MaxMessageSize)
+	// 认证通过后才能发送数据
+	if misc.Conf.Collector.Auth {
+		if err := t.auth(conn, reader); err != nil {
+			logger.Warn("tcp auth", zap.String("err", err.Error()), zap.String("addr", t.addr))
+			return err
+		}
+	}
 
+	// 协商协议版本和压缩算法
+	hello, err := t.handshake(conn, reader)
+	if err != nil {
+		logger.Warn("tcp hello", zap.String("err", err.Error()), zap.String("addr", t.addr))
+		return err
+	}
+	t.Lock()
+	t.hello = hello
+	t.codec = linkCodec(hello)
 	t.isStart = true
+	t.Unlock()
+	if atomic.AddUint64(&t.dials, 1) > 1 {
+		atomic.AddUint64(&t.reconnects, 1)
+	}
+
+	// 重放断线期间缓存的数据
+	go gAgent.collector.replay()
 
 	// 启动心跳
 	go func() {
@@ -66,6 +162,8 @@ func (t *tcpClient) init() error {
 			case <-ticker.C:
 				if err := t.keeplive(); err != nil {
 					logger.Warn("keeplive", zap.String("error", err.Error()))
+					// 关闭链接，后续数据切换到其他collector
+					t.close()
 					return
 				}
 				break
@@ -74,7 +172,6 @@ func (t *tcpClient) init() error {
 			}
 		}
 	}()
-	reader := bufio.NewReaderSize(t.conn, constant.MaxMessageSize)
 	for {
 		select {
 		case <-quitC:
@@ -88,12 +185,22 @@ func (t *tcpClient) init() error {
 			// 发给上层处理
 			switch packet.IsSync {
 			case constant.TypeOfSyncYes:
-				if err := gAgent.syncCall.syncWrite(packet.ID, packet); err != nil {
-					logger.Warn("syncWrite", zap.Error(err))
+				// 旧版本collector原样返回请求作为应答
+				if t.version() == 0 {
+					gAgent.rpc.Deliver(packet)
+					break
+				}
+				gAgent.rpc.Serve(packet, t.version(), t.write)
+				break
+			case constant.TypeOfSyncResponse, constant.TypeOfSyncError:
+				if !gAgent.rpc.Deliver(packet) {
+					logger.Debug("late response", zap.Uint32("id", packet.ID), zap.String("addr", t.addr))
 				}
 				break
 			default:
-				// gAgent.downloadC <- packet
+				if packet.Type == constant.TypeOfCmd {
+					t.cmdPacket(packet)
+				}
 				break
 			}
 		}
@@ -102,13 +209,33 @@ func (t *tcpClient) init() error {
 
 // close 关闭链接
 func (t *tcpClient) close() error {
+	t.Lock()
 	t.isStart = false
-	if t.conn != nil {
-		t.conn.Close()
+	conn := t.conn
+	t.Unlock()
+	if conn != nil {
+		conn.Close()
 	}
 	return nil
 }
 
+// ready 链接是否可用
+func (t *tcpClient) ready() bool {
+	t.RLock()
+	defer t.RUnlock()
+	return t.isStart
+}
+
+// negotiatedCodec 链接协商的压缩算法，链接不可用时返回nil
+func (t *tcpClient) negotiatedCodec() network.Codec {
+	t.RLock()
+	defer t.RUnlock()
+	if !t.isStart {
+		return nil
+	}
+	return t.codec
+}
+
 // keeplive 心跳
 func (t *tcpClient) keeplive() error {
 	ping := network.NewPing()
@@ -144,6 +271,176 @@ func (t *tcpClient) keeplive() error {
 	return nil
 }
 
+// cmdPacket 处理collector下发的指令
+func (t *tcpClient) cmdPacket(packet *network.TracePack) {
+	cmd := network.NewCMD()
+	if err := msgpack.Unmarshal(packet.Payload, cmd); err != nil {
+		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+		return
+	}
+	switch cmd.Type {
+	case constant.TypeOfCommand:
+		// 等待jvm应答耗时较长，不阻塞读
+		go gAgent.commands.handle(cmd.Payload)
+		break
+	default:
+		logger.Warn("unknow cmd type", zap.Uint16("type", cmd.Type))
+	}
+}
+
+// cmdRequest 处理collector通过rpc下发的指令，返回指令结果
+func cmdRequest(packet *network.TracePack) ([]byte, error) {
+	cmd := network.NewCMD()
+	if err := msgpack.Unmarshal(packet.Payload, cmd); err != nil {
+		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+		return nil, err
+	}
+	switch cmd.Type {
+	case constant.TypeOfCommand:
+		return gAgent.commands.call(cmd.Payload)
+	case constant.TypeOfConfig:
+		return gAgent.configs.apply(cmd.Payload)
+	}
+	return nil, fmt.Errorf("unknow cmd type %d", cmd.Type)
+}
+
+// version 协商的协议版本，旧版本collector为0
+func (t *tcpClient) version() byte {
+	t.RLock()
+	defer t.RUnlock()
+	if t.hello == nil {
+		return 0
+	}
+	return t.hello.Version
+}
+
+// hasFeature collector是否支持该功能，旧版本collector不支持任何协商功能
+func (t *tcpClient) hasFeature(feature string) bool {
+	t.RLock()
+	defer t.RUnlock()
+	return t.hello != nil && t.hello.HasFeature(feature)
+}
+
+// auth 发送token认证，认证失败collector会关闭链接
+func (t *tcpClient) auth(conn net.Conn, reader io.Reader) error {
+	auth := network.NewAuth()
+	auth.Token = misc.Conf.Common.AdminToken
+	b, err := msgpack.Marshal(auth)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	cmd := network.NewCMD()
+	cmd.Type = constant.TypeOfAuth
+	cmd.Payload = b
+	buf, err := msgpack.Marshal(cmd)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	packet := &network.TracePack{
+		Type:       constant.TypeOfCmd,
+		IsSync:     constant.TypeOfSyncYes,
+		IsCompress: constant.TypeOfCompressNo,
+		ID:         0,
+		Payload:    buf,
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Duration(authTimeout) * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(packet.Encode()); err != nil {
+		return err
+	}
+
+	rePacket, err := t.read(reader)
+	if err != nil {
+		return err
+	}
+	reCmd := network.NewCMD()
+	if err := msgpack.Unmarshal(rePacket.Payload, reCmd); err != nil {
+		return err
+	}
+	if reCmd.Type != constant.TypeOfAuth {
+		return fmt.Errorf("unexpected cmd type %d", reCmd.Type)
+	}
+	result := network.NewAuthResult()
+	if err := msgpack.Unmarshal(reCmd.Payload, result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("auth failed, %s", result.Message)
+	}
+	return nil
+}
+
+// handshake 发送本端能力，旧版本collector不会应答，超时后使用旧格式报文
+func (t *tcpClient) handshake(conn net.Conn, reader io.Reader) (*network.Hello, error) {
+	local := network.NewHello()
+	local.Compressions = compressions()
+	b, err := msgpack.Marshal(local)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	cmd := network.NewCMD()
+	cmd.Type = constant.TypeOfHello
+	cmd.Payload = b
+	buf, err := msgpack.Marshal(cmd)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return nil, err
+	}
+
+	packet := &network.TracePack{
+		Type:       constant.TypeOfCmd,
+		IsSync:     constant.TypeOfSyncYes,
+		IsCompress: constant.TypeOfCompressNo,
+		ID:         0,
+		Payload:    buf,
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Duration(helloTimeout) * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(packet.Encode()); err != nil {
+		return nil, err
+	}
+
+	rePacket, err := t.read(reader)
+	if err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			logger.Info("collector not support hello, use legacy protocol", zap.String("addr", t.addr))
+			return &network.Hello{Compression: network.CompressSnappy}, nil
+		}
+		return nil, err
+	}
+	reCmd := network.NewCMD()
+	if err := msgpack.Unmarshal(rePacket.Payload, reCmd); err != nil {
+		return nil, err
+	}
+	if reCmd.Type != constant.TypeOfHello {
+		return nil, fmt.Errorf("unexpected cmd type %d", reCmd.Type)
+	}
+	remote := &network.Hello{}
+	if err := msgpack.Unmarshal(reCmd.Payload, remote); err != nil {
+		return nil, err
+	}
+	if len(remote.Error) > 0 {
+		return nil, fmt.Errorf("incompatible collector, %s", remote.Error)
+	}
+
+	hello, err := network.Negotiate(local, remote)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("hello", zap.String("addr", t.addr), zap.Uint8("version", hello.Version), zap.String("compression", hello.Compression), zap.Strings("features", hello.Features))
+	return hello, nil
+}
+
 // read tcp读包
 func (t *tcpClient) read(reader io.Reader) (*network.TracePack, error) {
 	packet := &network.TracePack{}
@@ -156,13 +453,67 @@ func (t *tcpClient) read(reader io.Reader) (*network.TracePack, error) {
 
 // write tcp写包
 func (t *tcpClient) write(packet *network.TracePack) error {
-	body := packet.Encode()
-	if t.conn != nil {
-		_, err := t.conn.Write(body)
+	return t.writeFrame(packet.Encode())
+}
+
+// writeFrame 写入已经编码的报文
+func (t *tcpClient) writeFrame(body []byte) error {
+	t.RLock()
+	isStart, conn, hello, codec := t.isStart, t.conn, t.hello, t.codec
+	t.RUnlock()
+	if !isStart || conn == nil {
+		return fmt.Errorf("conn not ready, addr is %s", t.addr)
+	}
+	// 压缩算法与链接协商的不一致时重新压缩，例如重放的缓存数据或者切换了collector
+	if codec != nil {
+		frame, err := network.Transcode(body, codec)
 		if err != nil {
-			logger.Warn("tcp write", zap.String("error", err.Error()))
+			logger.Warn("transcode", zap.String("error", err.Error()), zap.String("codec", codec.Name()))
 			return err
 		}
+		body = frame
+	}
+	// 旧版本collector只能解析旧格式
+	if hello == nil || hello.Version == 0 {
+		body = network.LegacyFrame(body)
+	}
+	n, err := conn.Write(body)
+	atomic.AddUint64(&t.sentBytes, uint64(n))
+	if err != nil {
+		logger.Warn("tcp write", zap.String("error", err.Error()))
+		return err
 	}
 	return nil
 }
+
+// compressions 配置的压缩算法，zstd-dict替换为加载的字典
+func compressions() []string {
+	names := make([]string, 0, len(misc.Conf.Collector.Compressions))
+	for _, name := range misc.Conf.Collector.Compressions {
+		if name == network.CompressZstdDict {
+			for _, supported := range network.CodecNames() {
+				if strings.HasPrefix(supported, network.CompressZstdDict) {
+					names = append(names, supported)
+				}
+			}
+			continue
+		}
+		if _, ok := network.CodecByName(name); !ok {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		names = append(names, network.CompressSnappy)
+	}
+	return names
+}
+
+// linkCodec 协商的压缩算法，未协商出结果时使用snappy
+func linkCodec(hello *network.Hello) network.Codec {
+	if codec, ok := network.CodecByName(hello.Compression); ok {
+		return codec
+	}
+	codec, _ := network.CodecByName(network.CompressSnappy)
+	return codec
+}
@@ -0,0 +1,326 @@
+package service
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bsed/trace/agent/misc"
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/otlp"
+	"go.uber.org/zap"
+)
+
+// 单次上报请求的最大长度，解压后
+const otlpMaxBody = 16 << 20
+
+// 注册失败后的重试间隔，避免collector不可用时每个请求都等待同步应答
+const otlpRegisterRetry = 10 * time.Second
+
+// OTLP 接收opentelemetry sdk通过OTLP/HTTP上报的span
+// 转换为pinpoint span后与java应用使用同样的上报流程，collector无需区分数据来源
+type OTLP struct {
+	sync.RWMutex
+	server    *http.Server
+	instances map[string]*otlpInstance // 上报过数据的服务实例，key为agentID
+	closed    int32
+	stopC     chan bool
+}
+
+func newOTLP() *OTLP {
+	return &OTLP{
+		instances: make(map[string]*otlpInstance),
+		stopC:     make(chan bool),
+	}
+}
+
+// Start 启动OTLP/HTTP接收服务
+func (o *OTLP) Start() error {
+	if !misc.Conf.OTLP.Enable {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/traces", o.traces)
+	o.server = &http.Server{
+		Addr:    misc.Conf.OTLP.Addr,
+		Handler: mux,
+	}
+	go func() {
+		if err := o.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal("otlp listen", zap.String("addr", misc.Conf.OTLP.Addr), zap.String("error", err.Error()))
+		}
+	}()
+	go o.expire()
+	return nil
+}
+
+// Close 停止接收并等待处理中的请求完成，所有服务实例发送下线通知
+func (o *OTLP) Close(deadline time.Time) error {
+	if o.server == nil || !atomic.CompareAndSwapInt32(&o.closed, 0, 1) {
+		return nil
+	}
+	close(o.stopC)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := o.server.Shutdown(ctx); err != nil {
+		logger.Warn("otlp shutdown", zap.String("error", err.Error()))
+	}
+
+	o.Lock()
+	instances := o.instances
+	o.instances = make(map[string]*otlpInstance)
+	o.Unlock()
+	for _, inst := range instances {
+		inst.offline()
+	}
+	return nil
+}
+
+// apps 上报过数据的服务名
+func (o *OTLP) apps() []string {
+	o.RLock()
+	defer o.RUnlock()
+	names := make(map[string]struct{})
+	apps := make([]string, 0, len(o.instances))
+	for _, inst := range o.instances {
+		if _, ok := names[inst.ss.appName]; ok {
+			continue
+		}
+		names[inst.ss.appName] = struct{}{}
+		apps = append(apps, inst.ss.appName)
+	}
+	return apps
+}
+
+// count 服务实例数
+func (o *OTLP) count() int {
+	o.RLock()
+	defer o.RUnlock()
+	return len(o.instances)
+}
+
+// traces 处理 POST /v1/traces，支持protobuf和json两种编码
+func (o *OTLP) traces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	isJSON := strings.HasPrefix(contentType, "application/json")
+	if !isJSON && !strings.HasPrefix(contentType, "application/x-protobuf") && !strings.HasPrefix(contentType, "application/protobuf") {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := readOTLPBody(w, r)
+	if err != nil {
+		logger.Warn("otlp read body", zap.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req *otlp.ExportRequest
+	if isJSON {
+		req, err = otlp.ParseJSON(body)
+	} else {
+		req, err = otlp.ParseProto(body)
+	}
+	if err != nil {
+		gAgent.pinpoint.counter.malform()
+		logger.Warn("otlp parse", zap.String("error", err.Error()), zap.String("contentType", contentType))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	for _, rs := range req.ResourceSpans {
+		if len(rs.Spans) == 0 {
+			continue
+		}
+		o.export(rs, ip)
+	}
+
+	// 应答为空的ExportTraceServiceResponse
+	if isJSON {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+// export 转换一个服务实例的span并写入上报管道
+func (o *OTLP) export(rs *otlp.ResourceSpans, ip string) {
+	inst := o.instance(rs.Resource, ip)
+	spans, metas := inst.convert(rs.Spans)
+
+	// api、sql、string元数据与java应用一样走tcp管道
+	for _, meta := range metas {
+		gAgent.pinpoint.counter.receive(meta.Type)
+		gAgent.pinpoint.tcpChan <- &appSpans{appName: inst.ss.appName, agentID: inst.ss.agentID, spans: meta}
+	}
+	for _, span := range spans {
+		gAgent.pinpoint.enqueue(&appSpans{appName: inst.ss.appName, agentID: inst.ss.agentID, spans: span})
+	}
+}
+
+// instance 获取资源对应的服务实例，第一次上报时注册
+func (o *OTLP) instance(resource otlp.Attributes, ip string) *otlpInstance {
+	appName, agentID := otlp.ServiceInstance(resource)
+
+	o.Lock()
+	inst, ok := o.instances[agentID]
+	if !ok || inst.ss.appName != appName {
+		if ok {
+			// 同一个agentID更换了服务名，旧实例下线
+			go inst.offline()
+		}
+		inst = newOTLPInstance(appName, agentID, resource, ip)
+		o.instances[agentID] = inst
+	}
+	inst.lastSeen = time.Now()
+	o.Unlock()
+
+	inst.register()
+	return inst
+}
+
+// expire 长时间没有上报的服务实例发送下线通知
+func (o *OTLP) expire() {
+	timeout := time.Duration(misc.Conf.OTLP.InstanceTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 300 * time.Second
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			expired := make([]*otlpInstance, 0)
+			o.Lock()
+			for agentID, inst := range o.instances {
+				if now.Sub(inst.lastSeen) > timeout {
+					delete(o.instances, agentID)
+					expired = append(expired, inst)
+				}
+			}
+			o.Unlock()
+			for _, inst := range expired {
+				inst.offline()
+			}
+		case <-o.stopC:
+			return
+		}
+	}
+}
+
+// otlpInstance 通过OTLP上报的服务实例，相当于一个pinpoint agent
+type otlpInstance struct {
+	sync.Mutex
+	ss         *session        // 复用pinpoint会话的上下线通知，没有jvm链接
+	converter  *otlp.Converter // 转换为pinpoint span，缓存已经发送的元数据
+	lastSeen   time.Time       // 最近一次上报时间，由OTLP的锁保护
+	registerAt time.Time       // 最近一次注册时间
+}
+
+func newOTLPInstance(appName, agentID string, resource otlp.Attributes, ip string) *otlpInstance {
+	startTime := time.Now().UnixNano() / 1e6
+
+	ss := newSession(nil)
+	ss.appName = appName
+	ss.agentID = agentID
+	ss.agentInfo.AppName = appName
+	ss.agentInfo.AgentID = agentID
+	ss.agentInfo.ServiceType = int32(constant.OTLP_SERVER)
+	ss.agentInfo.HostName = resource.String("host.name")
+	ss.agentInfo.IP4S = ip
+	ss.agentInfo.StartTimestamp = startTime
+	ss.agentInfo.OperatingEnv = constant.TypeOfEnvOTLP
+	if b, err := json.Marshal(resource); err == nil {
+		ss.agentInfo.AgentInfo = string(b)
+	}
+
+	return &otlpInstance{
+		ss:        ss,
+		converter: otlp.NewConverter(appName, agentID, startTime),
+	}
+}
+
+// register 上线通知，失败时间隔otlpRegisterRetry后重试
+func (inst *otlpInstance) register() {
+	inst.Lock()
+	defer inst.Unlock()
+	if inst.ss.isLive || time.Since(inst.registerAt) < otlpRegisterRetry {
+		return
+	}
+
+	// 链接该app对应的collector，链接可用后再发送上线通知，不阻塞上报请求
+	if err := gAgent.collector.route(inst.ss.appName); err != nil {
+		logger.Warn("collector route", zap.String("error", err.Error()), zap.String("appName", inst.ss.appName))
+	}
+	if !gAgent.collector.ready(inst.ss.appName) {
+		return
+	}
+	inst.registerAt = time.Now()
+	if err := updateAgentStats(inst.ss, true); err != nil {
+		logger.Warn("agent update stats", zap.String("error", err.Error()), zap.Bool("live", true), zap.String("agentID", inst.ss.agentID))
+		return
+	}
+	inst.ss.isLive = true
+	logger.Info("otlp online", zap.String("appName", inst.ss.appName), zap.String("agentID", inst.ss.agentID))
+}
+
+// offline 下线通知
+func (inst *otlpInstance) offline() {
+	inst.Lock()
+	defer inst.Unlock()
+	if !inst.ss.isLive {
+		return
+	}
+	if err := updateAgentStats(inst.ss, false); err != nil {
+		logger.Warn("agent update stats", zap.String("error", err.Error()), zap.Bool("live", false), zap.String("agentID", inst.ss.agentID))
+	}
+	inst.ss.isLive = false
+	logger.Info("otlp offline", zap.String("appName", inst.ss.appName), zap.String("agentID", inst.ss.agentID))
+}
+
+// readOTLPBody 读取请求内容，支持gzip压缩
+func readOTLPBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, otlpMaxBody)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		break
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+		break
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", r.Header.Get("Content-Encoding"))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, otlpMaxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > otlpMaxBody {
+		return nil, fmt.Errorf("request body too large")
+	}
+	return body, nil
+}
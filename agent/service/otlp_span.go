@@ -0,0 +1,59 @@
+package service
+
+import (
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/otlp"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+)
+
+// convert 将一批OTLP span转换为pinpoint报文，返回span报文以及需要发送的元数据报文
+func (inst *otlpInstance) convert(spans []*otlp.Span) ([]*network.Spans, []*network.Spans) {
+	result := inst.converter.Convert(spans)
+
+	metas := make([]*network.Spans, 0, len(result.APIs)+len(result.SQLs)+len(result.Strings))
+	for _, meta := range result.APIs {
+		metas = append(metas, metaSpans(constant.TypeOfAPIMetaData, thrift.SerializeNew(meta)))
+	}
+	for _, meta := range result.SQLs {
+		metas = append(metas, metaSpans(constant.TypeOfSQLMetaData, thrift.SerializeNew(meta)))
+	}
+	for _, meta := range result.Strings {
+		metas = append(metas, metaSpans(constant.TypeOfStringMetaData, thrift.SerializeNew(meta)))
+	}
+
+	tspans := make([]*network.Spans, 0, len(result.Spans)+len(result.Chunks))
+	for _, span := range result.Spans {
+		s := network.NewSpans()
+		s.Type = constant.TypeOfTSpan
+		if gAgent.sampler.span(span) {
+			s.Spans = thrift.SerializeNew(span)
+		} else {
+			// 未采样的span只发送统计需要的字段
+			s.Spans = thrift.SerializeNew(statsSpan(span))
+			s.Unsampled = true
+		}
+		tspans = append(tspans, s)
+	}
+	for _, chunk := range result.Chunks {
+		s := network.NewSpans()
+		s.Type = constant.TypeOfTSpanChunk
+		// 同一批的span已经有采样结果，不需要等待
+		if keep, _ := gAgent.sampler.spanChunk(nil, chunk); keep {
+			s.Spans = thrift.SerializeNew(chunk)
+		} else {
+			s.Spans = thrift.SerializeNew(statsSpanChunk(chunk))
+			s.Unsampled = true
+		}
+		tspans = append(tspans, s)
+	}
+	return tspans, metas
+}
+
+// metaSpans 元数据报文
+func metaSpans(spanType uint16, data []byte) *network.Spans {
+	spans := network.NewSpans()
+	spans.Type = spanType
+	spans.Spans = data
+	return spans
+}
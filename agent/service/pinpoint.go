@@ -2,11 +2,13 @@ package service
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/bsed/trace/agent/misc"
@@ -22,14 +24,29 @@ import (
 
 // Pinpoint p数据采集
 type Pinpoint struct {
-	tcpChan chan *network.Spans // tcp报文接收管道
-	udpChan chan *network.Spans // udp报文接收管道
+	tcpChan   chan *appSpans // tcp报文接收管道
+	udpChan   chan *appSpans // udp报文接收管道
+	counter   *spanCounter   // 报文计数
+	sampleSeq uint64         // 采样序号
+	listener  net.Listener   // agent info监听
+	statConn  *net.UDPConn   // agent stat监听
+	spanConn  *net.UDPConn   // agent span监听
+	closed    int32          // 是否已经停止接收
+	stopC     chan bool      // 通知上报协程发送剩余数据后退出
+	doneC     chan bool      // 上报协程已经退出
 }
 
 func newPinpoint() *Pinpoint {
+	queueLen := misc.Conf.Pinpoint.UDPQueueLen
+	if queueLen <= 0 {
+		queueLen = 300
+	}
 	return &Pinpoint{
-		tcpChan: make(chan *network.Spans, 100),
-		udpChan: make(chan *network.Spans, 300),
+		tcpChan: make(chan *appSpans, 100),
+		udpChan: make(chan *appSpans, queueLen),
+		counter: newSpanCounter(),
+		stopC:   make(chan bool),
+		doneC:   make(chan bool, 2),
 	}
 }
 
@@ -43,11 +60,46 @@ func (p *Pinpoint) Start() error {
 	// pinpoint tcp、udp信息采集&上报
 	go p.tcpCollector()
 	go p.udpCollector()
+
+	// 清理过期的采样结果
+	go p.sampleExpire()
 	return nil
 }
 
-// Close 关闭pinpoint采集服务
+// Close 停止接收jvm链接和udp数据
 func (p *Pinpoint) Close() error {
+	atomic.StoreInt32(&p.closed, 1)
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	if p.statConn != nil {
+		p.statConn.Close()
+	}
+	if p.spanConn != nil {
+		p.spanConn.Close()
+	}
+	return nil
+}
+
+// isClosed 是否已经停止接收
+func (p *Pinpoint) isClosed() bool {
+	return atomic.LoadInt32(&p.closed) == 1
+}
+
+// flush 发送管道和批量缓存中剩余的数据，超过deadline直接返回
+func (p *Pinpoint) flush(deadline time.Time) error {
+	// 等待span采样结果的spanChunk按未采样发送
+	gAgent.sampler.flush()
+	close(p.stopC)
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for i := 0; i < cap(p.doneC); i++ {
+		select {
+		case <-p.doneC:
+		case <-timer.C:
+			return fmt.Errorf("flush timeout, tcp queue %d, udp queue %d", len(p.tcpChan), len(p.udpChan))
+		}
+	}
 	return nil
 }
 
@@ -58,9 +110,13 @@ func (p *Pinpoint) AgentInfo() error {
 		logger.Fatal("AgentInfo", zap.Error(err))
 		return err
 	}
+	p.listener = l
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if p.isClosed() {
+				return nil
+			}
 			logger.Fatal("AgentInfo", zap.String("addr", misc.Conf.Pinpoint.InfoAddr), zap.Error(err))
 			return err
 		}
@@ -75,12 +131,16 @@ func (p *Pinpoint) AgentStat() error {
 	if err != nil {
 		logger.Fatal("AgentStat ListenUDP", zap.String("addr", misc.Conf.Pinpoint.StatAddr), zap.String("error", err.Error()))
 	}
+	p.statConn = listener
 
 	for {
 		data := make([]byte, proto.UDP_MAX_PACKET_SIZE)
 		listener.SetReadDeadline(time.Now().Add(2 * time.Second))
 		n, _, err := listener.ReadFrom(data)
 		if err != nil {
+			if p.isClosed() {
+				return nil
+			}
 			if err, ok := err.(net.Error); ok && err.Timeout() {
 
 			} else {
@@ -94,10 +154,16 @@ func (p *Pinpoint) AgentStat() error {
 
 		spans, err := udpRead(data[:n])
 		if err != nil {
+			// 错误报文直接丢弃，不影响后续接收
+			p.counter.malform()
 			logger.Warn("udpRead", zap.String("error", err.Error()))
-			return err
+			continue
 		}
-		p.udpChan <- spans
+		// 等待span采样结果的spanChunk由sampler发送
+		if spans == nil {
+			continue
+		}
+		p.enqueue(spans)
 	}
 }
 
@@ -108,12 +174,16 @@ func (p *Pinpoint) AgentSpan() error {
 	if err != nil {
 		logger.Fatal("listen udp", zap.String("addr", misc.Conf.Pinpoint.SpanAddr), zap.String("error", err.Error()))
 	}
+	p.spanConn = listener
 
 	for {
 		data := make([]byte, proto.UDP_MAX_PACKET_SIZE)
 		listener.SetReadDeadline(time.Now().Add(2 * time.Second))
 		n, _, err := listener.ReadFrom(data)
 		if err != nil {
+			if p.isClosed() {
+				return nil
+			}
 			if err, ok := err.(net.Error); ok && err.Timeout() {
 
 			} else {
@@ -127,17 +197,78 @@ func (p *Pinpoint) AgentSpan() error {
 
 		spans, err := udpRead(data[:n])
 		if err != nil {
+			// 错误报文直接丢弃，不影响后续接收
+			p.counter.malform()
 			logger.Warn("udpRead", zap.String("error", err.Error()))
-			return err
+			continue
+		}
+		// 等待span采样结果的spanChunk由sampler发送
+		if spans == nil {
+			continue
+		}
+		p.enqueue(spans)
+	}
+}
+
+// enqueue 非阻塞写入udp管道，管道满时按丢弃策略处理，避免阻塞udp接收
+func (p *Pinpoint) enqueue(spans *appSpans) {
+	spanType := spans.spans.Type
+	p.counter.receive(spanType)
+	if spans.spans.Unsampled {
+		p.counter.unsample(spanType)
+	}
+
+	switch misc.Conf.Pinpoint.DropPolicy {
+	case DropSample:
+		// 队列积压超过一半时开始采样
+		if len(p.udpChan) >= cap(p.udpChan)/2 {
+			ratio := misc.Conf.Pinpoint.SampleRatio
+			if ratio > 1 && atomic.AddUint64(&p.sampleSeq, 1)%uint64(ratio) != 0 {
+				p.counter.drop(spanType)
+				return
+			}
+		}
+		break
+	case DropOldest:
+		for {
+			select {
+			case p.udpChan <- spans:
+				return
+			default:
+			}
+			// 丢弃最早的数据，腾出位置
+			select {
+			case old := <-p.udpChan:
+				p.counter.drop(old.spans.Type)
+			default:
+			}
+		}
+	}
+
+	select {
+	case p.udpChan <- spans:
+	default:
+		p.counter.drop(spanType)
+	}
+}
+
+// sampleExpire 定时清理过期的采样结果
+func (p *Pinpoint) sampleExpire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			gAgent.sampler.expire(now)
+			break
+		case <-p.stopC:
+			return
 		}
-		p.udpChan <- spans
 	}
 }
 
 // tcpCollector ...
 func (p *Pinpoint) tcpCollector() {
-
-	spanPack := network.NewSpansPacket()
 	for {
 		select {
 		case span, ok := <-p.tcpChan:
@@ -145,108 +276,143 @@ func (p *Pinpoint) tcpCollector() {
 				break
 			}
 
+			spanPack := network.NewSpansPacket()
 			spanPack.Type = constant.TypeOfTCPData
-			spanPack.AppName = gAgent.appName
-			spanPack.AgentID = gAgent.agentID
-
-			tracePack := &network.TracePack{
-				Type:       constant.TypeOfPinpoint,
-				IsSync:     constant.TypeOfSyncNo,
-				IsCompress: constant.TypeOfCompressYes,
-			}
-
-			spanPack.Payload = append(spanPack.Payload, span)
-			payload, err := msgpack.Marshal(spanPack)
-			if err != nil {
-				logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
-				// 清空缓存
-				spanPack.Payload = spanPack.Payload[:0]
-				break
-			}
-			tracePack.Payload = payload
-			// 发送
-			if err := gAgent.collector.write(tracePack); err != nil {
-				logger.Warn("write", zap.String("error", err.Error()))
-			}
-			// 清空缓存
-			spanPack.Payload = spanPack.Payload[:0]
+			spanPack.AppName = span.appName
+			spanPack.AgentID = span.agentID
+			spanPack.Payload = append(spanPack.Payload, span.spans)
+			p.send(spanPack)
 			break
+		case <-p.stopC:
+			// 发送管道中剩余的数据
+			for {
+				select {
+				case span := <-p.tcpChan:
+					spanPack := network.NewSpansPacket()
+					spanPack.Type = constant.TypeOfTCPData
+					spanPack.AppName = span.appName
+					spanPack.AgentID = span.agentID
+					spanPack.Payload = append(spanPack.Payload, span.spans)
+					p.send(spanPack)
+				default:
+					p.doneC <- true
+					return
+				}
+			}
 		}
 	}
 }
 
 // udpCollector ...
 func (p *Pinpoint) udpCollector() {
-	// 定时器
-	ticker := time.NewTicker(time.Duration(misc.Conf.Pinpoint.SpanReportInterval) * time.Millisecond)
-	defer ticker.Stop()
-	spanPack := network.NewSpansPacket()
+	// 定时器，周期为所有app中最小的发送间隔
+	interval := gAgent.configs.minReportInterval()
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+	}()
+	// 按agent缓存，保证每个app的数据发送到各自的collector
+	spanPacks := make(map[string]*network.SpansPacket)
+	// 每个agent最近一次发送时间，app的发送间隔可以由collector下发调整
+	lastSends := make(map[string]time.Time)
 
 	for {
 		select {
-		case spanData, ok := <-p.udpChan:
+		case span, ok := <-p.udpChan:
 			if ok {
-				spanPack.Type = constant.TypeOfUDPData
-				spanPack.AppName = gAgent.appName
-				spanPack.AgentID = gAgent.agentID
-
-				tracePack := &network.TracePack{
-					Type:       constant.TypeOfPinpoint,
-					IsSync:     constant.TypeOfSyncNo,
-					IsCompress: constant.TypeOfCompressYes,
+				spanPack, ok := spanPacks[span.agentID]
+				if !ok {
+					spanPack = network.NewSpansPacket()
+					spanPack.Type = constant.TypeOfUDPData
+					spanPack.AgentID = span.agentID
+					spanPacks[span.agentID] = spanPack
 				}
-
-				spanPack.Payload = append(spanPack.Payload, spanData)
-				if len(spanPack.Payload) >= misc.Conf.Pinpoint.SpanQueueLen {
-					payload, err := msgpack.Marshal(spanPack)
-					if err != nil {
-						logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
-						// 清空缓存
-						spanPack.Payload = spanPack.Payload[:0]
-						continue
-					}
-					tracePack.Payload = payload
-					// 发送
-					if err := gAgent.collector.write(tracePack); err != nil {
-						logger.Warn("write", zap.String("error", err.Error()))
-					}
+				spanPack.AppName = span.appName
+				spanPack.Payload = append(spanPack.Payload, span.spans)
+				if len(spanPack.Payload) >= gAgent.configs.spanQueueLen(span.appName) {
+					p.send(spanPack)
+					lastSends[span.agentID] = time.Now()
 					// 清空缓存
 					spanPack.Payload = spanPack.Payload[:0]
 				}
 			}
 			break
-		case <-ticker.C:
-			if len(spanPack.Payload) > 0 {
-
-				spanPack.Type = constant.TypeOfUDPData
-				spanPack.AppName = gAgent.appName
-				spanPack.AgentID = gAgent.agentID
-
-				tracePack := &network.TracePack{
-					Type:       constant.TypeOfPinpoint,
-					IsSync:     constant.TypeOfSyncNo,
-					IsCompress: constant.TypeOfCompressYes,
-				}
-
-				payload, err := msgpack.Marshal(spanPack)
-				if err != nil {
-					logger.Warn("agentInfo:msgpack.Marshal", zap.String("error", err.Error()))
-					// 清空缓存
-					spanPack.Payload = spanPack.Payload[:0]
+		case now := <-ticker.C:
+			for agentID, spanPack := range spanPacks {
+				if len(spanPack.Payload) == 0 {
+					// 长时间无数据的agent不再缓存
+					delete(spanPacks, agentID)
+					delete(lastSends, agentID)
 					continue
 				}
-				tracePack.Payload = payload
-				// 发送
-				if err := gAgent.collector.write(tracePack); err != nil {
-					logger.Warn("write", zap.String("error", err.Error()))
+				// 未到该app的发送间隔，误差小于半个定时器周期时发送
+				if now.Sub(lastSends[agentID])+interval/2 < gAgent.configs.spanReportInterval(spanPack.AppName) {
+					continue
 				}
+				p.send(spanPack)
+				lastSends[agentID] = now
 				// 清空缓存
 				spanPack.Payload = spanPack.Payload[:0]
 			}
+			break
+		case <-gAgent.configs.changeC:
+			// 下发配置后立即检查发送间隔，变化时重建定时器
+			if newInterval := gAgent.configs.minReportInterval(); newInterval != interval {
+				ticker.Stop()
+				interval = newInterval
+				ticker = time.NewTicker(interval)
+			}
+			break
+		case <-p.stopC:
+			// 管道中剩余的数据合并到批量缓存后一起发送
+			for len(p.udpChan) > 0 {
+				span := <-p.udpChan
+				spanPack, ok := spanPacks[span.agentID]
+				if !ok {
+					spanPack = network.NewSpansPacket()
+					spanPack.Type = constant.TypeOfUDPData
+					spanPack.AgentID = span.agentID
+					spanPacks[span.agentID] = spanPack
+				}
+				spanPack.AppName = span.appName
+				spanPack.Payload = append(spanPack.Payload, span.spans)
+			}
+			for _, spanPack := range spanPacks {
+				if len(spanPack.Payload) > 0 {
+					p.send(spanPack)
+				}
+			}
+			p.doneC <- true
+			return
 		}
 	}
 }
 
+// send 打包并发送到app对应的collector
+func (p *Pinpoint) send(spanPack *network.SpansPacket) {
+	payload, err := msgpack.Marshal(spanPack)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return
+	}
+
+	tracePack := &network.TracePack{
+		Type:       constant.TypeOfPinpoint,
+		IsSync:     constant.TypeOfSyncNo,
+		IsCompress: constant.TypeOfCompressYes,
+		Payload:    payload,
+	}
+
+	if err := gAgent.collector.write(spanPack.AppName, tracePack); err != nil {
+		logger.Warn("write", zap.String("error", err.Error()), zap.String("appName", spanPack.AppName))
+		return
+	}
+
+	for _, spans := range spanPack.Payload {
+		p.counter.forward(spans.Type)
+	}
+}
+
 func (p *Pinpoint) agentInfo(conn net.Conn) error {
 	defer func() {
 		if err := recover(); err != nil {
@@ -254,13 +420,15 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 		}
 	}()
 
-	isRecvOffline := false
+	// 每条链接对应一个应用会话
+	ss := newSession(conn)
 	defer func() {
-		updateAgentStats(false)
-		if !isRecvOffline {
-			// sdk客户端断线
-			gAgent.isLive = false
+		if len(ss.agentID) == 0 {
+			return
 		}
+		// sdk客户端断线
+		ss.offline()
+		gAgent.sessions.remove(ss)
 	}()
 
 	defer func() {
@@ -268,7 +436,6 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 			conn.Close()
 		}
 	}()
-	isSendOnline := false
 	reader := bufio.NewReaderSize(conn, proto.TCP_MAX_PACKET_SIZE)
 	buf := make([]byte, 2)
 	for {
@@ -298,7 +465,8 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 				return err
 			}
 
-			p.tcpChan <- spans
+			p.counter.receive(spans.Type)
+			p.tcpChan <- &appSpans{appName: ss.appName, agentID: ss.agentID, spans: spans}
 			break
 
 		case proto.APPLICATION_REQUEST:
@@ -314,7 +482,8 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 				logger.Warn("handle tcp", zap.String("error", err.Error()))
 				return err
 			}
-			p.tcpChan <- spans
+			p.counter.receive(spans.Type)
+			p.tcpChan <- &appSpans{appName: ss.appName, agentID: ss.agentID, spans: spans}
 
 			tResult := proto.DealRequestResponse(applicationRequest)
 			response := proto.NewApplicationResponse()
@@ -331,6 +500,8 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 				logger.Warn("response Decode", zap.String("error", err.Error()))
 				return err
 			}
+			// 指令应答
+			ss.response(applicationResponse)
 			break
 
 		case proto.APPLICATION_STREAM_CREATE:
@@ -349,6 +520,7 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 				logger.Warn("stream close Decode", zap.String("error", err.Error()))
 				return err
 			}
+			ss.stream(applicationStreamClose.ChannelID, applicationStreamClose)
 			break
 
 		case proto.APPLICATION_STREAM_CREATE_SUCCESS:
@@ -358,6 +530,7 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 				logger.Warn("stream create success Decode", zap.String("error", err.Error()))
 				return err
 			}
+			ss.stream(applicationStreamCreateSuccess.ChannelID, applicationStreamCreateSuccess)
 			break
 
 		case proto.APPLICATION_STREAM_CREATE_FAIL:
@@ -367,6 +540,7 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 				logger.Warn("stream create fail Decode", zap.String("error", err.Error()))
 				return err
 			}
+			ss.stream(applicationStreamCreateFail.ChannelID, applicationStreamCreateFail)
 
 			break
 
@@ -377,6 +551,7 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 				logger.Warn("stream response decode", zap.String("error", err.Error()))
 				return err
 			}
+			ss.stream(applicationStreamResponse.ChannelID, applicationStreamResponse)
 			break
 
 		case proto.APPLICATION_STREAM_PING:
@@ -386,6 +561,12 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 				logger.Warn("stream ping decode", zap.String("error", err.Error()))
 				return err
 			}
+			// 回复stream心跳
+			streamPong := proto.NewApplicationStreamPong()
+			streamPong.ChannelID = applicationStreamPing.ChannelID
+			streamPong.RequestID = applicationStreamPing.RequestID
+			isRePacket = true
+			rePacket = streamPong
 			break
 
 		case proto.APPLICATION_STREAM_PONG:
@@ -415,43 +596,40 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 			logger.Debug("agentInfo", zap.String("name", agentInfo.AppName), zap.String("id", agentInfo.AgentID))
 
 			// 保存App信息
-			gAgent.appName = agentInfo.AppName
-			gAgent.agentID = agentInfo.AgentID
-			gAgent.agentInfo.AppName = agentInfo.AppName
-			gAgent.agentInfo.AgentID = agentInfo.AgentID
-			gAgent.agentInfo.ServiceType = agentInfo.ServiceType
-			gAgent.agentInfo.HostName = agentInfo.HostName
-			gAgent.agentInfo.IP4S = agentInfo.IP4S
-			gAgent.agentInfo.StartTimestamp = agentInfo.StartTimestamp
-			gAgent.agentInfo.EndTimestamp = agentInfo.EndTimestamp
-			gAgent.agentInfo.IsContainer = agentInfo.IsContainer
-			gAgent.agentInfo.OperatingEnv = agentInfo.OperatingEnv
-			gAgent.agentInfo.AgentInfo = agentInfo.AgentInfo
-
-			if !isSendOnline {
-				if err := updateAgentStats(true); err != nil {
-					logger.Warn("agent update stats", zap.String("error", err.Error()), zap.Bool("live", true))
-					return err
-				}
-				isSendOnline = true
+			ss.appName = agentInfo.AppName
+			ss.agentID = agentInfo.AgentID
+			ss.agentInfo = agentInfo
+			gAgent.sessions.add(ss)
+
+			// 链接该app对应的collector
+			if err := gAgent.collector.route(ss.appName); err != nil {
+				logger.Warn("collector route", zap.String("error", err.Error()), zap.String("appName", ss.appName))
 			}
 
+			// 上线通知在后台等待collector链接可用后发送，握手直接应答
+			ss.online()
+
 			rePacket, err = createResponse(controlHandShake)
 			if err != nil {
 				logger.Warn("createResponse", zap.String("error", err.Error()))
 				return err
 			}
+			// 握手成功后jvm才会接收指令
+			isRePacket = true
 
 			break
 
 		case proto.CONTROL_CLIENT_CLOSE:
 			logger.Debug("agentInfo", zap.String("type", "CONTROL_CLIENT_CLOSE"))
-			if err := updateAgentStats(false); err != nil {
+			controlClientClose := proto.NewControlClientClose()
+			if err := controlClientClose.Decode(conn, reader); err != nil {
+				logger.Warn("control client close decode", zap.String("error", err.Error()))
+				return err
+			}
+			if err := ss.offline(); err != nil {
 				logger.Warn("agent update stats", zap.String("error", err.Error()), zap.Bool("live", false))
 				return err
 			}
-
-			isSendOnline = false
 			break
 
 		case proto.CONTROL_PING:
@@ -487,13 +665,7 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 		}
 
 		if isRePacket {
-			body, err := rePacket.Encode()
-			if err != nil {
-				logger.Warn("rePacket encode", zap.String("error", err.Error()))
-				return err
-			}
-
-			if _, err := conn.Write(body); err != nil {
+			if err := ss.write(rePacket); err != nil {
 				logger.Warn("write", zap.String("error", err.Error()))
 				return err
 			}
@@ -501,13 +673,14 @@ func (p *Pinpoint) agentInfo(conn net.Conn) error {
 	}
 }
 
-func updateAgentStats(islive bool) error {
+// updateAgentStats 上报app上下线信息
+func updateAgentStats(ss *session, islive bool) error {
 	spanPackets := network.NewSpansPacket()
 	spanPackets.Type = constant.TypeOfTCPData
-	spanPackets.AppName = gAgent.appName
-	spanPackets.AgentID = gAgent.agentID
+	spanPackets.AppName = ss.appName
+	spanPackets.AgentID = ss.agentID
 
-	agentInfo, err := msgpack.Marshal(gAgent.agentInfo)
+	agentInfo, err := msgpack.Marshal(ss.agentInfo)
 	if err != nil {
 		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
 		return err
@@ -528,29 +701,19 @@ func updateAgentStats(islive bool) error {
 		return err
 	}
 
-	id := gAgent.getSyncID()
 	tracePacket := &network.TracePack{
 		Type:       constant.TypeOfPinpoint,
-		IsSync:     constant.TypeOfSyncYes,
 		IsCompress: constant.TypeOfCompressNo,
-		ID:         id,
 		Payload:    payload,
 	}
 
-	if err := gAgent.collector.write(tracePacket); err != nil {
-		logger.Warn("write info", zap.String("error", err.Error()))
-		return err
-	}
-
-	// 创建chan
-	if _, ok := gAgent.syncCall.newChan(id, 10); !ok {
-		logger.Warn("syncCall newChan", zap.String("error", "创建sync chan失败"))
-		return err
-	}
-
-	// 阻塞同步等待，并关闭chan
-	if _, err := gAgent.syncCall.syncRead(id, 10, true); err != nil {
-		logger.Warn("syncRead", zap.String("error", err.Error()))
+	// 同步等待collector应答
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(syncTimeout)*time.Second)
+	defer cancel()
+	if _, err := gAgent.rpc.Call(ctx, tracePacket, func(packet *network.TracePack) error {
+		return gAgent.collector.write(ss.appName, packet)
+	}); err != nil {
+		logger.Warn("rpc call", zap.String("error", err.Error()), zap.String("appName", ss.appName))
 		return err
 	}
 	return nil
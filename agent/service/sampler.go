@@ -0,0 +1,290 @@
+package service
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/agent/misc"
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+	"go.uber.org/zap"
+)
+
+// 采样率精度
+const sampleScale = 10000
+
+// 等待span采样结果的spanChunk上限，超过后直接按未采样发送
+const maxPendingChunks = 10000
+
+// statsAnnotationKeys collector统计用到的annotation
+var statsAnnotationKeys = map[int32]struct{}{
+	constant.HTTP_STATUS_CODE:            {},
+	constant.DUBBO_STATUS_ANNOTATION_KEY: {},
+	constant.SQL_ID:                      {},
+	constant.DUBBO_RPC:                   {},
+	constant.HTTP_INTERNAL_DISPLAY:       {},
+	constant.HTTP_URL:                    {},
+	constant.RETURN_DATA:                 {},
+}
+
+// sampleKey 一个span的标识，spanChunk通过它找到所属span
+type sampleKey struct {
+	transactionID string
+	spanID        int64
+}
+
+// sampleDecision span的采样结果
+type sampleDecision struct {
+	keep bool
+	time time.Time
+}
+
+// pendingChunk 等待span采样结果的spanChunk
+type pendingChunk struct {
+	spans *appSpans
+	chunk *trace.TSpanChunk
+	time  time.Time
+}
+
+// Sampler 缓存span的采样结果，collector不支持采样时全部保存，spanChunk和所属span的采样结果保持一致
+type Sampler struct {
+	sync.Mutex
+	decisions map[sampleKey]*sampleDecision // span的采样结果
+	pendings  map[sampleKey][]*pendingChunk // 先于span到达的spanChunk
+	pending   int                           // 等待中的spanChunk数量
+}
+
+func newSampler() *Sampler {
+	return &Sampler{
+		decisions: make(map[sampleKey]*sampleDecision),
+		pendings:  make(map[sampleKey][]*pendingChunk),
+	}
+}
+
+// chunkTimeout spanChunk等待span采样结果的时间，也是采样结果的缓存时间
+func chunkTimeout() time.Duration {
+	if misc.Conf.Sampling.ChunkTimeout > 0 {
+		return time.Duration(misc.Conf.Sampling.ChunkTimeout) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// span span是否需要保存链路，缓存结果并释放等待该span的spanChunk
+func (s *Sampler) span(span *trace.TSpan) bool {
+	enable, rate, slowThreshold := gAgent.configs.sampling(span.GetApplicationName())
+	if !enable || !gAgent.collector.hasFeature(span.GetApplicationName(), network.FeatureSampling) {
+		return true
+	}
+	keep := sampleSpan(span, rate, slowThreshold)
+	key := sampleKey{string(span.GetTransactionId()), span.GetSpanId()}
+
+	s.Lock()
+	// spanChunk中有异常时整个span都保存
+	if decision, ok := s.decisions[key]; ok && decision.keep {
+		keep = true
+	}
+	s.decisions[key] = &sampleDecision{keep: keep, time: time.Now()}
+	pendings := s.pendings[key]
+	delete(s.pendings, key)
+	s.pending -= len(pendings)
+	s.Unlock()
+
+	for _, pending := range pendings {
+		s.release(pending, keep)
+	}
+	return keep
+}
+
+// spanChunk spanChunk是否需要保存链路，使用所属span的采样结果
+// span还未到达时，传入spans则缓存等待span的采样结果，返回held为true
+func (s *Sampler) spanChunk(spans *appSpans, spanChunk *trace.TSpanChunk) (keep bool, held bool) {
+	enable, rate, _ := gAgent.configs.sampling(spanChunk.GetApplicationName())
+	if !enable || !gAgent.collector.hasFeature(spanChunk.GetApplicationName(), network.FeatureSampling) {
+		return true, false
+	}
+	// 头部采样命中时span也一定保存
+	if headSample(rate, spanChunk.GetTransactionId()) {
+		return true, false
+	}
+	key := sampleKey{string(spanChunk.GetTransactionId()), spanChunk.GetSpanId()}
+
+	s.Lock()
+	defer s.Unlock()
+	if decision, ok := s.decisions[key]; ok {
+		return decision.keep, false
+	}
+	// 有异常时保存，并通知span也保存
+	if hasException(spanChunk.GetSpanEventList()) {
+		s.decisions[key] = &sampleDecision{keep: true, time: time.Now()}
+		return true, false
+	}
+	if spans == nil || s.pending >= maxPendingChunks {
+		return false, false
+	}
+	s.pendings[key] = append(s.pendings[key], &pendingChunk{spans: spans, chunk: spanChunk, time: time.Now()})
+	s.pending++
+	return false, true
+}
+
+// release 按span的采样结果发送等待中的spanChunk
+func (s *Sampler) release(pending *pendingChunk, keep bool) {
+	if !keep {
+		unsampleSpanChunk(pending.spans, pending.chunk)
+	}
+	gAgent.pinpoint.enqueue(pending.spans)
+}
+
+// expire 清理过期的采样结果，等待超时的spanChunk按未采样发送
+func (s *Sampler) expire(now time.Time) {
+	timeout := chunkTimeout()
+	expired := make([]*pendingChunk, 0)
+
+	s.Lock()
+	for key, decision := range s.decisions {
+		if now.Sub(decision.time) > timeout {
+			delete(s.decisions, key)
+		}
+	}
+	for key, pendings := range s.pendings {
+		if now.Sub(pendings[0].time) > timeout {
+			expired = append(expired, pendings...)
+			s.pending -= len(pendings)
+			delete(s.pendings, key)
+		}
+	}
+	s.Unlock()
+
+	for _, pending := range expired {
+		s.release(pending, false)
+	}
+	if len(expired) > 0 {
+		logger.Debug("span chunk timeout", zap.Int("count", len(expired)))
+	}
+}
+
+// flush 发送所有等待中的spanChunk
+func (s *Sampler) flush() {
+	s.expire(time.Now().Add(chunkTimeout() + time.Second))
+}
+
+// sampleRate 获取app的采样率，未单独配置时使用默认采样率
+func sampleRate(appName string) float64 {
+	if rate, ok := misc.Conf.Sampling.Apps[appName]; ok {
+		return rate
+	}
+	return misc.Conf.Sampling.Rate
+}
+
+// headSample 按transactionID哈希采样，同一条链路在所有agent上的结果一致
+func headSample(rate float64, transactionID []byte) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write(transactionID)
+	return h.Sum32()%sampleScale < uint32(rate*sampleScale)
+}
+
+// sampleSpan span是否需要保存链路，错误、异常和慢请求总是保存
+func sampleSpan(span *trace.TSpan, rate float64, slowThreshold int32) bool {
+	if span.GetErr() != 0 || span.IsSetExceptionInfo() {
+		return true
+	}
+	if slowThreshold > 0 && span.GetElapsed() >= slowThreshold {
+		return true
+	}
+	if hasException(span.GetSpanEventList()) {
+		return true
+	}
+	return headSample(rate, span.GetTransactionId())
+}
+
+// hasException event中是否有异常信息
+func hasException(events []*trace.TSpanEvent) bool {
+	for _, event := range events {
+		if event.IsSetExceptionInfo() {
+			return true
+		}
+	}
+	return false
+}
+
+// unsampleSpan 未采样的span只发送统计需要的字段
+func unsampleSpan(spans *appSpans, span *trace.TSpan) {
+	spans.spans.Spans = thrift.SerializeNew(statsSpan(span))
+	spans.spans.Unsampled = true
+}
+
+// unsampleSpanChunk 未采样的spanChunk只发送统计需要的字段
+func unsampleSpanChunk(spans *appSpans, spanChunk *trace.TSpanChunk) {
+	spans.spans.Spans = thrift.SerializeNew(statsSpanChunk(spanChunk))
+	spans.spans.Unsampled = true
+}
+
+// statsSpan 复制span中collector统计需要的字段
+func statsSpan(span *trace.TSpan) *trace.TSpan {
+	s := trace.NewTSpan()
+	s.AgentId = span.AgentId
+	s.ApplicationName = span.ApplicationName
+	s.ParentSpanId = span.ParentSpanId
+	s.StartTime = span.StartTime
+	s.Elapsed = span.Elapsed
+	s.RPC = span.RPC
+	s.ServiceType = span.ServiceType
+	s.Err = span.Err
+	s.ParentApplicationName = span.ParentApplicationName
+	s.ParentApplicationType = span.ParentApplicationType
+	s.Annotations = statsAnnotations(span.Annotations)
+	s.SpanEventList = statsSpanEvents(span.SpanEventList)
+	return s
+}
+
+// statsSpanChunk 复制spanChunk中collector统计需要的字段
+func statsSpanChunk(spanChunk *trace.TSpanChunk) *trace.TSpanChunk {
+	s := trace.NewTSpanChunk()
+	s.AgentId = spanChunk.AgentId
+	s.ApplicationName = spanChunk.ApplicationName
+	s.SpanEventList = statsSpanEvents(spanChunk.SpanEventList)
+	return s
+}
+
+// statsSpanEvents 复制event中collector统计需要的字段，异常只保留异常ID
+func statsSpanEvents(events []*trace.TSpanEvent) []*trace.TSpanEvent {
+	result := make([]*trace.TSpanEvent, 0, len(events))
+	for _, event := range events {
+		e := trace.NewTSpanEvent()
+		e.EndElapsed = event.EndElapsed
+		e.ServiceType = event.ServiceType
+		e.DestinationId = event.DestinationId
+		e.ApiId = event.ApiId
+		if event.ExceptionInfo != nil {
+			e.ExceptionInfo = &trace.TIntStringValue{IntValue: event.ExceptionInfo.IntValue}
+		}
+		e.Annotations = statsAnnotations(event.Annotations)
+		result = append(result, e)
+	}
+	return result
+}
+
+// statsAnnotations 只保留collector统计用到的annotation，sql只保留sqlID
+func statsAnnotations(annotations []*trace.TAnnotation) []*trace.TAnnotation {
+	result := make([]*trace.TAnnotation, 0)
+	for _, annotation := range annotations {
+		if _, ok := statsAnnotationKeys[annotation.GetKey()]; !ok {
+			continue
+		}
+		if annotation.GetKey() == constant.SQL_ID && annotation.GetValue().IsSetIntStringStringValue() {
+			value := trace.NewTAnnotationValue()
+			value.IntStringStringValue = &trace.TIntStringStringValue{IntValue: annotation.GetValue().GetIntStringStringValue().GetIntValue()}
+			annotation = &trace.TAnnotation{Key: annotation.GetKey(), Value: value}
+		}
+		result = append(result, annotation)
+	}
+	return result
+}
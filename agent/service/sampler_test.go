@@ -0,0 +1,173 @@
+package service
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/bsed/trace/agent/misc"
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+)
+
+func newTestSampler() *Sampler {
+	logger = zap.NewNop()
+	misc.Conf = &misc.Config{}
+	misc.Conf.Sampling.Enable = true
+	misc.Conf.Sampling.Rate = 0
+	misc.Conf.Sampling.SlowThreshold = 1000
+	gAgent = &Agent{
+		configs:   newConfigs(),
+		pinpoint:  newPinpoint(),
+		sampler:   newSampler(),
+		collector: newCollector(),
+	}
+	// 支持采样的collector链接
+	client := newtcpClient("127.0.0.1:0")
+	client.isStart = true
+	client.hello = &network.Hello{Features: []string{network.FeatureSampling}}
+	gAgent.collector.clients["collector"] = client
+	gAgent.collector.ranks["app"] = []string{"collector"}
+	return gAgent.sampler
+}
+
+func newTestSpan(elapsed int32) *trace.TSpan {
+	rpc := "/api/order"
+	span := trace.NewTSpan()
+	span.ApplicationName = "app"
+	span.AgentId = "agent"
+	span.TransactionId = []byte("agent^1^1")
+	span.SpanId = 7
+	span.Elapsed = elapsed
+	span.RPC = &rpc
+	return span
+}
+
+func newTestSpanChunk(withException bool) (*appSpans, *trace.TSpanChunk) {
+	chunk := trace.NewTSpanChunk()
+	chunk.ApplicationName = "app"
+	chunk.AgentId = "agent"
+	chunk.TransactionId = []byte("agent^1^1")
+	chunk.SpanId = 7
+	event := trace.NewTSpanEvent()
+	if withException {
+		event.ExceptionInfo = &trace.TIntStringValue{IntValue: 3}
+	}
+	chunk.SpanEventList = []*trace.TSpanEvent{event}
+
+	spans := network.NewSpans()
+	spans.Type = constant.TypeOfTSpanChunk
+	spans.Spans = thrift.SerializeNew(chunk)
+	return &appSpans{appName: "app", agentID: "agent", spans: spans}, chunk
+}
+
+func TestSamplerChunkFollowsSpan(t *testing.T) {
+	for _, elapsed := range []int32{10, 2000} {
+		s := newTestSampler()
+
+		// span之前到达的spanChunk等待span的采样结果
+		as, chunk := newTestSpanChunk(false)
+		if _, held := s.spanChunk(as, chunk); !held {
+			t.Fatalf("elapsed %d: chunk not held", elapsed)
+		}
+		keep := s.span(newTestSpan(elapsed))
+		if keep != (elapsed >= 1000) {
+			t.Fatalf("elapsed %d: keep = %v", elapsed, keep)
+		}
+		if s.pending != 0 || len(gAgent.pinpoint.udpChan) != 1 {
+			t.Fatalf("elapsed %d: pending = %d, queued = %d", elapsed, s.pending, len(gAgent.pinpoint.udpChan))
+		}
+		released := <-gAgent.pinpoint.udpChan
+		if released.spans.Unsampled == keep {
+			t.Fatalf("elapsed %d: released chunk unsampled = %v", elapsed, released.spans.Unsampled)
+		}
+
+		// span之后到达的spanChunk直接使用缓存的结果
+		as, chunk = newTestSpanChunk(false)
+		if got, held := s.spanChunk(as, chunk); held || got != keep {
+			t.Fatalf("elapsed %d: late chunk keep = %v, held = %v", elapsed, got, held)
+		}
+	}
+}
+
+func TestSamplerNeedsFeature(t *testing.T) {
+	s := newTestSampler()
+	gAgent.collector.clients["collector"].hello = &network.Hello{}
+	if !s.span(newTestSpan(10)) {
+		t.Fatalf("span sampled on a collector without sampling feature")
+	}
+	as, chunk := newTestSpanChunk(false)
+	if keep, held := s.spanChunk(as, chunk); !keep || held {
+		t.Fatalf("chunk keep = %v, held = %v without sampling feature", keep, held)
+	}
+}
+
+func TestSamplerChunkExceptionKeepsSpan(t *testing.T) {
+	s := newTestSampler()
+	as, chunk := newTestSpanChunk(true)
+	if keep, held := s.spanChunk(as, chunk); !keep || held {
+		t.Fatalf("exception chunk keep = %v, held = %v", keep, held)
+	}
+	if !s.span(newTestSpan(10)) {
+		t.Fatalf("span with exception chunk not kept")
+	}
+}
+
+func TestSamplerExpire(t *testing.T) {
+	s := newTestSampler()
+	as, chunk := newTestSpanChunk(false)
+	s.spanChunk(as, chunk)
+	s.flush()
+	if s.pending != 0 || len(s.decisions) != 0 {
+		t.Fatalf("pending = %d, decisions = %d", s.pending, len(s.decisions))
+	}
+	if released := <-gAgent.pinpoint.udpChan; !released.spans.Unsampled {
+		t.Fatalf("expired chunk sent as sampled")
+	}
+}
+
+func TestStatsSpan(t *testing.T) {
+	span := newTestSpan(10)
+	sqlText := "select * from orders"
+	code := int32(200)
+	span.Annotations = []*trace.TAnnotation{
+		{Key: constant.HTTP_STATUS_CODE, Value: &trace.TAnnotationValue{IntValue: &code}},
+		{Key: constant.HTTP_PARAM, Value: &trace.TAnnotationValue{StringValue: &sqlText}},
+	}
+	event := trace.NewTSpanEvent()
+	event.EndElapsed = 5
+	event.ExceptionInfo = &trace.TIntStringValue{IntValue: 3, StringValue: &sqlText}
+	event.Annotations = []*trace.TAnnotation{{
+		Key: constant.SQL_ID,
+		Value: &trace.TAnnotationValue{IntStringStringValue: &trace.TIntStringStringValue{
+			IntValue:     9,
+			StringValue1: &sqlText,
+		}},
+	}}
+	span.SpanEventList = []*trace.TSpanEvent{event}
+
+	data := thrift.SerializeNew(statsSpan(span))
+	if full := thrift.SerializeNew(span); len(data) >= len(full) {
+		t.Fatalf("stats span %d bytes, full span %d bytes", len(data), len(full))
+	}
+	got, ok := thrift.Deserialize(data).(*trace.TSpan)
+	if !ok {
+		t.Fatalf("deserialize stats span failed")
+	}
+	if got.GetRPC() != span.GetRPC() || got.GetElapsed() != 10 || got.GetApplicationName() != "app" {
+		t.Fatalf("span = %+v", got)
+	}
+	if len(got.Annotations) != 1 || got.Annotations[0].GetValue().GetIntValue() != 200 {
+		t.Fatalf("annotations = %+v", got.Annotations)
+	}
+	e := got.GetSpanEventList()[0]
+	if e.GetEndElapsed() != 5 || e.GetExceptionInfo().GetIntValue() != 3 || e.GetExceptionInfo().IsSetStringValue() {
+		t.Fatalf("event = %+v", e)
+	}
+	sqlID := e.GetAnnotations()[0].GetValue().GetIntStringStringValue()
+	if sqlID.GetIntValue() != 9 || sqlID.IsSetStringValue1() {
+		t.Fatalf("sql annotation = %+v", sqlID)
+	}
+}
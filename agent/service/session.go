@@ -0,0 +1,298 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/pinpoint/proto"
+	"go.uber.org/zap"
+)
+
+const (
+	registerInterval = 100 * time.Millisecond // 等待collector链接可用的检查间隔
+	registerRetry    = 5 * time.Second        // 上线通知失败后的重试间隔
+)
+
+// session 一条pinpoint tcp链接对应的应用会话
+type session struct {
+	sync.Mutex
+	appName     string                    // 服务名
+	agentID     string                    // 服务agent ID
+	isLive      bool                      // app是否存活
+	llock       sync.Mutex                // 上下线通知互斥
+	registering bool                      // 是否已经在后台发送上线通知
+	closed      bool                      // 会话已经下线，不再发送上线通知
+	agentInfo   *network.AgentInfo        // 监控上报的agent info原信息
+	conn        net.Conn                  // jvm链接
+	wlock       sync.Mutex                // 应答和指令下发可能并发写链接
+	requestID   int32                     // 下发请求ID
+	channelID   int32                     // 下发stream ID
+	requests    map[int]chan proto.Packet // 等待应答的请求，key为requestID
+	streams     map[int]chan proto.Packet // 打开的stream，key为channelID
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{
+		agentInfo: network.NewAgentInfo(),
+		conn:      conn,
+		requests:  make(map[int]chan proto.Packet),
+		streams:   make(map[int]chan proto.Packet),
+	}
+}
+
+// online 握手成功后在后台发送上线通知，不阻塞握手应答
+func (ss *session) online() {
+	ss.llock.Lock()
+	defer ss.llock.Unlock()
+	if ss.registering || ss.isLive || ss.closed {
+		return
+	}
+	ss.registering = true
+	go ss.register()
+}
+
+// register 等待collector链接可用后发送上线通知，失败后间隔registerRetry重试，会话下线后退出
+func (ss *session) register() {
+	for {
+		ss.llock.Lock()
+		if ss.closed {
+			ss.registering = false
+			ss.llock.Unlock()
+			return
+		}
+		if !gAgent.collector.ready(ss.appName) {
+			ss.llock.Unlock()
+			time.Sleep(registerInterval)
+			continue
+		}
+		err := updateAgentStats(ss, true)
+		if err == nil {
+			ss.isLive = true
+			ss.registering = false
+		}
+		ss.llock.Unlock()
+		if err == nil {
+			return
+		}
+		logger.Warn("agent update stats", zap.String("error", err.Error()), zap.Bool("live", true), zap.String("agentID", ss.agentID))
+		time.Sleep(registerRetry)
+	}
+}
+
+// offline 会话下线，已经上线时发送下线通知
+func (ss *session) offline() error {
+	ss.llock.Lock()
+	defer ss.llock.Unlock()
+	ss.closed = true
+	if !ss.isLive {
+		return nil
+	}
+	if err := updateAgentStats(ss, false); err != nil {
+		return err
+	}
+	ss.isLive = false
+	return nil
+}
+
+// write 写jvm链接
+func (ss *session) write(packet proto.Packet) error {
+	body, err := packet.Encode()
+	if err != nil {
+		return err
+	}
+	ss.wlock.Lock()
+	defer ss.wlock.Unlock()
+	_, err = ss.conn.Write(body)
+	return err
+}
+
+// request 向jvm发送APPLICATION_REQUEST，同步等待应答
+func (ss *session) request(payload []byte, timeout time.Duration) ([]byte, error) {
+	request := proto.NewApplicationRequest()
+	request.RequestID = int(atomic.AddInt32(&ss.requestID, 1))
+	request.Payload = payload
+
+	responseC := make(chan proto.Packet, 1)
+	ss.Lock()
+	ss.requests[request.RequestID] = responseC
+	ss.Unlock()
+	defer func() {
+		ss.Lock()
+		delete(ss.requests, request.RequestID)
+		ss.Unlock()
+	}()
+
+	if err := ss.write(request); err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-responseC:
+		return response.GetPayload(), nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("request timeout, agentID is %s", ss.agentID)
+	}
+}
+
+// response 收到jvm的APPLICATION_RESPONSE
+func (ss *session) response(response *proto.ApplicationResponse) {
+	ss.Lock()
+	responseC, ok := ss.requests[response.RequestID]
+	ss.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case responseC <- response:
+	default:
+	}
+}
+
+// openStream 向jvm发送APPLICATION_STREAM_CREATE，返回channelID和接收stream报文的管道
+// 服务端创建的stream使用偶数ID
+func (ss *session) openStream(payload []byte) (int, chan proto.Packet, error) {
+	create := proto.NewApplicationStreamCreate()
+	create.ChannelID = int(atomic.AddInt32(&ss.channelID, 1)) * 2
+	create.Payload = payload
+
+	streamC := make(chan proto.Packet, 10)
+	ss.Lock()
+	ss.streams[create.ChannelID] = streamC
+	ss.Unlock()
+
+	if err := ss.write(create); err != nil {
+		ss.Lock()
+		delete(ss.streams, create.ChannelID)
+		ss.Unlock()
+		return 0, nil, err
+	}
+	return create.ChannelID, streamC, nil
+}
+
+// closeStream 关闭stream，notify为false时表示jvm已经关闭，不再发送APPLICATION_STREAM_CLOSE
+func (ss *session) closeStream(channelID int, notify bool) error {
+	ss.Lock()
+	_, ok := ss.streams[channelID]
+	delete(ss.streams, channelID)
+	ss.Unlock()
+	if !ok || !notify {
+		return nil
+	}
+
+	streamClose := proto.NewApplicationStreamClose()
+	streamClose.ChannelID = channelID
+	return ss.write(streamClose)
+}
+
+// stream 收到jvm的stream报文
+func (ss *session) stream(channelID int, packet proto.Packet) {
+	ss.Lock()
+	streamC, ok := ss.streams[channelID]
+	ss.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case streamC <- packet:
+	default:
+	}
+}
+
+// Sessions 当前agent进程服务的所有应用会话
+type Sessions struct {
+	sync.RWMutex
+	sessions map[string]*session // key为agentID
+}
+
+func newSessions() *Sessions {
+	return &Sessions{
+		sessions: make(map[string]*session),
+	}
+}
+
+// add 保存握手成功的会话，同一agentID重复握手时以最新的为准
+func (s *Sessions) add(ss *session) {
+	s.Lock()
+	s.sessions[ss.agentID] = ss
+	s.Unlock()
+}
+
+// remove 删除会话，只有和当前保存的会话一致时才删除，避免误删重连后的新会话
+func (s *Sessions) remove(ss *session) {
+	s.Lock()
+	if old, ok := s.sessions[ss.agentID]; ok && old == ss {
+		delete(s.sessions, ss.agentID)
+	}
+	s.Unlock()
+}
+
+// get 通过agentID获取会话
+func (s *Sessions) get(agentID string) (*session, bool) {
+	s.RLock()
+	ss, ok := s.sessions[agentID]
+	s.RUnlock()
+	return ss, ok
+}
+
+// close 断开所有jvm链接，链接协程退出时发送下线通知
+func (s *Sessions) close() {
+	for _, ss := range s.list() {
+		ss.conn.Close()
+	}
+}
+
+// wait 等待所有会话下线，超过deadline返回false
+func (s *Sessions) wait(deadline time.Time) bool {
+	for time.Now().Before(deadline) {
+		s.RLock()
+		n := len(s.sessions)
+		s.RUnlock()
+		if n == 0 {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+// appName 通过agentID获取服务名
+func (s *Sessions) appName(agentID string) (string, bool) {
+	s.RLock()
+	ss, ok := s.sessions[agentID]
+	s.RUnlock()
+	if !ok {
+		return "", false
+	}
+	return ss.appName, true
+}
+
+// list 获取所有会话
+func (s *Sessions) list() []*session {
+	s.RLock()
+	defer s.RUnlock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		sessions = append(sessions, ss)
+	}
+	return sessions
+}
+
+// apps 获取所有在线的服务名
+func (s *Sessions) apps() []string {
+	s.RLock()
+	defer s.RUnlock()
+	names := make(map[string]struct{})
+	apps := make([]string, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		if _, ok := names[ss.appName]; ok {
+			continue
+		}
+		names[ss.appName] = struct{}{}
+		apps = append(apps, ss.appName)
+	}
+	return apps
+}
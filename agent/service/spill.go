@@ -0,0 +1,464 @@
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bsed/trace/agent/misc"
+	"go.uber.org/zap"
+)
+
+const (
+	spillSegmentSize  int64 = 4 * 1024 * 1024 // 单个缓存文件大小
+	spillHeaderSize         = 14              // 记录头: 时间(8) + app长度(2) + 报文长度(4)
+	spillFileSuffix         = ".spill"
+	spillOffsetSuffix       = ".offset" // 重放进度文件，保存在缓存文件旁边，重启后从该位置继续重放
+)
+
+// Spill 无可用collector时的磁盘缓存，按写入顺序重放
+type Spill struct {
+	sync.Mutex
+	dir       string          // 缓存目录
+	maxSize   int64           // 缓存上限，单位字节
+	maxAge    int64           // 缓存最长保留时间，单位秒
+	size      int64           // 当前缓存大小
+	segments  []*spillSegment // 缓存文件，按写入顺序排列
+	writer    *os.File        // 当前写入的文件
+	replaying int32           // 是否正在重放
+	spilled   uint64          // 写入磁盘的报文数
+	replayed  uint64          // 重放成功的报文数
+	dropped   uint64          // 超过缓存上限丢弃的报文数
+	expired   uint64          // 超时丢弃的报文数
+}
+
+// spillSegment 缓存文件
+type spillSegment struct {
+	seq    uint64 // 文件序号
+	path   string // 文件路径
+	size   int64  // 文件大小
+	offset int64  // 已重放的位置
+	count  int    // 未重放的报文数
+}
+
+// spillRecord 缓存记录
+type spillRecord struct {
+	time    int64
+	appName string
+	frame   []byte
+	size    int64
+}
+
+// SpillStats 磁盘缓存统计
+type SpillStats struct {
+	Size     int64
+	Pending  int
+	Spilled  uint64
+	Replayed uint64
+	Dropped  uint64
+	Expired  uint64
+}
+
+func newSpill() *Spill {
+	return &Spill{
+		segments: make([]*spillSegment, 0),
+	}
+}
+
+// Init 加载磁盘上未重放的缓存
+func (s *Spill) Init() error {
+	if !misc.Conf.Spill.Enable {
+		return nil
+	}
+
+	s.dir = misc.Conf.Spill.Dir
+	s.maxSize = misc.Conf.Spill.MaxSize * 1024 * 1024
+	s.maxAge = misc.Conf.Spill.MaxAge
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		// 缓存文件已经删除的重放进度文件
+		if strings.HasSuffix(file.Name(), spillFileSuffix+spillOffsetSuffix) {
+			if _, err := os.Stat(filepath.Join(s.dir, strings.TrimSuffix(file.Name(), spillOffsetSuffix))); os.IsNotExist(err) {
+				os.Remove(filepath.Join(s.dir, file.Name()))
+			}
+			continue
+		}
+		if file.IsDir() || !strings.HasSuffix(file.Name(), spillFileSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), spillFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &spillSegment{
+			seq:  seq,
+			path: filepath.Join(s.dir, file.Name()),
+		}
+		if err := seg.load(); err != nil {
+			logger.Warn("spill load", zap.String("path", seg.path), zap.String("error", err.Error()))
+			os.Remove(seg.path)
+			continue
+		}
+		if seg.count == 0 {
+			os.Remove(seg.path)
+			os.Remove(seg.path + spillOffsetSuffix)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].seq < s.segments[j].seq
+	})
+
+	logger.Info("spill init", zap.String("dir", s.dir), zap.Int("segments", len(s.segments)), zap.Int64("size", s.size))
+	return nil
+}
+
+// Close 关闭缓存文件
+func (s *Spill) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+	return nil
+}
+
+// push 写入磁盘缓存
+func (s *Spill) push(appName string, frame []byte) error {
+	if !misc.Conf.Spill.Enable {
+		return fmt.Errorf("spill disabled")
+	}
+
+	buf := make([]byte, spillHeaderSize+len(appName)+len(frame))
+	binary.BigEndian.PutUint64(buf[0:8], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint16(buf[8:10], uint16(len(appName)))
+	binary.BigEndian.PutUint32(buf[10:14], uint32(len(frame)))
+	copy(buf[spillHeaderSize:], appName)
+	copy(buf[spillHeaderSize+len(appName):], frame)
+	recordSize := int64(len(buf))
+
+	s.Lock()
+	defer s.Unlock()
+
+	// 超过上限，丢弃最早的缓存文件
+	for s.size+recordSize > s.maxSize && len(s.segments) > 1 {
+		s.dropOldest()
+	}
+	if s.size+recordSize > s.maxSize {
+		atomic.AddUint64(&s.dropped, 1)
+		return fmt.Errorf("spill full, size is %d", s.size)
+	}
+
+	tail := s.tail()
+	if tail == nil || s.writer == nil || tail.size >= spillSegmentSize {
+		var err error
+		if tail, err = s.rotate(); err != nil {
+			atomic.AddUint64(&s.dropped, 1)
+			return err
+		}
+	}
+
+	if _, err := s.writer.Write(buf); err != nil {
+		atomic.AddUint64(&s.dropped, 1)
+		return err
+	}
+	tail.size += recordSize
+	tail.count++
+	s.size += recordSize
+	atomic.AddUint64(&s.spilled, 1)
+	return nil
+}
+
+// pending 是否有未重放的缓存
+func (s *Spill) pending() bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, seg := range s.segments {
+		if seg.count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// replay 按写入顺序重放缓存，send失败时停止，等待下次重连
+func (s *Spill) replay(send func(appName string, frame []byte) error) {
+	if !atomic.CompareAndSwapInt32(&s.replaying, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.replaying, 0)
+
+	for {
+		s.Lock()
+		seg := s.head()
+		if seg == nil {
+			s.Unlock()
+			return
+		}
+		record, err := seg.read()
+		s.Unlock()
+		if err != nil {
+			logger.Warn("spill read", zap.String("path", seg.path), zap.String("error", err.Error()))
+			s.Lock()
+			s.remove(seg)
+			s.Unlock()
+			continue
+		}
+
+		if s.maxAge > 0 && time.Now().Unix()-record.time > s.maxAge {
+			atomic.AddUint64(&s.expired, 1)
+		} else {
+			if err := send(record.appName, record.frame); err != nil {
+				logger.Warn("spill replay", zap.String("appName", record.appName), zap.String("error", err.Error()))
+				return
+			}
+			atomic.AddUint64(&s.replayed, 1)
+		}
+
+		s.Lock()
+		seg.offset += record.size
+		seg.count--
+		if seg.count == 0 {
+			s.remove(seg)
+		} else if err := seg.commit(); err != nil {
+			logger.Warn("spill commit", zap.String("path", seg.path), zap.String("error", err.Error()))
+		}
+		s.Unlock()
+	}
+}
+
+// stats 获取缓存统计
+func (s *Spill) stats() *SpillStats {
+	s.Lock()
+	pending := 0
+	for _, seg := range s.segments {
+		pending += seg.count
+	}
+	size := s.size
+	s.Unlock()
+
+	return &SpillStats{
+		Size:     size,
+		Pending:  pending,
+		Spilled:  atomic.LoadUint64(&s.spilled),
+		Replayed: atomic.LoadUint64(&s.replayed),
+		Dropped:  atomic.LoadUint64(&s.dropped),
+		Expired:  atomic.LoadUint64(&s.expired),
+	}
+}
+
+// head 最早的未重放文件，需要持有锁
+func (s *Spill) head() *spillSegment {
+	for _, seg := range s.segments {
+		if seg.count > 0 {
+			return seg
+		}
+	}
+	return nil
+}
+
+// tail 当前写入的文件，需要持有锁
+func (s *Spill) tail() *spillSegment {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+// rotate 创建新的写入文件，需要持有锁
+func (s *Spill) rotate() (*spillSegment, error) {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	var seq uint64 = 1
+	if tail := s.tail(); tail != nil {
+		seq = tail.seq + 1
+	}
+	seg := &spillSegment{
+		seq:  seq,
+		path: filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spillFileSuffix)),
+	}
+	writer, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.writer = writer
+	s.segments = append(s.segments, seg)
+	return seg, nil
+}
+
+// dropOldest 丢弃最早的缓存文件，需要持有锁
+func (s *Spill) dropOldest() {
+	seg := s.segments[0]
+	atomic.AddUint64(&s.dropped, uint64(seg.count))
+	logger.Warn("spill full, drop segment", zap.String("path", seg.path), zap.Int("count", seg.count))
+	s.remove(seg)
+}
+
+// remove 删除缓存文件，需要持有锁
+func (s *Spill) remove(seg *spillSegment) {
+	found := false
+	for i, old := range s.segments {
+		if old != seg {
+			continue
+		}
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+		found = true
+		break
+	}
+	// 重放过程中该文件可能已经因为超过上限被丢弃
+	if !found {
+		return
+	}
+	// 删除正在写入的文件时，下次写入重新创建
+	if len(s.segments) == 0 || s.tail().seq < seg.seq {
+		if s.writer != nil {
+			s.writer.Close()
+			s.writer = nil
+		}
+	}
+	s.size -= seg.size
+	os.Remove(seg.path)
+	os.Remove(seg.path + spillOffsetSuffix)
+}
+
+// load 统计文件中重放进度之后的记录，丢弃末尾不完整的记录
+func (seg *spillSegment) load() error {
+	replayed, err := seg.loadOffset()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(seg.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, spillHeaderSize)
+	var offset int64
+	for {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			break
+		}
+		size := int64(spillHeaderSize) + int64(binary.BigEndian.Uint16(header[8:10])) + int64(binary.BigEndian.Uint32(header[10:14]))
+		if offset+size > info.Size() {
+			break
+		}
+		// 已经重放过的记录
+		if offset < replayed {
+			seg.offset = offset + size
+		} else {
+			seg.count++
+		}
+		offset += size
+	}
+	seg.size = offset
+	return file.Truncate(offset)
+}
+
+// loadOffset 读取重放进度，没有进度文件时从头重放
+func (seg *spillSegment) loadOffset() (int64, error) {
+	buf, err := ioutil.ReadFile(seg.path + spillOffsetSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(buf) != 8 {
+		return 0, fmt.Errorf("invalid offset file, size is %d", len(buf))
+	}
+	return int64(binary.BigEndian.Uint64(buf)), nil
+}
+
+// commit 保存重放进度，固定8字节覆盖写入
+func (seg *spillSegment) commit() error {
+	file, err := os.OpenFile(seg.path+spillOffsetSuffix, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(seg.offset))
+	if _, err := file.WriteAt(buf, 0); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// read 读取下一条未重放的记录
+func (seg *spillSegment) read() (*spillRecord, error) {
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, spillHeaderSize)
+	if _, err := file.ReadAt(header, seg.offset); err != nil {
+		return nil, err
+	}
+	appLen := int(binary.BigEndian.Uint16(header[8:10]))
+	frameLen := int(binary.BigEndian.Uint32(header[10:14]))
+	body := make([]byte, appLen+frameLen)
+	if _, err := file.ReadAt(body, seg.offset+spillHeaderSize); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return &spillRecord{
+		time:    int64(binary.BigEndian.Uint64(header[0:8])),
+		appName: string(body[:appLen]),
+		frame:   body[appLen:],
+		size:    int64(spillHeaderSize + appLen + frameLen),
+	}, nil
+}
+
+// ReadSpillFrames 读取缓存文件中的所有报文，用于离线分析，末尾不完整的记录会被忽略
+func ReadSpillFrames(path string) ([][]byte, error) {
+	seg := &spillSegment{path: path}
+	frames := make([][]byte, 0)
+	for {
+		record, err := seg.read()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return frames, nil
+			}
+			return nil, err
+		}
+		frames = append(frames, record.frame)
+		seg.offset += record.size
+	}
+}
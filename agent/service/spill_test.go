@@ -0,0 +1,82 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/bsed/trace/agent/misc"
+)
+
+func newTestSpill(t *testing.T, dir string) *Spill {
+	logger = zap.NewNop()
+	misc.Conf = &misc.Config{}
+	misc.Conf.Spill.Enable = true
+	misc.Conf.Spill.Dir = dir
+	misc.Conf.Spill.MaxSize = 16
+
+	s := newSpill()
+	if err := s.Init(); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	return s
+}
+
+func TestSpillRestartMidReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newTestSpill(t, dir)
+	for i := 0; i < 5; i++ {
+		if err := s.push("app", []byte(fmt.Sprintf("frame-%d", i))); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+
+	// 重放2条后collector断开
+	sent := make([]string, 0)
+	s.replay(func(appName string, frame []byte) error {
+		if len(sent) == 2 {
+			return errors.New("collector down")
+		}
+		sent = append(sent, string(frame))
+		return nil
+	})
+	s.Close()
+
+	// 重启后只重放剩余的3条
+	s = newTestSpill(t, dir)
+	if stats := s.stats(); stats.Pending != 3 {
+		t.Fatalf("pending after restart = %d, want 3", stats.Pending)
+	}
+	s.replay(func(appName string, frame []byte) error {
+		sent = append(sent, string(frame))
+		return nil
+	})
+	s.Close()
+
+	if len(sent) != 5 {
+		t.Fatalf("sent %d frames, want 5: %v", len(sent), sent)
+	}
+	for i, frame := range sent {
+		if want := fmt.Sprintf("frame-%d", i); frame != want {
+			t.Fatalf("frame %d = %q, want %q", i, frame, want)
+		}
+	}
+
+	// 全部重放后缓存文件和进度文件都已删除
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("%d files left after replay", len(files))
+	}
+}
@@ -1,19 +1,357 @@
 package service
 
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bsed/trace/agent/misc"
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/stats"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
 // System 系统信息采集服务
 type System struct {
+	stopC    chan bool
+	hostName string
+	lastTime time.Time // 上次采集时间
+	lastCPU  *cpuTimes // 上次采集的cpu时间
+	lastDisk [2]uint64 // 上次采集的磁盘读写字节数
+	lastNet  [2]uint64 // 上次采集的网卡收发字节数
+}
+
+// cpuTimes /proc/stat中的cpu时间
+type cpuTimes struct {
+	user   uint64
+	system uint64
+	idle   uint64
+	iowait uint64
+	total  uint64
 }
 
 func newSystem() *System {
-	return &System{}
+	return &System{
+		stopC: make(chan bool, 1),
+	}
 }
 
 // Start 启动系统采集服务
 func (s *System) Start() error {
+	if !misc.Conf.System.Enable {
+		return nil
+	}
+
+	s.hostName, _ = os.Hostname()
+	interval := misc.Conf.System.Interval
+	if interval <= 0 {
+		interval = 10
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		// 第一次采集作为计算速率的基准
+		s.collect()
+		for {
+			select {
+			case <-ticker.C:
+				info := s.collect()
+				if info == nil {
+					break
+				}
+				s.report(info)
+			case <-s.stopC:
+				return
+			}
+		}
+	}()
 	return nil
 }
 
 // Close 关闭系统采集服务
 func (s *System) Close() error {
+	close(s.stopC)
 	return nil
 }
+
+// report 以每个在线app的名义上报主机信息
+func (s *System) report(info *stats.SystemInfo) {
+	payload, err := msgpack.Marshal(info)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, ss := range gAgent.sessions.list() {
+		// collector不支持时不上报
+		if !gAgent.collector.hasFeature(ss.appName, network.FeatureSystem) {
+			continue
+		}
+		packet := network.NewSystemPacket()
+		packet.Type = constant.TypeOfHostInfo
+		packet.AppName = ss.appName
+		packet.AgentID = ss.agentID
+		packet.HostName = s.hostName
+		packet.Time = now
+		packet.Payload = payload
+
+		body, err := msgpack.Marshal(packet)
+		if err != nil {
+			logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+			continue
+		}
+
+		tracePack := &network.TracePack{
+			Type:       constant.TypeOfSystem,
+			IsSync:     constant.TypeOfSyncNo,
+			IsCompress: constant.TypeOfCompressYes,
+			Payload:    body,
+		}
+		if err := gAgent.collector.write(ss.appName, tracePack); err != nil {
+			logger.Warn("write", zap.String("error", err.Error()), zap.String("appName", ss.appName))
+		}
+	}
+}
+
+// collect 采集主机信息，第一次采集时没有速率数据返回nil
+func (s *System) collect() *stats.SystemInfo {
+	info := stats.NewSystemInfo()
+	now := time.Now()
+
+	info.CPU.Num = runtime.NumCPU()
+	cpu, err := readCPU()
+	if err != nil {
+		logger.Warn("read cpu", zap.String("error", err.Error()))
+	}
+
+	if err := readMemory(info.Memory); err != nil {
+		logger.Warn("read memory", zap.String("error", err.Error()))
+	}
+
+	if err := readLoad(info.Load); err != nil {
+		logger.Warn("read load", zap.String("error", err.Error()))
+	}
+
+	for _, mount := range misc.Conf.System.Mounts {
+		total, used, err := readDiskUsage(mount)
+		if err != nil {
+			logger.Warn("read disk usage", zap.String("mount", mount), zap.String("error", err.Error()))
+			continue
+		}
+		info.Disk.Total += total
+		info.Disk.Used += used
+	}
+
+	disk, err := readDiskIO()
+	if err != nil {
+		logger.Warn("read disk io", zap.String("error", err.Error()))
+	}
+
+	net, err := readNetwork()
+	if err != nil {
+		logger.Warn("read network", zap.String("error", err.Error()))
+	}
+
+	lastTime, lastCPU, lastDisk, lastNet := s.lastTime, s.lastCPU, s.lastDisk, s.lastNet
+	s.lastTime, s.lastCPU, s.lastDisk, s.lastNet = now, cpu, disk, net
+	if lastCPU == nil {
+		return nil
+	}
+
+	// cpu使用率
+	if cpu != nil && cpu.total > lastCPU.total {
+		total := float64(cpu.total - lastCPU.total)
+		info.CPU.User = float64(cpu.user-lastCPU.user) / total
+		info.CPU.System = float64(cpu.system-lastCPU.system) / total
+		info.CPU.IOWait = float64(cpu.iowait-lastCPU.iowait) / total
+		info.CPU.Used = 1 - float64(cpu.idle+cpu.iowait-lastCPU.idle-lastCPU.iowait)/total
+	}
+
+	// 磁盘、网卡速率
+	seconds := now.Sub(lastTime).Seconds()
+	if seconds > 0 {
+		info.Disk.ReadBytes = rate(disk[0], lastDisk[0], seconds)
+		info.Disk.WriteBytes = rate(disk[1], lastDisk[1], seconds)
+		info.Network.RecvBytes = rate(net[0], lastNet[0], seconds)
+		info.Network.SentBytes = rate(net[1], lastNet[1], seconds)
+	}
+	return info
+}
+
+func rate(now, last uint64, seconds float64) float64 {
+	if now < last {
+		return 0
+	}
+	return float64(now-last) / seconds
+}
+
+// readCPU 读取/proc/stat第一行汇总的cpu时间
+func readCPU() (*cpuTimes, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		cpu := &cpuTimes{}
+		for i, field := range fields[1:] {
+			value, _ := strconv.ParseUint(field, 10, 64)
+			// guest、guest_nice已经包含在user、nice中
+			if i < 8 {
+				cpu.total += value
+			}
+			switch i {
+			case 0, 1:
+				cpu.user += value
+			case 2, 5, 6:
+				cpu.system += value
+			case 3:
+				cpu.idle = value
+			case 4:
+				cpu.iowait = value
+			}
+		}
+		return cpu, nil
+	}
+	return nil, scanner.Err()
+}
+
+// readMemory 读取/proc/meminfo
+func readMemory(memory *stats.SystemMemory) error {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, _ := strconv.ParseInt(fields[1], 10, 64)
+		// 单位kB
+		values[strings.TrimSuffix(fields[0], ":")] = value * 1024
+	}
+
+	memory.Total = values["MemTotal"]
+	available, ok := values["MemAvailable"]
+	if !ok {
+		// 老内核没有MemAvailable
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	memory.Available = available
+	memory.Used = memory.Total - available
+	memory.SwapTotal = values["SwapTotal"]
+	memory.SwapUsed = values["SwapTotal"] - values["SwapFree"]
+	return scanner.Err()
+}
+
+// readLoad 读取/proc/loadavg
+func readLoad(load *stats.SystemLoad) error {
+	file, err := os.Open("/proc/loadavg")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 {
+			load.Load1, _ = strconv.ParseFloat(fields[0], 64)
+			load.Load5, _ = strconv.ParseFloat(fields[1], 64)
+			load.Load15, _ = strconv.ParseFloat(fields[2], 64)
+		}
+	}
+	return scanner.Err()
+}
+
+// readDiskUsage 读取挂载点的容量
+func readDiskUsage(mount string) (int64, int64, error) {
+	stat := &syscall.Statfs_t{}
+	if err := syscall.Statfs(mount, stat); err != nil {
+		return 0, 0, err
+	}
+	total := int64(stat.Blocks) * int64(stat.Bsize)
+	free := int64(stat.Bfree) * int64(stat.Bsize)
+	return total, total - free, nil
+}
+
+// readDiskIO 读取/proc/diskstats，只统计/sys/block下的整块磁盘，返回读、写字节数
+func readDiskIO() ([2]uint64, error) {
+	var io [2]uint64
+	file, err := os.Open("/proc/diskstats")
+	if err != nil {
+		return io, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		if _, err := os.Stat("/sys/block/" + name); err != nil {
+			continue
+		}
+		// 扇区大小固定为512字节
+		read, _ := strconv.ParseUint(fields[5], 10, 64)
+		write, _ := strconv.ParseUint(fields[9], 10, 64)
+		io[0] += read * 512
+		io[1] += write * 512
+	}
+	return io, scanner.Err()
+}
+
+// readNetwork 读取/proc/net/dev，不统计lo，返回收、发字节数
+func readNetwork() ([2]uint64, error) {
+	var net [2]uint64
+	file, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return net, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		index := strings.Index(line, ":")
+		if index < 0 {
+			continue
+		}
+		if strings.TrimSpace(line[:index]) == "lo" {
+			continue
+		}
+		fields := strings.Fields(line[index+1:])
+		if len(fields) < 9 {
+			continue
+		}
+		recv, _ := strconv.ParseUint(fields[0], 10, 64)
+		sent, _ := strconv.ParseUint(fields[8], 10, 64)
+		net[0] += recv
+		net[1] += sent
+	}
+	return net, scanner.Err()
+}
@@ -12,29 +12,73 @@ import (
 	"go.uber.org/zap"
 )
 
-func udpRead(data []byte) (*network.Spans, error) {
+// appSpans 携带应用信息的采集数据
+type appSpans struct {
+	appName string
+	agentID string
+	spans   *network.Spans
+}
+
+func udpRead(data []byte) (as *appSpans, err error) {
+	// 错误的报文可能导致thrift解析panic
+	defer func() {
+		if e := recover(); e != nil {
+			as = nil
+			err = fmt.Errorf("malformed packet, %v", e)
+		}
+	}()
+
 	spans := network.NewSpans()
+	as = &appSpans{
+		spans: spans,
+	}
 	tStruct := thrift.Deserialize(data)
 	switch m := tStruct.(type) {
 	case *trace.TSpan:
 		spans.Type = constant.TypeOfTSpan
 		spans.Spans = data
+		as.appName = m.GetApplicationName()
+		as.agentID = m.GetAgentId()
+		if !gAgent.sampler.span(m) {
+			unsampleSpan(as, m)
+		}
 		break
 	case *trace.TSpanChunk:
 		spans.Type = constant.TypeOfTSpanChunk
 		spans.Spans = data
+		as.appName = m.GetApplicationName()
+		as.agentID = m.GetAgentId()
+		keep, held := gAgent.sampler.spanChunk(as, m)
+		if held {
+			// 等待span的采样结果后再发送
+			return nil, nil
+		}
+		if !keep {
+			unsampleSpanChunk(as, m)
+		}
 		break
 	case *pinpoint.TAgentStat:
 		spans.Type = constant.TypeOfTAgentStat
 		spans.Spans = data
+		as.agentID = m.GetAgentId()
 		break
 	case *pinpoint.TAgentStatBatch:
 		spans.Type = constant.TypeOfTAgentStatBatch
 		spans.Spans = data
+		as.agentID = m.GetAgentId()
 		break
 	default:
 		logger.Warn("unknown type", zap.String("type", fmt.Sprintf("unknow type %t", m)))
 		return nil, fmt.Errorf("unknow type %t", m)
 	}
-	return spans, nil
+
+	// stat报文中只有agentID，通过握手信息查找服务名
+	if len(as.appName) == 0 {
+		appName, ok := gAgent.sessions.appName(as.agentID)
+		if !ok {
+			return nil, fmt.Errorf("unknow agent, agentID is %s", as.agentID)
+		}
+		as.appName = appName
+	}
+	return as, nil
 }
@@ -3,6 +3,7 @@ package misc
 import (
 	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/bsed/trace/alert/control"
 	"gopkg.in/yaml.v2"
@@ -10,9 +11,10 @@ import (
 
 type Config struct {
 	Common struct {
-		Version    string
-		LogLevel   string
-		AdminToken string
+		Version         string
+		LogLevel        string
+		AdminToken      string
+		ShutdownTimeout int // 退出时等待数据处理完成的最长时间，单位秒
 	}
 	MQ struct {
 		Addrs []string // mq地址
@@ -52,3 +54,11 @@ func InitConfig(path string) {
 	}
 	Conf = conf
 }
+
+// ShutdownTimeout 退出时等待数据处理完成的最长时间
+func ShutdownTimeout() time.Duration {
+	if Conf.Common.ShutdownTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(Conf.Common.ShutdownTimeout) * time.Second
+}
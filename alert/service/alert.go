@@ -79,8 +79,21 @@ func (a *Alert) Start() error {
 	return nil
 }
 
-// Close stop server
+// Close 处理完mq中已收到的数据后停止计算并关闭存储
 func (a *Alert) Close() error {
+	if err := a.mq.Drain(misc.ShutdownTimeout()); err != nil {
+		logger.Warn("mq drain", zap.String("error", err.Error()))
+	}
+
+	a.apps.close()
+
+	if a.traceCql != nil {
+		a.traceCql.Close()
+	}
+	if a.staticCql != nil {
+		a.staticCql.Close()
+	}
+	logger.Info("Alert close ok")
 	return nil
 }
 
@@ -206,6 +206,17 @@ func (a *Apps) remove(name string) {
 	a.Unlock()
 }
 
+// close 停止所有app的计算任务
+func (a *Apps) close() {
+	a.Lock()
+	for name, app := range a.Apps {
+		gAlert.tickers.RemoveTask(app.taskID)
+		app.close()
+		delete(a.Apps, name)
+	}
+	a.Unlock()
+}
+
 func (a *Apps) add(app *App) {
 	a.Lock()
 	a.Apps[app.policy.AppName] = app
@@ -19,6 +19,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/imdevlab/g"
 	"github.com/bsed/trace/collector/misc"
@@ -47,12 +48,25 @@ var rootCmd = &cobra.Command{
 		}
 
 		// 等待服务器停止信号
-		chSig := make(chan os.Signal)
+		chSig := make(chan os.Signal, 1)
 		signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
 		sig := <-chSig
 
 		g.L.Info("collector received signal", zap.Any("signal", sig))
-		c.Close()
+
+		// 停止接收数据并处理缓存，超时或者再次收到信号时强制退出
+		doneC := make(chan bool)
+		go func() {
+			c.Close()
+			close(doneC)
+		}()
+		select {
+		case <-doneC:
+		case sig := <-chSig:
+			g.L.Warn("collector force exit", zap.Any("signal", sig))
+		case <-time.After(misc.ShutdownTimeout() + time.Second):
+			g.L.Warn("collector close timeout")
+		}
 	},
 }
 
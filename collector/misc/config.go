@@ -3,6 +3,7 @@ package misc
 import (
 	"io/ioutil"
 	"log"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -10,14 +11,34 @@ import (
 // Config ...
 type Config struct {
 	Common struct {
-		Version    string
-		LogLevel   string
-		AdminToken string
+		Version         string
+		LogLevel        string
+		AdminToken      string
+		ShutdownTimeout int // 退出时等待数据处理完成的最长时间，单位秒
 	}
 
 	Collector struct {
 		Addr    string
 		Timeout int
+		Auth    bool // 是否要求agent认证，token使用common.admintoken
+		// 自身监控指标地址，prometheus格式，GET /metrics，为空时不启动
+		MetricsAddr string
+		// 允许agent使用的压缩算法，为空时支持全部: zstd-dict、zstd、gzip、snappy
+		Compressions []string
+		ZstdDicts    []string // zstd字典文件，更换字典时保留旧字典直到agent全部更新
+		TLS          struct {
+			Enable   bool
+			CertFile string
+			KeyFile  string
+			CAFile   string // 不为空时开启双向认证，校验agent证书
+		}
+	}
+
+	Receiver struct {
+		Addr            string // zipkin、jaeger span接收地址，为空时不启动
+		Zipkin          bool   // 接收zipkin v2 JSON，POST /api/v2/spans
+		Jaeger          bool   // 接收jaeger thrift，POST /api/traces
+		InstanceTimeout int    // 服务实例超过该时间没有上报时下线，单位秒
 	}
 
 	Etcd struct {
@@ -51,6 +72,15 @@ type Config struct {
 		TolerateTime     int32   // APDEX 可容忍时间指标，单位毫秒
 		RuntimeRange     int64   // Runtime延迟计算时间
 		DefaultCode      []int32 // http默认code
+		AllowedLateness  int64   // 计算点入库后允许迟到的时间，单位秒，超过后迟到数据丢弃
+		LatePolicy       string  // 迟到数据处理方式，merge: 合并到已入库数据，drop: 丢弃
+	}
+
+	Rollup struct {
+		Enable    bool             // 是否将分钟统计数据汇总为10分钟、1小时、1天数据
+		Interval  int64            // 汇总检查间隔，单位秒
+		Batch     int              // 每次检查每个精度最多汇总的窗口数，用于停机后追赶
+		Retention map[string]int64 // 各精度汇总数据保留天数，key为10m、1h、1d
 	}
 
 	Apps struct {
@@ -59,14 +89,30 @@ type Config struct {
 	}
 
 	MQ struct {
-		Addrs []string // mq地址
-		Topic string   // 主题
+		Addrs        []string // mq地址
+		Topic        string   // 主题
+		CommandTopic string   // web下发pinpoint指令的主题
+		ConfigTopic  string   // web修改app配置的主题
 	}
 
 	Ticker struct {
 		Num      int   // 定时器个数
 		Interval int64 // 任务时间间隔
 	}
+
+	Scrub struct {
+		Enable  bool                 // 是否对span annotation脱敏
+		Mask    string               // 脱敏后的值
+		Default ScrubRule            // 所有app使用的规则
+		Apps    map[string]ScrubRule // app单独追加的规则
+	}
+}
+
+// ScrubRule 脱敏规则
+type ScrubRule struct {
+	Keys     []string // annotation key，数值或者constant.AnnotationKeys中的名字
+	Patterns []string // 正则匹配的内容脱敏
+	Params   []string // url参数名，只脱敏参数值
 }
 
 // Conf ...
@@ -87,3 +133,11 @@ func InitConfig(path string) {
 	Conf = conf
 	log.Println(Conf)
 }
+
+// ShutdownTimeout 退出时等待数据处理完成的最长时间
+func ShutdownTimeout() time.Duration {
+	if Conf.Common.ShutdownTimeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(Conf.Common.ShutdownTimeout) * time.Second
+}
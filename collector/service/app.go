@@ -1,8 +1,10 @@
 package service
 
 import (
+	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/imdevlab/g/utils"
@@ -32,6 +34,7 @@ type App struct {
 	agents           map[string]*util.Agent    // agent集合
 	apis             map[string]struct{}       // 接口信息
 	stopC            chan bool                 // 停止通道
+	doneC            chan bool                 // 计算协程退出通道
 	tickerC          chan bool                 // 定时任务通道
 	apiTickerC       chan bool                 // 定时任务通道
 	spanC            chan *trace.TSpan         // span类型通道
@@ -44,6 +47,13 @@ type App struct {
 	policyUpdateDate int64                     // 策略更新时间
 	checkTime        int64                     // 检查时间
 	defaultCode      map[int32]struct{}        // 默认code， 不会被策略覆盖
+	apdex            map[string]*plugin.Apdex  // apdex阈值，key为api，空字符串为应用默认值
+	watermark        int64                     // 最后入库的计算点，不大于该时间的数据为迟到数据
+	apiWatermark     int64                     // 最后入库的api二次聚合点
+	lateStats        map[int64]struct{}        // 包含迟到数据的计算点，入库时和已入库数据合并
+	lateApis         map[int64]struct{}        // 包含迟到数据的api二次聚合点
+	handoffC         chan bool                 // 集群变化通知，检查api二次聚合点是否需要转交
+	stopped          int32                     // 计算协程是否已经停止
 }
 
 func newApp(name string) *App {
@@ -52,8 +62,10 @@ func newApp(name string) *App {
 		name:        name,
 		agents:      make(map[string]*util.Agent),
 		stopC:       make(chan bool, 1),
+		doneC:       make(chan bool),
 		tickerC:     make(chan bool, 10),
 		apiTickerC:  make(chan bool, 10),
+		handoffC:    make(chan bool, 1),
 		spanC:       make(chan *trace.TSpan, 200),
 		spanChunkC:  make(chan *trace.TSpanChunk, 200),
 		apiC:        make(chan *alert.Data, 200),
@@ -63,8 +75,15 @@ func newApp(name string) *App {
 		httpCodes:   make(map[int32]struct{}),
 		defaultCode: make(map[int32]struct{}),
 		apiCache:    make(map[int64]*stats.App),
+		lateStats:   make(map[int64]struct{}),
+		lateApis:    make(map[int64]struct{}),
 	}
 
+	// 上一分钟可能已经被其他collector或者重启前的进程入库，之后收到的数据需要合并
+	now := time.Now().Unix()
+	app.watermark = now - now%60 - 60
+	app.apiWatermark = app.watermark
+
 	for _, code := range misc.Conf.Stats.DefaultCode {
 		app.httpCodes[code] = struct{}{}
 		app.defaultCode[code] = struct{}{}
@@ -100,6 +119,53 @@ func (a *App) addCode(code int32) {
 	a.mutex.Unlock()
 }
 
+// setApdex 替换apdex阈值
+func (a *App) setApdex(apdex map[string]*plugin.Apdex) {
+	a.mutex.Lock()
+	a.apdex = apdex
+	a.mutex.Unlock()
+}
+
+// getApdex 获取api的apdex阈值，依次查找api、应用默认值，都没有配置时返回nil
+func (a *App) getApdex(api string) *plugin.Apdex {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if apdex, ok := a.apdex[api]; ok {
+		return apdex
+	}
+	if apdex, ok := a.apdex[""]; ok {
+		return apdex
+	}
+	return nil
+}
+
+// watermarks 计算点和api二次聚合点的入库进度
+func (a *App) watermarks() (int64, int64) {
+	return atomic.LoadInt64(&a.watermark), atomic.LoadInt64(&a.apiWatermark)
+}
+
+// advance 计算点入库后推进watermark
+func advance(watermark *int64, inputDate int64) {
+	if inputDate > atomic.LoadInt64(watermark) {
+		atomic.StoreInt64(watermark, inputDate)
+	}
+}
+
+// checkLate 检查数据是否迟到，迟到数据根据配置合并或者丢弃，返回false时丢弃
+func checkLate(inputDate int64, watermark *int64, lates map[int64]struct{}, source string) bool {
+	mark := atomic.LoadInt64(watermark)
+	if inputDate > mark {
+		return true
+	}
+	if misc.Conf.Stats.LatePolicy == "drop" || mark-inputDate > misc.Conf.Stats.AllowedLateness {
+		gLateCounter.inc(source, "dropped")
+		return false
+	}
+	lates[inputDate] = struct{}{}
+	gLateCounter.inc(source, "merged")
+	return true
+}
+
 // online agent上线
 func (a *App) online(agentid string) error {
 	a.mutex.RLock()
@@ -142,12 +208,14 @@ func (a *App) stats() {
 	// 	}
 	// }()
 
+	defer close(a.doneC)
+
 	for {
 		select {
 		// 二次聚合之后的api信息入库
 		case _, ok := <-a.apiTickerC:
 			if ok {
-				if err := a.apiStatsStore(); err != nil {
+				if err := a.apiStatsStore(false); err != nil {
 					logger.Warn("api stats & store error", zap.String("error", err.Error()))
 				}
 			}
@@ -155,7 +223,7 @@ func (a *App) stats() {
 		case _, ok := <-a.tickerC:
 			if ok {
 				// 链路统计信息入库
-				if err := a.statsStore(); err != nil {
+				if err := a.statsStore(false); err != nil {
 					logger.Warn("stats store error", zap.String("error", err.Error()))
 				}
 			}
@@ -183,6 +251,10 @@ func (a *App) stats() {
 				}
 			}
 			break
+		// 集群变化，不再负责的api二次聚合点转交给新owner
+		case <-a.handoffC:
+			a.handoff()
+			break
 		// agent stat数据统计
 		case agentStat, ok := <-a.statC:
 			if ok {
@@ -197,6 +269,59 @@ func (a *App) stats() {
 	}
 }
 
+// flush 停止计算协程，处理完管道中的数据后将所有计算点入库
+func (a *App) flush() {
+	a.flushStats()
+	a.flushApi()
+}
+
+// flushStats 停止计算协程，处理完管道中的数据后计算点入库，二次聚合数据发送给owner
+func (a *App) flushStats() {
+	a.stopC <- true
+	<-a.doneC
+	atomic.StoreInt32(&a.stopped, 1)
+
+	for len(a.spanC) > 0 {
+		if err := a.statsSpan(<-a.spanC); err != nil {
+			logger.Warn("stats span error", zap.String("error", err.Error()))
+		}
+	}
+	for len(a.spanChunkC) > 0 {
+		if err := a.statsSpanChunk(<-a.spanChunkC); err != nil {
+			logger.Warn("stats span error", zap.String("error", err.Error()))
+		}
+	}
+	for len(a.statC) > 0 {
+		if err := a.statsAgentStat(<-a.statC); err != nil {
+			logger.Warn("stats agent stat error", zap.String("error", err.Error()))
+		}
+	}
+	for len(a.statsCache) > 0 {
+		if err := a.statsStore(true); err != nil {
+			logger.Warn("stats store error", zap.String("error", err.Error()))
+			break
+		}
+	}
+}
+
+// flushApi 所有app的计算点入库之后调用，api二次聚合点转交或者入库
+func (a *App) flushApi() {
+	for len(a.apiC) > 0 {
+		if err := a.statsApi(<-a.apiC); err != nil {
+			logger.Warn("stats api error", zap.String("error", err.Error()))
+		}
+	}
+
+	// 退出前已经从hash中删除自己，api二次聚合点转交给新owner，没有其他collector时入库
+	a.handoff()
+	for len(a.apiCache) > 0 {
+		if err := a.apiStatsStore(true); err != nil {
+			logger.Warn("api stats & store error", zap.String("error", err.Error()))
+			break
+		}
+	}
+}
+
 // statsApi 二次聚合模块
 func (a *App) statsApi(packet *alert.Data) error {
 	newApp := stats.NewApp()
@@ -204,6 +329,10 @@ func (a *App) statsApi(packet *alert.Data) error {
 		logger.Warn("msgpack unmarshal", zap.String("error", err.Error()))
 		return err
 	}
+	if !checkLate(packet.Time, &a.apiWatermark, a.lateApis, "api") {
+		return nil
+	}
+
 	// 查找Api相关缓存，不存在新申请
 	cacheApp, ok := a.apiCache[packet.Time]
 	if !ok {
@@ -230,6 +359,7 @@ func (a *App) statsApi(packet *alert.Data) error {
 		url.AccessErrCount += tmpUrl.AccessErrCount
 		url.SatisfactionCount += tmpUrl.SatisfactionCount
 		url.TolerateCount += tmpUrl.TolerateCount
+		url.Histogram.Merge(tmpUrl.Histogram)
 	}
 
 	// 计算Dubbo信息
@@ -251,11 +381,33 @@ func (a *App) statsApi(packet *alert.Data) error {
 		dubbo.AccessErrCount += tmpDubbo.AccessErrCount
 		dubbo.SatisfactionCount += tmpDubbo.SatisfactionCount
 		dubbo.TolerateCount += tmpDubbo.TolerateCount
+		dubbo.Histogram.Merge(tmpDubbo.Histogram)
 	}
 
 	return nil
 }
 
+// handoff api二次聚合点的owner不是本collector时，转交给owner继续聚合，转交失败的留在本地入库
+func (a *App) handoff() {
+	for inputDate, cacheApp := range a.apiCache {
+		payload, err := msgpack.Marshal(cacheApp)
+		if err != nil {
+			logger.Warn("msgpack", zap.String("error", err.Error()))
+			continue
+		}
+		packet := alert.NewData()
+		packet.AppName = a.name
+		packet.Time = inputDate
+		packet.Payload = payload
+		if !gCollector.handoffApi(packet, "sent") {
+			// 本collector仍然是owner
+			continue
+		}
+		delete(a.apiCache, inputDate)
+		delete(a.lateApis, inputDate)
+	}
+}
+
 // stats 计算模块
 func (a *App) statsSpan(span *trace.TSpan) error {
 	// api缓存并入库
@@ -280,11 +432,14 @@ func (a *App) statsSpan(span *trace.TSpan) error {
 
 	// 获取时间戳并将其精确到分钟
 	spanTime := t.Unix() - int64(t.Second())
+	if !checkLate(spanTime, &a.watermark, a.lateStats, "span") {
+		return nil
+	}
 
 	// 查找时间点，不存在新申请, span统计的范围是分钟，所以这里直接用优化过后的spanTime
 	stats, ok := a.statsCache[spanTime]
 	if !ok {
-		stats = plugin.NewStats(a.httpCodes, a.mutex, logger, getNameByIP, getNameByDubboAPI)
+		stats = plugin.NewStats(a.httpCodes, a.mutex, logger, getNameByIP, getNameByDubboAPI, getApdex)
 		a.statsCache[spanTime] = stats
 	}
 	stats.SpanCounter(span)
@@ -303,11 +458,14 @@ func (a *App) statsAgentStat(agentStat *pinpoint.TAgentStat) error {
 
 	// 获取时间戳并将其精确到分钟
 	agentStatTime := t.Unix() - int64(t.Second())
+	if !checkLate(agentStatTime, &a.watermark, a.lateStats, "agent_stat") {
+		return nil
+	}
 
 	// 查找时间点，不存在新申请
 	stats, ok := a.statsCache[agentStatTime]
 	if !ok {
-		stats = plugin.NewStats(a.httpCodes, a.mutex, logger, getNameByIP, getNameByDubboAPI)
+		stats = plugin.NewStats(a.httpCodes, a.mutex, logger, getNameByIP, getNameByDubboAPI, getApdex)
 		a.statsCache[agentStatTime] = stats
 	}
 
@@ -326,7 +484,7 @@ func (a *App) statsSpanChunk(spanChunk *trace.TSpanChunk) error {
 	// 查找时间点，不存在新申请
 	stats, ok := a.statsCache[spanChunkTime]
 	if !ok {
-		stats = plugin.NewStats(a.httpCodes, a.mutex, logger, getNameByIP, getNameByDubboAPI)
+		stats = plugin.NewStats(a.httpCodes, a.mutex, logger, getNameByIP, getNameByDubboAPI, getApdex)
 		a.statsCache[spanChunkTime] = stats
 	}
 
@@ -399,7 +557,19 @@ func (a *App) recvSpanChunk(appName, agentID string, spanChunk *trace.TSpanChunk
 }
 
 func (a *App) recvApi(packet *alert.Data) error {
-	a.apiC <- packet
+	if atomic.LoadInt32(&a.stopped) == 0 {
+		a.apiC <- packet
+		return nil
+	}
+	// 计算协程已经停止，转交给新owner，没有其他collector时留给flushApi入库
+	if gCollector.handoffApi(packet, "forwarded") {
+		return nil
+	}
+	select {
+	case a.apiC <- packet:
+	default:
+		return fmt.Errorf("app is stopped and apiC is full, appName is %s", a.name)
+	}
 	return nil
 }
 
@@ -408,8 +578,8 @@ func (a *App) recvAgentStat(appName, agentID string, agentStat *pinpoint.TAgentS
 	return nil
 }
 
-// statsStore 链路统计信息入库
-func (a *App) statsStore() error {
+// statsStore 链路统计信息入库，force为true时不等待延迟时间
+func (a *App) statsStore(force bool) error {
 	// 清空之前节点
 	a.order = a.order[:0]
 
@@ -429,12 +599,19 @@ func (a *App) statsStore() error {
 	inputDate := a.order[0]
 	now := time.Now().Unix()
 
-	if now < inputDate+misc.Conf.Stats.DeferTime {
+	if !force && now < inputDate+misc.Conf.Stats.DeferTime {
 		return nil
 	}
 
+	// 迟到数据和已入库数据合并，告警已经按入库时的数据计算过，不再推送
+	_, late := a.lateStats[inputDate]
+
 	// 接口入库
 	for methodID, method := range a.statsCache[inputDate].Method.Methods {
+		if late {
+			gCollector.storage.MergeMethodStats(a.name, inputDate, a.statsCache[inputDate].Method.ApiStr, methodID, method)
+			continue
+		}
 		gCollector.storage.InsertMethodStats(a.name, inputDate, a.statsCache[inputDate].Method.ApiStr, methodID, method)
 	}
 
@@ -442,6 +619,10 @@ func (a *App) statsStore() error {
 
 	// sql入库
 	for sqlID, sql := range a.statsCache[inputDate].SQL.SQLS {
+		if late {
+			gCollector.storage.MergeSQLStats(a.name, inputDate, sqlID, sql)
+			continue
+		}
 		gCollector.storage.InsertSQLStats(a.name, inputDate, sqlID, sql)
 		alertSql := alert.NewSQL()
 		alertSql.Count = sql.Count
@@ -477,7 +658,7 @@ func (a *App) statsStore() error {
 		rs.Runtimes[agentID] = r
 	}
 
-	if len(rs.Runtimes) > 0 {
+	if len(rs.Runtimes) > 0 && !late {
 		data := alert.NewData()
 		data.AppName = a.name
 		data.Type = constant.ALERT_TYPE_RUNTIME
@@ -494,11 +675,15 @@ func (a *App) statsStore() error {
 
 	// 异常入库
 	for methodID, exceptions := range a.statsCache[inputDate].Exception.ExMethods {
+		if late {
+			gCollector.storage.MergeExceptionStats(a.name, inputDate, methodID, exceptions.Exceptions)
+			continue
+		}
 		gCollector.storage.InsertExceptionStats(a.name, inputDate, methodID, exceptions.Exceptions)
 	}
 
 	// 异常数大于0才需要上报
-	if a.statsCache[inputDate].Exception.ErrCount > 0 {
+	if a.statsCache[inputDate].Exception.ErrCount > 0 && !late {
 		exception := alert.NewException()
 		exception.Count = a.statsCache[inputDate].Exception.Count
 		exception.ErrCount = a.statsCache[inputDate].Exception.ErrCount
@@ -520,6 +705,10 @@ func (a *App) statsStore() error {
 	// 插入被访问者
 	for targetType, targets := range a.statsCache[inputDate].SrvMap.Targets {
 		for targetName, target := range targets {
+			if late {
+				gCollector.storage.MergeTargetMap(a.name, a.appType, inputDate, int32(targetType), targetName, target)
+				continue
+			}
 			gCollector.storage.InsertTargetMap(a.name, a.appType, inputDate, int32(targetType), targetName, target)
 		}
 	}
@@ -527,12 +716,20 @@ func (a *App) statsStore() error {
 	unknowParent := a.statsCache[inputDate].SrvMap.UnknowParent
 	// 只有被调用才可以入库
 	if unknowParent.AccessCount > 0 {
-		gCollector.storage.InsertUnknowParentMap(a.name, a.appType, inputDate, unknowParent)
+		if late {
+			gCollector.storage.MergeUnknowParentMap(a.name, a.appType, inputDate, unknowParent)
+		} else {
+			gCollector.storage.InsertUnknowParentMap(a.name, a.appType, inputDate, unknowParent)
+		}
 	}
 
 	// api被调用情况
 	for apiStr, apiInfo := range a.statsCache[inputDate].APIMap.Apis {
 		for parentName, parentInfo := range apiInfo.Parents {
+			if late {
+				gCollector.storage.MergeAPIMapStats(a.name, a.appType, inputDate, apiStr, parentName, parentInfo)
+				continue
+			}
 			gCollector.storage.InsertAPIMapStats(a.name, a.appType, inputDate, apiStr, parentName, parentInfo)
 		}
 	}
@@ -551,7 +748,10 @@ func (a *App) statsStore() error {
 			// 推送
 			topic, err := gCollector.getCollecotorTopic(appName)
 			if err != nil {
-				logger.Warn("get topic failed", zap.String("appName", appName), zap.String("error", err.Error()))
+				// 没有可用的collector(最后一个collector退出时)，本地聚合
+				if err := gCollector.apps.routerApi(packet); err != nil {
+					logger.Warn("get topic failed", zap.String("appName", appName), zap.String("error", err.Error()))
+				}
 				continue
 			}
 
@@ -569,11 +769,13 @@ func (a *App) statsStore() error {
 
 	// 上报打点信息并删除该时间点信息
 	delete(a.statsCache, inputDate)
+	delete(a.lateStats, inputDate)
+	advance(&a.watermark, inputDate)
 	return nil
 }
 
-// apiStatsStore api信息二次聚合并入库
-func (a *App) apiStatsStore() error {
+// apiStatsStore api信息二次聚合并入库，force为true时不等待延迟时间
+func (a *App) apiStatsStore(force bool) error {
 	// 清空之前节点
 	a.order = a.order[:0]
 
@@ -594,13 +796,20 @@ func (a *App) apiStatsStore() error {
 	now := time.Now().Unix()
 
 	// 延迟ApiStatsInterval
-	if now < inputDate+misc.Conf.Apps.ApiStatsInterval+60 {
+	if !force && now < inputDate+misc.Conf.Apps.ApiStatsInterval+60 {
 		return nil
 	}
 
+	// 迟到数据和已入库数据合并，不再推送告警
+	_, late := a.lateApis[inputDate]
+
 	apis := alert.NewAPIs()
 	// 遍历入库
 	for urlStr, url := range a.apiCache[inputDate].Urls {
+		if late {
+			gCollector.storage.MergeAPIStats(a.name, inputDate, urlStr, url)
+			continue
+		}
 		gCollector.storage.InsertAPIStats(a.name, inputDate, urlStr, url)
 		apiAlert := &alert.API{
 			Desc:           urlStr,
@@ -613,6 +822,10 @@ func (a *App) apiStatsStore() error {
 
 	// 遍历入库
 	for dubboAPI, dubbo := range a.apiCache[inputDate].Dubbos {
+		if late {
+			gCollector.storage.MergeDubboStats(a.name, inputDate, dubboAPI, dubbo)
+			continue
+		}
 		gCollector.storage.InsertDubboStats(a.name, inputDate, dubboAPI, dubbo)
 		apiAlert := &alert.API{
 			Desc:           dubboAPI,
@@ -641,5 +854,7 @@ func (a *App) apiStatsStore() error {
 	}
 	// 上报打点信息并删除该时间点信息
 	delete(a.apiCache, inputDate)
+	delete(a.lateApis, inputDate)
+	advance(&a.apiWatermark, inputDate)
 	return nil
 }
@@ -10,6 +10,7 @@ import (
 
 	"github.com/gocql/gocql"
 	"github.com/bsed/trace/collector/misc"
+	"github.com/bsed/trace/collector/service/plugin"
 	"github.com/bsed/trace/pkg/alert"
 	"github.com/bsed/trace/pkg/constant"
 	"github.com/bsed/trace/pkg/pinpoint/thrift/pinpoint"
@@ -37,6 +38,10 @@ func (a *Apps) start() error {
 		return err
 	}
 
+	if err := a.loadApdexSrv(); err != nil {
+		return err
+	}
+
 	if err := a.loadAppNameDubboSrv(); err != nil {
 		return err
 	}
@@ -138,6 +143,76 @@ func (a *Apps) loadApiCodeSrv() error {
 	return nil
 }
 
+// loadApdex 加载apdex阈值，没有配置的应用恢复为collector.yaml中的阈值
+func (a *Apps) loadApdex(cql *gocql.Session) error {
+	if cql == nil {
+		return fmt.Errorf("unfind cql")
+	}
+
+	query := cql.Query(sql.LoadApdex).Iter()
+
+	apdexs := make(map[string]map[string]*plugin.Apdex)
+	var appName, api string
+	var satisfaction, tolerate int32
+	for query.Scan(&appName, &api, &satisfaction, &tolerate) {
+		if satisfaction <= 0 {
+			logger.Warn("invalid apdex", zap.String("appName", appName), zap.String("api", api), zap.Int32("satisfaction", satisfaction))
+			continue
+		}
+		apis, ok := apdexs[appName]
+		if !ok {
+			apis = make(map[string]*plugin.Apdex)
+			apdexs[appName] = apis
+		}
+		apis[api] = plugin.NewApdex(satisfaction, tolerate)
+	}
+
+	if err := query.Close(); err != nil {
+		logger.Warn("close iter error:", zap.Error(err))
+		return err
+	}
+
+	a.RLock()
+	for name, app := range a.apps {
+		app.setApdex(apdexs[name])
+	}
+	a.RUnlock()
+	return nil
+}
+
+// loadApdexSrv 定时加载apdex阈值
+func (a *Apps) loadApdexSrv() error {
+	cql := gCollector.storage.GetStaticCql()
+	if err := a.loadApdex(cql); err != nil {
+		logger.Warn("load apdex", zap.String("error", err.Error()))
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Duration(misc.Conf.Apps.LoadInterval) * time.Second)
+			cql := gCollector.storage.GetStaticCql()
+			if err := a.loadApdex(cql); err != nil {
+				logger.Warn("load apdex", zap.String("error", err.Error()))
+			}
+		}
+	}()
+	return nil
+}
+
+// getApdex 获取应用api的apdex阈值，应用不存在或者没有配置时使用collector.yaml中的阈值
+func (a *Apps) getApdex(appName, api string) *plugin.Apdex {
+	a.RLock()
+	app, ok := a.apps[appName]
+	a.RUnlock()
+	if ok {
+		if apdex := app.getApdex(api); apdex != nil {
+			return apdex
+		}
+	}
+	return plugin.DefaultApdex()
+}
+
 // loadAppsStart 加载app
 func (a *Apps) loadAppsSrv() error {
 	cql := gCollector.storage.GetStaticCql()
@@ -295,6 +370,24 @@ func newApps() *Apps {
 	}
 }
 
+// flush 所有app的计算点入库
+func (a *Apps) flush() {
+	a.RLock()
+	apps := make([]*App, 0, len(a.apps))
+	for _, app := range a.apps {
+		apps = append(apps, app)
+	}
+	a.RUnlock()
+
+	// 计算点全部入库后二次聚合数据才完整
+	for _, app := range apps {
+		app.flushStats()
+	}
+	for _, app := range apps {
+		app.flushApi()
+	}
+}
+
 func (a *Apps) getApp(appName string) (*App, bool) {
 	a.RLock()
 	app, ok := a.apps[appName]
@@ -400,6 +493,18 @@ func (a *Apps) routerAgentStatBatch(appName, agentID string, agentStatBatch *pin
 	return nil
 }
 
+// handoff 集群变化后通知所有app检查api二次聚合点的owner
+func (a *Apps) handoff() {
+	a.RLock()
+	for _, app := range a.apps {
+		select {
+		case app.handoffC <- true:
+		default:
+		}
+	}
+	a.RUnlock()
+}
+
 func (a *Apps) routerApi(packet *alert.Data) error {
 	app, ok := a.getApp(packet.AppName)
 	if !ok {
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/bsed/trace/collector/misc"
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+// auth 校验agent发送的token，认证通过前的其他报文一律拒绝
+func (t *tcpClient) auth(conn net.Conn, packet *network.TracePack) error {
+	if packet.Type != constant.TypeOfCmd {
+		return fmt.Errorf("unauthenticated packet, type is %d", packet.Type)
+	}
+
+	cmd := network.NewCMD()
+	if err := msgpack.Unmarshal(packet.Payload, cmd); err != nil {
+		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+		return err
+	}
+	if cmd.Type != constant.TypeOfAuth {
+		return fmt.Errorf("unauthenticated cmd, type is %d", cmd.Type)
+	}
+
+	auth := network.NewAuth()
+	if err := msgpack.Unmarshal(cmd.Payload, auth); err != nil {
+		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	result := network.NewAuthResult()
+	if subtle.ConstantTimeCompare([]byte(auth.Token), []byte(misc.Conf.Common.AdminToken)) == 1 {
+		result.Success = true
+	} else {
+		result.Message = "invalid token"
+	}
+
+	if err := writeAuthResult(conn, packet.ID, result); err != nil {
+		return err
+	}
+
+	if !result.Success {
+		return fmt.Errorf("invalid token, addr is %s", conn.RemoteAddr().String())
+	}
+	t.authed = true
+	return nil
+}
+
+// writeAuthResult 返回认证结果
+func writeAuthResult(conn net.Conn, id uint32, result *network.AuthResult) error {
+	b, err := msgpack.Marshal(result)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	cmd := network.NewCMD()
+	cmd.Type = constant.TypeOfAuth
+	cmd.Payload = b
+	buf, err := msgpack.Marshal(cmd)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	packet := &network.TracePack{
+		Type:       constant.TypeOfCmd,
+		IsSync:     constant.TypeOfSyncYes,
+		IsCompress: constant.TypeOfCompressNo,
+		ID:         id,
+		Payload:    buf,
+	}
+	if _, err := conn.Write(packet.Encode()); err != nil {
+		logger.Warn("conn.Write", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// handshake 与agent协商协议版本和能力，不兼容时返回错误信息后断开链接
+func (t *tcpClient) handshake(conn net.Conn, id uint32, payload []byte) error {
+	remote := &network.Hello{}
+	if err := msgpack.Unmarshal(payload, remote); err != nil {
+		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	hello, err := network.Negotiate(localHello(), remote)
+	if err != nil {
+		hello = &network.Hello{Error: err.Error()}
+	}
+
+	b, err := msgpack.Marshal(hello)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	cmd := network.NewCMD()
+	cmd.Type = constant.TypeOfHello
+	cmd.Payload = b
+	buf, err := msgpack.Marshal(cmd)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	packet := &network.TracePack{
+		Type:       constant.TypeOfCmd,
+		IsSync:     constant.TypeOfSyncYes,
+		IsCompress: constant.TypeOfCompressNo,
+		ID:         id,
+		Payload:    buf,
+	}
+	if _, err := conn.Write(packet.Encode()); err != nil {
+		logger.Warn("conn.Write", zap.String("error", err.Error()))
+		return err
+	}
+
+	if len(hello.Error) > 0 {
+		return fmt.Errorf("incompatible agent, %s", hello.Error)
+	}
+	t.hello = hello
+	return nil
+}
+
+// localHello 本端能力，压缩算法按配置过滤
+func localHello() *network.Hello {
+	hello := network.NewHello()
+	if len(misc.Conf.Collector.Compressions) == 0 {
+		return hello
+	}
+	compressions := make([]string, 0, len(hello.Compressions))
+	for _, name := range hello.Compressions {
+		for _, allowed := range misc.Conf.Collector.Compressions {
+			if name == allowed || (allowed == network.CompressZstdDict && strings.HasPrefix(name, network.CompressZstdDict)) {
+				compressions = append(compressions, name)
+				break
+			}
+		}
+	}
+	hello.Compressions = compressions
+	return hello
+}
+
+// version 下发报文使用的协议版本
+func (t *tcpClient) version() byte {
+	if t.hello == nil {
+		return 0
+	}
+	return t.hello.Version
+}
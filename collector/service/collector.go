@@ -2,11 +2,12 @@ package service
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/imdevlab/g"
@@ -18,6 +19,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/bsed/trace/collector/misc"
+	"github.com/bsed/trace/collector/service/plugin"
 	"github.com/bsed/trace/collector/storage"
 	"github.com/bsed/trace/collector/ticker"
 	"github.com/bsed/trace/pkg/constant"
@@ -30,15 +32,26 @@ var logger *zap.Logger
 // Collector 采集服务
 type Collector struct {
 	sync.RWMutex
-	etcd       *Etcd               // 服务上报
-	apps       *Apps               // app集合
-	ticker     *ticker.Tickers     // 定时器
-	apiTicker  *ticker.Tickers     // 定时器
-	storage    *storage.Storage    // 存储
-	mq         *mq.Nats            // 消息队列
-	pushC      chan *alert.Data    // 推送通道
-	collectors map[string]struct{} // collectors
-	hash       *g.Hash             // 一致性hash
+	etcd       *Etcd                 // 服务上报
+	apps       *Apps                 // app集合
+	ticker     *ticker.Tickers       // 定时器
+	apiTicker  *ticker.Tickers       // 定时器
+	storage    *storage.Storage      // 存储
+	mq         *mq.Nats              // 消息队列
+	pushC      chan *alert.Data      // 推送通道
+	collectors map[string]struct{}   // collectors
+	hash       *g.Hash               // 一致性hash
+	agents     *Agents               // 链接在本collector上的agent
+	scrubber   *Scrubber             // 敏感数据脱敏
+	rpc        *network.RPC          // 下发给agent的同步请求
+	configs    *Configs              // web设置的app配置
+	listener   net.Listener          // agent链接监听
+	conns      map[net.Conn]struct{} // 当前所有agent链接
+	receiver   *Receiver             // zipkin、jaeger span接收
+	rollup     *Rollup               // 统计数据汇总
+	connWg     sync.WaitGroup        // 链接协程
+	pushDoneC  chan bool             // 推送协程退出通道
+	closed     int32                 // 是否已经停止接收
 }
 
 var gCollector *Collector
@@ -56,6 +69,14 @@ func New(l *zap.Logger) *Collector {
 		pushC:      make(chan *alert.Data, 3000),
 		collectors: make(map[string]struct{}), // collectors
 		hash:       g.NewHash(),
+		agents:     newAgents(),
+		scrubber:   newScrubber(),
+		rpc:        network.NewRPC(),
+		configs:    newConfigs(),
+		conns:      make(map[net.Conn]struct{}),
+		receiver:   newReceiver(),
+		rollup:     newRollup(),
+		pushDoneC:  make(chan bool),
 	}
 	return gCollector
 }
@@ -74,6 +95,24 @@ func (c *Collector) Start() error {
 		return err
 	}
 
+	// 加载app配置
+	if err := c.configs.load(); err != nil {
+		logger.Warn("load app configs error", zap.String("error", err.Error()))
+		return err
+	}
+
+	// 加载zstd字典
+	if err := network.LoadZstdDictFiles(misc.Conf.Collector.ZstdDicts...); err != nil {
+		logger.Warn("load zstd dicts error", zap.String("error", err.Error()))
+		return err
+	}
+
+	// 脱敏规则
+	if err := c.scrubber.start(); err != nil {
+		logger.Warn("scrubber start error", zap.String("error", err.Error()))
+		return err
+	}
+
 	// 存储服务类型
 	if err := c.apps.start(); err != nil {
 		logger.Warn("apps start error", zap.String("error", err.Error()))
@@ -105,28 +144,117 @@ func (c *Collector) Start() error {
 		return err
 	}
 
+	// 订阅web下发的指令
+	if err := c.mq.Subscribe(commandTopic(), commandHandle); err != nil {
+		logger.Warn("mq subscribe  error", zap.String("error", err.Error()))
+		return err
+	}
+
+	// 订阅web修改的app配置
+	if err := c.mq.Subscribe(configTopic(), configHandle); err != nil {
+		logger.Warn("mq subscribe  error", zap.String("error", err.Error()))
+		return err
+	}
+
 	// 启动tcp服务
 	if err := c.startNetwork(); err != nil {
 		logger.Warn("start network error", zap.String("error", err.Error()))
 		return err
 	}
 
-	// 启动推送服务
-	if err := c.pushWork(); err != nil {
-		logger.Warn("start push work error", zap.String("error", err.Error()))
+	// 启动zipkin、jaeger接收服务
+	if err := c.receiver.Start(); err != nil {
+		logger.Warn("receiver start error", zap.String("error", err.Error()))
 		return err
 	}
 
+	// 启动推送服务
+	go c.pushWork()
+
+	// 启动统计数据汇总
+	c.rollup.Start()
+
+	// 自身监控指标
+	startMetrics()
+
 	logger.Info("Collector start ok")
 	return nil
 }
 
-// Close 关闭collector
+// Close 从etcd注销并停止接收数据，计算点和缓存的span入库后关闭
 func (c *Collector) Close() error {
+	deadline := time.Now().Add(misc.ShutdownTimeout())
+
+	// 注销后agent会切换到其他collector
+	c.etcd.Close()
+
+	// 等待中的指令立即返回
+	c.rpc.Close()
+
+	// 停止接收agent数据，链接协程处理完已读取的报文后退出
+	atomic.StoreInt32(&c.closed, 1)
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	c.Lock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.Unlock()
+	if !waitTimeout(&c.connWg, deadline) {
+		logger.Warn("wait agent conns timeout")
+	}
+	c.receiver.Close(deadline)
+
+	// 从hash中删除自己，计算点的二次聚合数据发送给新的owner，api二次聚合点转交给新的owner
+	c.removeCollector(c.etcd.ReportKey)
+
+	// 其他collector更新hash前仍然会发送数据过来，停止订阅并处理完已收到的数据，api数据转交给新的owner
+	if err := c.mq.Unsubscribe(c.etcd.ReportKey, time.Until(deadline)); err != nil {
+		logger.Warn("mq unsubscribe", zap.String("error", err.Error()))
+	}
+
+	// 未到入库时间的计算点全部入库
+	c.apps.flush()
+
+	// 等待正在汇总的窗口完成
+	c.rollup.Close()
+
+	// 发送推送通道中剩余的数据
 	close(c.pushC)
+	select {
+	case <-c.pushDoneC:
+	case <-time.After(time.Until(deadline)):
+		logger.Warn("wait push work timeout", zap.Int("left", len(c.pushC)))
+	}
+
+	if err := c.storage.Close(); err != nil {
+		logger.Warn("storage close", zap.String("error", err.Error()))
+	}
+
+	if err := c.mq.Drain(time.Until(deadline)); err != nil {
+		logger.Warn("mq drain", zap.String("error", err.Error()))
+	}
+
+	logger.Info("Collector close ok")
 	return nil
 }
 
+// waitTimeout 等待WaitGroup，超过deadline返回false
+func waitTimeout(wg *sync.WaitGroup, deadline time.Time) bool {
+	doneC := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(doneC)
+	}()
+	select {
+	case <-doneC:
+		return true
+	case <-time.After(time.Until(deadline)):
+		return false
+	}
+}
+
 func reportKey(dir string) (string, error) {
 	value, err := collectorName()
 	if err != nil {
@@ -149,6 +277,22 @@ func collectorName() (string, error) {
 	return fmt.Sprintf("%s-%d", host, os.Getpid()), nil
 }
 
+// commandTopic web下发指令的主题
+func commandTopic() string {
+	if len(misc.Conf.MQ.CommandTopic) == 0 {
+		return "tracing_command"
+	}
+	return misc.Conf.MQ.CommandTopic
+}
+
+// configTopic web修改app配置的主题
+func configTopic() string {
+	if len(misc.Conf.MQ.ConfigTopic) == 0 {
+		return "tracing_config"
+	}
+	return misc.Conf.MQ.ConfigTopic
+}
+
 func initDir(dir string) string {
 	dirLen := len(dir)
 	if dirLen > 0 && dir[dirLen-1] != '/' {
@@ -158,7 +302,7 @@ func initDir(dir string) string {
 }
 
 // cmdPacket 处理agent 发送来的cmd报文
-func cmdPacket(conn net.Conn, packet *network.TracePack) error {
+func (t *tcpClient) cmdPacket(conn net.Conn, packet *network.TracePack) error {
 	cmd := network.NewCMD()
 	if err := msgpack.Unmarshal(packet.Payload, cmd); err != nil {
 		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
@@ -172,6 +316,38 @@ func cmdPacket(conn net.Conn, packet *network.TracePack) error {
 			return err
 		}
 		// logger.Debug("ping", zap.String("addr", conn.RemoteAddr().String()))
+	case constant.TypeOfCommandResult:
+		if err := commandResult(cmd.Payload); err != nil {
+			logger.Warn("command result", zap.String("error", err.Error()))
+		}
+	case constant.TypeOfHello:
+		if err := t.handshake(conn, packet.ID, cmd.Payload); err != nil {
+			logger.Warn("hello", zap.String("error", err.Error()), zap.String("addr", conn.RemoteAddr().String()))
+			return err
+		}
+	}
+	return nil
+}
+
+// reply 应答agent的同步请求，旧版本agent使用原样返回的格式
+func (t *tcpClient) reply(conn net.Conn, req *network.TracePack, payload []byte, err error) error {
+	if req.IsSync != constant.TypeOfSyncYes {
+		return nil
+	}
+	resp := network.NewResponse(req, payload, err, t.version())
+	if _, err := conn.Write(resp.Encode()); err != nil {
+		logger.Warn("conn.Write", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// send 由链接协程写入，队列满时返回错误
+func (t *tcpClient) send(packet *network.TracePack) error {
+	select {
+	case t.cmdC <- packet:
+	default:
+		return fmt.Errorf("command queue is full")
 	}
 	return nil
 }
@@ -183,33 +359,75 @@ func (c *Collector) startNetwork() error {
 		logger.Fatal("Listen", zap.String("msg", err.Error()), zap.String("addr", misc.Conf.Collector.Addr))
 	}
 
+	// 开启tls
+	if misc.Conf.Collector.TLS.Enable {
+		conf := misc.Conf.Collector.TLS
+		tlsConfig, err := network.ServerTLSConfig(conf.CertFile, conf.KeyFile, conf.CAFile)
+		if err != nil {
+			logger.Warn("tls config", zap.String("error", err.Error()))
+			return err
+		}
+		lsocket = tls.NewListener(lsocket, tlsConfig)
+	}
+	c.listener = lsocket
+
 	go func() {
 		for {
 			conn, err := lsocket.Accept()
 			if err != nil {
+				if atomic.LoadInt32(&c.closed) == 1 {
+					return
+				}
 				logger.Fatal("Accept", zap.String("msg", err.Error()), zap.String("addr", misc.Conf.Collector.Addr))
 			}
 			conn.SetReadDeadline(time.Now().Add(time.Duration(misc.Conf.Collector.Timeout) * time.Second))
 			tcpClient := newtcpClient()
+			c.addConn(conn)
 			go tcpClient.start(conn)
 		}
 	}()
 	return nil
 }
 
+// addConn 保存agent链接，关闭时统一断开
+func (c *Collector) addConn(conn net.Conn) {
+	c.connWg.Add(1)
+	c.Lock()
+	c.conns[conn] = struct{}{}
+	c.Unlock()
+}
+
+// removeConn 链接协程退出
+func (c *Collector) removeConn(conn net.Conn) {
+	c.Lock()
+	delete(c.conns, conn)
+	c.Unlock()
+	c.connWg.Done()
+}
+
 type tcpClient struct {
-	appName string
-	agentID string
+	appName  string
+	agentID  string
+	authed   bool                    // 是否认证通过
+	agentIDs map[string]struct{}     // 该链接上报过数据的agent
+	cmdC     chan *network.TracePack // 待下发的指令和rpc请求
+	hello    *network.Hello          // 协议协商结果，旧版本agent为nil
 }
 
 func newtcpClient() *tcpClient {
-	return &tcpClient{}
+	return &tcpClient{
+		authed:   !misc.Conf.Collector.Auth,
+		agentIDs: make(map[string]struct{}),
+		cmdC:     make(chan *network.TracePack, 10),
+	}
 }
 
 func (t *tcpClient) start(conn net.Conn) {
 	quitC := make(chan bool, 1)
 	packetC := make(chan *network.TracePack, 100)
 
+	defer gCollector.removeConn(conn)
+
 	defer func() {
 		if err := gCollector.storage.UpdateAgentState(t.appName, t.agentID, false); err != nil {
 			logger.Warn("tcp close , update agent state Store", zap.String("error", err.Error()))
@@ -221,6 +439,7 @@ func (t *tcpClient) start(conn net.Conn) {
 	}()
 
 	defer func() {
+		gCollector.agents.remove(t)
 		if conn != nil {
 			conn.Close()
 		}
@@ -231,14 +450,37 @@ func (t *tcpClient) start(conn net.Conn) {
 
 	for {
 		select {
+		case packet := <-t.cmdC:
+			// 指令和应答都在本协程写入，避免并发写链接
+			packet.Version = t.version()
+			if _, err := conn.Write(packet.Encode()); err != nil {
+				logger.Warn("conn.Write", zap.String("error", err.Error()))
+				return
+			}
+			break
 		case packet, ok := <-packetC:
 			if !ok {
 				logger.Info("quit")
 				return
 			}
+			// 开启认证时，认证通过前不处理任何数据
+			if !t.authed {
+				if err := t.auth(conn, packet); err != nil {
+					logger.Warn("auth", zap.String("error", err.Error()), zap.String("addr", conn.RemoteAddr().String()))
+					return
+				}
+				break
+			}
+			// agent对指令的应答
+			if network.IsResponse(packet) {
+				if !gCollector.rpc.Deliver(packet) {
+					logger.Debug("late response", zap.Uint32("id", packet.ID), zap.String("addr", conn.RemoteAddr().String()))
+				}
+				break
+			}
 			switch packet.Type {
 			case constant.TypeOfCmd:
-				if err := cmdPacket(conn, packet); err != nil {
+				if err := t.cmdPacket(conn, packet); err != nil {
 					logger.Warn("cmd packet", zap.String("error", err.Error()))
 					return
 				}
@@ -250,8 +492,10 @@ func (t *tcpClient) start(conn net.Conn) {
 				}
 				break
 			case constant.TypeOfSystem:
-
-				log.Println("TypeOfSystem")
+				if err := t.systemPacket(packet); err != nil {
+					logger.Warn("system packet", zap.String("error", err.Error()))
+					return
+				}
 				break
 			}
 		}
@@ -287,24 +531,19 @@ func (t *tcpClient) tcpRead(conn net.Conn, packetC chan *network.TracePack, quit
 	}
 }
 
-func (c *Collector) pushWork() error {
-	for {
-		select {
-		case packet, ok := <-c.pushC:
-			if ok {
-				data, err := msgpack.Marshal(packet)
-				if err != nil {
-					logger.Warn("msgpack", zap.String("error", err.Error()))
-					break
-				}
-				if err := c.mq.Publish(misc.Conf.MQ.Topic, data); err != nil {
-					logger.Warn("publish", zap.Error(err))
-				}
-			}
-			break
+// pushWork 推送计算结果给alert，通道关闭后退出
+func (c *Collector) pushWork() {
+	defer close(c.pushDoneC)
+	for packet := range c.pushC {
+		data, err := msgpack.Marshal(packet)
+		if err != nil {
+			logger.Warn("msgpack", zap.String("error", err.Error()))
+			continue
+		}
+		if err := c.mq.Publish(misc.Conf.MQ.Topic, data); err != nil {
+			logger.Warn("publish", zap.Error(err))
 		}
 	}
-	// return nil
 }
 
 func (c *Collector) publish(data *alert.Data) {
@@ -320,6 +559,8 @@ func (c *Collector) addCollector(key string) {
 		c.collectors[key] = struct{}{}
 		c.Unlock()
 		c.hash.Add(key)
+		// 不再负责的app转交api二次聚合数据
+		c.apps.handoff()
 	}
 }
 
@@ -332,9 +573,31 @@ func (c *Collector) removeCollector(key string) {
 		delete(c.collectors, key)
 		c.Unlock()
 		c.hash.Remove(key)
+		c.apps.handoff()
 	}
 }
 
+// handoffApi app的owner不是本collector时，将api二次聚合数据转交给owner，返回是否已经转交
+func (c *Collector) handoffApi(packet *alert.Data, result string) bool {
+	topic, err := c.getCollecotorTopic(packet.AppName)
+	if err != nil || topic == c.etcd.ReportKey {
+		return false
+	}
+
+	packet.Type = constant.ALERT_TYPE_API_HANDOFF
+	data, err := msgpack.Marshal(packet)
+	if err != nil {
+		logger.Warn("msgpack", zap.String("error", err.Error()))
+		return false
+	}
+	if err := c.mq.Publish(topic, data); err != nil {
+		logger.Warn("publish", zap.String("topic", topic), zap.String("error", err.Error()))
+		return false
+	}
+	gHandoffCounter.inc(result)
+	return true
+}
+
 // getCollecotorTopic 获取collector主题
 func (c *Collector) getCollecotorTopic(appName string) (string, error) {
 	topic, err := c.hash.Get(appName)
@@ -368,3 +631,8 @@ func getNameByDubboAPI(api string) (string, bool) {
 	appName, ok := gCollector.apps.dubbo.Get(api)
 	return appName, ok
 }
+
+// getApdex 通过应用名和api获取apdex阈值
+func getApdex(appName, api string) *plugin.Apdex {
+	return gCollector.apps.getApdex(appName, api)
+}
@@ -0,0 +1,266 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/command"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+	"github.com/nats-io/nats.go"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+// 等待agent返回指令结果的超时时间，agent等待jvm应答最多10秒，单位秒
+const commandCallTimeout = 15
+
+// Agents 当前collector上链接的pinpoint agent，用于下发指令
+type Agents struct {
+	sync.RWMutex
+	clients  map[string]*tcpClient // key为agentID
+	appNames map[string]string     // agentID对应的appName
+}
+
+func newAgents() *Agents {
+	return &Agents{
+		clients:  make(map[string]*tcpClient),
+		appNames: make(map[string]string),
+	}
+}
+
+// add 保存agent所在的链接
+func (a *Agents) add(appName, agentID string, client *tcpClient) {
+	a.RLock()
+	old, ok := a.clients[agentID]
+	a.RUnlock()
+	if ok && old == client {
+		return
+	}
+	a.Lock()
+	a.clients[agentID] = client
+	a.appNames[agentID] = appName
+	a.Unlock()
+	client.agentIDs[agentID] = struct{}{}
+}
+
+// remove 链接断开时删除该链接上的所有agent
+func (a *Agents) remove(client *tcpClient) {
+	a.Lock()
+	for agentID := range client.agentIDs {
+		if old, ok := a.clients[agentID]; ok && old == client {
+			delete(a.clients, agentID)
+			delete(a.appNames, agentID)
+		}
+	}
+	a.Unlock()
+}
+
+// get 获取agent所在的链接
+func (a *Agents) get(agentID string) (*tcpClient, bool) {
+	a.RLock()
+	client, ok := a.clients[agentID]
+	a.RUnlock()
+	return client, ok
+}
+
+// byApp 获取app的agent所在的链接，key为链接，value为该链接上的agentID
+func (a *Agents) byApp(appName string) map[*tcpClient][]string {
+	clients := make(map[*tcpClient][]string)
+	a.RLock()
+	for agentID, name := range a.appNames {
+		if name == appName {
+			client := a.clients[agentID]
+			clients[client] = append(clients[client], agentID)
+		}
+	}
+	a.RUnlock()
+	return clients
+}
+
+// commandHandle web通过mq广播的指令，只有agent链接在本collector上时才下发
+func commandHandle(msg *nats.Msg) {
+	cmd := network.NewCommand()
+	if err := msgpack.Unmarshal(msg.Data, cmd); err != nil {
+		logger.Warn("msgpack unmarshal", zap.String("error", err.Error()))
+		return
+	}
+
+	client, ok := gCollector.agents.get(cmd.AgentID)
+	if !ok {
+		return
+	}
+	if !client.support(cmd.Type) {
+		commandFailed(cmd, fmt.Sprintf("agent not support command type %d", cmd.Type))
+		return
+	}
+	// 支持rpc的agent同步等待指令结果
+	if client.version() > 0 {
+		go client.call(cmd, msg.Data)
+		return
+	}
+	if err := client.command(msg.Data); err != nil {
+		logger.Warn("command", zap.String("error", err.Error()), zap.String("agentID", cmd.AgentID))
+	}
+}
+
+// call 通过rpc下发指令，失败时保存失败原因
+func (t *tcpClient) call(cmd *network.Command, payload []byte) {
+	reqCmd := network.NewCMD()
+	reqCmd.Type = constant.TypeOfCommand
+	reqCmd.Payload = payload
+	buf, err := msgpack.Marshal(reqCmd)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return
+	}
+
+	packet := &network.TracePack{
+		Type:       constant.TypeOfCmd,
+		IsCompress: constant.TypeOfCompressNo,
+		Payload:    buf,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(commandCallTimeout)*time.Second)
+	defer cancel()
+	resp, err := gCollector.rpc.Call(ctx, packet, t.send)
+	if err != nil {
+		logger.Warn("command call", zap.String("error", err.Error()), zap.String("agentID", cmd.AgentID))
+		commandFailed(cmd, err.Error())
+		return
+	}
+
+	// 重复下发的指令和stream指令没有结果
+	if len(resp.Payload) == 0 {
+		return
+	}
+	if err := commandResult(resp.Payload); err != nil {
+		logger.Warn("command result", zap.String("error", err.Error()))
+	}
+}
+
+// support agent是否支持该指令，没有发送hello的旧版本agent不支持指令
+func (t *tcpClient) support(cmdType uint16) bool {
+	if t.hello == nil || !t.hello.HasFeature(network.FeatureCommand) {
+		return false
+	}
+	if cmdType == constant.TypeOfActiveThreadStream {
+		return t.hello.HasFeature(network.FeatureActiveThreadStream)
+	}
+	return true
+}
+
+// commandFailed 保存下发失败的原因
+func commandFailed(cmd *network.Command, message string) {
+	result := network.NewCommandResult()
+	result.ID = cmd.ID
+	result.Type = cmd.Type
+	result.AppName = cmd.AppName
+	result.AgentID = cmd.AgentID
+	result.Message = message
+	result.Time = time.Now().UnixNano() / 1e6
+	if err := gCollector.storage.WriteCommandResult(result, ""); err != nil {
+		logger.Warn("command result", zap.String("error", err.Error()))
+	}
+}
+
+// command 下发指令给旧版本agent，结果由agent异步上报
+func (t *tcpClient) command(payload []byte) error {
+	cmd := network.NewCMD()
+	cmd.Type = constant.TypeOfCommand
+	cmd.Payload = payload
+	buf, err := msgpack.Marshal(cmd)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	packet := &network.TracePack{
+		Type:       constant.TypeOfCmd,
+		IsSync:     constant.TypeOfSyncNo,
+		IsCompress: constant.TypeOfCompressNo,
+		Payload:    buf,
+	}
+	return t.send(packet)
+}
+
+// commandResult 保存agent返回的指令结果，jvm返回的thrift报文转换成json存储
+func commandResult(payload []byte) error {
+	result := network.NewCommandResult()
+	if err := msgpack.Unmarshal(payload, result); err != nil {
+		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	// 活跃线程数实时数据单独存储
+	if result.Success && result.Type == constant.TypeOfActiveThreadStream {
+		return activeThreadResult(result)
+	}
+
+	var body string
+	if result.Success {
+		tStruct, err := deserializeCommand(result.Payload)
+		if err != nil {
+			result.Success = false
+			result.Message = err.Error()
+		} else if tResult, ok := tStruct.(*trace.TResult_); ok {
+			// jvm执行失败时返回TResult
+			result.Success = tResult.GetSuccess()
+			result.Message = tResult.GetMessage()
+		} else {
+			b, err := json.Marshal(tStruct)
+			if err != nil {
+				logger.Warn("json Marshal", zap.String("error", err.Error()))
+				return err
+			}
+			body = string(b)
+		}
+	}
+
+	if err := gCollector.storage.WriteCommandResult(result, body); err != nil {
+		logger.Warn("command result", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// activeThreadResult 保存活跃线程数stream数据
+func activeThreadResult(result *network.CommandResult) error {
+	tStruct, err := deserializeCommand(result.Payload)
+	if err != nil {
+		logger.Warn("active thread", zap.String("error", err.Error()))
+		return err
+	}
+	res, ok := tStruct.(*command.TCmdActiveThreadCountRes)
+	if !ok {
+		return fmt.Errorf("unexpected active thread response %T", tStruct)
+	}
+
+	inputDate := result.Time
+	if res.IsSetTimeStamp() {
+		inputDate = res.GetTimeStamp()
+	}
+	if err := gCollector.storage.WriteActiveThread(result.AppName, result.AgentID, inputDate, res.GetHistogramSchemaType(), res.GetActiveThreadCount()); err != nil {
+		logger.Warn("active thread", zap.String("error", err.Error()))
+		return err
+	}
+	return nil
+}
+
+// deserializeCommand thrift反序列化，错误报文会导致panic
+func deserializeCommand(payload []byte) (tStruct interface{}, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("thrift deserialize, %v", e)
+		}
+	}()
+	tStruct = thrift.Deserialize(payload)
+	if tStruct == nil {
+		return nil, fmt.Errorf("thrift deserialize, unknow payload")
+	}
+	return tStruct, nil
+}
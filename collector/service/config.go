@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/nats-io/nats.go"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+// 等待agent应用配置的超时时间，单位秒
+const configCallTimeout = 5
+
+// Configs web设置的app配置，agent注册和配置修改时下发
+type Configs struct {
+	sync.RWMutex
+	apps map[string]*network.AgentConfig // key为appName
+}
+
+func newConfigs() *Configs {
+	return &Configs{
+		apps: make(map[string]*network.AgentConfig),
+	}
+}
+
+// load 启动时加载所有app配置
+func (c *Configs) load() error {
+	configs, err := gCollector.storage.LoadAppConfigs()
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.apps = configs
+	c.Unlock()
+	return nil
+}
+
+// get 获取app配置
+func (c *Configs) get(appName string) (*network.AgentConfig, bool) {
+	c.RLock()
+	conf, ok := c.apps[appName]
+	c.RUnlock()
+	return conf, ok
+}
+
+// update 保存更新的配置，旧版本返回false
+func (c *Configs) update(conf *network.AgentConfig) bool {
+	c.Lock()
+	defer c.Unlock()
+	if old, ok := c.apps[conf.AppName]; ok && old.Version >= conf.Version {
+		return false
+	}
+	c.apps[conf.AppName] = conf
+	return true
+}
+
+// configHandle web通过mq广播的配置修改，下发给链接在本collector上的agent
+func configHandle(msg *nats.Msg) {
+	conf := network.NewAgentConfig()
+	if err := msgpack.Unmarshal(msg.Data, conf); err != nil {
+		logger.Warn("msgpack unmarshal", zap.String("error", err.Error()))
+		return
+	}
+	if !gCollector.configs.update(conf) {
+		return
+	}
+	for client, agentIDs := range gCollector.agents.byApp(conf.AppName) {
+		go client.pushConfig(conf, agentIDs)
+	}
+}
+
+// pushConfig 下发配置给agent，保存应用结果
+func (t *tcpClient) pushConfig(conf *network.AgentConfig, agentIDs []string) {
+	if t.hello == nil || !t.hello.HasFeature(network.FeatureConfig) {
+		return
+	}
+
+	payload, err := msgpack.Marshal(conf)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return
+	}
+	cmd := network.NewCMD()
+	cmd.Type = constant.TypeOfConfig
+	cmd.Payload = payload
+	buf, err := msgpack.Marshal(cmd)
+	if err != nil {
+		logger.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return
+	}
+
+	packet := &network.TracePack{
+		Type:       constant.TypeOfCmd,
+		IsCompress: constant.TypeOfCompressNo,
+		Payload:    buf,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(configCallTimeout)*time.Second)
+	defer cancel()
+
+	ack := network.NewConfigAck()
+	ack.AppName = conf.AppName
+	ack.Version = conf.Version
+	resp, err := gCollector.rpc.Call(ctx, packet, t.send)
+	if err == nil {
+		err = msgpack.Unmarshal(resp.Payload, ack)
+	}
+	if err != nil {
+		ack.Success = false
+		ack.Message = err.Error()
+	}
+	if !ack.Success {
+		logger.Warn("push config", zap.String("error", ack.Message), zap.String("appName", conf.AppName), zap.Int64("version", conf.Version))
+	}
+
+	for _, agentID := range agentIDs {
+		gCollector.storage.WriteConfigAck(agentID, ack)
+	}
+}
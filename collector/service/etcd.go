@@ -29,6 +29,10 @@ func newEtcd() *Etcd {
 
 // Start start report thread
 func (e *Etcd) Start() error {
+	// 先加载已经注册的collector，否则在其他collector下次上报前hash中只有部分collector
+	if err := e.load(); err != nil {
+		logger.Warn("Etcd load", zap.String("error", err.Error()))
+	}
 	go e.registerWork()
 	go e.Get()
 	return nil
@@ -43,10 +47,38 @@ func (e *Etcd) Close() {
 	close(e.StopC)
 
 	if e.Client != nil {
+		// 删除上报的key，agent不再路由到本collector
+		if err := e.deregister(); err != nil {
+			logger.Warn("Etcd deregister", zap.String("error", err.Error()))
+		}
 		e.Client.Close()
 	}
 }
 
+// load 加载已经注册的collector和自己
+func (e *Etcd) load() error {
+	gCollector.addCollector(e.ReportKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(misc.Conf.Etcd.TimeOut)*time.Second)
+	defer cancel()
+	resp, err := e.Client.Get(ctx, misc.Conf.Etcd.ReportDir, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	for _, kv := range resp.Kvs {
+		gCollector.addCollector(string(kv.Key))
+	}
+	return nil
+}
+
+// deregister 删除上报key
+func (e *Etcd) deregister() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(misc.Conf.Etcd.TimeOut)*time.Second)
+	defer cancel()
+	_, err := e.Client.Delete(ctx, e.ReportKey)
+	return err
+}
+
 // Init init Etcd
 func (e *Etcd) Init(addrs []string, reportKey, reportValue string) error {
 	e.ReportKey = reportKey
@@ -118,5 +150,11 @@ func (e *Etcd) Get() {
 				}
 			}
 		}
+		// 关闭后不再监听
+		select {
+		case <-e.StopC:
+			return
+		default:
+		}
 	}
 }
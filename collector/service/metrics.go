@@ -0,0 +1,165 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/bsed/trace/collector/misc"
+)
+
+// lateCounter 迟到数据计数，key为数据来源和处理结果
+type lateCounter struct {
+	sync.Mutex
+	counts map[[2]string]uint64
+}
+
+var gLateCounter = &lateCounter{
+	counts: make(map[[2]string]uint64),
+}
+
+func (l *lateCounter) inc(source, result string) {
+	l.Lock()
+	l.counts[[2]string{source, result}]++
+	l.Unlock()
+}
+
+func (l *lateCounter) snapshot() map[[2]string]uint64 {
+	l.Lock()
+	counts := make(map[[2]string]uint64, len(l.counts))
+	for key, count := range l.counts {
+		counts[key] = count
+	}
+	l.Unlock()
+	return counts
+}
+
+// handoffCounter 集群变化时转交的api二次聚合数据计数，key为sent、forwarded、received
+type handoffCounter struct {
+	sync.Mutex
+	counts map[string]uint64
+}
+
+var gHandoffCounter = &handoffCounter{
+	counts: make(map[string]uint64),
+}
+
+func (h *handoffCounter) inc(result string) {
+	h.Lock()
+	h.counts[result]++
+	h.Unlock()
+}
+
+func (h *handoffCounter) snapshot() map[string]uint64 {
+	h.Lock()
+	counts := make(map[string]uint64, len(h.counts))
+	for result, count := range h.counts {
+		counts[result] = count
+	}
+	h.Unlock()
+	return counts
+}
+
+// startMetrics 启动自身监控指标服务，地址为空时不启动
+func startMetrics() {
+	if len(misc.Conf.Collector.MetricsAddr) == 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", http.HandlerFunc(metrics))
+	go func() {
+		if err := http.ListenAndServe(misc.Conf.Collector.MetricsAddr, mux); err != nil {
+			logger.Warn("metrics serve", zap.String("addr", misc.Conf.Collector.MetricsAddr), zap.String("error", err.Error()))
+		}
+	}()
+}
+
+// metrics prometheus格式的collector自身监控指标
+func metrics(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+
+	// 迟到数据
+	counts := gLateCounter.snapshot()
+	keys := make([][2]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	writeHelp(buf, "collector_late_data_total", "counter", "Data that arrived after its window was stored, by source and result.")
+	for _, key := range keys {
+		writeMetric(buf, "collector_late_data_total", counts[key], "source", key[0], "result", key[1])
+	}
+	writeHelp(buf, "collector_allowed_lateness_seconds", "gauge", "How long a stored window still accepts late data.")
+	writeMetric(buf, "collector_allowed_lateness_seconds", misc.Conf.Stats.AllowedLateness)
+
+	// api二次聚合数据转交
+	handoffs := gHandoffCounter.snapshot()
+	writeHelp(buf, "collector_api_handoff_total", "counter", "API aggregation data handed off between collectors on ring changes.")
+	for _, result := range []string{"sent", "forwarded", "received"} {
+		writeMetric(buf, "collector_api_handoff_total", handoffs[result], "result", result)
+	}
+	writeHelp(buf, "collector_ring_members", "gauge", "Collectors in the consistent hash ring.")
+	gCollector.RLock()
+	members := len(gCollector.collectors)
+	gCollector.RUnlock()
+	writeMetric(buf, "collector_ring_members", members)
+
+	// 各app计算点进度
+	gCollector.apps.RLock()
+	names := make([]string, 0, len(gCollector.apps.apps))
+	apps := make(map[string]*App, len(gCollector.apps.apps))
+	for name, app := range gCollector.apps.apps {
+		names = append(names, name)
+		apps[name] = app
+	}
+	gCollector.apps.RUnlock()
+	sort.Strings(names)
+
+	now := time.Now().Unix()
+	writeHelp(buf, "collector_watermark_lag_seconds", "gauge", "Seconds between now and the last stored window.")
+	for _, name := range names {
+		stats, api := apps[name].watermarks()
+		writeMetric(buf, "collector_watermark_lag_seconds", now-stats, "app", name, "window", "stats")
+		writeMetric(buf, "collector_watermark_lag_seconds", now-api, "app", name, "window", "api")
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func writeHelp(buf *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeMetric labels为key、value交替的列表
+func writeMetric(buf *bytes.Buffer, name string, value interface{}, labels ...string) {
+	buf.WriteString(name)
+	if len(labels) > 1 {
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		buf.WriteByte('}')
+	}
+	fmt.Fprintf(buf, " %v\n", value)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelReplacer.Replace(value)
+}
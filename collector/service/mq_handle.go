@@ -16,11 +16,29 @@ func msgHandle(msg *nats.Msg) {
 	}
 	switch packet.Type {
 	case constant.ALERT_TYPE_API:
+		// 集群变化时发送方的hash可能还没有更新，本collector不是owner时转交给owner
+		if gCollector.handoffApi(packet, "forwarded") {
+			break
+		}
+		if err := gCollector.apps.routerApi(packet); err != nil {
+			logger.Warn("routerApi error", zap.String("error", err.Error()))
+			break
+		}
+		break
+	case constant.ALERT_TYPE_API_HANDOFF:
+		// 转交的数据直接聚合，hash不一致时也不再转发，避免来回转交
+		gHandoffCounter.inc("received")
 		if err := gCollector.apps.routerApi(packet); err != nil {
 			logger.Warn("routerApi error", zap.String("error", err.Error()))
 			break
 		}
 		break
+	case constant.ALERT_TYPE_SPANS:
+		if err := gCollector.receiver.recvForward(packet); err != nil {
+			logger.Warn("recvForward error", zap.String("error", err.Error()))
+			break
+		}
+		break
 	default:
 		logger.Warn("msgHandle unknow type", zap.Int("Type", packet.Type))
 		break
@@ -22,6 +22,11 @@ func (t *tcpClient) pinpointPacket(conn net.Conn, tracePack *network.TracePack)
 		return err
 	}
 
+	// 记录agent所在链接，指令通过该链接下发
+	if len(packet.AgentID) > 0 {
+		gCollector.agents.add(packet.AppName, packet.AgentID, t)
+	}
+
 	switch packet.Type {
 	case constant.TypeOfTCPData:
 		for _, value := range packet.Payload {
@@ -34,11 +39,13 @@ func (t *tcpClient) pinpointPacket(conn net.Conn, tracePack *network.TracePack)
 				}
 				if err := gCollector.storage.AppNameStore(agentInfo.AppName); err != nil {
 					logger.Warn("insert apps error", zap.String("error", err.Error()))
+					t.reply(conn, tracePack, nil, err)
 					return err
 				}
 
 				if err := gCollector.storage.AgentStore(agentInfo, true); err != nil {
 					logger.Warn("agent Store", zap.String("error", err.Error()))
+					t.reply(conn, tracePack, nil, err)
 					return err
 				}
 
@@ -46,12 +53,16 @@ func (t *tcpClient) pinpointPacket(conn net.Conn, tracePack *network.TracePack)
 				t.agentID = agentInfo.AgentID
 
 				logger.Info("Online", zap.String("appName", agentInfo.AppName), zap.String("agentID", agentInfo.AgentID))
-				// 注册信息原样返回
-				if _, err := conn.Write(tracePack.Encode()); err != nil {
-					logger.Warn("conn.Write", zap.String("error", err.Error()))
+				// 应答注册请求
+				if err := t.reply(conn, tracePack, nil, nil); err != nil {
 					return err
 				}
 
+				// 下发web设置的app配置
+				if conf, ok := gCollector.configs.get(agentInfo.AppName); ok {
+					go t.pushConfig(conf, []string{agentInfo.AgentID})
+				}
+
 				break
 			case constant.TypeOfAgentOffline:
 				agentInfo := network.NewAgentInfo()
@@ -62,12 +73,12 @@ func (t *tcpClient) pinpointPacket(conn net.Conn, tracePack *network.TracePack)
 
 				if err := gCollector.storage.UpdateAgentState(agentInfo.AppName, agentInfo.AgentID, false); err != nil {
 					logger.Warn("update agent state Store", zap.String("error", err.Error()))
+					t.reply(conn, tracePack, nil, err)
 					return err
 				}
 
-				// 信息原样返回
-				if _, err := conn.Write(tracePack.Encode()); err != nil {
-					logger.Warn("conn.Write", zap.String("error", err.Error()))
+				// 应答下线请求
+				if err := t.reply(conn, tracePack, nil, nil); err != nil {
 					return err
 				}
 				logger.Info("Offline", zap.String("appName", agentInfo.AppName), zap.String("agentID", agentInfo.AgentID))
@@ -87,7 +98,7 @@ func (t *tcpClient) pinpointPacket(conn net.Conn, tracePack *network.TracePack)
 		break
 	case constant.TypeOfUDPData:
 		for _, value := range packet.Payload {
-			t.udpRequest(packet.AppName, packet.AgentID, value.Spans)
+			t.udpRequest(packet.AppName, packet.AgentID, value)
 		}
 		break
 	default:
@@ -96,16 +107,23 @@ func (t *tcpClient) pinpointPacket(conn net.Conn, tracePack *network.TracePack)
 	return nil
 }
 
-// udpRequest udp报文处理
-func (t *tcpClient) udpRequest(appName, agentID string, data []byte) {
+// udpRequest udp报文处理，未采样的span只参与统计
+func (t *tcpClient) udpRequest(appName, agentID string, spans *network.Spans) {
+	data := spans.Spans
 	tStruct := thrift.Deserialize(data)
 	switch m := tStruct.(type) {
 	case *trace.TSpan:
-		gCollector.storage.SpanStore(m)
+		gCollector.scrubber.span(m)
+		if !spans.Unsampled {
+			gCollector.storage.SpanStore(m)
+		}
 		gCollector.apps.routerSapn(appName, agentID, m)
 		break
 	case *trace.TSpanChunk:
-		gCollector.storage.SpanChunkStore(m)
+		gCollector.scrubber.spanChunk(m)
+		if !spans.Unsampled {
+			gCollector.storage.SpanChunkStore(m)
+		}
 		gCollector.apps.routersapnChunk(appName, agentID, m)
 		break
 	case *pinpoint.TAgentStat:
@@ -0,0 +1,39 @@
+package plugin
+
+import "github.com/bsed/trace/collector/misc"
+
+// Apdex 满意、可容忍时间阈值，单位毫秒
+type Apdex struct {
+	Satisfaction int32
+	Tolerate     int32
+}
+
+// NewApdex 可容忍时间为0时使用满意时间的4倍
+func NewApdex(satisfaction, tolerate int32) *Apdex {
+	if tolerate <= 0 {
+		tolerate = 4 * satisfaction
+	}
+	return &Apdex{
+		Satisfaction: satisfaction,
+		Tolerate:     tolerate,
+	}
+}
+
+// DefaultApdex collector.yaml中的全局阈值
+func DefaultApdex() *Apdex {
+	return &Apdex{
+		Satisfaction: misc.Conf.Stats.SatisfactionTime,
+		Tolerate:     misc.Conf.Stats.TolerateTime,
+	}
+}
+
+// Level 耗时小于满意时间为满意，小于可容忍时间为可容忍，其他都为沮丧
+func (a *Apdex) Level(elapsed int32) (bool, bool) {
+	if elapsed < a.Satisfaction {
+		return true, false
+	}
+	if elapsed < a.Tolerate {
+		return false, true
+	}
+	return false, false
+}
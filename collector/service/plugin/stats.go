@@ -5,7 +5,6 @@ import (
 	"strings"
 	"sync"
 
-	"github.com/bsed/trace/collector/misc"
 	"github.com/bsed/trace/pkg/constant"
 	"github.com/bsed/trace/pkg/pinpoint/thrift/pinpoint"
 	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
@@ -27,10 +26,11 @@ type Stats struct {
 	Runtime   *stats.Runtimes    // runtime计算
 	getNbyIP  func(string) (string, bool)
 	getNbyApi func(string) (string, bool)
+	getApdex  func(string, string) *Apdex // 通过应用名和api获取apdex阈值
 }
 
 // NewStats ....
-func NewStats(httpCodes map[int32]struct{}, mutex *sync.RWMutex, l *zap.Logger, f func(string) (string, bool), f2 func(string) (string, bool)) *Stats {
+func NewStats(httpCodes map[int32]struct{}, mutex *sync.RWMutex, l *zap.Logger, f func(string) (string, bool), f2 func(string) (string, bool), f3 func(string, string) *Apdex) *Stats {
 	logger = l
 	stats := &Stats{
 		httpCodes: make(map[int32]struct{}),
@@ -43,6 +43,7 @@ func NewStats(httpCodes map[int32]struct{}, mutex *sync.RWMutex, l *zap.Logger,
 		Runtime:   stats.NewRuntimes(),
 		getNbyIP:  f,
 		getNbyApi: f2,
+		getApdex:  f3,
 	}
 	// 添加策略
 	mutex.RLock()
@@ -70,6 +71,7 @@ func (s *Stats) selfApiCounter(span *trace.TSpan) {
 
 	url.Duration += span.GetElapsed()
 	url.AccessCount++
+	url.Histogram.Record(span.GetElapsed())
 	if span.GetElapsed() > url.MaxDuration {
 		url.MaxDuration = span.GetElapsed()
 	}
@@ -108,11 +110,11 @@ func (s *Stats) selfApiCounter(span *trace.TSpan) {
 			}
 		}
 	}
-	// 耗时小于满意时间满意次数加1
-	if span.GetElapsed() < misc.Conf.Stats.SatisfactionTime {
+	// 耗时小于满意时间满意次数加1，耗时小于可容忍时间，可容忍次数加一， 其他都为沮丧次数
+	satisfied, tolerated := s.getApdex(span.GetApplicationName(), span.GetRPC()).Level(span.GetElapsed())
+	if satisfied {
 		url.SatisfactionCount++
-		// 耗时小于可容忍时间，可容忍次数加一， 其他都为沮丧次数
-	} else if span.GetElapsed() < misc.Conf.Stats.TolerateTime {
+	} else if tolerated {
 		url.TolerateCount++
 	}
 }
@@ -153,6 +155,7 @@ func (s *Stats) urlCounter(target string, urlStr string, findCode bool, code int
 
 	url.Duration += event.GetEndElapsed()
 	url.AccessCount++
+	url.Histogram.Record(event.GetEndElapsed())
 	if event.GetEndElapsed() > url.MaxDuration {
 		url.MaxDuration = event.GetEndElapsed()
 	}
@@ -173,11 +176,11 @@ func (s *Stats) urlCounter(target string, urlStr string, findCode bool, code int
 		}
 	}
 
-	// 耗时小于满意时间满意次数加1
-	if event.GetEndElapsed() < misc.Conf.Stats.SatisfactionTime {
+	// 使用被访问应用的阈值
+	satisfied, tolerated := s.getApdex(target, urlStr).Level(event.GetEndElapsed())
+	if satisfied {
 		url.SatisfactionCount++
-		// 耗时小于可容忍时间，可容忍次数加一， 其他都为沮丧次数
-	} else if event.GetEndElapsed() < misc.Conf.Stats.TolerateTime {
+	} else if tolerated {
 		url.TolerateCount++
 	}
 
@@ -258,6 +261,7 @@ func (s *Stats) sqlCount(event *trace.TSpanEvent) {
 
 	sql.Duration += event.GetEndElapsed()
 	sql.Count++
+	sql.Histogram.Record(event.GetEndElapsed())
 
 	if event.GetEndElapsed() > sql.MaxDuration {
 		sql.MaxDuration = event.GetEndElapsed()
@@ -393,6 +397,7 @@ func (s *Stats) dubboCounter(event *trace.TSpanEvent) {
 	}
 	dubbo.AccessCount++
 	dubbo.Duration += event.GetEndElapsed()
+	dubbo.Histogram.Record(event.GetEndElapsed())
 
 	if dubbo.MinDuration == 0 || dubbo.MinDuration > event.GetEndElapsed() {
 		dubbo.MinDuration = event.GetEndElapsed()
@@ -487,6 +492,7 @@ func (s *Stats) methodCount(apiStr string, event *trace.TSpanEvent) {
 
 	method.Duration += event.GetEndElapsed()
 	method.Count++
+	method.Histogram.Record(event.GetEndElapsed())
 
 	if event.GetEndElapsed() > method.MaxDuration {
 		method.MaxDuration = event.GetEndElapsed()
@@ -0,0 +1,447 @@
+package service
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/collector/misc"
+	"github.com/bsed/trace/pkg/alert"
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/jaeger"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/otlp"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+	"github.com/bsed/trace/pkg/zipkin"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+// 单次上报请求的最大长度，解压后
+const receiverMaxBody = 16 << 20
+
+// 注册失败后的重试间隔
+const receiverRegisterRetry = 10 * time.Second
+
+// 转发给owner的单条消息中span的最大长度，小于nats默认的1MB
+const receiverForwardSize = 512 << 10
+
+// Receiver 接收zipkin、jaeger上报的span
+// 转换为pinpoint span后与agent上报的span一样入库和统计，服务拓扑可以跨语言串联
+type Receiver struct {
+	sync.RWMutex
+	server    *http.Server
+	instances map[string]*receiverInstance // 上报过数据的服务实例，key为agentID
+	stopC     chan bool
+}
+
+func newReceiver() *Receiver {
+	return &Receiver{
+		instances: make(map[string]*receiverInstance),
+		stopC:     make(chan bool),
+	}
+}
+
+// Start 启动HTTP接收服务
+func (r *Receiver) Start() error {
+	conf := misc.Conf.Receiver
+	if len(conf.Addr) == 0 || (!conf.Zipkin && !conf.Jaeger) {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	if conf.Zipkin {
+		mux.HandleFunc("/api/v2/spans", r.zipkin)
+	}
+	if conf.Jaeger {
+		mux.HandleFunc("/api/traces", r.jaeger)
+	}
+	listener, err := net.Listen("tcp", conf.Addr)
+	if err != nil {
+		return err
+	}
+	r.server = &http.Server{Handler: mux}
+	go func() {
+		if err := r.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Warn("receiver serve", zap.String("addr", conf.Addr), zap.String("error", err.Error()))
+		}
+	}()
+	go r.expire()
+	logger.Info("receiver start ok", zap.String("addr", conf.Addr), zap.Bool("zipkin", conf.Zipkin), zap.Bool("jaeger", conf.Jaeger))
+	return nil
+}
+
+// Close 停止接收并等待处理中的请求完成，所有服务实例下线
+func (r *Receiver) Close(deadline time.Time) error {
+	if r.server == nil {
+		return nil
+	}
+	close(r.stopC)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := r.server.Shutdown(ctx); err != nil {
+		logger.Warn("receiver shutdown", zap.String("error", err.Error()))
+	}
+
+	r.Lock()
+	instances := r.instances
+	r.instances = make(map[string]*receiverInstance)
+	r.Unlock()
+	for _, inst := range instances {
+		inst.offline()
+	}
+	return nil
+}
+
+// zipkin 处理 POST /api/v2/spans，只支持JSON编码
+func (r *Receiver) zipkin(w http.ResponseWriter, req *http.Request) {
+	contentType := req.Header.Get("Content-Type")
+	if len(contentType) > 0 && !strings.HasPrefix(contentType, "application/json") {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	r.handle(w, req, constant.TypeOfEnvZipkin, zipkin.Parse)
+}
+
+// jaeger 处理 POST /api/traces，TBinaryProtocol编码的Batch
+func (r *Receiver) jaeger(w http.ResponseWriter, req *http.Request) {
+	contentType := req.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/x-thrift") && !strings.HasPrefix(contentType, "application/vnd.apache.thrift.binary") {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	r.handle(w, req, constant.TypeOfEnvJaeger, jaeger.Parse)
+}
+
+func (r *Receiver) handle(w http.ResponseWriter, req *http.Request, env int32, parse func([]byte) (*otlp.ExportRequest, error)) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := readReceiverBody(w, req)
+	if err != nil {
+		logger.Warn("receiver read body", zap.String("error", err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request, err := parse(body)
+	if err != nil {
+		logger.Warn("receiver parse", zap.String("error", err.Error()), zap.String("path", req.URL.Path))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
+	for _, rs := range request.ResourceSpans {
+		if len(rs.Spans) == 0 {
+			continue
+		}
+		if err := r.export(rs, env, ip); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// export 转换一个服务实例的span，元数据和span入库，span参与统计
+func (r *Receiver) export(rs *otlp.ResourceSpans, env int32, ip string) error {
+	inst := r.instance(rs.Resource, env, ip)
+	if err := inst.register(); err != nil {
+		return err
+	}
+
+	appName, agentID := inst.agentInfo.AppName, inst.agentInfo.AgentID
+	result := inst.converter.Convert(rs.Spans)
+	for _, meta := range result.APIs {
+		if err := gCollector.storage.AppMethodStore(appName, meta); err != nil {
+			logger.Warn("api store", zap.String("error", err.Error()))
+		}
+	}
+	for _, meta := range result.SQLs {
+		if err := gCollector.storage.AppSQLStore(appName, meta); err != nil {
+			logger.Warn("sql store", zap.String("error", err.Error()))
+		}
+	}
+	for _, meta := range result.Strings {
+		if err := gCollector.storage.AppStringStore(appName, meta); err != nil {
+			logger.Warn("string store", zap.String("error", err.Error()))
+		}
+	}
+
+	for _, span := range result.Spans {
+		gCollector.scrubber.span(span)
+		gCollector.storage.SpanStore(span)
+	}
+	for _, chunk := range result.Chunks {
+		gCollector.scrubber.spanChunk(chunk)
+		gCollector.storage.SpanChunkStore(chunk)
+	}
+
+	// 同一个app只能由一个collector统计，否则统计数据入库时会互相覆盖
+	topic, err := gCollector.getCollecotorTopic(appName)
+	if err != nil || topic == gCollector.etcd.ReportKey {
+		for _, span := range result.Spans {
+			gCollector.apps.routerSapn(appName, agentID, span)
+		}
+		for _, chunk := range result.Chunks {
+			gCollector.apps.routersapnChunk(appName, agentID, chunk)
+		}
+		return nil
+	}
+	return r.forward(topic, inst.agentInfo.ServiceType, appName, agentID, result)
+}
+
+// receiverSpans 转发给owner统计的span和span chunk，thrift编码
+type receiverSpans struct {
+	AppType int32    `msg:"type"`
+	Spans   [][]byte `msg:"spans"`
+	Chunks  [][]byte `msg:"chunks"`
+}
+
+// forward 转发给app的owner统计，超过receiverForwardSize时分多条发送
+func (r *Receiver) forward(topic string, appType int32, appName, agentID string, result *otlp.Pinpoint) error {
+	forward := &receiverSpans{AppType: appType}
+	size := 0
+	publish := func() error {
+		if len(forward.Spans) == 0 && len(forward.Chunks) == 0 {
+			return nil
+		}
+		payload, err := msgpack.Marshal(forward)
+		if err != nil {
+			logger.Warn("msgpack", zap.String("error", err.Error()))
+			return err
+		}
+		packet := alert.NewData()
+		packet.Type = constant.ALERT_TYPE_SPANS
+		packet.AppName = appName
+		packet.AgentID = agentID
+		packet.Payload = payload
+		data, err := msgpack.Marshal(packet)
+		if err != nil {
+			logger.Warn("msgpack", zap.String("error", err.Error()))
+			return err
+		}
+		if err := gCollector.mq.Publish(topic, data); err != nil {
+			logger.Warn("publish", zap.String("topic", topic), zap.String("error", err.Error()))
+			return err
+		}
+		forward = &receiverSpans{AppType: appType}
+		size = 0
+		return nil
+	}
+
+	for _, span := range result.Spans {
+		data := thrift.SerializeNew(span)
+		if size+len(data) > receiverForwardSize {
+			if err := publish(); err != nil {
+				return err
+			}
+		}
+		forward.Spans = append(forward.Spans, data)
+		size += len(data)
+	}
+	for _, chunk := range result.Chunks {
+		data := thrift.SerializeNew(chunk)
+		if size+len(data) > receiverForwardSize {
+			if err := publish(); err != nil {
+				return err
+			}
+		}
+		forward.Chunks = append(forward.Chunks, data)
+		size += len(data)
+	}
+	return publish()
+}
+
+// recvForward 其他collector转发过来的span，只参与统计，span已经由接收方入库
+func (r *Receiver) recvForward(packet *alert.Data) error {
+	forward := &receiverSpans{}
+	if err := msgpack.Unmarshal(packet.Payload, forward); err != nil {
+		return err
+	}
+
+	// owner可能还没有加载该app
+	gCollector.apps.storeApp(packet.AppName)
+	if app, ok := gCollector.apps.getApp(packet.AppName); ok && app.appType == 0 {
+		app.appType = forward.AppType
+	}
+
+	for _, data := range forward.Spans {
+		if span, ok := thrift.Deserialize(data).(*trace.TSpan); ok {
+			gCollector.apps.routerSapn(packet.AppName, packet.AgentID, span)
+		}
+	}
+	for _, data := range forward.Chunks {
+		if chunk, ok := thrift.Deserialize(data).(*trace.TSpanChunk); ok {
+			gCollector.apps.routersapnChunk(packet.AppName, packet.AgentID, chunk)
+		}
+	}
+	return nil
+}
+
+// instance 获取资源对应的服务实例
+func (r *Receiver) instance(resource otlp.Attributes, env int32, ip string) *receiverInstance {
+	appName, agentID := otlp.ServiceInstance(resource)
+
+	r.Lock()
+	defer r.Unlock()
+	inst, ok := r.instances[agentID]
+	if !ok || inst.agentInfo.AppName != appName {
+		if ok {
+			// 同一个agentID更换了服务名，旧实例下线
+			go inst.offline()
+		}
+		inst = newReceiverInstance(appName, agentID, resource, env, ip)
+		r.instances[agentID] = inst
+	}
+	inst.lastSeen = time.Now()
+	return inst
+}
+
+// expire 长时间没有上报的服务实例下线
+func (r *Receiver) expire() {
+	timeout := time.Duration(misc.Conf.Receiver.InstanceTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 300 * time.Second
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			expired := make([]*receiverInstance, 0)
+			r.Lock()
+			for agentID, inst := range r.instances {
+				if now.Sub(inst.lastSeen) > timeout {
+					delete(r.instances, agentID)
+					expired = append(expired, inst)
+				}
+			}
+			r.Unlock()
+			for _, inst := range expired {
+				inst.offline()
+			}
+		case <-r.stopC:
+			return
+		}
+	}
+}
+
+// receiverInstance 通过zipkin、jaeger上报的服务实例，相当于一个pinpoint agent
+type receiverInstance struct {
+	sync.Mutex
+	agentInfo  *network.AgentInfo
+	converter  *otlp.Converter // 转换为pinpoint span，缓存已经入库的元数据
+	isLive     bool
+	lastSeen   time.Time // 最近一次上报时间，由Receiver的锁保护
+	registerAt time.Time // 最近一次注册时间
+}
+
+func newReceiverInstance(appName, agentID string, resource otlp.Attributes, env int32, ip string) *receiverInstance {
+	agentInfo := network.NewAgentInfo()
+	agentInfo.AppName = appName
+	agentInfo.AgentID = agentID
+	agentInfo.ServiceType = int32(constant.OTLP_SERVER)
+	agentInfo.HostName = resource.String("host.name")
+	agentInfo.IP4S = resource.First("host.ip", "ip")
+	if len(agentInfo.IP4S) == 0 {
+		agentInfo.IP4S = ip
+	}
+	agentInfo.StartTimestamp = time.Now().UnixNano() / 1e6
+	agentInfo.OperatingEnv = env
+	if b, err := json.Marshal(resource); err == nil {
+		agentInfo.AgentInfo = string(b)
+	}
+
+	return &receiverInstance{
+		agentInfo: agentInfo,
+		converter: otlp.NewConverter(appName, agentID, agentInfo.StartTimestamp),
+	}
+}
+
+// register 第一次上报时保存app和agent信息，失败时间隔receiverRegisterRetry后重试
+func (inst *receiverInstance) register() error {
+	inst.Lock()
+	defer inst.Unlock()
+	if inst.isLive {
+		return nil
+	}
+	if time.Since(inst.registerAt) < receiverRegisterRetry {
+		return fmt.Errorf("agent %s register failed, retry later", inst.agentInfo.AgentID)
+	}
+	inst.registerAt = time.Now()
+
+	agentInfo := inst.agentInfo
+	if err := gCollector.storage.AppNameStore(agentInfo.AppName); err != nil {
+		logger.Warn("insert apps error", zap.String("error", err.Error()))
+		return err
+	}
+	if err := gCollector.storage.AgentStore(agentInfo, true); err != nil {
+		logger.Warn("agent Store", zap.String("error", err.Error()))
+		return err
+	}
+	if err := gCollector.storage.AgentInfoStore(agentInfo.AppName, agentInfo.AgentID, agentInfo.StartTimestamp, []byte(agentInfo.AgentInfo)); err != nil {
+		logger.Warn("agent info store", zap.String("error", err.Error()))
+	}
+	gCollector.apps.storeAgent(agentInfo.AppName, agentInfo.AgentID, agentInfo.ServiceType, agentInfo.StartTimestamp, true, agentInfo.HostName, agentInfo.IP4S)
+	gCollector.apps.storeIPandHost(agentInfo.AppName, agentInfo.IP4S, agentInfo.HostName)
+
+	inst.isLive = true
+	logger.Info("Online", zap.String("appName", agentInfo.AppName), zap.String("agentID", agentInfo.AgentID), zap.Int32("env", agentInfo.OperatingEnv))
+	return nil
+}
+
+// offline 下线
+func (inst *receiverInstance) offline() {
+	inst.Lock()
+	defer inst.Unlock()
+	if !inst.isLive {
+		return
+	}
+	if err := gCollector.storage.UpdateAgentState(inst.agentInfo.AppName, inst.agentInfo.AgentID, false); err != nil {
+		logger.Warn("update agent state Store", zap.String("error", err.Error()))
+	}
+	gCollector.apps.storeAgent(inst.agentInfo.AppName, inst.agentInfo.AgentID, inst.agentInfo.ServiceType, inst.agentInfo.StartTimestamp, false, inst.agentInfo.HostName, inst.agentInfo.IP4S)
+	inst.isLive = false
+	logger.Info("Offline", zap.String("appName", inst.agentInfo.AppName), zap.String("agentID", inst.agentInfo.AgentID))
+}
+
+// readReceiverBody 读取请求内容，支持gzip压缩
+func readReceiverBody(w http.ResponseWriter, req *http.Request) ([]byte, error) {
+	var reader io.Reader = http.MaxBytesReader(w, req.Body, receiverMaxBody)
+	switch req.Header.Get("Content-Encoding") {
+	case "", "identity":
+		break
+	case "gzip":
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+		break
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", req.Header.Get("Content-Encoding"))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, receiverMaxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > receiverMaxBody {
+		return nil, fmt.Errorf("request body too large")
+	}
+	return body, nil
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/bsed/trace/collector/misc"
+	"github.com/bsed/trace/pkg/stats"
+)
+
+// 未知父节点访问的服务拓扑以UNKNOWN为源节点入库，由hash选中UNKNOWN的collector汇总
+const unknowSource = "UNKNOWN"
+
+// Rollup 分钟统计数据定时汇总为10分钟、1小时、1天数据，每个app只由一致性hash选中的collector汇总
+type Rollup struct {
+	started bool
+	stopC   chan bool
+	doneC   chan bool
+}
+
+func newRollup() *Rollup {
+	return &Rollup{
+		stopC: make(chan bool),
+		doneC: make(chan bool),
+	}
+}
+
+// Start 启动汇总任务
+func (r *Rollup) Start() {
+	if !misc.Conf.Rollup.Enable {
+		return
+	}
+	r.started = true
+	go r.run()
+}
+
+// Close 停止汇总任务，正在汇总的窗口完成后退出
+func (r *Rollup) Close() {
+	if !r.started {
+		return
+	}
+	close(r.stopC)
+	<-r.doneC
+}
+
+func (r *Rollup) run() {
+	defer close(r.doneC)
+	interval := misc.Conf.Rollup.Interval
+	if interval <= 0 {
+		interval = 60
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.rollup()
+			break
+		case <-r.stopC:
+			return
+		}
+	}
+}
+
+// rollup 汇总本collector负责的app
+func (r *Rollup) rollup() {
+	gCollector.apps.RLock()
+	names := make([]string, 0, len(gCollector.apps.apps)+1)
+	for name := range gCollector.apps.apps {
+		names = append(names, name)
+	}
+	gCollector.apps.RUnlock()
+	names = append(names, unknowSource)
+	sort.Strings(names)
+
+	for _, name := range names {
+		topic, err := gCollector.getCollecotorTopic(name)
+		if err != nil || topic != gCollector.etcd.ReportKey {
+			continue
+		}
+		r.rollupApp(name)
+		select {
+		case <-r.stopC:
+			return
+		default:
+		}
+	}
+}
+
+// rollupApp 逐级汇总，每一级只汇总上一级已经完成的窗口
+func (r *Rollup) rollupApp(appName string) {
+	// 分钟数据在延迟计算、api二次聚合和迟到数据合并之后才不再变化
+	ready := time.Now().Unix() - misc.Conf.Stats.DeferTime - misc.Conf.Apps.ApiStatsInterval - 60 - misc.Conf.Stats.AllowedLateness
+	ready -= ready % 60
+
+	src := ""
+	for _, rollup := range stats.Rollups {
+		ready = r.rollupLevel(appName, rollup, src, ready)
+		src = rollup.Name
+	}
+}
+
+// rollupLevel 汇总一个精度，ready之前的源数据已经完整，返回该精度的汇总进度
+func (r *Rollup) rollupLevel(appName string, rollup *stats.Rollup, src string, ready int64) int64 {
+	storage := gCollector.storage
+	progress, err := storage.LoadRollupProgress(appName, rollup.Interval)
+	if err != nil {
+		return 0
+	}
+	// 第一次汇总从最近一个完整的窗口开始，不汇总历史数据
+	if progress == 0 {
+		progress = rollup.Align(ready) - rollup.Interval
+	}
+
+	retention, ok := misc.Conf.Rollup.Retention[rollup.Name]
+	if !ok || retention <= 0 {
+		retention = rollup.Retention
+	}
+	ttl := retention * 86400
+	batch := misc.Conf.Rollup.Batch
+	if batch <= 0 {
+		batch = 1
+	}
+	for i := 0; i < batch && progress+rollup.Interval <= ready; i++ {
+		start, end := progress, progress+rollup.Interval
+		if err := r.rollupWindow(appName, rollup, src, start, end, ttl); err != nil {
+			logger.Warn("rollup error", zap.String("appName", appName), zap.String("rollup", rollup.Name), zap.Int64("start", start), zap.String("error", err.Error()))
+			break
+		}
+		if err := storage.StoreRollupProgress(appName, rollup.Interval, end); err != nil {
+			break
+		}
+		progress = end
+	}
+	return progress
+}
+
+// rollupWindow 汇总一个窗口，src为空时源表为分钟表
+func (r *Rollup) rollupWindow(appName string, rollup *stats.Rollup, src string, start, end, ttl int64) error {
+	storage := gCollector.storage
+	srcTable := func(table string) string {
+		if len(src) == 0 {
+			return table
+		}
+		return table + "_" + src
+	}
+
+	// UNKNOWN只有服务拓扑数据
+	if appName != unknowSource {
+		if err := storage.RollupAPIStats(appName, start, end, srcTable("api_stats"), rollup.Table("api_stats"), ttl); err != nil {
+			return err
+		}
+		if err := storage.RollupSQLStats(appName, start, end, srcTable("sql_stats"), rollup.Table("sql_stats"), ttl); err != nil {
+			return err
+		}
+		if err := storage.RollupMethodStats(appName, start, end, srcTable("method_stats"), rollup.Table("method_stats"), ttl); err != nil {
+			return err
+		}
+		if err := storage.RollupExceptionStats(appName, start, end, srcTable("exception_stats"), rollup.Table("exception_stats"), ttl); err != nil {
+			return err
+		}
+	}
+	return storage.RollupServiceMap(appName, start, end, srcTable("service_map"), rollup.Table("service_map"), ttl)
+}
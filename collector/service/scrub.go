@@ -0,0 +1,286 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/collector/misc"
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+	"go.uber.org/zap"
+)
+
+// 默认脱敏后的值
+const defaultScrubMask = "******"
+
+// scrubRules 一个app的脱敏规则
+type scrubRules struct {
+	keys      map[int32]struct{} // 整个值脱敏的annotation key
+	sqlParam  bool               // SQL-ID中解析出的sql参数
+	bindValue bool               // SQL-ID中的绑定变量
+	patterns  []*regexp.Regexp   // 正则匹配的内容脱敏
+	params    *regexp.Regexp     // url参数名匹配的参数值脱敏
+}
+
+// Scrubber span annotation敏感数据脱敏，在入库和统计之前执行
+type Scrubber struct {
+	sync.Mutex
+	mask   string                 // 脱敏后的值
+	rules  *scrubRules            // 默认规则
+	apps   map[string]*scrubRules // app单独配置的规则，包含默认规则
+	counts map[string]int64       // 每个app的脱敏次数，定时上报后清零
+}
+
+func newScrubber() *Scrubber {
+	return &Scrubber{
+		mask:   defaultScrubMask,
+		apps:   make(map[string]*scrubRules),
+		counts: make(map[string]int64),
+	}
+}
+
+// start 编译脱敏规则，启动脱敏次数上报
+func (s *Scrubber) start() error {
+	if !misc.Conf.Scrub.Enable {
+		return nil
+	}
+	if len(misc.Conf.Scrub.Mask) > 0 {
+		s.mask = misc.Conf.Scrub.Mask
+	}
+
+	rules, err := newScrubRules(misc.Conf.Scrub.Default)
+	if err != nil {
+		return err
+	}
+	s.rules = rules
+
+	for appName, rule := range misc.Conf.Scrub.Apps {
+		merged := misc.ScrubRule{
+			Keys:     append(append([]string{}, misc.Conf.Scrub.Default.Keys...), rule.Keys...),
+			Patterns: append(append([]string{}, misc.Conf.Scrub.Default.Patterns...), rule.Patterns...),
+			Params:   append(append([]string{}, misc.Conf.Scrub.Default.Params...), rule.Params...),
+		}
+		rules, err := newScrubRules(merged)
+		if err != nil {
+			return fmt.Errorf("app %s, %v", appName, err)
+		}
+		s.apps[appName] = rules
+	}
+
+	go s.report()
+	return nil
+}
+
+// newScrubRules 编译规则
+func newScrubRules(rule misc.ScrubRule) (*scrubRules, error) {
+	rules := &scrubRules{
+		keys: make(map[int32]struct{}),
+	}
+	for _, name := range rule.Keys {
+		key, ok := annotationKey(name)
+		if !ok {
+			return nil, fmt.Errorf("unknow annotation key %s", name)
+		}
+		// sql参数和绑定变量在SQL-ID中上报
+		switch key {
+		case constant.SQL_PARAM:
+			rules.sqlParam = true
+			break
+		case constant.SQL_BINDVALUE:
+			rules.bindValue = true
+			break
+		}
+		rules.keys[key] = struct{}{}
+	}
+
+	for _, pattern := range rule.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules.patterns = append(rules.patterns, re)
+	}
+
+	if len(rule.Params) > 0 {
+		names := make([]string, 0, len(rule.Params))
+		for _, param := range rule.Params {
+			names = append(names, regexp.QuoteMeta(param))
+		}
+		re, err := regexp.Compile(`(?i)((?:^|[?&;,\s])(?:` + strings.Join(names, "|") + `)=)[^&;,\s#]*`)
+		if err != nil {
+			return nil, err
+		}
+		rules.params = re
+	}
+	return rules, nil
+}
+
+// annotationKey 通过数值或者constant.AnnotationKeys中的名字获取annotation key
+func annotationKey(name string) (int32, bool) {
+	if key, err := strconv.Atoi(name); err == nil {
+		return int32(key), true
+	}
+	for key, keyName := range constant.AnnotationKeys {
+		if strings.EqualFold(keyName, name) {
+			return int32(key), true
+		}
+	}
+	return 0, false
+}
+
+// getRules 获取app的脱敏规则
+func (s *Scrubber) getRules(appName string) *scrubRules {
+	if rules, ok := s.apps[appName]; ok {
+		return rules
+	}
+	return s.rules
+}
+
+// span 脱敏span和event的annotation
+func (s *Scrubber) span(span *trace.TSpan) {
+	if s.rules == nil {
+		return
+	}
+	rules := s.getRules(span.GetApplicationName())
+	n := s.annotations(rules, span.GetAnnotations())
+	for _, event := range span.GetSpanEventList() {
+		n += s.annotations(rules, event.GetAnnotations())
+	}
+	s.count(span.GetApplicationName(), n)
+}
+
+// spanChunk 脱敏spanChunk中event的annotation
+func (s *Scrubber) spanChunk(spanChunk *trace.TSpanChunk) {
+	if s.rules == nil {
+		return
+	}
+	rules := s.getRules(spanChunk.GetApplicationName())
+	n := 0
+	for _, event := range spanChunk.GetSpanEventList() {
+		n += s.annotations(rules, event.GetAnnotations())
+	}
+	s.count(spanChunk.GetApplicationName(), n)
+}
+
+// annotations 返回脱敏次数
+func (s *Scrubber) annotations(rules *scrubRules, annotations []*trace.TAnnotation) int {
+	n := 0
+	for _, annotation := range annotations {
+		if annotation == nil || annotation.Value == nil {
+			continue
+		}
+		value := annotation.Value
+
+		// 按key整个值脱敏
+		if _, ok := rules.keys[annotation.Key]; ok {
+			n += s.maskValue(value)
+			continue
+		}
+
+		// sql参数和绑定变量
+		if annotation.Key == constant.SQL_ID && value.IntStringStringValue != nil {
+			if rules.sqlParam {
+				n += s.maskString(value.IntStringStringValue.StringValue1)
+			}
+			if rules.bindValue {
+				n += s.maskString(value.IntStringStringValue.StringValue2)
+			}
+		}
+
+		// url参数
+		if rules.params != nil && (annotation.Key == constant.HTTP_URL || annotation.Key == constant.HTTP_PARAM) {
+			n += s.replace(rules.params, value.StringValue, "${1}"+strings.Replace(s.mask, "$", "$$", -1))
+		}
+
+		// 正则
+		for _, re := range rules.patterns {
+			for _, str := range stringValues(value) {
+				n += s.replace(re, str, strings.Replace(s.mask, "$", "$$", -1))
+			}
+		}
+	}
+	return n
+}
+
+// maskValue 整个值脱敏
+func (s *Scrubber) maskValue(value *trace.TAnnotationValue) int {
+	n := 0
+	for _, str := range stringValues(value) {
+		n += s.maskString(str)
+	}
+	if len(value.BinaryValue) > 0 {
+		value.BinaryValue = nil
+		n++
+	}
+	return n
+}
+
+// maskString 字符串脱敏
+func (s *Scrubber) maskString(str *string) int {
+	if str == nil || len(*str) == 0 || *str == s.mask {
+		return 0
+	}
+	*str = s.mask
+	return 1
+}
+
+// replace 替换正则匹配的内容
+func (s *Scrubber) replace(re *regexp.Regexp, str *string, repl string) int {
+	if str == nil || len(*str) == 0 || !re.MatchString(*str) {
+		return 0
+	}
+	*str = re.ReplaceAllString(*str, repl)
+	return 1
+}
+
+// count 累计脱敏次数
+func (s *Scrubber) count(appName string, n int) {
+	if n == 0 {
+		return
+	}
+	s.Lock()
+	s.counts[appName] += int64(n)
+	s.Unlock()
+}
+
+// report 每分钟上报一次脱敏次数
+func (s *Scrubber) report() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.Lock()
+		counts := s.counts
+		s.counts = make(map[string]int64)
+		s.Unlock()
+		for appName, count := range counts {
+			logger.Info("scrub", zap.String("appName", appName), zap.Int64("count", count))
+		}
+	}
+}
+
+// stringValues annotation中所有的字符串值
+func stringValues(value *trace.TAnnotationValue) []*string {
+	values := make([]*string, 0, 2)
+	if value.StringValue != nil {
+		values = append(values, value.StringValue)
+	}
+	if value.IntStringValue != nil && value.IntStringValue.StringValue != nil {
+		values = append(values, value.IntStringValue.StringValue)
+	}
+	if v := value.IntStringStringValue; v != nil {
+		if v.StringValue1 != nil {
+			values = append(values, v.StringValue1)
+		}
+		if v.StringValue2 != nil {
+			values = append(values, v.StringValue2)
+		}
+	}
+	if value.LongIntIntByteByteStringValue != nil && value.LongIntIntByteByteStringValue.StringValue != nil {
+		values = append(values, value.LongIntIntByteByteStringValue.StringValue)
+	}
+	return values
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/stats"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+// systemPacket 处理agent上报的主机信息
+func (t *tcpClient) systemPacket(tracePack *network.TracePack) error {
+	packet := network.NewSystemPacket()
+	if err := msgpack.Unmarshal(tracePack.Payload, packet); err != nil {
+		logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+		return err
+	}
+
+	switch packet.Type {
+	case constant.TypeOfHostInfo:
+		info := stats.NewSystemInfo()
+		if err := msgpack.Unmarshal(packet.Payload, info); err != nil {
+			logger.Warn("msgpack Unmarshal", zap.String("error", err.Error()))
+			return err
+		}
+
+		// 和agent_runtime一样使用json存储，方便web解析
+		metrics, err := json.Marshal(info)
+		if err != nil {
+			logger.Warn("json Marshal", zap.String("error", err.Error()))
+			return err
+		}
+
+		if err := gCollector.storage.WriteSystemStat(packet.AppName, packet.AgentID, packet.HostName, packet.Time, metrics); err != nil {
+			logger.Warn("system stat", zap.String("error", err.Error()))
+		}
+		break
+	default:
+		logger.Warn("unknow type", zap.String("type", fmt.Sprintf("%T", packet.Type)), zap.Uint16("value", packet.Type))
+	}
+	return nil
+}
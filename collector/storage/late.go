@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"github.com/bsed/trace/pkg/sql"
+	"github.com/bsed/trace/pkg/stats"
+	"github.com/gocql/gocql"
+	"go.uber.org/zap"
+)
+
+// 迟到数据合并: 计算点已经入库后才到达的数据，先读取已入库的数据合并后再覆盖写入
+
+// mergeDuration 合并最大、最小耗时，已入库的数据为空时不参与比较
+func mergeDuration(count int, maxDuration, minDuration *int32, oldMax, oldMin int32) {
+	if count <= 0 {
+		return
+	}
+	if oldMax > *maxDuration {
+		*maxDuration = oldMax
+	}
+	if oldMin < *minDuration {
+		*minDuration = oldMin
+	}
+}
+
+// mergeHistogram 合并已入库的直方图，数据损坏时只保留新数据
+func (s *Storage) mergeHistogram(h *stats.Histogram, data []byte) {
+	old, err := stats.DecodeHistogram(data)
+	if err != nil {
+		s.logger.Warn("decode histogram error", zap.String("error", err.Error()))
+		return
+	}
+	h.Merge(old)
+}
+
+// MergeAPIStats 迟到数据和已入库的api统计合并
+func (s *Storage) MergeAPIStats(appName string, inputDate int64, urlStr string, url *stats.Url) error {
+	var count, errCount, satisfaction, tolerate int
+	var duration, maxDuration, minDuration int32
+	var histogram []byte
+	query := s.traceCql.Query(sql.LoadAPIStats, appName, urlStr, inputDate).Consistency(gocql.One)
+	err := query.Scan(&count, &errCount, &duration, &maxDuration, &minDuration, &satisfaction, &tolerate, &histogram)
+	if err != nil && err != gocql.ErrNotFound {
+		s.logger.Warn("load api stats error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+		return err
+	}
+	if err == nil {
+		mergeDuration(count, &url.MaxDuration, &url.MinDuration, maxDuration, minDuration)
+		url.AccessCount += count
+		url.AccessErrCount += errCount
+		url.Duration += duration
+		url.SatisfactionCount += satisfaction
+		url.TolerateCount += tolerate
+		s.mergeHistogram(url.Histogram, histogram)
+	}
+	return s.InsertAPIStats(appName, inputDate, urlStr, url)
+}
+
+// MergeDubboStats 迟到数据和已入库的dubbo接口统计合并
+func (s *Storage) MergeDubboStats(appName string, inputDate int64, dubboApi string, dubbo *stats.Dubbo) error {
+	var count, errCount, satisfaction, tolerate int
+	var duration, maxDuration, minDuration int32
+	var histogram []byte
+	query := s.traceCql.Query(sql.LoadAPIStats, appName, dubboApi, inputDate).Consistency(gocql.One)
+	err := query.Scan(&count, &errCount, &duration, &maxDuration, &minDuration, &satisfaction, &tolerate, &histogram)
+	if err != nil && err != gocql.ErrNotFound {
+		s.logger.Warn("load dubbo api stats error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+		return err
+	}
+	if err == nil {
+		mergeDuration(count, &dubbo.MaxDuration, &dubbo.MinDuration, maxDuration, minDuration)
+		dubbo.AccessCount += count
+		dubbo.AccessErrCount += errCount
+		dubbo.Duration += duration
+		dubbo.SatisfactionCount += satisfaction
+		dubbo.TolerateCount += tolerate
+		s.mergeHistogram(dubbo.Histogram, histogram)
+	}
+	return s.InsertDubboStats(appName, inputDate, dubboApi, dubbo)
+}
+
+// MergeMethodStats 迟到数据和已入库的接口方法统计合并
+func (s *Storage) MergeMethodStats(appName string, inputTime int64, apiStr string, methodID int32, methodInfo *stats.Method) error {
+	var count, errCount int
+	var duration, maxDuration, minDuration int32
+	var histogram []byte
+	query := s.traceCql.Query(sql.LoadMethodStats, appName, apiStr, inputTime, methodID).Consistency(gocql.One)
+	err := query.Scan(&duration, &maxDuration, &minDuration, &count, &errCount, &histogram)
+	if err != nil && err != gocql.ErrNotFound {
+		s.logger.Warn("load method stats error", zap.String("error", err.Error()), zap.String("SQL", query.String()))
+		return err
+	}
+	if err == nil {
+		mergeDuration(count, &methodInfo.MaxDuration, &methodInfo.MinDuration, maxDuration, minDuration)
+		methodInfo.Count += count
+		methodInfo.ErrCount += errCount
+		methodInfo.Duration += duration
+		s.mergeHistogram(methodInfo.Histogram, histogram)
+	}
+	return s.InsertMethodStats(appName, inputTime, apiStr, methodID, methodInfo)
+}
+
+// MergeSQLStats 迟到数据和已入库的sql统计合并
+func (s *Storage) MergeSQLStats(appName string, inputTime int64, sqlID int32, sqlInfo *stats.SQL) error {
+	var count, errCount int
+	var duration, maxDuration, minDuration int32
+	var histogram []byte
+	query := s.traceCql.Query(sql.LoadSQLStats, appName, sqlID, inputTime).Consistency(gocql.One)
+	err := query.Scan(&duration, &maxDuration, &minDuration, &count, &errCount, &histogram)
+	if err != nil && err != gocql.ErrNotFound {
+		s.logger.Warn("load sql stats error", zap.String("error", err.Error()), zap.String("SQL", query.String()))
+		return err
+	}
+	if err == nil {
+		mergeDuration(count, &sqlInfo.MaxDuration, &sqlInfo.MinDuration, maxDuration, minDuration)
+		sqlInfo.Count += count
+		sqlInfo.ErrCount += errCount
+		sqlInfo.Duration += duration
+		s.mergeHistogram(sqlInfo.Histogram, histogram)
+	}
+	return s.InsertSQLStats(appName, inputTime, sqlID, sqlInfo)
+}
+
+// MergeExceptionStats 迟到数据和已入库的异常统计合并
+func (s *Storage) MergeExceptionStats(appName string, inputTime int64, methodID int32, exceptions map[int32]*stats.Exception) error {
+	for classID, exinfo := range exceptions {
+		var count int
+		var duration, maxDuration, minDuration int32
+		query := s.traceCql.Query(sql.LoadExceptionStats, appName, methodID, classID, inputTime).Consistency(gocql.One)
+		err := query.Scan(&duration, &maxDuration, &minDuration, &count)
+		if err != nil && err != gocql.ErrNotFound {
+			s.logger.Warn("load exception stats error", zap.String("error", err.Error()), zap.String("SQL", query.String()))
+			return err
+		}
+		if err == nil {
+			mergeDuration(count, &exinfo.MaxDuration, &exinfo.MinDuration, maxDuration, minDuration)
+			exinfo.Count += count
+			exinfo.Duration += duration
+		}
+	}
+	return s.InsertExceptionStats(appName, inputTime, methodID, exceptions)
+}
+
+// loadServiceMap 读取已入库的服务拓扑
+func (s *Storage) loadServiceMap(sourceName, targetName string, inputDate int64, targetType int32) (int, int, int32, error) {
+	var count, errCount int
+	var duration int32
+	query := s.traceCql.Query(sql.LoadServiceMap, sourceName, targetName, inputDate, targetType).Consistency(gocql.One)
+	err := query.Scan(&count, &errCount, &duration)
+	if err == gocql.ErrNotFound {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		s.logger.Warn("load service map error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+		return 0, 0, 0, err
+	}
+	return count, errCount, duration, nil
+}
+
+// MergeTargetMap 迟到数据和已入库的子节点拓扑合并
+func (s *Storage) MergeTargetMap(appName string,
+	appType int32, inputDate int64,
+	targetType int32, targetName string,
+	target *stats.Target) error {
+
+	count, errCount, duration, err := s.loadServiceMap(appName, targetName, inputDate, targetType)
+	if err != nil {
+		return err
+	}
+	target.AccessCount += count
+	target.AccessErrCount += errCount
+	target.AccessDuration += duration
+	return s.InsertTargetMap(appName, appType, inputDate, targetType, targetName, target)
+}
+
+// MergeUnknowParentMap 迟到数据和已入库的未知父节点拓扑合并
+func (s *Storage) MergeUnknowParentMap(targetName string, targetType int32, inputDate int64, unknowParent *stats.UnknowParent) error {
+	count, _, duration, err := s.loadServiceMap("UNKNOWN", targetName, inputDate, targetType)
+	if err != nil {
+		return err
+	}
+	unknowParent.AccessCount += count
+	unknowParent.AccessDuration += duration
+	return s.InsertUnknowParentMap(targetName, targetType, inputDate, unknowParent)
+}
+
+// MergeAPIMapStats 迟到数据和已入库的api调用统计合并
+func (s *Storage) MergeAPIMapStats(appName string, appType int32, inputTime int64, apiStr string, parentname string, parentInfo *stats.Parent) error {
+	var count, errCount int
+	var duration int32
+	query := s.traceCql.Query(sql.LoadAPIMapStats, appName, inputTime, apiStr, parentname).Consistency(gocql.One)
+	err := query.Scan(&count, &errCount, &duration)
+	if err != nil && err != gocql.ErrNotFound {
+		s.logger.Warn("load api map error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+		return err
+	}
+	if err == nil {
+		parentInfo.AccessCount += count
+		parentInfo.AccessErrCount += errCount
+		parentInfo.AccessDuration += duration
+	}
+	return s.InsertAPIMapStats(appName, appType, inputTime, apiStr, parentname, parentInfo)
+}
@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/bsed/trace/pkg/sql"
+	"github.com/bsed/trace/pkg/stats"
+	"github.com/gocql/gocql"
+	"go.uber.org/zap"
+)
+
+// rollupStat 汇总窗口内同一个key的统计，次数和耗时累加，汇总表中为bigint
+type rollupStat struct {
+	serviceType  int32
+	count        int64
+	errCount     int64
+	duration     int64
+	maxDuration  int32
+	minDuration  int32
+	satisfaction int64
+	tolerate     int64
+	histogram    *stats.Histogram
+}
+
+func newRollupStat() *rollupStat {
+	return &rollupStat{
+		histogram: stats.NewHistogram(),
+	}
+}
+
+// add 累加一条源数据
+func (r *rollupStat) add(count, errCount, duration int64, maxDuration, minDuration int32) {
+	if r.count == 0 || minDuration < r.minDuration {
+		r.minDuration = minDuration
+	}
+	if maxDuration > r.maxDuration {
+		r.maxDuration = maxDuration
+	}
+	r.count += count
+	r.errCount += errCount
+	r.duration += duration
+}
+
+// LoadRollupProgress 汇总进度，没有汇总过时返回0
+func (s *Storage) LoadRollupProgress(appName string, interval int64) (int64, error) {
+	var inputDate int64
+	query := s.traceCql.Query(sql.LoadRollupProgress, appName, interval).Consistency(gocql.One)
+	if err := query.Scan(&inputDate); err != nil {
+		if err == gocql.ErrNotFound {
+			return 0, nil
+		}
+		s.logger.Warn("load rollup progress error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+		return 0, err
+	}
+	return inputDate, nil
+}
+
+// StoreRollupProgress 保存汇总进度
+func (s *Storage) StoreRollupProgress(appName string, interval int64, inputDate int64) error {
+	query := s.traceCql.Query(sql.InsertRollupProgress, appName, interval, inputDate).Consistency(gocql.One)
+	if err := query.Exec(); err != nil {
+		s.logger.Warn("store rollup progress error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+		return err
+	}
+	return nil
+}
+
+// RollupAPIStats 汇总[start, end)内的api统计，src为源表，dst为汇总表，ttl单位秒
+func (s *Storage) RollupAPIStats(appName string, start, end int64, src, dst string, ttl int64) error {
+	iter := s.traceCql.Query(fmt.Sprintf(sql.LoadRollupAPIStats, src), appName, start, end).Iter()
+	apis := make(map[string]*rollupStat)
+	var api string
+	var count, errCount, duration, satisfaction, tolerate int64
+	var maxDuration, minDuration int32
+	var histogram []byte
+	for iter.Scan(&api, &count, &errCount, &duration, &maxDuration, &minDuration, &satisfaction, &tolerate, &histogram) {
+		stat, ok := apis[api]
+		if !ok {
+			stat = newRollupStat()
+			apis[api] = stat
+		}
+		stat.add(count, errCount, duration, maxDuration, minDuration)
+		stat.satisfaction += satisfaction
+		stat.tolerate += tolerate
+		s.mergeHistogram(stat.histogram, histogram)
+	}
+	if err := iter.Close(); err != nil {
+		s.logger.Warn("load rollup api stats error", zap.String("error", err.Error()), zap.String("table", src))
+		return err
+	}
+
+	for api, stat := range apis {
+		p50, p90, p99 := stat.histogram.Percentiles()
+		query := s.traceCql.Query(fmt.Sprintf(sql.InsertRollupAPIStats, dst),
+			appName,
+			api,
+			start,
+			stat.count,
+			stat.errCount,
+			stat.duration,
+			stat.maxDuration,
+			stat.minDuration,
+			stat.satisfaction,
+			stat.tolerate,
+			p50, p90, p99,
+			stat.histogram.Encode(),
+			ttl,
+		).Consistency(gocql.One)
+		if err := query.Exec(); err != nil {
+			s.logger.Warn("insert rollup api stats error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+			return err
+		}
+	}
+	return nil
+}
+
+// RollupSQLStats 汇总[start, end)内的sql统计
+func (s *Storage) RollupSQLStats(appName string, start, end int64, src, dst string, ttl int64) error {
+	iter := s.traceCql.Query(fmt.Sprintf(sql.LoadRollupSQLStats, src), appName, start, end).Iter()
+	sqls := make(map[int32]*rollupStat)
+	var sqlID int32
+	var count, errCount, duration int64
+	var maxDuration, minDuration int32
+	var histogram []byte
+	for iter.Scan(&sqlID, &count, &errCount, &duration, &maxDuration, &minDuration, &histogram) {
+		stat, ok := sqls[sqlID]
+		if !ok {
+			stat = newRollupStat()
+			sqls[sqlID] = stat
+		}
+		stat.add(count, errCount, duration, maxDuration, minDuration)
+		s.mergeHistogram(stat.histogram, histogram)
+	}
+	if err := iter.Close(); err != nil {
+		s.logger.Warn("load rollup sql stats error", zap.String("error", err.Error()), zap.String("table", src))
+		return err
+	}
+
+	for sqlID, stat := range sqls {
+		p50, p90, p99 := stat.histogram.Percentiles()
+		query := s.traceCql.Query(fmt.Sprintf(sql.InsertRollupSQLStats, dst),
+			appName,
+			sqlID,
+			start,
+			stat.count,
+			stat.errCount,
+			stat.duration,
+			stat.maxDuration,
+			stat.minDuration,
+			p50, p90, p99,
+			stat.histogram.Encode(),
+			ttl,
+		).Consistency(gocql.One)
+		if err := query.Exec(); err != nil {
+			s.logger.Warn("insert rollup sql stats error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+			return err
+		}
+	}
+	return nil
+}
+
+// methodKey 接口方法统计的key
+type methodKey struct {
+	api      string
+	methodID int32
+}
+
+// RollupMethodStats 汇总[start, end)内的接口方法统计
+func (s *Storage) RollupMethodStats(appName string, start, end int64, src, dst string, ttl int64) error {
+	iter := s.traceCql.Query(fmt.Sprintf(sql.LoadRollupMethodStats, src), appName, start, end).Iter()
+	methods := make(map[methodKey]*rollupStat)
+	var key methodKey
+	var serviceType int32
+	var count, errCount, duration int64
+	var maxDuration, minDuration int32
+	var histogram []byte
+	for iter.Scan(&key.api, &key.methodID, &serviceType, &count, &errCount, &duration, &maxDuration, &minDuration, &histogram) {
+		stat, ok := methods[key]
+		if !ok {
+			stat = newRollupStat()
+			stat.serviceType = serviceType
+			methods[key] = stat
+		}
+		stat.add(count, errCount, duration, maxDuration, minDuration)
+		s.mergeHistogram(stat.histogram, histogram)
+	}
+	if err := iter.Close(); err != nil {
+		s.logger.Warn("load rollup method stats error", zap.String("error", err.Error()), zap.String("table", src))
+		return err
+	}
+
+	for key, stat := range methods {
+		p50, p90, p99 := stat.histogram.Percentiles()
+		query := s.traceCql.Query(fmt.Sprintf(sql.InsertRollupMethodStats, dst),
+			appName,
+			key.api,
+			key.methodID,
+			start,
+			stat.serviceType,
+			stat.count,
+			stat.errCount,
+			stat.duration,
+			stat.maxDuration,
+			stat.minDuration,
+			p50, p90, p99,
+			stat.histogram.Encode(),
+			ttl,
+		).Consistency(gocql.One)
+		if err := query.Exec(); err != nil {
+			s.logger.Warn("insert rollup method stats error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+			return err
+		}
+	}
+	return nil
+}
+
+// exceptionKey 异常统计的key
+type exceptionKey struct {
+	methodID int32
+	classID  int32
+}
+
+// RollupExceptionStats 汇总[start, end)内的异常统计
+func (s *Storage) RollupExceptionStats(appName string, start, end int64, src, dst string, ttl int64) error {
+	iter := s.traceCql.Query(fmt.Sprintf(sql.LoadRollupExceptionStats, src), appName, start, end).Iter()
+	exceptions := make(map[exceptionKey]*rollupStat)
+	var key exceptionKey
+	var serviceType int32
+	var count, duration int64
+	var maxDuration, minDuration int32
+	for iter.Scan(&key.methodID, &key.classID, &serviceType, &count, &duration, &maxDuration, &minDuration) {
+		stat, ok := exceptions[key]
+		if !ok {
+			stat = newRollupStat()
+			stat.serviceType = serviceType
+			exceptions[key] = stat
+		}
+		stat.add(count, 0, duration, maxDuration, minDuration)
+	}
+	if err := iter.Close(); err != nil {
+		s.logger.Warn("load rollup exception stats error", zap.String("error", err.Error()), zap.String("table", src))
+		return err
+	}
+
+	for key, stat := range exceptions {
+		query := s.traceCql.Query(fmt.Sprintf(sql.InsertRollupExceptionStats, dst),
+			appName,
+			key.methodID,
+			key.classID,
+			start,
+			stat.serviceType,
+			stat.count,
+			stat.duration,
+			stat.maxDuration,
+			stat.minDuration,
+			ttl,
+		).Consistency(gocql.One)
+		if err := query.Exec(); err != nil {
+			s.logger.Warn("insert rollup exception stats error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+			return err
+		}
+	}
+	return nil
+}
+
+// targetKey 服务拓扑的子节点
+type targetKey struct {
+	name       string
+	targetType int32
+}
+
+// RollupServiceMap 汇总[start, end)内sourceName访问子节点的统计
+func (s *Storage) RollupServiceMap(sourceName string, start, end int64, src, dst string, ttl int64) error {
+	iter := s.traceCql.Query(fmt.Sprintf(sql.LoadRollupServiceMap, src), sourceName, start, end).Iter()
+	targets := make(map[targetKey]*rollupStat)
+	var key targetKey
+	var sourceType int32
+	var count, errCount, duration int64
+	for iter.Scan(&sourceType, &key.name, &key.targetType, &count, &errCount, &duration) {
+		stat, ok := targets[key]
+		if !ok {
+			stat = newRollupStat()
+			// 服务拓扑中serviceType为源节点类型
+			stat.serviceType = sourceType
+			targets[key] = stat
+		}
+		stat.add(count, errCount, duration, 0, 0)
+	}
+	if err := iter.Close(); err != nil {
+		s.logger.Warn("load rollup service map error", zap.String("error", err.Error()), zap.String("table", src))
+		return err
+	}
+
+	for key, stat := range targets {
+		query := s.traceCql.Query(fmt.Sprintf(sql.InsertRollupServiceMap, dst),
+			sourceName,
+			stat.serviceType,
+			key.name,
+			key.targetType,
+			stat.count,
+			stat.errCount,
+			stat.duration,
+			start,
+			ttl,
+		).Consistency(gocql.One)
+		if err := query.Exec(); err != nil {
+			s.logger.Warn("insert rollup service map error", zap.String("error", err.Error()), zap.String("sql", query.String()))
+			return err
+		}
+	}
+	return nil
+}
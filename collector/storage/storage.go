@@ -3,6 +3,7 @@ package storage
 import (
 	"encoding/json"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
@@ -28,6 +29,8 @@ type Storage struct {
 	spanChans      []chan *trace.TSpan
 	spanChunkChans []chan *trace.TSpanChunk
 	logger         *zap.Logger
+	stopC          chan bool      // 通知入库协程写完缓存后退出
+	wg             sync.WaitGroup // 入库协程
 	// spanChan       chan *trace.TSpan
 	// spanChunkChan  chan *trace.TSpanChunk
 }
@@ -38,6 +41,7 @@ func NewStorage(logger *zap.Logger) *Storage {
 		spanChans:      make([]chan *trace.TSpan, misc.Conf.Storage.GoruntineNum),
 		spanChunkChans: make([]chan *trace.TSpanChunk, misc.Conf.Storage.GoruntineNum),
 		logger:         logger,
+		stopC:          make(chan bool),
 		// spanChunkChans []chan *trace.TSpanChunk
 		// metricsChan:   make(chan *util.MetricData, misc.Conf.Storage.MetricCacheLen+500),
 	}
@@ -105,6 +109,7 @@ func (s *Storage) Start() error {
 		spanChunkChan := make(chan *trace.TSpanChunk, misc.Conf.Storage.SpanChunkCacheLen+500)
 		s.spanChans[index] = spanChan
 		s.spanChunkChans[index] = spanChunkChan
+		s.wg.Add(2)
 		go s.spanStore(spanChan)
 		go s.spanChunkStore(spanChunkChan)
 	}
@@ -125,8 +130,16 @@ func (s *Storage) SpanChunkStore(span *trace.TSpanChunk) {
 	s.spanChunkChans[index] <- span
 }
 
-// Close ...
+// Close 等待缓存的span写入完成后关闭cql
 func (s *Storage) Close() error {
+	close(s.stopC)
+	s.wg.Wait()
+	if s.traceCql != nil {
+		s.traceCql.Close()
+	}
+	if s.staticCql != nil {
+		s.staticCql.Close()
+	}
 	return nil
 }
 
@@ -266,10 +279,23 @@ func (s *Storage) AppStringStore(appName string, strInfo *trace.TStringMetaData)
 
 // spanStore ...
 func (s *Storage) spanStore(spanChan chan *trace.TSpan) {
+	defer s.wg.Done()
 	ticker := time.NewTicker(time.Duration(misc.Conf.Storage.SpanStoreInterval) * time.Millisecond)
+	defer ticker.Stop()
 	var spansQueue []*trace.TSpan
 	for {
 		select {
+		case <-s.stopC:
+			// 写入管道和缓存中剩余的span
+			for len(spanChan) > 0 {
+				spansQueue = append(spansQueue, <-spanChan)
+			}
+			for _, span := range spansQueue {
+				if err := s.WriteSpan(span); err != nil {
+					s.logger.Warn("write span", zap.String("error", err.Error()))
+				}
+			}
+			return
 		case span, ok := <-spanChan:
 			if ok {
 				spansQueue = append(spansQueue, span)
@@ -380,10 +406,23 @@ func (s *Storage) spanStore(spanChan chan *trace.TSpan) {
 
 // spanChunkStore ...
 func (s *Storage) spanChunkStore(spanChunkChan chan *trace.TSpanChunk) {
+	defer s.wg.Done()
 	ticker := time.NewTicker(time.Duration(misc.Conf.Storage.SpanStoreInterval) * time.Millisecond)
+	defer ticker.Stop()
 	var spansChunkQueue []*trace.TSpanChunk
 	for {
 		select {
+		case <-s.stopC:
+			// 写入管道和缓存中剩余的spanChunk
+			for len(spanChunkChan) > 0 {
+				spansChunkQueue = append(spansChunkQueue, <-spanChunkChan)
+			}
+			for _, spanChunk := range spansChunkQueue {
+				if err := s.writeSpanChunk(spanChunk); err != nil {
+					s.logger.Warn("write spanChunk", zap.String("error", err.Error()))
+				}
+			}
+			return
 		case spanChunk, ok := <-spanChunkChan:
 			if ok {
 				spansChunkQueue = append(spansChunkQueue, spanChunk)
@@ -759,6 +798,104 @@ func (s *Storage) WriteAgentStat(appName, agentID string, agentStat *pinpoint.TA
 	return nil
 }
 
+// WriteSystemStat 主机信息存储
+func (s *Storage) WriteSystemStat(appName, agentID, hostName string, inputDate int64, metrics []byte) error {
+	query := s.traceCql.Query(
+		sql.InsertSystemStat,
+		appName,
+		agentID,
+		hostName,
+		inputDate,
+		metrics,
+	).Consistency(gocql.One)
+	if err := query.Exec(); err != nil {
+		s.logger.Warn("inster system stat", zap.String("SQL", query.String()), zap.String("error", err.Error()))
+		return err
+	}
+
+	return nil
+}
+
+// WriteCommandResult pinpoint指令执行结果存储
+func (s *Storage) WriteCommandResult(result *network.CommandResult, body string) error {
+	query := s.traceCql.Query(
+		sql.InsertCommandResult,
+		result.AppName,
+		result.AgentID,
+		result.Time,
+		result.ID,
+		int(result.Type),
+		result.Success,
+		result.Message,
+		body,
+	).Consistency(gocql.One)
+	if err := query.Exec(); err != nil {
+		s.logger.Warn("inster command result", zap.String("SQL", query.String()), zap.String("error", err.Error()))
+		return err
+	}
+
+	return nil
+}
+
+// WriteActiveThread 活跃线程数实时数据存储
+func (s *Storage) WriteActiveThread(appName, agentID string, inputDate int64, schema int32, counts []int32) error {
+	query := s.traceCql.Query(
+		sql.InsertActiveThread,
+		appName,
+		agentID,
+		inputDate,
+		schema,
+		counts,
+	).Consistency(gocql.One)
+	if err := query.Exec(); err != nil {
+		s.logger.Warn("inster active thread", zap.String("SQL", query.String()), zap.String("error", err.Error()))
+		return err
+	}
+
+	return nil
+}
+
+// WriteConfigAck agent应用配置的结果存储
+func (s *Storage) WriteConfigAck(agentID string, ack *network.ConfigAck) error {
+	query := s.traceCql.Query(
+		sql.InsertConfigAck,
+		ack.AppName,
+		agentID,
+		ack.Version,
+		ack.Success,
+		ack.Message,
+		time.Now().UnixNano()/1e6,
+	).Consistency(gocql.One)
+	if err := query.Exec(); err != nil {
+		s.logger.Warn("inster config ack", zap.String("SQL", query.String()), zap.String("error", err.Error()))
+		return err
+	}
+
+	return nil
+}
+
+// LoadAppConfigs 加载所有app的配置
+func (s *Storage) LoadAppConfigs() (map[string]*network.AgentConfig, error) {
+	configs := make(map[string]*network.AgentConfig)
+	iter := s.staticCql.Query(sql.LoadAppConfigs).Consistency(gocql.One).Iter()
+
+	var appName, config string
+	for iter.Scan(&appName, &config) {
+		conf := network.NewAgentConfig()
+		if err := json.Unmarshal([]byte(config), conf); err != nil {
+			s.logger.Warn("json Unmarshal", zap.String("error", err.Error()), zap.String("appName", appName))
+			continue
+		}
+		configs[appName] = conf
+	}
+
+	if err := iter.Close(); err != nil {
+		s.logger.Warn("load app configs", zap.String("SQL", sql.LoadAppConfigs), zap.String("error", err.Error()))
+		return nil, err
+	}
+	return configs, nil
+}
+
 // StoreAPI 存储API信息
 func (s *Storage) StoreAPI(span *trace.TSpan) error {
 	query := s.staticCql.Query(
@@ -776,6 +913,7 @@ func (s *Storage) StoreAPI(span *trace.TSpan) error {
 
 // InsertAPIStats ...
 func (s *Storage) InsertAPIStats(appName string, inputDate int64, urlStr string, url *stats.Url) error {
+	p50, p90, p99 := url.Histogram.Percentiles()
 	query := s.traceCql.Query(sql.InsertAPIStats,
 		appName,
 		url.AccessCount,
@@ -785,6 +923,8 @@ func (s *Storage) InsertAPIStats(appName string, inputDate int64, urlStr string,
 		url.MinDuration,
 		url.SatisfactionCount,
 		url.TolerateCount,
+		p50, p90, p99,
+		url.Histogram.Encode(),
 		urlStr,
 		inputDate).Consistency(gocql.One)
 
@@ -820,6 +960,7 @@ func (s *Storage) InsertAPIStats(appName string, inputDate int64, urlStr string,
 
 // InsertDubboStats ...
 func (s *Storage) InsertDubboStats(appName string, inputDate int64, dubboApi string, dubbo *stats.Dubbo) error {
+	p50, p90, p99 := dubbo.Histogram.Percentiles()
 	query := s.traceCql.Query(sql.InsertAPIStats,
 		appName,
 		dubbo.AccessCount,
@@ -829,6 +970,8 @@ func (s *Storage) InsertDubboStats(appName string, inputDate int64, dubboApi str
 		dubbo.MinDuration,
 		dubbo.SatisfactionCount,
 		dubbo.TolerateCount,
+		p50, p90, p99,
+		dubbo.Histogram.Encode(),
 		dubboApi,
 		inputDate).Consistency(gocql.One)
 
@@ -842,6 +985,7 @@ func (s *Storage) InsertDubboStats(appName string, inputDate int64, dubboApi str
 
 // InsertMethodStats 接口计算数据存储
 func (s *Storage) InsertMethodStats(appName string, inputTime int64, apiStr string, methodID int32, methodInfo *stats.Method) error {
+	p50, p90, p99 := methodInfo.Histogram.Percentiles()
 	query := s.traceCql.Query(sql.InsertMethodStats,
 		appName,
 		apiStr,
@@ -853,6 +997,8 @@ func (s *Storage) InsertMethodStats(appName string, inputTime int64, apiStr stri
 		methodInfo.MinDuration,
 		methodInfo.Count,
 		methodInfo.ErrCount,
+		p50, p90, p99,
+		methodInfo.Histogram.Encode(),
 	).Consistency(gocql.One)
 	if err := query.Exec(); err != nil {
 		s.logger.Warn("insert method error", zap.String("error", err.Error()), zap.String("SQL", query.String()))
@@ -971,6 +1117,7 @@ func (s *Storage) InsertAPIMapStats(appName string, appType int32, inputTime int
 
 // InsertSQLStats ...
 func (s *Storage) InsertSQLStats(appName string, inputTime int64, sqlID int32, sqlInfo *stats.SQL) error {
+	p50, p90, p99 := sqlInfo.Histogram.Percentiles()
 	query := s.traceCql.Query(sql.InsertSQLStats,
 		appName,
 		sqlID,
@@ -980,6 +1127,8 @@ func (s *Storage) InsertSQLStats(appName string, inputTime int64, sqlID int32, s
 		sqlInfo.MinDuration,
 		sqlInfo.Count,
 		sqlInfo.ErrCount,
+		p50, p90, p99,
+		sqlInfo.Histogram.Encode(),
 	).Consistency(gocql.One)
 
 	if err := query.Exec(); err != nil {
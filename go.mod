@@ -10,6 +10,7 @@ require (
 	github.com/golang/snappy v0.0.1
 	github.com/imdevlab/g v0.0.0-20190404015224-1e23ede31f19
 	github.com/jmoiron/sqlx v1.2.0 // indirect
+	github.com/klauspost/compress v1.11.0
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/labstack/gommon v0.2.8 // indirect
 	github.com/mattn/go-colorable v0.1.2 // indirect
@@ -26,7 +27,7 @@ require (
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.10.0
 	golang.org/x/net v0.0.0-20190603091049-60506f45cf65 // indirect
-	google.golang.org/grpc v1.21.1 // indirect
+	google.golang.org/grpc v1.21.1
 	gopkg.in/yaml.v2 v2.2.2
 	stathat.com/c/consistent v1.0.0 // indirect
 )
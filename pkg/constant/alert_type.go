@@ -18,6 +18,11 @@ const (
 	ALERT_TYPE_RUNTIME   = 1002 // runtime 数据
 	ALERT_TYPE_EXCEPTION = 1003 // 异常 数据
 
+	// receiver转发给app owner的span，只参与统计
+	ALERT_TYPE_SPANS = 1004
+	// collector之间转交的api二次聚合数据，接收方直接聚合，不再转发
+	ALERT_TYPE_API_HANDOFF = 1005
+
 	POLICY_Type_DEFAULT = 1 // 默认模版
 	POLICY_Type_CUSTOM  = 2 // 自定义策略模版
 )
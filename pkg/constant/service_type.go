@@ -145,6 +145,16 @@ const (
 
 	WEBSPHERE        int16 = 1060
 	WEBSPHERE_METHOD int16 = 1061
+
+	OTLP_SERVER int16 = 1900
+	OTLP_METHOD int16 = 1901
+	OTLP_CLIENT int16 = 9900
+
+	GO_APP      int16 = 1800
+	GO_FUNCTION int16 = 1801
+
+	GRPC_SERVER int16 = 1130
+	GRPC_CLIENT int16 = 9160
 )
 
 func init() {
@@ -344,6 +354,19 @@ func init() {
 	ServiceType[1060] = "WEBSPHERE"
 	ServiceType[1061] = "WEBSPHERE_METHOD"
 
+	// opentelemetry
+	ServiceType[1900] = "OTLP_SERVER"
+	ServiceType[1901] = "OTLP_METHOD"
+	ServiceType[9900] = "OTLP_CLIENT"
+
+	// go sdk
+	ServiceType[1800] = "GO_APP"
+	ServiceType[1801] = "GO_FUNCTION"
+
+	// grpc
+	ServiceType[1130] = "GRPC_SERVER"
+	ServiceType[9160] = "GRPC_CLIENT"
+
 	initAnnotationKeys()
 	initAlertType()
 }
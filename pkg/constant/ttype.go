@@ -11,7 +11,21 @@ const (
 
 // 指令报文类型
 const (
-	TypeOfPing uint16 = 100 // 	Skywalking 监控数据 uint16(iota + 1) // 	Skywalking 监控数据
+	TypeOfPing          uint16 = 100 // 	Skywalking 监控数据 uint16(iota + 1) // 	Skywalking 监控数据
+	TypeOfAuth          uint16 = 101 // 	链接认证
+	TypeOfCommand       uint16 = 102 // 	下发给pinpoint agent的指令
+	TypeOfCommandResult uint16 = 103 // 	pinpoint agent指令执行结果
+	TypeOfHello         uint16 = 104 // 	协议版本和能力协商
+	TypeOfConfig        uint16 = 105 // 	collector下发的应用配置
+)
+
+// pinpoint agent指令类型
+const (
+	TypeOfThreadDump            uint16 = 1 // 线程dump
+	TypeOfActiveThreadCount     uint16 = 2 // 活跃线程数
+	TypeOfActiveThreadDump      uint16 = 3 // 活跃线程dump
+	TypeOfActiveThreadLightDump uint16 = 4 // 活跃线程简要dump
+	TypeOfActiveThreadStream    uint16 = 5 // 活跃线程数实时stream
 )
 
 // 监控报文类型SKYWalking
@@ -44,24 +58,33 @@ const (
 const (
 	TypeOfCPU        uint16 = 1 // cpu
 	TypeOfSystemload uint16 = 2 // Systemload
+	TypeOfHostInfo   uint16 = 3 // 主机cpu、内存、负载、磁盘、网络
 )
 
 // 其他控制类型
 const (
 	// MaxMessageSize max message size
-	MaxMessageSize    int  = 16 * 1024
-	TypeOfCompressYes byte = 1 // 数据压缩
-	TypeOfCompressNo  byte = 2 // 数据不压缩
-	TypeOfSyncYes     byte = 1 // 同步
-	TypeOfSyncNo      byte = 2 // 非同步
-	TypeOfApiStats    byte = 1 // API统计
-	TypeOfSerMapStats byte = 2 // sermap统计
+	MaxMessageSize         int  = 16 * 1024
+	TypeOfCompressYes      byte = 1 // 数据压缩，snappy
+	TypeOfCompressNo       byte = 2 // 数据不压缩
+	TypeOfCompressGzip     byte = 3 // gzip压缩
+	TypeOfCompressZstd     byte = 4 // zstd压缩
+	TypeOfCompressZstdDict byte = 5 // 使用字典的zstd压缩
+	TypeOfSyncYes          byte = 1 // 同步
+	TypeOfSyncNo           byte = 2 // 非同步
+	TypeOfSyncResponse     byte = 3 // 同步应答，ID与请求相同
+	TypeOfSyncError        byte = 4 // 同步应答，payload为错误信息
+	TypeOfApiStats         byte = 1 // API统计
+	TypeOfSerMapStats      byte = 2 // sermap统计
 )
 
 // 运行环境
 const (
-	TypeOfEnvJAVA int32 = 1
-	TypeOfEnvGO   int32 = 2
+	TypeOfEnvJAVA   int32 = 1
+	TypeOfEnvGO     int32 = 2
+	TypeOfEnvOTLP   int32 = 3 // 通过OTLP接入的opentelemetry应用
+	TypeOfEnvZipkin int32 = 4 // collector接收的zipkin应用
+	TypeOfEnvJaeger int32 = 5 // collector接收的jaeger应用
 )
 
 // 版本类型
@@ -0,0 +1,384 @@
+package jaeger
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/bsed/trace/pkg/otlp"
+)
+
+// jaeger.thrift中的Batch，由jaeger client通过HTTP上报，TBinaryProtocol编码
+// 只读取转换需要的字段，其他字段跳过，时间单位为微秒
+
+// tag类型
+const (
+	tagString = 0
+	tagDouble = 1
+	tagBool   = 2
+	tagLong   = 3
+	tagBinary = 4
+)
+
+// span引用类型
+const (
+	refChildOf     = 0
+	refFollowsFrom = 1
+)
+
+// Parse 解析thrift编码的Batch，转换为OTLP格式
+func Parse(data []byte) (*otlp.ExportRequest, error) {
+	trans := thrift.NewTMemoryBufferLen(len(data))
+	if _, err := trans.Write(data); err != nil {
+		return nil, err
+	}
+	p := thrift.NewTBinaryProtocolTransport(trans)
+
+	rs := &otlp.ResourceSpans{
+		Resource: make(otlp.Attributes),
+	}
+	err := readStruct(p, func(id int16, typ thrift.TType) error {
+		switch {
+		case id == 1 && typ == thrift.STRUCT:
+			return readProcess(p, rs.Resource)
+		case id == 2 && typ == thrift.LIST:
+			return readList(p, func() error {
+				span, err := readSpan(p)
+				if err != nil {
+					return err
+				}
+				rs.Spans = append(rs.Spans, span)
+				return nil
+			})
+		}
+		return p.Skip(typ)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("jaeger: %v", err)
+	}
+	return &otlp.ExportRequest{ResourceSpans: []*otlp.ResourceSpans{rs}}, nil
+}
+
+// readProcess 读取Process，进程tag转换为资源属性
+func readProcess(p thrift.TProtocol, resource otlp.Attributes) error {
+	tags := make(otlp.Attributes)
+	err := readStruct(p, func(id int16, typ thrift.TType) error {
+		switch {
+		case id == 1 && typ == thrift.STRING:
+			name, err := p.ReadString()
+			resource["service.name"] = name
+			return err
+		case id == 2 && typ == thrift.LIST:
+			return readTags(p, tags)
+		}
+		return p.Skip(typ)
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, value := range tags {
+		resource[key] = value
+	}
+	if host := tags.String("hostname"); len(host) > 0 {
+		resource["host.name"] = host
+	} else if ip := tags.String("ip"); len(ip) > 0 {
+		resource["host.name"] = ip
+	}
+	if ip := tags.String("ip"); len(ip) > 0 {
+		resource["host.ip"] = ip
+	}
+	if uuid := tags.String("client-uuid"); len(uuid) > 0 {
+		resource["service.instance.id"] = uuid
+	}
+	return nil
+}
+
+// readSpan 读取Span，span.kind、error以及opentracing约定的tag转换为OTLP属性
+func readSpan(p thrift.TProtocol) (*otlp.Span, error) {
+	span := &otlp.Span{
+		Attributes: make(otlp.Attributes),
+	}
+	var traceLow, traceHigh, spanID, parentID int64
+	var startTime, duration int64
+	err := readStruct(p, func(id int16, typ thrift.TType) error {
+		var err error
+		switch {
+		case id == 1 && typ == thrift.I64:
+			traceLow, err = p.ReadI64()
+			return err
+		case id == 2 && typ == thrift.I64:
+			traceHigh, err = p.ReadI64()
+			return err
+		case id == 3 && typ == thrift.I64:
+			spanID, err = p.ReadI64()
+			return err
+		case id == 4 && typ == thrift.I64:
+			parentID, err = p.ReadI64()
+			return err
+		case id == 5 && typ == thrift.STRING:
+			span.Name, err = p.ReadString()
+			return err
+		case id == 6 && typ == thrift.LIST:
+			// parentSpanId为0时使用引用中的父span
+			return readList(p, func() error {
+				refType, refID, err := readSpanRef(p)
+				if err != nil {
+					return err
+				}
+				if parentID == 0 && (refType == refChildOf || refType == refFollowsFrom) {
+					parentID = refID
+				}
+				return nil
+			})
+		case id == 8 && typ == thrift.I64:
+			startTime, err = p.ReadI64()
+			return err
+		case id == 9 && typ == thrift.I64:
+			duration, err = p.ReadI64()
+			return err
+		case id == 10 && typ == thrift.LIST:
+			return readTags(p, span.Attributes)
+		case id == 11 && typ == thrift.LIST:
+			return readList(p, func() error {
+				event, err := readLog(p)
+				if err != nil {
+					return err
+				}
+				span.Events = append(span.Events, event)
+				return nil
+			})
+		}
+		return p.Skip(typ)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	span.TraceID = make([]byte, 16)
+	binary.BigEndian.PutUint64(span.TraceID, uint64(traceHigh))
+	binary.BigEndian.PutUint64(span.TraceID[8:], uint64(traceLow))
+	span.SpanID = int64ID(spanID)
+	if parentID != 0 {
+		span.ParentSpanID = int64ID(parentID)
+	}
+	span.StartTime = uint64(startTime) * 1000
+	span.EndTime = uint64(startTime+duration) * 1000
+
+	attrs := span.Attributes
+	switch attrs.String("span.kind") {
+	case "server":
+		span.Kind = otlp.SpanKindServer
+		break
+	case "client":
+		span.Kind = otlp.SpanKindClient
+		break
+	case "producer":
+		span.Kind = otlp.SpanKindProducer
+		break
+	case "consumer":
+		span.Kind = otlp.SpanKindConsumer
+		break
+	default:
+		span.Kind = otlp.SpanKindInternal
+		break
+	}
+	if isErr, ok := attrs["error"].(bool); (ok && isErr) || attrs.String("error") == "true" {
+		span.Status.Code = otlp.StatusCodeError
+	}
+
+	// opentracing约定的tag
+	if dbType := attrs.String("db.type"); len(dbType) > 0 && len(attrs.String("db.system")) == 0 {
+		if dbType == "sql" {
+			// 关系型数据库没有具体类型时使用peer.service
+			dbType = attrs.First("peer.service", "sql")
+		}
+		attrs["db.system"] = dbType
+	}
+	if instance := attrs.String("db.instance"); len(instance) > 0 && len(attrs.String("db.name")) == 0 {
+		attrs["db.name"] = instance
+	}
+	if host := attrs.First("peer.hostname", "peer.ipv4", "peer.ipv6"); len(host) > 0 && len(attrs.String("net.peer.name")) == 0 {
+		attrs["net.peer.name"] = host
+	}
+	if port, ok := attrs.Int("peer.port"); ok {
+		attrs["net.peer.port"] = port
+	}
+	if span.Kind == otlp.SpanKindServer {
+		if ip := attrs.First("peer.ipv4", "peer.ipv6"); len(ip) > 0 {
+			attrs["client.address"] = ip
+		}
+	}
+
+	for _, event := range span.Events {
+		if event.Attributes.String("event") != "error" {
+			continue
+		}
+		// error日志作为exception事件
+		event.Name = "exception"
+		if kind := event.Attributes.String("error.kind"); len(kind) > 0 {
+			event.Attributes["exception.type"] = kind
+		} else {
+			event.Attributes["exception.type"] = "error"
+		}
+		event.Attributes["exception.message"] = event.Attributes.String("message")
+		if span.Status.Code == otlp.StatusCodeUnset {
+			span.Status.Code = otlp.StatusCodeError
+		}
+		break
+	}
+	return span, nil
+}
+
+// readSpanRef 读取SpanRef，返回引用类型和spanId
+func readSpanRef(p thrift.TProtocol) (int32, int64, error) {
+	var refType int32
+	var spanID int64
+	err := readStruct(p, func(id int16, typ thrift.TType) error {
+		var err error
+		switch {
+		case id == 1 && typ == thrift.I32:
+			refType, err = p.ReadI32()
+			return err
+		case id == 4 && typ == thrift.I64:
+			spanID, err = p.ReadI64()
+			return err
+		}
+		return p.Skip(typ)
+	})
+	return refType, spanID, err
+}
+
+// readLog 读取Log，转换为事件，event字段为事件名
+func readLog(p thrift.TProtocol) (*otlp.Event, error) {
+	event := &otlp.Event{
+		Attributes: make(otlp.Attributes),
+	}
+	err := readStruct(p, func(id int16, typ thrift.TType) error {
+		switch {
+		case id == 1 && typ == thrift.I64:
+			ts, err := p.ReadI64()
+			event.Time = uint64(ts) * 1000
+			return err
+		case id == 2 && typ == thrift.LIST:
+			return readTags(p, event.Attributes)
+		}
+		return p.Skip(typ)
+	})
+	if err != nil {
+		return nil, err
+	}
+	event.Name = event.Attributes.First("event", "message")
+	if len(event.Name) == 0 {
+		event.Name = "log"
+	}
+	return event, nil
+}
+
+// readTags 读取list<Tag>并保存到attrs
+func readTags(p thrift.TProtocol, attrs otlp.Attributes) error {
+	return readList(p, func() error {
+		var key string
+		var tagType int32
+		var value interface{}
+		values := make(map[int16]interface{})
+		err := readStruct(p, func(id int16, typ thrift.TType) error {
+			var err error
+			var v interface{}
+			switch {
+			case id == 1 && typ == thrift.STRING:
+				key, err = p.ReadString()
+				return err
+			case id == 2 && typ == thrift.I32:
+				tagType, err = p.ReadI32()
+				return err
+			case id == 3 && typ == thrift.STRING:
+				v, err = p.ReadString()
+			case id == 4 && typ == thrift.DOUBLE:
+				v, err = p.ReadDouble()
+			case id == 5 && typ == thrift.BOOL:
+				v, err = p.ReadBool()
+			case id == 6 && typ == thrift.I64:
+				v, err = p.ReadI64()
+			case id == 7 && typ == thrift.STRING:
+				v, err = p.ReadBinary()
+			default:
+				return p.Skip(typ)
+			}
+			values[id] = v
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		switch tagType {
+		case tagString:
+			value = values[3]
+			break
+		case tagDouble:
+			value = values[4]
+			break
+		case tagBool:
+			value = values[5]
+			break
+		case tagLong:
+			value = values[6]
+			break
+		case tagBinary:
+			value = values[7]
+			break
+		}
+		if len(key) > 0 && value != nil {
+			attrs[key] = value
+		}
+		return nil
+	})
+}
+
+// readStruct 依次读取结构体的字段，由fn读取或者跳过字段的值
+func readStruct(p thrift.TProtocol, fn func(id int16, typ thrift.TType) error) error {
+	if _, err := p.ReadStructBegin(); err != nil {
+		return err
+	}
+	for {
+		_, typ, id, err := p.ReadFieldBegin()
+		if err != nil {
+			return err
+		}
+		if typ == thrift.STOP {
+			break
+		}
+		if err := fn(id, typ); err != nil {
+			return err
+		}
+		if err := p.ReadFieldEnd(); err != nil {
+			return err
+		}
+	}
+	return p.ReadStructEnd()
+}
+
+// readList 读取结构体列表，每个元素调用一次fn
+func readList(p thrift.TProtocol, fn func() error) error {
+	typ, size, err := p.ReadListBegin()
+	if err != nil {
+		return err
+	}
+	if typ != thrift.STRUCT {
+		return fmt.Errorf("unexpected list element type %d", typ)
+	}
+	for i := 0; i < size; i++ {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return p.ReadListEnd()
+}
+
+// int64ID jaeger的64位ID转换为8字节的spanID
+func int64ID(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
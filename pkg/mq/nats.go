@@ -2,6 +2,8 @@ package mq
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/nats-io/nats.go"
 	"go.uber.org/zap"
@@ -9,15 +11,18 @@ import (
 
 // Nats nats struct
 type Nats struct {
+	sync.Mutex
 	addrs  []string
 	conn   *nats.Conn
 	logger *zap.Logger
+	subs   map[string]*nats.Subscription // 普通订阅，key为topic
 }
 
 // NewNats return new nats
 func NewNats(logger *zap.Logger) *Nats {
 	return &Nats{
 		logger: logger,
+		subs:   make(map[string]*nats.Subscription),
 	}
 }
 
@@ -33,11 +38,30 @@ func (n *Nats) Start(addrs []string) error {
 
 // Close close nats
 func (n *Nats) Close() error {
-	err := n.Close()
-	if err != nil {
-		n.logger.Warn("nats close", zap.String("error", err.Error()))
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	return nil
+}
+
+// Drain 处理完已收到的消息并发送完缓存的消息后关闭，超时直接关闭
+func (n *Nats) Drain(timeout time.Duration) error {
+	if n.conn == nil {
+		return nil
+	}
+	if err := n.conn.Drain(); err != nil {
+		n.logger.Warn("nats drain", zap.String("error", err.Error()))
+		n.conn.Close()
 		return err
 	}
+	deadline := time.Now().Add(timeout)
+	for !n.conn.IsClosed() {
+		if time.Now().After(deadline) {
+			n.conn.Close()
+			return fmt.Errorf("nats drain timeout")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 	return nil
 }
 
@@ -74,16 +98,43 @@ func (n *Nats) start() error {
 // Subscribe ....
 func (n *Nats) Subscribe(topic string, handler func(msg *nats.Msg)) error {
 	// 普通订阅
-	_, err := n.conn.Subscribe(topic, handler)
+	sub, err := n.conn.Subscribe(topic, handler)
 	if err != nil {
 		n.logger.Warn("nats subscribe error", zap.String("error", err.Error()), zap.Strings("addrs", n.addrs))
 		n.conn.Close()
 		return err
 	}
+	n.Lock()
+	n.subs[topic] = sub
+	n.Unlock()
 	n.logger.Info("subscribe ok", zap.String("topic", topic))
 	return nil
 }
 
+// Unsubscribe 停止订阅，处理完已收到的消息后返回，超时直接取消订阅
+func (n *Nats) Unsubscribe(topic string, timeout time.Duration) error {
+	n.Lock()
+	sub, ok := n.subs[topic]
+	delete(n.subs, topic)
+	n.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := sub.Drain(); err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for sub.IsValid() {
+		if time.Now().After(deadline) {
+			sub.Unsubscribe()
+			return fmt.Errorf("nats unsubscribe timeout, topic is %s", topic)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
 // QueueSubscribe ....
 func (n *Nats) QueueSubscribe(topic, queue string, handler func(msg *nats.Msg)) error {
 	// 普通订阅
@@ -1,5 +1,7 @@
 package network
 
+import "fmt"
+
 // CMD ...
 type CMD struct {
 	Type    uint16 `msg:"t"`
@@ -20,3 +22,136 @@ type Ping struct {
 func NewPing() *Ping {
 	return &Ping{}
 }
+
+// Auth 链接认证，agent链接collector后第一个报文
+type Auth struct {
+	Token string `msg:"tk"`
+}
+
+// NewAuth ...
+func NewAuth() *Auth {
+	return &Auth{}
+}
+
+// AuthResult 认证结果
+type AuthResult struct {
+	Success bool   `msg:"s"`
+	Message string `msg:"m"`
+}
+
+// NewAuthResult ...
+func NewAuthResult() *AuthResult {
+	return &AuthResult{}
+}
+
+// Command web下发给pinpoint agent的指令，经collector、agent转发给jvm
+type Command struct {
+	ID          string   `msg:"id"` // 指令ID，用于查询结果
+	Type        uint16   `msg:"t"`  // 指令类型
+	AppName     string   `msg:"an"` // 服务名
+	AgentID     string   `msg:"ai"` // 服务agent ID
+	ThreadNames []string `msg:"tn"` // 指定线程名，活跃线程dump使用
+	Limit       int32    `msg:"l"`  // 返回数量限制，活跃线程dump使用
+	Time        int64    `msg:"ti"` // 下发时间
+}
+
+// NewCommand ...
+func NewCommand() *Command {
+	return &Command{}
+}
+
+// CommandResult 指令执行结果
+type CommandResult struct {
+	ID      string `msg:"id"` // 指令ID
+	Type    uint16 `msg:"t"`  // 指令类型
+	AppName string `msg:"an"` // 服务名
+	AgentID string `msg:"ai"` // 服务agent ID
+	Success bool   `msg:"s"`  // 是否执行成功
+	Message string `msg:"m"`  // 失败原因
+	Payload []byte `msg:"p"`  // jvm返回的thrift报文
+	Time    int64  `msg:"ti"` // 返回时间
+}
+
+// NewCommandResult ...
+func NewCommandResult() *CommandResult {
+	return &CommandResult{}
+}
+
+// 可协商的功能
+const (
+	FeatureCommand            = "command"              // pinpoint指令下发
+	FeatureActiveThreadStream = "active_thread_stream" // 活跃线程数实时stream
+	FeatureSampling           = "sampling"             // 未采样span只统计不保存
+	FeatureSystem             = "system"               // 主机监控数据
+	FeatureConfig             = "config"               // collector下发应用配置
+)
+
+// Hello 协议版本和能力协商，agent认证通过后发送，collector返回协商结果
+type Hello struct {
+	Version      byte     `msg:"v"`  // 支持的最高协议版本，应答中为协商结果
+	MinVersion   byte     `msg:"mv"` // 支持的最低协议版本
+	Compressions []string `msg:"cs"` // 支持的压缩算法，按优先级排序
+	Compression  string   `msg:"c"`  // 协商的压缩算法
+	Features     []string `msg:"f"`  // 支持的功能，应答中为双方都支持的功能
+	Error        string   `msg:"e"`  // 不兼容时的错误信息
+}
+
+// NewHello 本端支持的能力
+func NewHello() *Hello {
+	return &Hello{
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Compressions: CodecNames(),
+		Features:     []string{FeatureCommand, FeatureActiveThreadStream, FeatureSampling, FeatureSystem, FeatureConfig},
+	}
+}
+
+// Negotiate 根据本端和对端的能力计算协商结果，版本不兼容时返回错误
+func Negotiate(local, remote *Hello) (*Hello, error) {
+	result := &Hello{
+		Version:    local.Version,
+		MinVersion: local.MinVersion,
+	}
+	if remote.Version < result.Version {
+		result.Version = remote.Version
+	}
+	if remote.MinVersion > result.MinVersion {
+		result.MinVersion = remote.MinVersion
+	}
+	if result.Version < result.MinVersion {
+		return nil, fmt.Errorf("incompatible protocol version, local is %d-%d, remote is %d-%d",
+			local.MinVersion, local.Version, remote.MinVersion, remote.Version)
+	}
+
+	// 按对端的优先级选择压缩算法，对端为协商结果时直接使用
+	for _, compression := range remote.Compressions {
+		if contains(local.Compressions, compression) {
+			result.Compression = compression
+			break
+		}
+	}
+	if len(remote.Compressions) == 0 && contains(local.Compressions, remote.Compression) {
+		result.Compression = remote.Compression
+	}
+
+	for _, feature := range remote.Features {
+		if contains(local.Features, feature) {
+			result.Features = append(result.Features, feature)
+		}
+	}
+	return result, nil
+}
+
+// HasFeature 协商结果中是否包含该功能
+func (h *Hello) HasFeature(feature string) bool {
+	return contains(h.Features, feature)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	local := &Hello{Version: 1, MinVersion: 0}
+
+	result, err := Negotiate(local, &Hello{Version: 0, MinVersion: 0})
+	if err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+	if result.Version != 0 || result.MinVersion != 0 {
+		t.Fatalf("version = %d-%d, want 0-0", result.MinVersion, result.Version)
+	}
+
+	result, err = Negotiate(local, &Hello{Version: 2, MinVersion: 1})
+	if err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+	if result.Version != 1 || result.MinVersion != 1 {
+		t.Fatalf("version = %d-%d, want 1-1", result.MinVersion, result.Version)
+	}
+
+	if _, err := Negotiate(&Hello{Version: 1, MinVersion: 1}, &Hello{Version: 0, MinVersion: 0}); err == nil {
+		t.Fatalf("incompatible versions negotiated")
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	local := &Hello{
+		Version:      ProtocolVersion,
+		Compressions: []string{CompressZstd, CompressGzip, CompressSnappy},
+	}
+
+	tests := []struct {
+		name   string
+		remote *Hello
+		want   string
+	}{
+		// 按对端的优先级选择
+		{"remote priority", &Hello{Compressions: []string{CompressGzip, CompressZstd}}, CompressGzip},
+		{"skip unsupported", &Hello{Compressions: []string{"lz4", CompressSnappy}}, CompressSnappy},
+		{"no common", &Hello{Compressions: []string{"lz4"}}, ""},
+		// 对端为协商结果
+		{"negotiated result", &Hello{Compression: CompressZstd}, CompressZstd},
+		{"unsupported result", &Hello{Compression: "lz4"}, ""},
+		// 不支持压缩协商的对端
+		{"empty list", &Hello{}, ""},
+	}
+	for _, test := range tests {
+		result, err := Negotiate(local, test.remote)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if result.Compression != test.want {
+			t.Fatalf("%s: compression = %q, want %q", test.name, result.Compression, test.want)
+		}
+	}
+}
+
+func TestNegotiateFeatures(t *testing.T) {
+	local := &Hello{Features: []string{FeatureCommand, FeatureSampling, FeatureActiveThreadStream}}
+	remote := &Hello{Features: []string{FeatureActiveThreadStream, FeatureSystem, FeatureCommand}}
+
+	result, err := Negotiate(local, remote)
+	if err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+	if want := []string{FeatureActiveThreadStream, FeatureCommand}; !reflect.DeepEqual(result.Features, want) {
+		t.Fatalf("features = %v, want %v", result.Features, want)
+	}
+	if !result.HasFeature(FeatureCommand) || result.HasFeature(FeatureSystem) {
+		t.Fatalf("HasFeature mismatch, features = %v", result.Features)
+	}
+}
@@ -0,0 +1,282 @@
+package network
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩算法
+const (
+	CompressSnappy = "snappy"
+	CompressGzip   = "gzip"
+	CompressZstd   = "zstd"
+	// CompressZstdDict 使用字典的zstd，完整名字为zstd-dict-<字典ID>，双方字典ID一致时才能协商成功
+	CompressZstdDict = "zstd-dict"
+)
+
+// zstd字典头的magic，小端序
+const zstdDictMagic uint32 = 0xEC30A437
+
+// ErrBadDict 不是zstd字典格式
+var ErrBadDict = errors.New("bad zstd dictionary")
+
+// Codec payload压缩算法
+type Codec interface {
+	Name() string                      // 协商时使用的名字
+	ID() byte                          // 报文头IsCompress字段
+	Encode(src []byte) []byte          // 压缩
+	Decode(src []byte) ([]byte, error) // 解压，解压后的长度不能超过MaxFrameSize
+}
+
+var (
+	codecLock sync.RWMutex
+	codecs    = make(map[string]Codec) // 按名字注册，用于协商
+	encoders  = make(map[byte]Codec)   // 按ID查找压缩算法
+	decoders  = make(map[byte]Codec)   // 按ID查找解压算法
+	dictNames []string                 // 已加载的字典，按加载顺序
+)
+
+func init() {
+	zstdEnc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		panic(err)
+	}
+	zstdDec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxFrameSize))
+	if err != nil {
+		panic(err)
+	}
+
+	registerCodec(&snappyCodec{})
+	registerCodec(&gzipCodec{})
+	registerCodec(&zstdCodec{
+		name: CompressZstd,
+		id:   constant.TypeOfCompressZstd,
+		enc:  zstdEnc,
+		dec:  zstdDec,
+	})
+}
+
+func registerCodec(codec Codec) {
+	codecs[codec.Name()] = codec
+	encoders[codec.ID()] = codec
+	decoders[codec.ID()] = codec
+}
+
+// CodecByName 通过协商结果获取压缩算法
+func CodecByName(name string) (Codec, bool) {
+	codecLock.RLock()
+	codec, ok := codecs[name]
+	codecLock.RUnlock()
+	return codec, ok
+}
+
+// codecByID 通过报文头获取压缩算法
+func codecByID(id byte, decode bool) (Codec, bool) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	if decode {
+		codec, ok := decoders[id]
+		return codec, ok
+	}
+	codec, ok := encoders[id]
+	return codec, ok
+}
+
+// CodecNames 本端支持的压缩算法，压缩率高的在前
+func CodecNames() []string {
+	codecLock.RLock()
+	names := append([]string{}, dictNames...)
+	codecLock.RUnlock()
+	return append(names, CompressZstd, CompressGzip, CompressSnappy)
+}
+
+// LoadZstdDicts 加载zstd字典，第一个字典用于压缩，所有字典都可以用于解压
+// 字典使用 zstd --train 对采集的span payload训练生成
+func LoadZstdDicts(dicts ...[]byte) error {
+	if len(dicts) == 0 {
+		return nil
+	}
+
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxFrameSize), zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		return err
+	}
+
+	loaded := make([]*zstdCodec, 0, len(dicts))
+	for _, dict := range dicts {
+		id, err := zstdDictID(dict)
+		if err != nil {
+			return err
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderDict(dict))
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, &zstdCodec{
+			name: fmt.Sprintf("%s-%d", CompressZstdDict, id),
+			id:   constant.TypeOfCompressZstdDict,
+			enc:  enc,
+			dec:  dec,
+		})
+	}
+
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	for _, name := range dictNames {
+		delete(codecs, name)
+	}
+	dictNames = dictNames[:0]
+	for _, codec := range loaded {
+		codecs[codec.name] = codec
+		dictNames = append(dictNames, codec.name)
+	}
+	encoders[constant.TypeOfCompressZstdDict] = loaded[0]
+	decoders[constant.TypeOfCompressZstdDict] = loaded[0]
+	return nil
+}
+
+// LoadZstdDictFiles 从文件加载zstd字典
+func LoadZstdDictFiles(paths ...string) error {
+	dicts := make([][]byte, 0, len(paths))
+	for _, path := range paths {
+		dict, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		dicts = append(dicts, dict)
+	}
+	return LoadZstdDicts(dicts...)
+}
+
+// zstdDictID 解析字典头中的字典ID
+func zstdDictID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || binary.LittleEndian.Uint32(dict[:4]) != zstdDictMagic {
+		return 0, ErrBadDict
+	}
+	return binary.LittleEndian.Uint32(dict[4:8]), nil
+}
+
+// Transcode 将已经编码的报文转换为另一种压缩算法，不压缩或者算法相同时返回原报文
+func Transcode(frame []byte, codec Codec) ([]byte, error) {
+	offset := 0
+	if len(frame) >= headerLen && frame[0] == magic0 && frame[1] == magic1 {
+		offset = headerLen - legacyHeaderLen
+	}
+	if len(frame) < offset+legacyHeaderLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+	id := frame[offset+2]
+	if id == constant.TypeOfCompressNo || id == codec.ID() {
+		return frame, nil
+	}
+
+	packet := NewTracePack()
+	if err := packet.Decode(bytes.NewReader(frame)); err != nil {
+		return nil, err
+	}
+	return packet.EncodeWith(codec), nil
+}
+
+// snappyCodec snappy，旧版本默认的压缩算法
+type snappyCodec struct{}
+
+func (c *snappyCodec) Name() string {
+	return CompressSnappy
+}
+
+func (c *snappyCodec) ID() byte {
+	return constant.TypeOfCompressYes
+}
+
+func (c *snappyCodec) Encode(src []byte) []byte {
+	return snappy.Encode(nil, src)
+}
+
+func (c *snappyCodec) Decode(src []byte) ([]byte, error) {
+	decodedLen, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if decodedLen > MaxFrameSize {
+		return nil, fmt.Errorf("%v, decoded length is %d", ErrFrameTooLarge, decodedLen)
+	}
+	return snappy.Decode(nil, src)
+}
+
+// gzipCodec gzip，压缩率比snappy高，cpu开销较大
+type gzipCodec struct {
+	writers sync.Pool
+}
+
+func (c *gzipCodec) Name() string {
+	return CompressGzip
+}
+
+func (c *gzipCodec) ID() byte {
+	return constant.TypeOfCompressGzip
+}
+
+func (c *gzipCodec) Encode(src []byte) []byte {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if !ok {
+		w = gzip.NewWriter(&buf)
+	} else {
+		w.Reset(&buf)
+	}
+	// 写入内存不会失败
+	w.Write(src)
+	w.Close()
+	c.writers.Put(w)
+	return buf.Bytes()
+}
+
+func (c *gzipCodec) Decode(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	dst, err := ioutil.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(dst) > MaxFrameSize {
+		return nil, fmt.Errorf("%v, decoded length exceeds %d", ErrFrameTooLarge, MaxFrameSize)
+	}
+	return dst, nil
+}
+
+// zstdCodec zstd，可以使用字典提升小报文的压缩率
+type zstdCodec struct {
+	name string
+	id   byte
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+}
+
+func (c *zstdCodec) Name() string {
+	return c.name
+}
+
+func (c *zstdCodec) ID() byte {
+	return c.id
+}
+
+func (c *zstdCodec) Encode(src []byte) []byte {
+	return c.enc.EncodeAll(src, nil)
+}
+
+func (c *zstdCodec) Decode(src []byte) ([]byte, error) {
+	return c.dec.DecodeAll(src, nil)
+}
@@ -0,0 +1,44 @@
+package network
+
+import (
+	"testing"
+)
+
+func benchCodecs(b *testing.B) []Codec {
+	return []Codec{
+		mustCodec(b, CompressSnappy),
+		mustCodec(b, CompressGzip),
+		mustCodec(b, CompressZstd),
+		loadTestDict(b),
+	}
+}
+
+func BenchmarkCodecEncode(b *testing.B) {
+	payload := testPayload()
+	for _, codec := range benchCodecs(b) {
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				codec.Encode(payload)
+			}
+		})
+	}
+}
+
+func BenchmarkCodecDecode(b *testing.B) {
+	payload := testPayload()
+	for _, codec := range benchCodecs(b) {
+		encoded := codec.Encode(payload)
+		b.Run(codec.Name(), func(b *testing.B) {
+			// 按解压后的字节数计算吞吐
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Decode(encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
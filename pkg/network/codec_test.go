@@ -0,0 +1,162 @@
+package network
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/bsed/trace/pkg/constant"
+)
+
+// testdata/span.dict 由 zstd --train --maxdict=2048 对模拟的span json训练生成
+const testDictPath = "testdata/span.dict"
+
+func testPayload() []byte {
+	var buf bytes.Buffer
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&buf, `{"app":"order-service","api":"/api/order/create","agentId":"agent-%d","elapsed":%d}`, i%7, i*13)
+	}
+	return buf.Bytes()
+}
+
+func mustCodec(t testing.TB, name string) Codec {
+	codec, ok := CodecByName(name)
+	if !ok {
+		t.Fatalf("codec %s not registered", name)
+	}
+	return codec
+}
+
+func loadTestDict(t testing.TB) Codec {
+	if err := LoadZstdDictFiles(testDictPath); err != nil {
+		t.Fatalf("load dict: %v", err)
+	}
+	dict, err := ioutil.ReadFile(testDictPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := zstdDictID(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mustCodec(t, fmt.Sprintf("%s-%d", CompressZstdDict, id))
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := []Codec{
+		mustCodec(t, CompressSnappy),
+		mustCodec(t, CompressGzip),
+		mustCodec(t, CompressZstd),
+		loadTestDict(t),
+	}
+
+	payload := testPayload()
+	for _, codec := range codecs {
+		encoded := codec.Encode(payload)
+		if len(encoded) >= len(payload) {
+			t.Fatalf("%s: encoded %d bytes from %d", codec.Name(), len(encoded), len(payload))
+		}
+		decoded, err := codec.Decode(encoded)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", codec.Name(), err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Fatalf("%s: round trip mismatch", codec.Name())
+		}
+
+		// 通过报文头的IsCompress解压
+		packet := &TracePack{Version: ProtocolVersion, Type: constant.TypeOfPinpoint, Payload: payload}
+		got := NewTracePack()
+		if err := got.Decode(bytes.NewReader(packet.EncodeWith(codec))); err != nil {
+			t.Fatalf("%s: frame decode: %v", codec.Name(), err)
+		}
+		if got.IsCompress != codec.ID() || !bytes.Equal(got.Payload, payload) {
+			t.Fatalf("%s: frame round trip mismatch, compress = %d", codec.Name(), got.IsCompress)
+		}
+	}
+}
+
+func TestCodecRejectBomb(t *testing.T) {
+	bomb := make([]byte, MaxFrameSize+1)
+
+	var gzipBuf bytes.Buffer
+	w := gzip.NewWriter(&gzipBuf)
+	w.Write(bomb)
+	w.Close()
+
+	zstdEnc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		codec   string
+		encoded []byte
+	}{
+		{CompressSnappy, snappy.Encode(nil, bomb)},
+		{CompressGzip, gzipBuf.Bytes()},
+		{CompressZstd, zstdEnc.EncodeAll(bomb, nil)},
+	}
+	for _, test := range tests {
+		decoded, err := mustCodec(t, test.codec).Decode(test.encoded)
+		if err == nil {
+			t.Fatalf("%s: decoded %d bytes, want error", test.codec, len(decoded))
+		}
+	}
+
+	// 刚好MaxFrameSize可以解压
+	for _, test := range tests[:2] {
+		codec := mustCodec(t, test.codec)
+		if _, err := codec.Decode(codec.Encode(bomb[:MaxFrameSize])); err != nil {
+			t.Fatalf("%s: decode max frame: %v", test.codec, err)
+		}
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	snappyCodec := mustCodec(t, CompressSnappy)
+	gzipCodec := mustCodec(t, CompressGzip)
+	zstdCodec := mustCodec(t, CompressZstd)
+
+	payload := testPayload()
+	for _, version := range []byte{0, ProtocolVersion} {
+		packet := &TracePack{Version: version, Type: constant.TypeOfPinpoint, ID: 7, Payload: payload}
+		frame := packet.EncodeWith(snappyCodec)
+
+		// 算法相同时返回原报文
+		same, err := Transcode(frame, snappyCodec)
+		if err != nil || !bytes.Equal(same, frame) {
+			t.Fatalf("v%d: transcode to same codec changed the frame, err = %v", version, err)
+		}
+
+		for _, codec := range []Codec{gzipCodec, zstdCodec} {
+			transcoded, err := Transcode(frame, codec)
+			if err != nil {
+				t.Fatalf("v%d: transcode to %s: %v", version, codec.Name(), err)
+			}
+			got := NewTracePack()
+			if err := got.Decode(bytes.NewReader(transcoded)); err != nil {
+				t.Fatalf("v%d: decode %s: %v", version, codec.Name(), err)
+			}
+			if got.Version != version || got.ID != 7 || got.IsCompress != codec.ID() || !bytes.Equal(got.Payload, payload) {
+				t.Fatalf("v%d: transcode to %s mismatch, got version %d id %d compress %d", version, codec.Name(), got.Version, got.ID, got.IsCompress)
+			}
+		}
+	}
+
+	// 不压缩的报文不转换
+	plain := (&TracePack{Version: ProtocolVersion, Type: constant.TypeOfPinpoint, IsCompress: constant.TypeOfCompressNo, Payload: payload}).Encode()
+	if got, err := Transcode(plain, gzipCodec); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("transcode uncompressed frame changed it, err = %v", err)
+	}
+
+	if _, err := Transcode(plain[:5], gzipCodec); err == nil || !strings.Contains(err.Error(), "EOF") {
+		t.Fatalf("truncated frame err = %v", err)
+	}
+}
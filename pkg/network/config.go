@@ -0,0 +1,58 @@
+package network
+
+import "fmt"
+
+// AgentConfig collector下发给agent的应用配置，零值表示使用agent.yaml中的配置
+type AgentConfig struct {
+	AppName            string          `msg:"a" json:"app_name"`
+	Version            int64           `msg:"v" json:"version"`    // 配置版本，修改时间的毫秒时间戳，agent只应用更新的版本
+	LogLevel           string          `msg:"ll" json:"log_level"` // 日志级别，agent所有app共用，取所有app中最详细的级别
+	SpanReportInterval int             `msg:"ri" json:"span_report_interval"`
+	SpanQueueLen       int             `msg:"ql" json:"span_queue_len"`
+	Sampling           *SamplingConfig `msg:"s" json:"sampling"`
+}
+
+// SamplingConfig 链路采样配置
+type SamplingConfig struct {
+	Enable        bool    `msg:"e" json:"enable"`
+	Rate          float64 `msg:"r" json:"rate"`
+	SlowThreshold int32   `msg:"st" json:"slow_threshold"`
+}
+
+// NewAgentConfig ...
+func NewAgentConfig() *AgentConfig {
+	return &AgentConfig{}
+}
+
+// Validate 检查配置是否合法
+func (c *AgentConfig) Validate() error {
+	if len(c.AppName) == 0 {
+		return fmt.Errorf("app name is empty")
+	}
+	if c.SpanReportInterval < 0 || c.SpanQueueLen < 0 {
+		return fmt.Errorf("invalid span report interval %d or queue len %d", c.SpanReportInterval, c.SpanQueueLen)
+	}
+	if c.Sampling != nil && (c.Sampling.Rate < 0 || c.Sampling.Rate > 1) {
+		return fmt.Errorf("invalid sampling rate %v", c.Sampling.Rate)
+	}
+	switch c.LogLevel {
+	case "", "debug", "info", "warn", "error":
+		break
+	default:
+		return fmt.Errorf("invalid log level %s", c.LogLevel)
+	}
+	return nil
+}
+
+// ConfigAck agent应用配置的结果
+type ConfigAck struct {
+	AppName string `msg:"a"`
+	Version int64  `msg:"v"`
+	Success bool   `msg:"s"`
+	Message string `msg:"m"`
+}
+
+// NewConfigAck ...
+func NewConfigAck() *ConfigAck {
+	return &ConfigAck{}
+}
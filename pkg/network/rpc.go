@@ -0,0 +1,217 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bsed/trace/pkg/constant"
+)
+
+var (
+	// ErrRPCClosed 等待应答时RPC被关闭
+	ErrRPCClosed = errors.New("rpc closed")
+	// ErrNoHandler 对端没有注册该类型请求的处理函数
+	ErrNoHandler = errors.New("no handler")
+	// ErrBusy 对端正在处理的请求达到上限
+	ErrBusy = errors.New("too many requests")
+)
+
+// RemoteError 对端处理请求失败时返回的错误
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
+// 同时处理的对端请求数上限，超过时直接应答ErrBusy
+const maxServing = 64
+
+// Handler 处理对端的请求，返回应答的payload
+type Handler func(packet *TracePack) ([]byte, error)
+
+// RPC 基于TracePack的请求应答，agent和collector共用
+// 请求IsSync为TypeOfSyncYes，应答使用相同ID，IsSync为TypeOfSyncResponse或TypeOfSyncError
+// 旧版本对端只会原样返回请求，应答的IsSync仍为TypeOfSyncYes
+type RPC struct {
+	sync.Mutex
+	id       uint32                     // 请求ID
+	calls    map[uint32]chan *TracePack // 等待应答的请求
+	handlers map[byte]Handler           // 按TracePack.Type注册的请求处理函数
+	serving  chan struct{}              // 正在处理的请求，容量为maxServing
+	closed   bool
+	timeouts uint64 // 超时次数
+	lates    uint64 // 超时后才收到的应答数
+	rejects  uint64 // 超过maxServing被拒绝的请求数
+}
+
+// NewRPC ...
+func NewRPC() *RPC {
+	return &RPC{
+		calls:    make(map[uint32]chan *TracePack),
+		handlers: make(map[byte]Handler),
+		serving:  make(chan struct{}, maxServing),
+	}
+}
+
+// Handle 注册请求处理函数
+func (r *RPC) Handle(packetType byte, handler Handler) {
+	r.Lock()
+	r.handlers[packetType] = handler
+	r.Unlock()
+}
+
+// Call 发送请求并等待应答，超时和取消由ctx控制
+// 应答通道在发送前创建，不会错过很快返回的应答
+func (r *RPC) Call(ctx context.Context, packet *TracePack, send func(*TracePack) error) (*TracePack, error) {
+	respC := make(chan *TracePack, 1)
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return nil, ErrRPCClosed
+	}
+	r.id++
+	id := r.id
+	r.calls[id] = respC
+	r.Unlock()
+
+	defer r.remove(id)
+
+	packet.ID = id
+	packet.IsSync = constant.TypeOfSyncYes
+	if err := send(packet); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-respC:
+		if !ok {
+			return nil, ErrRPCClosed
+		}
+		if resp.IsSync == constant.TypeOfSyncError {
+			return nil, &RemoteError{Message: string(resp.Payload)}
+		}
+		return resp, nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&r.timeouts, 1)
+		}
+		return nil, fmt.Errorf("rpc call %d, %v", id, ctx.Err())
+	}
+}
+
+// Deliver 将应答交给等待的请求，请求已经超时或者取消时返回false
+func (r *RPC) Deliver(packet *TracePack) bool {
+	r.Lock()
+	respC, ok := r.calls[packet.ID]
+	if ok {
+		delete(r.calls, packet.ID)
+	}
+	r.Unlock()
+	if !ok {
+		atomic.AddUint64(&r.lates, 1)
+		return false
+	}
+	// 通道有缓冲且只会写入一次，不会阻塞
+	respC <- packet
+	return true
+}
+
+// Serve 异步处理对端的请求，通过reply返回应答，version为对端的协议版本
+// 正在处理的请求达到maxServing时直接应答ErrBusy，不阻塞读取协程
+func (r *RPC) Serve(packet *TracePack, version byte, reply func(*TracePack) error) {
+	r.Lock()
+	handler, ok := r.handlers[packet.Type]
+	r.Unlock()
+
+	select {
+	case r.serving <- struct{}{}:
+	default:
+		atomic.AddUint64(&r.rejects, 1)
+		go reply(NewResponse(packet, nil, ErrBusy, version))
+		return
+	}
+	go func() {
+		defer func() {
+			<-r.serving
+		}()
+		var payload []byte
+		err := ErrNoHandler
+		if ok {
+			payload, err = handler(packet)
+		}
+		reply(NewResponse(packet, payload, err, version))
+	}()
+}
+
+// Close 关闭后新的请求直接失败，等待中的请求立即返回
+func (r *RPC) Close() {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	for id, respC := range r.calls {
+		delete(r.calls, id)
+		close(respC)
+	}
+}
+
+// Pending 等待应答的请求数
+func (r *RPC) Pending() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.calls)
+}
+
+// Timeouts 超时的请求数
+func (r *RPC) Timeouts() uint64 {
+	return atomic.LoadUint64(&r.timeouts)
+}
+
+// Lates 超时后才收到的应答数
+func (r *RPC) Lates() uint64 {
+	return atomic.LoadUint64(&r.lates)
+}
+
+// Rejects 超过处理上限被拒绝的请求数
+func (r *RPC) Rejects() uint64 {
+	return atomic.LoadUint64(&r.rejects)
+}
+
+func (r *RPC) remove(id uint32) {
+	r.Lock()
+	delete(r.calls, id)
+	r.Unlock()
+}
+
+// NewResponse 根据请求生成应答，err不为空时返回错误信息，旧版本对端使用原样返回的格式
+func NewResponse(req *TracePack, payload []byte, err error, version byte) *TracePack {
+	resp := &TracePack{
+		Version:    version,
+		Type:       req.Type,
+		IsSync:     constant.TypeOfSyncResponse,
+		IsCompress: constant.TypeOfCompressNo,
+		ID:         req.ID,
+		Payload:    payload,
+	}
+	if err != nil {
+		resp.IsSync = constant.TypeOfSyncError
+		resp.Payload = []byte(err.Error())
+	}
+	if version == 0 {
+		resp.IsSync = constant.TypeOfSyncYes
+		resp.Payload = req.Payload
+	}
+	return resp
+}
+
+// IsResponse 是否为新版本的应答报文
+func IsResponse(packet *TracePack) bool {
+	return packet.IsSync == constant.TypeOfSyncResponse || packet.IsSync == constant.TypeOfSyncError
+}
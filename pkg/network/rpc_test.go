@@ -0,0 +1,217 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bsed/trace/pkg/constant"
+)
+
+func newRequest(payload string) *TracePack {
+	return &TracePack{
+		Version:    ProtocolVersion,
+		Type:       constant.TypeOfPinpoint,
+		IsCompress: constant.TypeOfCompressNo,
+		Payload:    []byte(payload),
+	}
+}
+
+// waitPending 等待Call进入等待应答状态
+func waitPending(t *testing.T, r *RPC, n int) {
+	deadline := time.Now().Add(time.Second)
+	for r.Pending() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("pending = %d, want %d", r.Pending(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRPCReplyBeforeWait(t *testing.T) {
+	r := NewRPC()
+	// 对端在send返回之前就已经应答
+	resp, err := r.Call(context.Background(), newRequest("ping"), func(req *TracePack) error {
+		if !r.Deliver(NewResponse(req, []byte("pong"), nil, ProtocolVersion)) {
+			t.Fatalf("deliver before wait failed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	if string(resp.Payload) != "pong" || resp.IsSync != constant.TypeOfSyncResponse {
+		t.Fatalf("resp = %+v", resp)
+	}
+	if r.Pending() != 0 || r.Lates() != 0 {
+		t.Fatalf("pending = %d, lates = %d", r.Pending(), r.Lates())
+	}
+}
+
+func TestRPCTimeoutAndLateDelivery(t *testing.T) {
+	r := NewRPC()
+	var sent *TracePack
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := r.Call(ctx, newRequest("ping"), func(req *TracePack) error {
+		sent = req
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("call without reply succeeded")
+	}
+	if r.Timeouts() != 1 || r.Pending() != 0 {
+		t.Fatalf("timeouts = %d, pending = %d", r.Timeouts(), r.Pending())
+	}
+
+	// 超时后才收到的应答被丢弃
+	if r.Deliver(NewResponse(sent, []byte("pong"), nil, ProtocolVersion)) {
+		t.Fatalf("late response delivered")
+	}
+	if r.Lates() != 1 {
+		t.Fatalf("lates = %d, want 1", r.Lates())
+	}
+
+	// 发送失败直接返回
+	sendErr := errors.New("no healthy server")
+	if _, err := r.Call(context.Background(), newRequest("ping"), func(*TracePack) error { return sendErr }); err != sendErr {
+		t.Fatalf("send error = %v, want %v", err, sendErr)
+	}
+	if r.Pending() != 0 {
+		t.Fatalf("pending = %d after send error", r.Pending())
+	}
+}
+
+func TestRPCCloseReleasesPending(t *testing.T) {
+	r := NewRPC()
+	errC := make(chan error, 1)
+	go func() {
+		_, err := r.Call(context.Background(), newRequest("ping"), func(*TracePack) error { return nil })
+		errC <- err
+	}()
+	waitPending(t, r, 1)
+
+	r.Close()
+	select {
+	case err := <-errC:
+		if err != ErrRPCClosed {
+			t.Fatalf("err = %v, want %v", err, ErrRPCClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("pending call not released by Close")
+	}
+
+	if _, err := r.Call(context.Background(), newRequest("ping"), func(*TracePack) error { return nil }); err != ErrRPCClosed {
+		t.Fatalf("call after close err = %v, want %v", err, ErrRPCClosed)
+	}
+	r.Close()
+}
+
+func TestRPCRemoteError(t *testing.T) {
+	r := NewRPC()
+	_, err := r.Call(context.Background(), newRequest("ping"), func(req *TracePack) error {
+		r.Deliver(NewResponse(req, nil, errors.New("bad config"), ProtocolVersion))
+		return nil
+	})
+	remote, ok := err.(*RemoteError)
+	if !ok || remote.Message != "bad config" {
+		t.Fatalf("err = %v, want remote error", err)
+	}
+}
+
+func TestNewResponseEcho(t *testing.T) {
+	req := newRequest("request")
+	req.ID = 9
+	req.IsSync = constant.TypeOfSyncYes
+
+	// 旧版本对端只识别原样返回的请求，错误信息也不返回
+	for _, err := range []error{nil, errors.New("failed")} {
+		resp := NewResponse(req, []byte("result"), err, 0)
+		if resp.Version != 0 || resp.ID != 9 || resp.IsSync != constant.TypeOfSyncYes || string(resp.Payload) != "request" {
+			t.Fatalf("v0 response = %+v", resp)
+		}
+		if IsResponse(resp) {
+			t.Fatalf("v0 response recognized as new response")
+		}
+	}
+
+	resp := NewResponse(req, []byte("result"), nil, ProtocolVersion)
+	if resp.IsSync != constant.TypeOfSyncResponse || string(resp.Payload) != "result" || !IsResponse(resp) {
+		t.Fatalf("v1 response = %+v", resp)
+	}
+	resp = NewResponse(req, []byte("result"), errors.New("failed"), ProtocolVersion)
+	if resp.IsSync != constant.TypeOfSyncError || string(resp.Payload) != "failed" || !IsResponse(resp) {
+		t.Fatalf("v1 error response = %+v", resp)
+	}
+}
+
+func TestRPCServe(t *testing.T) {
+	r := NewRPC()
+	releaseC := make(chan bool)
+	var running, peak int32
+	r.Handle(constant.TypeOfPinpoint, func(packet *TracePack) ([]byte, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		<-releaseC
+		atomic.AddInt32(&running, -1)
+		return packet.Payload, nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(maxServing)
+	reply := func(*TracePack) error {
+		wg.Done()
+		return nil
+	}
+	for i := 0; i < maxServing; i++ {
+		r.Serve(newRequest("ping"), ProtocolVersion, reply)
+	}
+
+	// 超过maxServing的请求直接拒绝，不阻塞读取协程
+	busyC := make(chan *TracePack, 1)
+	served := make(chan bool)
+	go func() {
+		r.Serve(newRequest("ping"), ProtocolVersion, func(resp *TracePack) error {
+			busyC <- resp
+			return nil
+		})
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("serve blocked at maxServing")
+	}
+	if resp := <-busyC; resp.IsSync != constant.TypeOfSyncError || string(resp.Payload) != ErrBusy.Error() {
+		t.Fatalf("busy response = %+v", resp)
+	}
+	if r.Rejects() != 1 {
+		t.Fatalf("rejects = %d, want 1", r.Rejects())
+	}
+
+	close(releaseC)
+	wg.Wait()
+	if p := atomic.LoadInt32(&peak); p > maxServing {
+		t.Fatalf("peak = %d, want <= %d", p, maxServing)
+	}
+
+	// 没有处理函数时返回错误
+	respC := make(chan *TracePack, 1)
+	req := newRequest("ping")
+	req.Type = constant.TypeOfSystem
+	r.Serve(req, ProtocolVersion, func(resp *TracePack) error {
+		respC <- resp
+		return nil
+	})
+	if resp := <-respC; resp.IsSync != constant.TypeOfSyncError || string(resp.Payload) != ErrNoHandler.Error() {
+		t.Fatalf("no handler response = %+v", resp)
+	}
+}
@@ -24,6 +24,7 @@ func NewSpans() *Spans {
 // type DataType : SpanV2 SpanChunk AgentStat AgentStatBatch
 // Spans data
 type Spans struct {
-	Type  uint16 `msg:"type"`
-	Spans []byte `msg:"spans"`
+	Type      uint16 `msg:"type"`
+	Spans     []byte `msg:"spans"`
+	Unsampled bool   `msg:"unsampled"` // 未被采样，collector只统计不保存链路
 }
@@ -0,0 +1,16 @@
+package network
+
+// SystemPacket 主机监控数据
+type SystemPacket struct {
+	Type     uint16 `msg:"type"`
+	AppName  string `msg:"appName"`
+	AgentID  string `msg:"agentID"`
+	HostName string `msg:"hostName"`
+	Time     int64  `msg:"time"` // 采集时间，单位秒
+	Payload  []byte `msg:"payload"`
+}
+
+// NewSystemPacket ...
+func NewSystemPacket() *SystemPacket {
+	return &SystemPacket{}
+}
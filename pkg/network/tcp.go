@@ -2,16 +2,39 @@ package network
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 
-	"github.com/golang/snappy"
 	"github.com/imdevlab/g"
 	"github.com/bsed/trace/pkg/constant"
 	"go.uber.org/zap"
 )
 
+// 协议版本
+const (
+	ProtocolVersion    byte = 1 // 当前协议版本
+	MinProtocolVersion byte = 0 // 兼容的最低版本，0为没有magic和版本号的旧格式
+)
+
+const (
+	legacyHeaderLen      = 11       // 旧格式报文头长度
+	headerLen            = 14       // magic(2) + version(1) + 旧格式报文头
+	MaxFrameSize         = 16 << 20 // 单个报文最大长度，解压后同样限制
+	magic0          byte = 0x54     // 'T'
+	magic1          byte = 0x50     // 'P'
+)
+
+var (
+	// ErrBadMagic 报文头既不是新格式的magic，也不是旧格式的报文类型
+	ErrBadMagic = errors.New("bad frame magic")
+	// ErrFrameTooLarge 报文长度超过MaxFrameSize
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
 // TracePack trace通信标准包
 type TracePack struct {
+	Version    byte   `msgp:"v"`  // 协议版本，0为旧格式
 	Type       byte   `msgp:"t"`  // 类型
 	IsSync     byte   `msgp:"is"` // 是否同步
 	IsCompress byte   `msgp:"cp"` // 是否压缩
@@ -25,46 +48,97 @@ func NewTracePack() *TracePack {
 	return &TracePack{}
 }
 
-// Encode encode
+// Encode encode，Version为0时使用旧格式
 func (t *TracePack) Encode() []byte {
-	// 压缩
-	if t.IsCompress == constant.TypeOfCompressYes {
-		if len(t.Payload) > 0 {
-			compressBuf := snappy.Encode(nil, t.Payload)
-			t.Payload = compressBuf
+	if t.IsCompress != 0 && t.IsCompress != constant.TypeOfCompressNo {
+		codec, ok := codecByID(t.IsCompress, false)
+		if !ok {
+			// 本端不支持的压缩算法使用snappy
+			codec, _ = codecByID(constant.TypeOfCompressYes, false)
 		}
+		return t.EncodeWith(codec)
+	}
+	return t.encode()
+}
+
+// EncodeWith 使用指定的压缩算法encode
+func (t *TracePack) EncodeWith(codec Codec) []byte {
+	t.IsCompress = codec.ID()
+	if len(t.Payload) > 0 {
+		t.Payload = codec.Encode(t.Payload)
 	}
+	return t.encode()
+}
 
+func (t *TracePack) encode() []byte {
 	t.Len = uint32(len(t.Payload))
-	buf := make([]byte, t.Len+11)
 
-	buf[0] = t.Type
-	buf[1] = t.IsSync
-	buf[2] = t.IsCompress
-	binary.BigEndian.PutUint32(buf[3:7], t.ID)
-	binary.BigEndian.PutUint32(buf[7:11], t.Len)
+	offset := 0
+	if t.Version > 0 {
+		offset = headerLen - legacyHeaderLen
+	}
+	buf := make([]byte, uint32(offset+legacyHeaderLen)+t.Len)
+	if t.Version > 0 {
+		buf[0] = magic0
+		buf[1] = magic1
+		buf[2] = t.Version
+	}
+
+	header := buf[offset:]
+	header[0] = t.Type
+	header[1] = t.IsSync
+	header[2] = t.IsCompress
+	binary.BigEndian.PutUint32(header[3:7], t.ID)
+	binary.BigEndian.PutUint32(header[7:11], t.Len)
 
 	if t.Len > 0 {
-		copy(buf[11:], t.Payload)
+		copy(header[legacyHeaderLen:], t.Payload)
 	}
 	return buf
 
 }
 
-// Decode decode
+// Decode decode，同时兼容旧格式
 func (t *TracePack) Decode(rdr io.Reader) error {
-	buf := make([]byte, 11)
-	if _, err := io.ReadFull(rdr, buf); err != nil {
+	buf := make([]byte, headerLen)
+	if _, err := io.ReadFull(rdr, buf[:3]); err != nil {
 		g.L.Warn("Decode:io.ReadFull", zap.String("err", err.Error()))
 		return err
 	}
 
-	t.Type = buf[0]
-	t.IsSync = buf[1]
-	t.IsCompress = buf[2]
-	t.ID = binary.BigEndian.Uint32(buf[3:7])
+	var header []byte
+	if buf[0] == magic0 && buf[1] == magic1 {
+		t.Version = buf[2]
+		if t.Version > ProtocolVersion {
+			return fmt.Errorf("unsupported protocol version %d, max supported is %d", t.Version, ProtocolVersion)
+		}
+		if _, err := io.ReadFull(rdr, buf[3:]); err != nil {
+			g.L.Warn("Decode:io.ReadFull", zap.String("err", err.Error()))
+			return err
+		}
+		header = buf[3:]
+	} else {
+		// 旧格式第一个字节为报文类型
+		if buf[0] < constant.TypeOfSkywalking || buf[0] > constant.TypeOfSystem {
+			return ErrBadMagic
+		}
+		t.Version = 0
+		if _, err := io.ReadFull(rdr, buf[3:legacyHeaderLen]); err != nil {
+			g.L.Warn("Decode:io.ReadFull", zap.String("err", err.Error()))
+			return err
+		}
+		header = buf[:legacyHeaderLen]
+	}
+
+	t.Type = header[0]
+	t.IsSync = header[1]
+	t.IsCompress = header[2]
+	t.ID = binary.BigEndian.Uint32(header[3:7])
 
-	length := binary.BigEndian.Uint32(buf[7:11])
+	length := binary.BigEndian.Uint32(header[7:11])
+	if length > MaxFrameSize {
+		return fmt.Errorf("%v, length is %d", ErrFrameTooLarge, length)
+	}
 	payload := make([]byte, length)
 	if length > 0 {
 		_, err := io.ReadFull(rdr, payload)
@@ -73,12 +147,14 @@ func (t *TracePack) Decode(rdr io.Reader) error {
 			return err
 		}
 		// 解压
-		if t.IsCompress == constant.TypeOfCompressYes {
-			t.Payload, err = snappy.Decode(nil, payload)
+		if codec, ok := codecByID(t.IsCompress, true); ok {
+			t.Payload, err = codec.Decode(payload)
 			if err != nil {
-				g.L.Warn("Decode:snappy.Decode", zap.String("error", err.Error()))
+				g.L.Warn("Decode:codec.Decode", zap.String("codec", codec.Name()), zap.String("error", err.Error()))
 				return err
 			}
+		} else if t.IsCompress > constant.TypeOfCompressNo {
+			return fmt.Errorf("unsupported compression %d", t.IsCompress)
 		} else {
 			t.Payload = payload
 		}
@@ -86,3 +162,11 @@ func (t *TracePack) Decode(rdr io.Reader) error {
 	}
 	return nil
 }
+
+// LegacyFrame 将Encode后的新格式报文转换为旧格式，发送给不支持版本协商的对端
+func LegacyFrame(frame []byte) []byte {
+	if len(frame) >= headerLen && frame[0] == magic0 && frame[1] == magic1 {
+		return frame[headerLen-legacyHeaderLen:]
+	}
+	return frame
+}
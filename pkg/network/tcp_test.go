@@ -0,0 +1,115 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/imdevlab/g"
+	"go.uber.org/zap"
+
+	"github.com/bsed/trace/pkg/constant"
+)
+
+func init() {
+	g.L = zap.NewNop()
+}
+
+func newTestPack(version byte) *TracePack {
+	return &TracePack{
+		Version:    version,
+		Type:       constant.TypeOfPinpoint,
+		IsSync:     constant.TypeOfSyncYes,
+		IsCompress: constant.TypeOfCompressNo,
+		ID:         42,
+		Payload:    []byte("hello trace"),
+	}
+}
+
+func decodeFrame(t *testing.T, frame []byte) *TracePack {
+	packet := NewTracePack()
+	if err := packet.Decode(bytes.NewReader(frame)); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return packet
+}
+
+func checkPack(t *testing.T, got *TracePack, version byte, payload string) {
+	if got.Version != version {
+		t.Fatalf("version = %d, want %d", got.Version, version)
+	}
+	if got.Type != constant.TypeOfPinpoint || got.IsSync != constant.TypeOfSyncYes || got.ID != 42 {
+		t.Fatalf("header = %+v", got)
+	}
+	if string(got.Payload) != payload || got.Len != uint32(len(payload)) {
+		t.Fatalf("payload = %q, len = %d, want %q", got.Payload, got.Len, payload)
+	}
+}
+
+func TestTracePackRoundTrip(t *testing.T) {
+	frame := newTestPack(ProtocolVersion).Encode()
+	if frame[0] != magic0 || frame[1] != magic1 || frame[2] != ProtocolVersion {
+		t.Fatalf("frame header = %v", frame[:3])
+	}
+	checkPack(t, decodeFrame(t, frame), ProtocolVersion, "hello trace")
+
+	// 压缩后解压
+	packet := newTestPack(ProtocolVersion)
+	packet.IsCompress = constant.TypeOfCompressYes
+	got := decodeFrame(t, packet.Encode())
+	if got.IsCompress != constant.TypeOfCompressYes {
+		t.Fatalf("compress = %d", got.IsCompress)
+	}
+	checkPack(t, got, ProtocolVersion, "hello trace")
+}
+
+func TestTracePackLegacyDecode(t *testing.T) {
+	frame := newTestPack(0).Encode()
+	if frame[0] != constant.TypeOfPinpoint || len(frame) != legacyHeaderLen+len("hello trace") {
+		t.Fatalf("legacy frame = %v", frame)
+	}
+	checkPack(t, decodeFrame(t, frame), 0, "hello trace")
+
+	// 新格式转换为旧格式
+	legacy := LegacyFrame(newTestPack(ProtocolVersion).Encode())
+	if !bytes.Equal(legacy, frame) {
+		t.Fatalf("LegacyFrame = %v, want %v", legacy, frame)
+	}
+	if got := LegacyFrame(frame); !bytes.Equal(got, frame) {
+		t.Fatalf("LegacyFrame changed a legacy frame")
+	}
+}
+
+func TestTracePackRejectBadHeader(t *testing.T) {
+	frame := newTestPack(ProtocolVersion).Encode()
+	frame[0] = 0xff
+	if err := NewTracePack().Decode(bytes.NewReader(frame)); err != ErrBadMagic {
+		t.Fatalf("bad magic err = %v, want %v", err, ErrBadMagic)
+	}
+
+	frame = newTestPack(ProtocolVersion).Encode()
+	frame[2] = ProtocolVersion + 1
+	err := NewTracePack().Decode(bytes.NewReader(frame))
+	if err == nil || !strings.Contains(err.Error(), "unsupported protocol version") {
+		t.Fatalf("too new version err = %v", err)
+	}
+}
+
+func TestTracePackRejectTooLarge(t *testing.T) {
+	frame := newTestPack(ProtocolVersion).Encode()[:headerLen]
+	binary.BigEndian.PutUint32(frame[headerLen-4:], MaxFrameSize+1)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err := NewTracePack().Decode(bytes.NewReader(frame))
+	runtime.ReadMemStats(&after)
+
+	if err == nil || !strings.HasPrefix(err.Error(), ErrFrameTooLarge.Error()) {
+		t.Fatalf("err = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > MaxFrameSize/2 {
+		t.Fatalf("allocated %d bytes for a rejected frame", allocated)
+	}
+}
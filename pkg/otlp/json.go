@@ -0,0 +1,273 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OTLP/JSON格式，字段名为lowerCamelCase，traceId、spanId为hex，64位整数可能为字符串
+
+type jsonRequest struct {
+	ResourceSpans []*jsonResourceSpans `json:"resourceSpans"`
+}
+
+type jsonResourceSpans struct {
+	Resource struct {
+		Attributes []*jsonKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []*jsonScopeSpans `json:"scopeSpans"`
+	// 旧版本字段名
+	InstrumentationLibrarySpans []*jsonScopeSpans `json:"instrumentationLibrarySpans"`
+}
+
+type jsonScopeSpans struct {
+	Spans []*jsonSpan `json:"spans"`
+}
+
+type jsonSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId"`
+	Name              string          `json:"name"`
+	Kind              jsonEnum        `json:"kind"`
+	StartTimeUnixNano jsonUint        `json:"startTimeUnixNano"`
+	EndTimeUnixNano   jsonUint        `json:"endTimeUnixNano"`
+	Attributes        []*jsonKeyValue `json:"attributes"`
+	Events            []*jsonEvent    `json:"events"`
+	Status            struct {
+		Code    jsonEnum `json:"code"`
+		Message string   `json:"message"`
+	} `json:"status"`
+}
+
+type jsonEvent struct {
+	TimeUnixNano jsonUint        `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []*jsonKeyValue `json:"attributes"`
+}
+
+type jsonKeyValue struct {
+	Key   string        `json:"key"`
+	Value *jsonAnyValue `json:"value"`
+}
+
+type jsonAnyValue struct {
+	StringValue *string   `json:"stringValue"`
+	BoolValue   *bool     `json:"boolValue"`
+	IntValue    *jsonUint `json:"intValue"`
+	DoubleValue *float64  `json:"doubleValue"`
+	BytesValue  *string   `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []*jsonAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []*jsonKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+// jsonUint 64位整数，兼容数字和字符串两种格式
+type jsonUint uint64
+
+func (u *jsonUint) UnmarshalJSON(data []byte) error {
+	s := string(bytes.Trim(data, `"`))
+	if len(s) == 0 || s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, "-") {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		*u = jsonUint(n)
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*u = jsonUint(n)
+	return nil
+}
+
+// jsonEnum 枚举值，兼容数字和枚举名两种格式
+type jsonEnum int32
+
+var enumNames = map[string]int32{
+	"SPAN_KIND_UNSPECIFIED": int32(SpanKindUnspecified),
+	"SPAN_KIND_INTERNAL":    int32(SpanKindInternal),
+	"SPAN_KIND_SERVER":      int32(SpanKindServer),
+	"SPAN_KIND_CLIENT":      int32(SpanKindClient),
+	"SPAN_KIND_PRODUCER":    int32(SpanKindProducer),
+	"SPAN_KIND_CONSUMER":    int32(SpanKindConsumer),
+	"STATUS_CODE_UNSET":     StatusCodeUnset,
+	"STATUS_CODE_OK":        StatusCodeOk,
+	"STATUS_CODE_ERROR":     StatusCodeError,
+}
+
+func (e *jsonEnum) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return err
+		}
+		v, ok := enumNames[name]
+		if !ok {
+			return fmt.Errorf("otlp: unknow enum %s", name)
+		}
+		*e = jsonEnum(v)
+		return nil
+	}
+	var v int32
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*e = jsonEnum(v)
+	return nil
+}
+
+// ParseJSON 解析OTLP/JSON格式的ExportTraceServiceRequest
+func ParseJSON(data []byte) (*ExportRequest, error) {
+	jreq := &jsonRequest{}
+	if err := json.Unmarshal(data, jreq); err != nil {
+		return nil, err
+	}
+
+	req := &ExportRequest{}
+	for _, jrs := range jreq.ResourceSpans {
+		if jrs == nil {
+			continue
+		}
+		rs := &ResourceSpans{
+			Resource: make(Attributes),
+		}
+		if err := jsonAttributes(jrs.Resource.Attributes, rs.Resource); err != nil {
+			return nil, err
+		}
+		for _, scope := range append(jrs.ScopeSpans, jrs.InstrumentationLibrarySpans...) {
+			if scope == nil {
+				continue
+			}
+			for _, jspan := range scope.Spans {
+				if jspan == nil {
+					continue
+				}
+				span, err := jspan.span()
+				if err != nil {
+					return nil, err
+				}
+				rs.Spans = append(rs.Spans, span)
+			}
+		}
+		req.ResourceSpans = append(req.ResourceSpans, rs)
+	}
+	return req, nil
+}
+
+func (j *jsonSpan) span() (*Span, error) {
+	span := &Span{
+		Name:       j.Name,
+		Kind:       SpanKind(j.Kind),
+		StartTime:  uint64(j.StartTimeUnixNano),
+		EndTime:    uint64(j.EndTimeUnixNano),
+		Attributes: make(Attributes),
+		Status: Status{
+			Code:    int32(j.Status.Code),
+			Message: j.Status.Message,
+		},
+	}
+	var err error
+	if span.TraceID, err = hexID(j.TraceID); err != nil {
+		return nil, err
+	}
+	if span.SpanID, err = hexID(j.SpanID); err != nil {
+		return nil, err
+	}
+	if span.ParentSpanID, err = hexID(j.ParentSpanID); err != nil {
+		return nil, err
+	}
+	if err := jsonAttributes(j.Attributes, span.Attributes); err != nil {
+		return nil, err
+	}
+	for _, jevent := range j.Events {
+		if jevent == nil {
+			continue
+		}
+		event := &Event{
+			Time:       uint64(jevent.TimeUnixNano),
+			Name:       jevent.Name,
+			Attributes: make(Attributes),
+		}
+		if err := jsonAttributes(jevent.Attributes, event.Attributes); err != nil {
+			return nil, err
+		}
+		span.Events = append(span.Events, event)
+	}
+	return span, nil
+}
+
+func hexID(s string) ([]byte, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	id, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("otlp: invalid id %s", s)
+	}
+	return id, nil
+}
+
+func jsonAttributes(kvs []*jsonKeyValue, attrs Attributes) error {
+	for _, kv := range kvs {
+		if kv == nil || len(kv.Key) == 0 || kv.Value == nil {
+			continue
+		}
+		v, err := kv.Value.value()
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			attrs[kv.Key] = v
+		}
+	}
+	return nil
+}
+
+func (j *jsonAnyValue) value() (interface{}, error) {
+	switch {
+	case j.StringValue != nil:
+		return *j.StringValue, nil
+	case j.BoolValue != nil:
+		return *j.BoolValue, nil
+	case j.IntValue != nil:
+		return int64(*j.IntValue), nil
+	case j.DoubleValue != nil:
+		return *j.DoubleValue, nil
+	case j.BytesValue != nil:
+		return base64.StdEncoding.DecodeString(*j.BytesValue)
+	case j.ArrayValue != nil:
+		values := make([]interface{}, 0, len(j.ArrayValue.Values))
+		for _, jv := range j.ArrayValue.Values {
+			if jv == nil {
+				continue
+			}
+			v, err := jv.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	case j.KvlistValue != nil:
+		kvs := make(Attributes)
+		if err := jsonAttributes(j.KvlistValue.Values, kvs); err != nil {
+			return nil, err
+		}
+		return kvs, nil
+	}
+	return nil, nil
+}
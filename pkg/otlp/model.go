@@ -0,0 +1,158 @@
+package otlp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// SpanKind span类型
+type SpanKind int32
+
+// span类型，与opentelemetry-proto定义一致
+const (
+	SpanKindUnspecified SpanKind = 0
+	SpanKindInternal    SpanKind = 1
+	SpanKindServer      SpanKind = 2
+	SpanKindClient      SpanKind = 3
+	SpanKindProducer    SpanKind = 4
+	SpanKindConsumer    SpanKind = 5
+)
+
+// span状态码
+const (
+	StatusCodeUnset int32 = 0
+	StatusCodeOk    int32 = 1
+	StatusCodeError int32 = 2
+)
+
+// ExportRequest OTLP ExportTraceServiceRequest
+type ExportRequest struct {
+	ResourceSpans []*ResourceSpans
+}
+
+// ResourceSpans 同一个资源(服务实例)上报的span，scope层级已展开
+type ResourceSpans struct {
+	Resource Attributes
+	Spans    []*Span
+}
+
+// Span ...
+type Span struct {
+	TraceID      []byte
+	SpanID       []byte
+	ParentSpanID []byte
+	Name         string
+	Kind         SpanKind
+	StartTime    uint64 // 单位纳秒
+	EndTime      uint64 // 单位纳秒
+	Attributes   Attributes
+	Events       []*Event
+	Status       Status
+}
+
+// Event span中的事件，例如exception
+type Event struct {
+	Time       uint64 // 单位纳秒
+	Name       string
+	Attributes Attributes
+}
+
+// Status span状态
+type Status struct {
+	Code    int32
+	Message string
+}
+
+// Attributes 属性，值为string、bool、int64、float64、[]byte、[]interface{}或者Attributes
+type Attributes map[string]interface{}
+
+// String 获取字符串属性，非字符串类型转换为字符串
+func (a Attributes) String(key string) string {
+	v, ok := a[key]
+	if !ok {
+		return ""
+	}
+	switch value := v.(type) {
+	case string:
+		return value
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	case []byte:
+		return hex.EncodeToString(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// Int 获取整数属性，字符串类型的数字也可以获取
+func (a Attributes) Int(key string) (int64, bool) {
+	v, ok := a[key]
+	if !ok {
+		return 0, false
+	}
+	switch value := v.(type) {
+	case int64:
+		return value, true
+	case float64:
+		return int64(value), true
+	case string:
+		n, err := strconv.ParseInt(value, 10, 64)
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// First 按顺序获取第一个不为空的字符串属性，用于兼容新旧版本的语义约定
+func (a Attributes) First(keys ...string) string {
+	for _, key := range keys {
+		if v := a.String(key); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// Duration span耗时，单位纳秒
+func (s *Span) Duration() uint64 {
+	if s.EndTime < s.StartTime {
+		return 0
+	}
+	return s.EndTime - s.StartTime
+}
+
+// HasParent 是否有父span
+func (s *Span) HasParent() bool {
+	return !isZeroID(s.ParentSpanID)
+}
+
+func isZeroID(id []byte) bool {
+	for _, b := range id {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ServiceInstance 资源对应的服务名和agentID
+// service.instance.id为agentID，没有时使用服务名@host.name
+func ServiceInstance(resource Attributes) (string, string) {
+	appName := resource.String("service.name")
+	if len(appName) == 0 {
+		appName = "unknown_service"
+	}
+	agentID := resource.String("service.instance.id")
+	if len(agentID) == 0 {
+		agentID = appName
+		if host := resource.String("host.name"); len(host) > 0 {
+			agentID = appName + "@" + host
+		}
+	}
+	return appName, agentID
+}
@@ -0,0 +1,419 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+)
+
+// 向上查找入口span的最大层级，避免错误数据中的循环引用
+const maxDepth = 64
+
+// Converter 将同一个服务实例的span转换为pinpoint span，agent和collector共用
+// SERVER、CONSUMER以及没有父span的span转换为TSpan，其他span作为所属TSpan的event
+// 所属TSpan不在同一批数据中时转换为TSpanChunk，spanId为最近的父span
+type Converter struct {
+	sync.Mutex
+	AppName   string
+	AgentID   string
+	StartTime int64               // agentStartTime，单位毫秒
+	metas     map[string]struct{} // 已经生成的元数据，key为类型:ID
+}
+
+// NewConverter ...
+func NewConverter(appName, agentID string, startTime int64) *Converter {
+	return &Converter{
+		AppName:   appName,
+		AgentID:   agentID,
+		StartTime: startTime,
+		metas:     make(map[string]struct{}),
+	}
+}
+
+// Pinpoint 转换结果，元数据只包含第一次出现的api、sql、string
+type Pinpoint struct {
+	Spans   []*trace.TSpan
+	Chunks  []*trace.TSpanChunk
+	APIs    []*trace.TApiMetaData
+	SQLs    []*trace.TSqlMetaData
+	Strings []*trace.TStringMetaData
+}
+
+// Convert 转换一批span
+func (c *Converter) Convert(spans []*Span) *Pinpoint {
+	c.Lock()
+	defer c.Unlock()
+
+	result := &Pinpoint{}
+	byID := make(map[string]*Span, len(spans))
+	entries := make(map[string]*trace.TSpan)
+	for _, span := range spans {
+		byID[string(span.SpanID)] = span
+		if isEntrySpan(span) {
+			entries[string(span.SpanID)] = c.span(span, result)
+		}
+	}
+
+	// 所属TSpan不在本批数据中的span，按traceID和最近的父span分组
+	orphans := make(map[string][]*orphan)
+	orphanKeys := make([]string, 0)
+	for _, span := range spans {
+		if isEntrySpan(span) {
+			continue
+		}
+		depth := int32(1)
+		parentID := span.ParentSpanID
+		for depth < maxDepth {
+			if entry, ok := entries[string(parentID)]; ok {
+				entry.SpanEventList = append(entry.SpanEventList, c.event(span, entry.StartTime, depth, result))
+				break
+			}
+			parent, ok := byID[string(parentID)]
+			if !ok {
+				key := string(span.TraceID) + string(parentID)
+				if _, ok := orphans[key]; !ok {
+					orphanKeys = append(orphanKeys, key)
+				}
+				orphans[key] = append(orphans[key], &orphan{span: span, parentID: parentID, depth: depth})
+				break
+			}
+			depth++
+			parentID = parent.ParentSpanID
+		}
+	}
+
+	for _, span := range spans {
+		tspan, ok := entries[string(span.SpanID)]
+		if !ok {
+			continue
+		}
+		sortEvents(tspan.SpanEventList)
+		result.Spans = append(result.Spans, tspan)
+	}
+	for _, key := range orphanKeys {
+		group := orphans[key]
+		// chunk中event的开始时间相对于最早的event
+		keyTime := int64(group[0].span.StartTime / 1e6)
+		for _, o := range group {
+			if start := int64(o.span.StartTime / 1e6); start < keyTime {
+				keyTime = start
+			}
+		}
+		chunk := c.spanChunk(group[0].span.TraceID, group[0].parentID)
+		chunk.KeyTime = &keyTime
+		for _, o := range group {
+			chunk.SpanEventList = append(chunk.SpanEventList, c.event(o.span, keyTime, o.depth, result))
+		}
+		sortEvents(chunk.SpanEventList)
+		result.Chunks = append(result.Chunks, chunk)
+	}
+	return result
+}
+
+// orphan 所属TSpan不在本批数据中的span
+type orphan struct {
+	span     *Span
+	parentID []byte // 本批数据中找不到的父span
+	depth    int32
+}
+
+// isEntrySpan 是否为服务的入口span
+func isEntrySpan(span *Span) bool {
+	return span.Kind == SpanKindServer || span.Kind == SpanKindConsumer || !span.HasParent()
+}
+
+// span 入口span转换为TSpan
+func (c *Converter) span(span *Span, result *Pinpoint) *trace.TSpan {
+	attrs := span.Attributes
+	tspan := trace.NewTSpan()
+	tspan.AgentId = c.AgentID
+	tspan.ApplicationName = c.AppName
+	tspan.AgentStartTime = c.StartTime
+	tspan.TransactionId = []byte(hex.EncodeToString(span.TraceID))
+	tspan.SpanId = pinpointSpanID(span.SpanID)
+	if span.HasParent() {
+		tspan.ParentSpanId = pinpointSpanID(span.ParentSpanID)
+	}
+	tspan.StartTime = int64(span.StartTime / 1e6)
+	tspan.Elapsed = int32(span.Duration() / 1e6)
+	tspan.ServiceType = constant.OTLP_SERVER
+	serviceType := constant.OTLP_SERVER
+	tspan.ApplicationServiceType = &serviceType
+
+	rpc := serverRPC(span)
+	tspan.RPC = &rpc
+	if endPoint := hostPort(attrs.First("server.address", "net.host.name", "http.host"), attrs, "server.port", "net.host.port"); len(endPoint) > 0 {
+		tspan.EndPoint = &endPoint
+		tspan.AcceptorHost = &endPoint
+	}
+	if remoteAddr := attrs.First("client.address", "http.client_ip", "net.sock.peer.addr", "net.peer.ip"); len(remoteAddr) > 0 {
+		tspan.RemoteAddr = &remoteAddr
+	}
+
+	if code, ok := httpStatusCode(attrs); ok {
+		tspan.Annotations = append(tspan.Annotations, intAnnotation(constant.HTTP_STATUS_CODE, code))
+	}
+	if u := attrs.First("url.full", "http.url"); len(u) > 0 {
+		tspan.Annotations = append(tspan.Annotations, stringAnnotation(constant.HTTP_URL, u))
+	}
+
+	apiID := c.metaID(constant.TypeOfAPIMetaData, span.Name, result)
+	tspan.ApiId = &apiID
+	if exception := c.exception(span, result); exception != nil {
+		tspan.ExceptionInfo = exception
+		if span.Status.Code == StatusCodeError {
+			isErr := int32(1)
+			tspan.Err = &isErr
+		}
+	}
+	return tspan
+}
+
+// spanChunk 所属TSpan不在本批数据中的event
+func (c *Converter) spanChunk(traceID, spanID []byte) *trace.TSpanChunk {
+	chunk := trace.NewTSpanChunk()
+	chunk.AgentId = c.AgentID
+	chunk.ApplicationName = c.AppName
+	chunk.AgentStartTime = c.StartTime
+	chunk.ServiceType = constant.OTLP_SERVER
+	serviceType := constant.OTLP_SERVER
+	chunk.ApplicationServiceType = &serviceType
+	chunk.TransactionId = []byte(hex.EncodeToString(traceID))
+	chunk.SpanId = pinpointSpanID(spanID)
+	return chunk
+}
+
+// event 非入口span转换为TSpanEvent，base为所属TSpan或者TSpanChunk的开始时间
+// http、数据库调用转换为对应的pinpoint类型，用于接口和服务拓扑统计
+func (c *Converter) event(span *Span, base int64, depth int32, result *Pinpoint) *trace.TSpanEvent {
+	attrs := span.Attributes
+	event := trace.NewTSpanEvent()
+	event.StartElapsed = int32(int64(span.StartTime/1e6) - base)
+	event.EndElapsed = int32(span.Duration() / 1e6)
+	event.Depth = depth
+	if span.Kind == SpanKindClient || span.Kind == SpanKindProducer {
+		// 下游服务的TSpan以该span为parentSpanId
+		event.NextSpanId = pinpointSpanID(span.SpanID)
+	}
+
+	rpc := span.Name
+	if dbSystem := attrs.String("db.system"); len(dbSystem) > 0 {
+		event.ServiceType = dbServiceType(dbSystem)
+		destination := attrs.First("db.name", "db.namespace", "server.address", "net.peer.name")
+		event.DestinationId = &destination
+		if endPoint := hostPort(attrs.First("server.address", "net.peer.name"), attrs, "server.port", "net.peer.port"); len(endPoint) > 0 {
+			event.EndPoint = &endPoint
+		}
+		if statement := attrs.First("db.statement", "db.query.text"); len(statement) > 0 {
+			sqlID := c.metaID(constant.TypeOfSQLMetaData, statement, result)
+			value := trace.NewTAnnotationValue()
+			value.IntStringStringValue = &trace.TIntStringStringValue{IntValue: sqlID}
+			event.Annotations = append(event.Annotations, &trace.TAnnotation{Key: constant.SQL_ID, Value: value})
+		}
+	} else if span.Kind == SpanKindClient && len(attrs.First("http.request.method", "http.method")) > 0 {
+		event.ServiceType = constant.HTTP_CLIENT_4
+		rawURL := attrs.First("url.full", "http.url")
+		host := attrs.First("server.address", "net.peer.name")
+		path := rawURL
+		if u, err := url.Parse(rawURL); err == nil {
+			if len(host) == 0 {
+				host = u.Host
+			}
+			if len(u.Path) > 0 {
+				path = u.Path
+			}
+		}
+		target := hostPort(host, attrs, "server.port", "net.peer.port")
+		if len(target) > 0 {
+			event.DestinationId = &target
+			event.EndPoint = &target
+			event.Annotations = append(event.Annotations, stringAnnotation(constant.HTTP_INTERNAL_DISPLAY, target))
+		}
+		if len(path) > 0 {
+			rpc = path
+			event.Annotations = append(event.Annotations, stringAnnotation(constant.HTTP_URL, path))
+		}
+		if code, ok := httpStatusCode(attrs); ok {
+			event.Annotations = append(event.Annotations, intAnnotation(constant.HTTP_STATUS_CODE, code))
+		}
+	} else if span.Kind == SpanKindClient || span.Kind == SpanKindProducer {
+		event.ServiceType = constant.OTLP_CLIENT
+		if destination := attrs.First("peer.service", "messaging.destination.name", "messaging.destination", "rpc.service", "server.address", "net.peer.name"); len(destination) > 0 {
+			event.DestinationId = &destination
+		}
+	} else {
+		event.ServiceType = constant.OTLP_METHOD
+	}
+	event.RPC = &rpc
+
+	apiID := c.metaID(constant.TypeOfAPIMetaData, span.Name, result)
+	event.ApiId = &apiID
+	event.ExceptionInfo = c.exception(span, result)
+	return event
+}
+
+// exception 异常信息，优先使用exception事件，其次为错误状态
+func (c *Converter) exception(span *Span, result *Pinpoint) *trace.TIntStringValue {
+	var name, message string
+	for _, event := range span.Events {
+		if event.Name == "exception" {
+			name = event.Attributes.String("exception.type")
+			message = event.Attributes.String("exception.message")
+			break
+		}
+	}
+	if len(name) == 0 {
+		if span.Status.Code != StatusCodeError {
+			return nil
+		}
+		name = "error"
+		message = span.Status.Message
+	}
+	return &trace.TIntStringValue{
+		IntValue:    c.metaID(constant.TypeOfStringMetaData, name, result),
+		StringValue: &message,
+	}
+}
+
+// metaID 由内容计算api、sql、string的ID，第一次出现时生成元数据
+// collector按服务名保存元数据，同一个服务的所有实例ID一致
+func (c *Converter) metaID(metaType uint16, value string, result *Pinpoint) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	id := int32(h.Sum32() & 0x7fffffff)
+
+	key := fmt.Sprintf("%d:%d", metaType, id)
+	if _, ok := c.metas[key]; ok {
+		return id
+	}
+	c.metas[key] = struct{}{}
+
+	switch metaType {
+	case constant.TypeOfAPIMetaData:
+		meta := trace.NewTApiMetaData()
+		meta.AgentId = c.AgentID
+		meta.AgentStartTime = c.StartTime
+		meta.ApiId = id
+		meta.ApiInfo = value
+		result.APIs = append(result.APIs, meta)
+		break
+	case constant.TypeOfSQLMetaData:
+		meta := trace.NewTSqlMetaData()
+		meta.AgentId = c.AgentID
+		meta.AgentStartTime = c.StartTime
+		meta.SqlId = id
+		meta.Sql = value
+		result.SQLs = append(result.SQLs, meta)
+		break
+	case constant.TypeOfStringMetaData:
+		meta := trace.NewTStringMetaData()
+		meta.AgentId = c.AgentID
+		meta.AgentStartTime = c.StartTime
+		meta.StringId = id
+		meta.StringValue = value
+		result.Strings = append(result.Strings, meta)
+		break
+	}
+	return id
+}
+
+// sortEvents 按开始时间排序并编号
+func sortEvents(events []*trace.TSpanEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].StartElapsed < events[j].StartElapsed
+	})
+	for i, event := range events {
+		event.Sequence = int16(i)
+	}
+}
+
+// pinpointSpanID 8字节的spanID直接转换为int64，其他长度取哈希
+func pinpointSpanID(id []byte) int64 {
+	if len(id) == 8 {
+		return int64(binary.BigEndian.Uint64(id))
+	}
+	h := fnv.New64a()
+	h.Write(id)
+	return int64(h.Sum64())
+}
+
+// serverRPC 入口span的接口名，http请求使用路由或者路径
+func serverRPC(span *Span) string {
+	attrs := span.Attributes
+	if route := attrs.String("http.route"); len(route) > 0 {
+		return route
+	}
+	if target := attrs.First("url.path", "http.target"); len(target) > 0 {
+		if i := strings.IndexByte(target, '?'); i >= 0 {
+			target = target[:i]
+		}
+		return target
+	}
+	return span.Name
+}
+
+// dbServiceType 数据库类型对应的pinpoint类型
+func dbServiceType(dbSystem string) int16 {
+	switch dbSystem {
+	case "mysql":
+		return constant.MYSQL_EXECUTE_QUERY
+	case "mariadb":
+		return constant.MARIADB_EXECUTE_QUERY
+	case "oracle":
+		return constant.ORACLE_EXECUTE_QUERY
+	case "postgresql":
+		return constant.POSTGRESQL_EXECUTE_QUERY
+	case "mssql":
+		return constant.MSSQL_EXECUTE_QUERY
+	case "cassandra":
+		return constant.CASSANDRA_EXECUTE_QUERY
+	case "redis":
+		return constant.REDIS
+	}
+	return constant.OTLP_CLIENT
+}
+
+// httpStatusCode 兼容新旧版本语义约定的http状态码
+func httpStatusCode(attrs Attributes) (int32, bool) {
+	if code, ok := attrs.Int("http.response.status_code"); ok {
+		return int32(code), true
+	}
+	if code, ok := attrs.Int("http.status_code"); ok {
+		return int32(code), true
+	}
+	return 0, false
+}
+
+// hostPort 拼接地址和端口
+func hostPort(host string, attrs Attributes, portKeys ...string) string {
+	if len(host) == 0 || strings.Contains(host, ":") {
+		return host
+	}
+	for _, key := range portKeys {
+		if port, ok := attrs.Int(key); ok && port > 0 {
+			return host + ":" + strconv.FormatInt(port, 10)
+		}
+	}
+	return host
+}
+
+func stringAnnotation(key int32, value string) *trace.TAnnotation {
+	v := trace.NewTAnnotationValue()
+	v.StringValue = &value
+	return &trace.TAnnotation{Key: key, Value: v}
+}
+
+func intAnnotation(key int32, value int32) *trace.TAnnotation {
+	v := trace.NewTAnnotationValue()
+	v.IntValue = &value
+	return &trace.TAnnotation{Key: key, Value: v}
+}
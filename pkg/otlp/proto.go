@@ -0,0 +1,397 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// protobuf wire type
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// ErrTruncated protobuf报文不完整
+var ErrTruncated = errors.New("otlp: truncated message")
+
+// ParseProto 解析protobuf格式的ExportTraceServiceRequest
+func ParseProto(data []byte) (*ExportRequest, error) {
+	req := &ExportRequest{}
+	err := walk(data, func(d *decoder, field, wire int) error {
+		if field == 1 && wire == wireBytes {
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			rs, err := parseResourceSpans(b)
+			if err != nil {
+				return err
+			}
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+			return nil
+		}
+		return d.skip(wire)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func parseResourceSpans(data []byte) (*ResourceSpans, error) {
+	rs := &ResourceSpans{
+		Resource: make(Attributes),
+	}
+	err := walk(data, func(d *decoder, field, wire int) error {
+		if wire != wireBytes {
+			return d.skip(wire)
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			// Resource
+			return walk(b, func(d *decoder, field, wire int) error {
+				if field == 1 && wire == wireBytes {
+					kv, err := d.bytes()
+					if err != nil {
+						return err
+					}
+					return parseKeyValue(kv, rs.Resource)
+				}
+				return d.skip(wire)
+			})
+		case 2, 1000:
+			// ScopeSpans，1000为旧版本的InstrumentationLibrarySpans
+			spans, err := parseScopeSpans(b)
+			if err != nil {
+				return err
+			}
+			rs.Spans = append(rs.Spans, spans...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func parseScopeSpans(data []byte) ([]*Span, error) {
+	spans := make([]*Span, 0)
+	err := walk(data, func(d *decoder, field, wire int) error {
+		if field == 2 && wire == wireBytes {
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			span, err := parseSpan(b)
+			if err != nil {
+				return err
+			}
+			spans = append(spans, span)
+			return nil
+		}
+		return d.skip(wire)
+	})
+	return spans, err
+}
+
+func parseSpan(data []byte) (*Span, error) {
+	span := &Span{
+		Attributes: make(Attributes),
+	}
+	err := walk(data, func(d *decoder, field, wire int) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			b, err := d.bytes()
+			span.TraceID = b
+			return err
+		case field == 2 && wire == wireBytes:
+			b, err := d.bytes()
+			span.SpanID = b
+			return err
+		case field == 4 && wire == wireBytes:
+			b, err := d.bytes()
+			span.ParentSpanID = b
+			return err
+		case field == 5 && wire == wireBytes:
+			b, err := d.bytes()
+			span.Name = string(b)
+			return err
+		case field == 6 && wire == wireVarint:
+			v, err := d.varint()
+			span.Kind = SpanKind(v)
+			return err
+		case field == 7 && wire == wireFixed64:
+			v, err := d.fixed64()
+			span.StartTime = v
+			return err
+		case field == 8 && wire == wireFixed64:
+			v, err := d.fixed64()
+			span.EndTime = v
+			return err
+		case field == 9 && wire == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			return parseKeyValue(b, span.Attributes)
+		case field == 11 && wire == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			event, err := parseEvent(b)
+			if err != nil {
+				return err
+			}
+			span.Events = append(span.Events, event)
+			return nil
+		case field == 15 && wire == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			return parseStatus(b, &span.Status)
+		}
+		return d.skip(wire)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return span, nil
+}
+
+func parseEvent(data []byte) (*Event, error) {
+	event := &Event{
+		Attributes: make(Attributes),
+	}
+	err := walk(data, func(d *decoder, field, wire int) error {
+		switch {
+		case field == 1 && wire == wireFixed64:
+			v, err := d.fixed64()
+			event.Time = v
+			return err
+		case field == 2 && wire == wireBytes:
+			b, err := d.bytes()
+			event.Name = string(b)
+			return err
+		case field == 3 && wire == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			return parseKeyValue(b, event.Attributes)
+		}
+		return d.skip(wire)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+func parseStatus(data []byte, status *Status) error {
+	return walk(data, func(d *decoder, field, wire int) error {
+		switch {
+		case field == 2 && wire == wireBytes:
+			b, err := d.bytes()
+			status.Message = string(b)
+			return err
+		case field == 3 && wire == wireVarint:
+			v, err := d.varint()
+			status.Code = int32(v)
+			return err
+		}
+		return d.skip(wire)
+	})
+}
+
+// parseKeyValue 解析KeyValue并保存到attrs
+func parseKeyValue(data []byte, attrs Attributes) error {
+	var key string
+	var value interface{}
+	err := walk(data, func(d *decoder, field, wire int) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			b, err := d.bytes()
+			key = string(b)
+			return err
+		case field == 2 && wire == wireBytes:
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			value, err = parseAnyValue(b)
+			return err
+		}
+		return d.skip(wire)
+	})
+	if err != nil {
+		return err
+	}
+	if len(key) > 0 && value != nil {
+		attrs[key] = value
+	}
+	return nil
+}
+
+func parseAnyValue(data []byte) (interface{}, error) {
+	var value interface{}
+	err := walk(data, func(d *decoder, field, wire int) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			b, err := d.bytes()
+			value = string(b)
+			return err
+		case field == 2 && wire == wireVarint:
+			v, err := d.varint()
+			value = v != 0
+			return err
+		case field == 3 && wire == wireVarint:
+			v, err := d.varint()
+			value = int64(v)
+			return err
+		case field == 4 && wire == wireFixed64:
+			v, err := d.fixed64()
+			value = math.Float64frombits(v)
+			return err
+		case field == 5 && wire == wireBytes:
+			// ArrayValue
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			values := make([]interface{}, 0)
+			err = walk(b, func(d *decoder, field, wire int) error {
+				if field == 1 && wire == wireBytes {
+					b, err := d.bytes()
+					if err != nil {
+						return err
+					}
+					v, err := parseAnyValue(b)
+					if err != nil {
+						return err
+					}
+					values = append(values, v)
+					return nil
+				}
+				return d.skip(wire)
+			})
+			value = values
+			return err
+		case field == 6 && wire == wireBytes:
+			// KeyValueList
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			kvs := make(Attributes)
+			err = walk(b, func(d *decoder, field, wire int) error {
+				if field == 1 && wire == wireBytes {
+					kv, err := d.bytes()
+					if err != nil {
+						return err
+					}
+					return parseKeyValue(kv, kvs)
+				}
+				return d.skip(wire)
+			})
+			value = kvs
+			return err
+		case field == 7 && wire == wireBytes:
+			b, err := d.bytes()
+			value = b
+			return err
+		}
+		return d.skip(wire)
+	})
+	return value, err
+}
+
+// decoder protobuf wire格式读取
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+// walk 依次读取报文中的字段，由fn读取或者跳过字段的值
+func walk(data []byte, fn func(d *decoder, field, wire int) error) error {
+	d := &decoder{buf: data}
+	for d.pos < len(d.buf) {
+		tag, err := d.varint()
+		if err != nil {
+			return err
+		}
+		field, wire := int(tag>>3), int(tag&7)
+		if field == 0 {
+			return fmt.Errorf("otlp: invalid field number")
+		}
+		if err := fn(d, field, wire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		return 0, ErrTruncated
+	}
+	d.pos += n
+	return v, nil
+}
+
+func (d *decoder) fixed64() (uint64, error) {
+	if len(d.buf)-d.pos < 8 {
+		return 0, ErrTruncated
+	}
+	v := binary.LittleEndian.Uint64(d.buf[d.pos:])
+	d.pos += 8
+	return v, nil
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	l, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(d.buf)-d.pos) < l {
+		return nil, ErrTruncated
+	}
+	b := d.buf[d.pos : d.pos+int(l)]
+	d.pos += int(l)
+	return b, nil
+}
+
+func (d *decoder) skip(wire int) error {
+	switch wire {
+	case wireVarint:
+		_, err := d.varint()
+		return err
+	case wireFixed64:
+		if len(d.buf)-d.pos < 8 {
+			return ErrTruncated
+		}
+		d.pos += 8
+	case wireBytes:
+		_, err := d.bytes()
+		return err
+	case wireFixed32:
+		if len(d.buf)-d.pos < 4 {
+			return ErrTruncated
+		}
+		d.pos += 4
+	default:
+		return fmt.Errorf("otlp: unsupported wire type %d", wire)
+	}
+	return nil
+}
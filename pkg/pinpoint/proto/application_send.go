@@ -42,7 +42,11 @@ func (a *ApplicationSend) Decode(conn net.Conn, reader io.Reader) error {
 
 // Encode ...
 func (a *ApplicationSend) Encode() ([]byte, error) {
-	return nil, nil
+	body := make([]byte, 6)
+	binary.BigEndian.PutUint16(body[0:2], uint16(a.Type))
+	binary.BigEndian.PutUint32(body[2:6], uint32(len(a.Payload)))
+	body = append(body, a.Payload...)
+	return body, nil
 }
 
 // GetPacketType ...
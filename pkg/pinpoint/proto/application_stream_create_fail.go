@@ -38,7 +38,11 @@ func (a *ApplicationStreamCreateFail) Decode(conn net.Conn, reader io.Reader) er
 
 // Encode ...
 func (a *ApplicationStreamCreateFail) Encode() ([]byte, error) {
-	return nil, nil
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint16(body[0:2], uint16(a.Type))
+	binary.BigEndian.PutUint32(body[2:6], uint32(a.ChannelID))
+	binary.BigEndian.PutUint16(body[6:8], uint16(a.Code))
+	return body, nil
 }
 
 // GetPacketType ...
@@ -38,7 +38,11 @@ func (a *ApplicationStreamPong) Decode(conn net.Conn, reader io.Reader) error {
 
 // Encode ...
 func (a *ApplicationStreamPong) Encode() ([]byte, error) {
-	return nil, nil
+	body := make([]byte, 10)
+	binary.BigEndian.PutUint16(body[0:2], uint16(a.Type))
+	binary.BigEndian.PutUint32(body[2:6], uint32(a.ChannelID))
+	binary.BigEndian.PutUint32(body[6:10], uint32(a.RequestID))
+	return body, nil
 }
 
 // GetPacketType ...
@@ -54,7 +54,7 @@ func (a *ApplicationStreamResponse) GetPacketType() int16 {
 
 // GetPayload ...
 func (a *ApplicationStreamResponse) GetPayload() []byte {
-	return nil
+	return a.Payload
 }
 
 // GetRequestID ...
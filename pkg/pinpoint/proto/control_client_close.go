@@ -43,7 +43,11 @@ func (c *ControlClientClose) Decode(conn net.Conn, reader io.Reader) error {
 
 // Encode ...
 func (c *ControlClientClose) Encode() ([]byte, error) {
-	return nil, nil
+	body := make([]byte, 6)
+	binary.BigEndian.PutUint16(body[0:2], uint16(c.Type))
+	binary.BigEndian.PutUint32(body[2:6], uint32(len(c.Payload)))
+	body = append(body, c.Payload...)
+	return body, nil
 }
 
 // GetPacketType ...
@@ -45,7 +45,12 @@ func (c *ControlHandShake) Decode(conn net.Conn, reader io.Reader) error {
 
 // Encode ...
 func (c *ControlHandShake) Encode() ([]byte, error) {
-	return nil, nil
+	body := make([]byte, 10)
+	binary.BigEndian.PutUint16(body[0:2], uint16(c.Type))
+	binary.BigEndian.PutUint32(body[2:6], uint32(c.RequestID))
+	binary.BigEndian.PutUint32(body[6:10], uint32(len(c.Payload)))
+	body = append(body, c.Payload...)
+	return body, nil
 }
 
 // GetPacketType ...
@@ -23,7 +23,15 @@ func NewControlHandShakeResponse() *ControlHandShakeResponse {
 
 // Decode ...
 func (c *ControlHandShakeResponse) Decode(conn net.Conn, reader io.Reader) error {
-	return nil
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return err
+	}
+	c.RequestID = int(binary.BigEndian.Uint32(buf[:4]))
+	c.Length = int(binary.BigEndian.Uint32(buf[4:8]))
+	c.Payload = make([]byte, c.Length)
+	_, err := io.ReadFull(reader, c.Payload)
+	return err
 }
 
 // Encode ...
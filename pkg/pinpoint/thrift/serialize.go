@@ -37,6 +37,25 @@ func Serialize(tStruct thrift.TStruct) []byte {
 	return buf
 }
 
+// SerializeCopy 使用缓存的序列化器，返回数据的拷贝，可以在多个协程中并发使用
+func SerializeCopy(tStruct thrift.TStruct) []byte {
+	var sServer *SerializeServer
+	v := serializePool.Get()
+	if v == nil {
+		sServer = NewSerializeServer()
+	} else {
+		sServer = v.(*SerializeServer)
+	}
+	header := HeaderLookup(tStruct)
+	sServer.baos.Reset()
+	writeHeader(sServer.sprotocol, header)
+	tStruct.Write(sServer.sprotocol)
+	buf := make([]byte, sServer.baos.Len())
+	copy(buf, sServer.baos.Bytes())
+	serializePool.Put(sServer)
+	return buf
+}
+
 func SerializeNew(tStruct thrift.TStruct) []byte {
 	var sServer *SerializeServer = NewSerializeServer()
 	header := HeaderLookup(tStruct)
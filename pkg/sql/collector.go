@@ -36,6 +36,30 @@ var InsertRuntimeStat string = `
 	INTO agent_runtime(app_name, agent_id, input_date, metrics, runtime_type)
 	VALUES (?, ?, ?, ?, ?);`
 
+// insert system stat 主机信息入库
+var InsertSystemStat string = `
+	INSERT
+	INTO agent_system(app_name, agent_id, host_name, input_date, metrics)
+	VALUES (?, ?, ?, ?, ?);`
+
+// insert command result pinpoint指令执行结果入库
+var InsertCommandResult string = `
+	INSERT
+	INTO agent_command(app_name, agent_id, input_date, id, type, success, message, result)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+
+// insert config ack agent应用配置的结果入库
+var InsertConfigAck string = `
+	INSERT
+	INTO agent_config_ack(app_name, agent_id, version, success, message, input_date)
+	VALUES (?, ?, ?, ?, ?, ?);`
+
+// insert active thread 活跃线程数实时数据入库
+var InsertActiveThread string = `
+	INSERT
+	INTO agent_active_thread(app_name, agent_id, input_date, histogram_schema, counts)
+	VALUES (?, ?, ?, ?, ?);`
+
 // agent stat 信息入库 + 过期时间
 // var InsertAgentStatWithTTL string = `
 // 	INSERT
@@ -71,18 +95,19 @@ INTO service_type(service_type, info)
 VALUES (?, ?) ;`
 
 // API 记录语句
-var InsertAPIStats string = `INSERT INTO api_stats (app_name, count, err_count, duration, max_duration, min_duration, satisfaction, tolerate, api, input_date)
- VALUES (?,?,?,?,?,?,?,?,?,?);`
+var InsertAPIStats string = `INSERT INTO api_stats (app_name, count, err_count, duration, max_duration, min_duration, satisfaction, tolerate,
+ p50, p90, p99, histogram, api, input_date)
+ VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?);`
 
 // InsertMethodStats ...
 var InsertMethodStats string = ` INSERT INTO method_stats (app_name, api, input_date,
 	 method_id, service_type, elapsed, max_elapsed, 
-	 min_elapsed, count, err_count) VALUES (?,?,?,?,?,?,?,?,?,?);`
+	 min_elapsed, count, err_count, p50, p90, p99, histogram) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?);`
 
 //  InserSQLStats ...
 var InsertSQLStats string = `INSERT INTO sql_stats (app_name, sql, 
-	input_date, elapsed, max_elapsed, min_elapsed, count, err_count) 
-VALUES (?,?,?,?,?,?,?,?);`
+	input_date, elapsed, max_elapsed, min_elapsed, count, err_count, p50, p90, p99, histogram) 
+VALUES (?,?,?,?,?,?,?,?,?,?,?,?);`
 
 // InsertExceptionStats ....
 var InsertExceptionStats string = `INSERT INTO exception_stats (app_name, method_id, class_id, input_date, total_elapsed, max_elapsed, 
@@ -145,4 +170,65 @@ var LoadAgents string = `SELECT service_type, agent_id, start_time, ip, is_live,
 
 var LoadApps string = `SELECT app_name FROM apps;`
 
+// 加载app配置
+var LoadAppConfigs string = `SELECT app_name, config FROM app_config;`
+
+// 加载apdex阈值
+var LoadApdex string = `SELECT app_name, api, satisfaction, tolerate FROM app_apdex;`
+
+// 迟到数据合并前读取已入库的数据
+var LoadAPIStats string = `SELECT count, err_count, duration, max_duration, min_duration, satisfaction, tolerate, histogram
+ FROM api_stats WHERE app_name=? AND api=? AND input_date=?;`
+
+var LoadMethodStats string = `SELECT elapsed, max_elapsed, min_elapsed, count, err_count, histogram
+ FROM method_stats WHERE app_name=? AND api=? AND input_date=? AND method_id=?;`
+
+var LoadSQLStats string = `SELECT elapsed, max_elapsed, min_elapsed, count, err_count, histogram
+ FROM sql_stats WHERE app_name=? AND sql=? AND input_date=?;`
+
+var LoadExceptionStats string = `SELECT total_elapsed, max_elapsed, min_elapsed, count
+ FROM exception_stats WHERE app_name=? AND method_id=? AND class_id=? AND input_date=?;`
+
+var LoadServiceMap string = `SELECT access_count, access_err_count, access_duration
+ FROM service_map WHERE source_name=? AND target_name=? AND input_date=? AND target_type=?;`
+
+var LoadAPIMapStats string = `SELECT access_count, access_err_count, access_duration
+ FROM api_map WHERE target_name=? AND input_date=? AND api=? AND source_name=?;`
+
 var LoadDubboApis string = `SELECT app_name, api, api_type  FROM app_apis;`
+
+// 统计数据汇总，%s为源表和汇总表，源表为分钟表或者上一级汇总表
+var LoadRollupAPIStats string = `SELECT api, count, err_count, duration, max_duration, min_duration, satisfaction, tolerate, histogram
+ FROM %s WHERE app_name=? AND input_date>=? AND input_date<?;`
+
+var InsertRollupAPIStats string = `INSERT INTO %s (app_name, api, input_date, count, err_count, duration, max_duration, min_duration,
+ satisfaction, tolerate, p50, p90, p99, histogram) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?) USING TTL ?;`
+
+var LoadRollupSQLStats string = `SELECT sql, count, err_count, elapsed, max_elapsed, min_elapsed, histogram
+ FROM %s WHERE app_name=? AND input_date>=? AND input_date<?;`
+
+var InsertRollupSQLStats string = `INSERT INTO %s (app_name, sql, input_date, count, err_count, elapsed, max_elapsed, min_elapsed,
+ p50, p90, p99, histogram) VALUES (?,?,?,?,?,?,?,?,?,?,?,?) USING TTL ?;`
+
+var LoadRollupMethodStats string = `SELECT api, method_id, service_type, count, err_count, elapsed, max_elapsed, min_elapsed, histogram
+ FROM %s WHERE app_name=? AND input_date>=? AND input_date<?;`
+
+var InsertRollupMethodStats string = `INSERT INTO %s (app_name, api, method_id, input_date, service_type, count, err_count, elapsed, max_elapsed, min_elapsed,
+ p50, p90, p99, histogram) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?) USING TTL ?;`
+
+var LoadRollupExceptionStats string = `SELECT method_id, class_id, service_type, count, total_elapsed, max_elapsed, min_elapsed
+ FROM %s WHERE app_name=? AND input_date>=? AND input_date<?;`
+
+var InsertRollupExceptionStats string = `INSERT INTO %s (app_name, method_id, class_id, input_date, service_type, count, total_elapsed, max_elapsed, min_elapsed)
+ VALUES (?,?,?,?,?,?,?,?,?) USING TTL ?;`
+
+var LoadRollupServiceMap string = `SELECT source_type, target_name, target_type, access_count, access_err_count, access_duration
+ FROM %s WHERE source_name=? AND input_date>=? AND input_date<?;`
+
+var InsertRollupServiceMap string = `INSERT INTO %s (source_name, source_type, target_name, target_type, access_count, access_err_count, access_duration, input_date)
+ VALUES (?,?,?,?,?,?,?,?) USING TTL ?;`
+
+// 汇总进度，小于input_date的数据已经汇总
+var LoadRollupProgress string = `SELECT input_date FROM stats_rollup WHERE app_name=? AND resolution=?;`
+
+var InsertRollupProgress string = `INSERT INTO stats_rollup (app_name, resolution, input_date) VALUES (?,?,?);`
@@ -27,32 +27,38 @@ func NewApp() *App {
 
 // Dubbo ...
 type Dubbo struct {
-	Duration          int32 `msg:"d"`   // 总耗时
-	MinDuration       int32 `msg:"min"` // 最小耗时
-	MaxDuration       int32 `msg:"max"` // 最大耗时
-	AccessCount       int   `msg:"ac"`  // 访问总数
-	AccessErrCount    int   `msg:"aec"` // 访问错误数
-	SatisfactionCount int   `msg:"sc"`  // 满意次数
-	TolerateCount     int   `msg:"tc"`  // 可容忍次数
+	Duration          int32      `msg:"d"`   // 总耗时
+	MinDuration       int32      `msg:"min"` // 最小耗时
+	MaxDuration       int32      `msg:"max"` // 最大耗时
+	AccessCount       int        `msg:"ac"`  // 访问总数
+	AccessErrCount    int        `msg:"aec"` // 访问错误数
+	SatisfactionCount int        `msg:"sc"`  // 满意次数
+	TolerateCount     int        `msg:"tc"`  // 可容忍次数
+	Histogram         *Histogram `msg:"h"`   // 耗时分布
 }
 
 // NewDubbo new dubbo
 func NewDubbo() *Dubbo {
-	return &Dubbo{}
+	return &Dubbo{
+		Histogram: NewHistogram(),
+	}
 }
 
 // Url url
 type Url struct {
-	Duration          int32 `msg:"d"`   // 总耗时
-	MinDuration       int32 `msg:"min"` // 最小耗时
-	MaxDuration       int32 `msg:"max"` // 最大耗时
-	AccessCount       int   `msg:"ac"`  // 访问总数
-	AccessErrCount    int   `msg:"aec"` // 访问错误数
-	SatisfactionCount int   `msg:"sc"`  // 满意次数
-	TolerateCount     int   `msg:"tc"`  // 可容忍次数
+	Duration          int32      `msg:"d"`   // 总耗时
+	MinDuration       int32      `msg:"min"` // 最小耗时
+	MaxDuration       int32      `msg:"max"` // 最大耗时
+	AccessCount       int        `msg:"ac"`  // 访问总数
+	AccessErrCount    int        `msg:"aec"` // 访问错误数
+	SatisfactionCount int        `msg:"sc"`  // 满意次数
+	TolerateCount     int        `msg:"tc"`  // 可容忍次数
+	Histogram         *Histogram `msg:"h"`   // 耗时分布
 }
 
 // NewUrl new url
 func NewUrl() *Url {
-	return &Url{}
+	return &Url{
+		Histogram: NewHistogram(),
+	}
 }
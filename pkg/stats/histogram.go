@@ -0,0 +1,177 @@
+package stats
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// 耗时直方图按对数分桶，桶的相对误差为histogramAccuracy，可以在collector之间、不同时间点之间合并
+const histogramAccuracy = 0.02
+
+var (
+	histogramGamma    = (1 + histogramAccuracy) / (1 - histogramAccuracy)
+	histogramLogGamma = math.Log(histogramGamma)
+)
+
+// Histogram 耗时直方图，单位毫秒
+type Histogram struct {
+	Zero    int           `msg:"z"` // 耗时为0的次数
+	Buckets map[int32]int `msg:"b"` // 桶序号: 次数
+}
+
+// NewHistogram ...
+func NewHistogram() *Histogram {
+	return &Histogram{
+		Buckets: make(map[int32]int),
+	}
+}
+
+// histogramIndex 耗时对应的桶序号
+func histogramIndex(duration int32) int32 {
+	return int32(math.Ceil(math.Log(float64(duration)) / histogramLogGamma))
+}
+
+// histogramValue 桶的代表值，(gamma^(i-1), gamma^i]的中间值
+func histogramValue(index int32) int32 {
+	return int32(math.Round(2 * math.Pow(histogramGamma, float64(index)) / (histogramGamma + 1)))
+}
+
+// Record 记录一次耗时
+func (h *Histogram) Record(duration int32) {
+	if duration <= 0 {
+		h.Zero++
+		return
+	}
+	if h.Buckets == nil {
+		h.Buckets = make(map[int32]int)
+	}
+	h.Buckets[histogramIndex(duration)]++
+}
+
+// Merge 合并其他直方图
+func (h *Histogram) Merge(other *Histogram) {
+	if other == nil {
+		return
+	}
+	h.Zero += other.Zero
+	if h.Buckets == nil {
+		h.Buckets = make(map[int32]int)
+	}
+	for index, count := range other.Buckets {
+		h.Buckets[index] += count
+	}
+}
+
+// Count 记录总次数
+func (h *Histogram) Count() int {
+	if h == nil {
+		return 0
+	}
+	count := h.Zero
+	for _, c := range h.Buckets {
+		count += c
+	}
+	return count
+}
+
+// Quantile 分位耗时，q取值0-1，没有数据时返回0
+func (h *Histogram) Quantile(q float64) int32 {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q * float64(count)))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank <= h.Zero {
+		return 0
+	}
+
+	indexes := h.indexes()
+	total := h.Zero
+	for _, index := range indexes {
+		total += h.Buckets[index]
+		if total >= rank {
+			return histogramValue(index)
+		}
+	}
+	return histogramValue(indexes[len(indexes)-1])
+}
+
+// Percentiles p50、p90、p99耗时
+func (h *Histogram) Percentiles() (int32, int32, int32) {
+	return h.Quantile(0.5), h.Quantile(0.9), h.Quantile(0.99)
+}
+
+// indexes 有数据的桶序号，从小到大
+func (h *Histogram) indexes() []int32 {
+	indexes := make([]int32, 0, len(h.Buckets))
+	for index, count := range h.Buckets {
+		if count > 0 {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	return indexes
+}
+
+// Encode 编码后存储到数据库: zero、桶数量、(桶序号, 次数)...，均为varint
+func (h *Histogram) Encode() []byte {
+	if h == nil {
+		return nil
+	}
+	indexes := h.indexes()
+	buf := make([]byte, 0, 2*binary.MaxVarintLen32+len(indexes)*4)
+	tmp := make([]byte, binary.MaxVarintLen64)
+
+	n := binary.PutUvarint(tmp, uint64(h.Zero))
+	buf = append(buf, tmp[:n]...)
+	n = binary.PutUvarint(tmp, uint64(len(indexes)))
+	buf = append(buf, tmp[:n]...)
+	for _, index := range indexes {
+		n = binary.PutVarint(tmp, int64(index))
+		buf = append(buf, tmp[:n]...)
+		n = binary.PutUvarint(tmp, uint64(h.Buckets[index]))
+		buf = append(buf, tmp[:n]...)
+	}
+	return buf
+}
+
+// DecodeHistogram 解码数据库中的直方图，数据为空时返回空直方图
+func DecodeHistogram(data []byte) (*Histogram, error) {
+	h := NewHistogram()
+	if len(data) == 0 {
+		return h, nil
+	}
+
+	zero, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("histogram: invalid zero count")
+	}
+	data = data[n:]
+	h.Zero = int(zero)
+
+	length, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, fmt.Errorf("histogram: invalid bucket length")
+	}
+	data = data[n:]
+
+	for i := uint64(0); i < length; i++ {
+		index, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("histogram: invalid bucket index")
+		}
+		data = data[n:]
+		count, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("histogram: invalid bucket count")
+		}
+		data = data[n:]
+		h.Buckets[int32(index)] += int(count)
+	}
+	return h, nil
+}
@@ -26,17 +26,19 @@ func (m *Methods) Store(methodID int32, method *Method) {
 
 // Method 接口信息
 type Method struct {
-	Type        int16 // 服务类型
-	Duration    int32 // 总耗时
-	Count       int   // 发生次数
-	ErrCount    int   // 错误次数
-	MinDuration int32 // 最小耗时
-	MaxDuration int32 // 最大耗时
+	Type        int16      // 服务类型
+	Duration    int32      // 总耗时
+	Count       int        // 发生次数
+	ErrCount    int        // 错误次数
+	MinDuration int32      // 最小耗时
+	MaxDuration int32      // 最大耗时
+	Histogram   *Histogram // 耗时分布
 }
 
 // NewMethod ...
 func NewMethod(methodType int16) *Method {
 	return &Method{
-		Type: methodType,
+		Type:      methodType,
+		Histogram: NewHistogram(),
 	}
 }
@@ -0,0 +1,28 @@
+package stats
+
+import "time"
+
+// Rollup 统计数据汇总精度，汇总表为分钟表名加上后缀
+type Rollup struct {
+	Name      string // 精度名称，同时是汇总表后缀
+	Interval  int64  // 汇总窗口，单位秒
+	Retention int64  // 默认保留天数，与建表时的default_time_to_live一致
+}
+
+// Rollups 从细到粗的汇总精度，第一级由分钟表汇总，之后每一级由上一级汇总
+var Rollups = []*Rollup{
+	{Name: "10m", Interval: 600, Retention: 90},
+	{Name: "1h", Interval: 3600, Retention: 365},
+	{Name: "1d", Interval: 86400, Retention: 1095},
+}
+
+// Table 汇总表名
+func (r *Rollup) Table(table string) string {
+	return table + "_" + r.Name
+}
+
+// Align 时间所在汇总窗口的开始时间，按本地时区对齐，天汇总从本地零点开始
+func (r *Rollup) Align(t int64) int64 {
+	_, offset := time.Unix(t, 0).Zone()
+	return t - (t+int64(offset))%r.Interval
+}
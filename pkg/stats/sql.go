@@ -25,14 +25,17 @@ func (s *SQLS) Store(sqlID int32, info *SQL) {
 
 // SQL 统计信息
 type SQL struct {
-	Duration    int32 // 总耗时
-	MinDuration int32 // 最小耗时
-	MaxDuration int32 // 最大耗时
-	Count       int   // 发生次数
-	ErrCount    int   // 错误次数
+	Duration    int32      // 总耗时
+	MinDuration int32      // 最小耗时
+	MaxDuration int32      // 最大耗时
+	Count       int        // 发生次数
+	ErrCount    int        // 错误次数
+	Histogram   *Histogram // 耗时分布
 }
 
 // NewSQL ...
 func NewSQL() *SQL {
-	return &SQL{}
+	return &SQL{
+		Histogram: NewHistogram(),
+	}
 }
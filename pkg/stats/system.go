@@ -0,0 +1,60 @@
+package stats
+
+// SystemInfo 主机监控指标
+type SystemInfo struct {
+	CPU     *SystemCPU     `json:"cpu" msg:"cpu"`
+	Memory  *SystemMemory  `json:"memory" msg:"memory"`
+	Load    *SystemLoad    `json:"load" msg:"load"`
+	Disk    *SystemDisk    `json:"disk" msg:"disk"`
+	Network *SystemNetwork `json:"network" msg:"network"`
+}
+
+// NewSystemInfo ...
+func NewSystemInfo() *SystemInfo {
+	return &SystemInfo{
+		CPU:     &SystemCPU{},
+		Memory:  &SystemMemory{},
+		Load:    &SystemLoad{},
+		Disk:    &SystemDisk{},
+		Network: &SystemNetwork{},
+	}
+}
+
+// SystemCPU cpu使用率，0-1
+type SystemCPU struct {
+	Num    int     `json:"num" msg:"num"`
+	Used   float64 `json:"used" msg:"used"`
+	User   float64 `json:"user" msg:"user"`
+	System float64 `json:"system" msg:"system"`
+	IOWait float64 `json:"iowait" msg:"iowait"`
+}
+
+// SystemMemory 内存，单位字节
+type SystemMemory struct {
+	Total     int64 `json:"total" msg:"total"`
+	Used      int64 `json:"used" msg:"used"`
+	Available int64 `json:"available" msg:"available"`
+	SwapTotal int64 `json:"swapTotal" msg:"swapTotal"`
+	SwapUsed  int64 `json:"swapUsed" msg:"swapUsed"`
+}
+
+// SystemLoad 系统负载
+type SystemLoad struct {
+	Load1  float64 `json:"load1" msg:"load1"`
+	Load5  float64 `json:"load5" msg:"load5"`
+	Load15 float64 `json:"load15" msg:"load15"`
+}
+
+// SystemDisk 磁盘，容量单位字节，读写单位字节/秒
+type SystemDisk struct {
+	Total      int64   `json:"total" msg:"total"`
+	Used       int64   `json:"used" msg:"used"`
+	ReadBytes  float64 `json:"readBytes" msg:"readBytes"`
+	WriteBytes float64 `json:"writeBytes" msg:"writeBytes"`
+}
+
+// SystemNetwork 网卡流量，单位字节/秒
+type SystemNetwork struct {
+	RecvBytes float64 `json:"recvBytes" msg:"recvBytes"`
+	SentBytes float64 `json:"sentBytes" msg:"sentBytes"`
+}
@@ -0,0 +1,308 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/pkg/pinpoint/proto"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/command"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/pinpoint"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+)
+
+const (
+	agentDialTimeout   = 3 * time.Second
+	agentRetryInterval = 5 * time.Second
+	agentPingInterval  = 60 * time.Second
+	// 等待握手应答的最长时间，agent需要同步等待collector注册完成
+	agentHandshakeTimeout = 10 * time.Second
+	// 元数据发送队列长度
+	agentRequestQueueLen = 1000
+	// pinpoint StreamCode.TYPE_UNSUPPORT
+	streamTypeUnsupport int16 = 132
+)
+
+// agentConn 与本机agent的tcp链接，握手注册后发送元数据，断线后自动重连
+type agentConn struct {
+	tracer    *Tracer
+	requestC  chan []byte // 等待发送的元数据
+	requestID int32
+	wlock     sync.Mutex
+	stopC     chan bool
+	doneC     chan bool
+	closeOnce sync.Once
+}
+
+func newAgentConn(t *Tracer) *agentConn {
+	return &agentConn{
+		tracer:   t,
+		requestC: make(chan []byte, agentRequestQueueLen),
+		stopC:    make(chan bool),
+		doneC:    make(chan bool),
+	}
+}
+
+// request 非阻塞写入元数据发送队列，队列满时返回false
+func (a *agentConn) request(data []byte) bool {
+	select {
+	case a.requestC <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// close 发送CONTROL_CLIENT_CLOSE后断开链接
+func (a *agentConn) close() {
+	a.closeOnce.Do(func() {
+		close(a.stopC)
+		select {
+		case <-a.doneC:
+		case <-time.After(agentDialTimeout):
+		}
+	})
+}
+
+// run 链接agent，断线后间隔agentRetryInterval重连
+func (a *agentConn) run() {
+	defer close(a.doneC)
+	for {
+		conn, err := net.DialTimeout("tcp", a.tracer.conf.InfoAddr, agentDialTimeout)
+		if err == nil {
+			if a.serve(conn) {
+				return
+			}
+		}
+		select {
+		case <-time.After(agentRetryInterval):
+		case <-a.stopC:
+			return
+		}
+	}
+}
+
+// serve 握手后发送元数据和心跳，链接断开时返回false，sdk关闭时返回true
+func (a *agentConn) serve(conn net.Conn) bool {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, proto.TCP_MAX_PACKET_SIZE)
+
+	if err := a.handshake(conn, reader); err != nil {
+		return false
+	}
+
+	// agent信息，collector保存后在页面展示
+	if err := a.write(conn, a.newRequest(thrift.SerializeCopy(a.agentInfo()))); err != nil {
+		return false
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- a.read(conn, reader)
+	}()
+
+	ticker := time.NewTicker(agentPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-a.requestC:
+			if err := a.write(conn, a.newRequest(data)); err != nil {
+				// 发送失败的元数据重新放入队列，重连后发送
+				a.request(data)
+				return false
+			}
+		case <-ticker.C:
+			ping := make([]byte, 2)
+			binary.BigEndian.PutUint16(ping, uint16(proto.CONTROL_PING_SIMPLE))
+			if err := a.writeBytes(conn, ping); err != nil {
+				return false
+			}
+		case <-errC:
+			return false
+		case <-a.stopC:
+			a.write(conn, proto.NewControlClientClose())
+			return true
+		}
+	}
+}
+
+// handshake 发送CONTROL_HANDSHAKE，agent完成注册后应答
+func (a *agentConn) handshake(conn net.Conn, reader *bufio.Reader) error {
+	t := a.tracer
+	agentInfo := network.NewAgentInfo()
+	agentInfo.AppName = t.conf.AppName
+	agentInfo.AgentID = t.conf.AgentID
+	agentInfo.ServiceType = int32(t.conf.ServiceType)
+	agentInfo.HostName = t.hostName
+	agentInfo.IP4S = t.ip
+	agentInfo.StartTimestamp = t.startTime
+	agentInfo.OperatingEnv = constant.TypeOfEnvGO
+	payload, err := json.Marshal(agentInfo)
+	if err != nil {
+		return err
+	}
+
+	handshake := proto.NewControlHandShake()
+	handshake.RequestID = int(a.nextRequestID())
+	handshake.Payload = payload
+	if err := a.write(conn, handshake); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(agentHandshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	packetType, err := readPacketType(reader)
+	if err != nil {
+		return err
+	}
+	if packetType != proto.CONTROL_HANDSHAKE_RESPONSE {
+		return fmt.Errorf("tracing: unexpected handshake response %d", packetType)
+	}
+	response := proto.NewControlHandShakeResponse()
+	if err := response.Decode(conn, reader); err != nil {
+		return err
+	}
+	result := make(map[string]interface{})
+	if err := json.Unmarshal(response.Payload, &result); err != nil {
+		return err
+	}
+	if code, ok := result[proto.CODE].(float64); !ok || int(code) != proto.HANDSHAKE_SUCCESS.Code {
+		return fmt.Errorf("tracing: handshake failed, %s", string(response.Payload))
+	}
+	return nil
+}
+
+// read 处理agent发送的报文，元数据应答直接丢弃，不支持的指令应答失败
+func (a *agentConn) read(conn net.Conn, reader *bufio.Reader) error {
+	for {
+		packetType, err := readPacketType(reader)
+		if err != nil {
+			return err
+		}
+		switch packetType {
+		case proto.APPLICATION_RESPONSE:
+			response := proto.NewApplicationResponse()
+			if err := readRequestBody(reader, &response.RequestID, &response.Payload); err != nil {
+				return err
+			}
+			break
+		case proto.APPLICATION_REQUEST:
+			request := proto.NewApplicationRequest()
+			if err := readRequestBody(reader, &request.RequestID, &request.Payload); err != nil {
+				return err
+			}
+			response := proto.NewApplicationResponse()
+			response.RequestID = request.RequestID
+			response.Payload = commandResponse(request.Payload)
+			if err := a.write(conn, response); err != nil {
+				return err
+			}
+			break
+		case proto.APPLICATION_STREAM_CREATE:
+			var channelID int
+			var payload []byte
+			if err := readRequestBody(reader, &channelID, &payload); err != nil {
+				return err
+			}
+			fail := proto.NewApplicationStreamCreateFail()
+			fail.ChannelID = channelID
+			fail.Code = streamTypeUnsupport
+			if err := a.write(conn, fail); err != nil {
+				return err
+			}
+			break
+		case proto.CONTROL_PONG:
+			break
+		default:
+			return fmt.Errorf("tracing: unsupported packet type %d", packetType)
+		}
+	}
+}
+
+// commandResponse agent下发的指令，只支持echo
+func commandResponse(payload []byte) []byte {
+	if echo, ok := thrift.Deserialize(payload).(*command.TCommandEcho); ok {
+		return thrift.SerializeCopy(echo)
+	}
+	result := trace.NewTResult_()
+	message := "unsupported command"
+	result.Message = &message
+	return thrift.SerializeCopy(result)
+}
+
+// agentInfo go进程的TAgentInfo
+func (a *agentConn) agentInfo() *pinpoint.TAgentInfo {
+	t := a.tracer
+	info := pinpoint.NewTAgentInfo()
+	info.Hostname = t.hostName
+	info.IP = t.ip
+	info.AgentId = t.conf.AgentID
+	info.ApplicationName = t.conf.AppName
+	info.ServiceType = t.conf.ServiceType
+	info.Pid = int32(os.Getpid())
+	info.AgentVersion = "go-sdk"
+	info.VmVersion = runtime.Version()
+	info.StartTimestamp = t.startTime
+	return info
+}
+
+func (a *agentConn) newRequest(payload []byte) *proto.ApplicationRequest {
+	request := proto.NewApplicationRequest()
+	request.RequestID = int(a.nextRequestID())
+	request.Payload = payload
+	return request
+}
+
+func (a *agentConn) nextRequestID() int32 {
+	a.wlock.Lock()
+	defer a.wlock.Unlock()
+	a.requestID++
+	return a.requestID
+}
+
+// write 编码并写链接，读写协程可能并发写
+func (a *agentConn) write(conn net.Conn, packet proto.Packet) error {
+	body, err := packet.Encode()
+	if err != nil {
+		return err
+	}
+	return a.writeBytes(conn, body)
+}
+
+func (a *agentConn) writeBytes(conn net.Conn, body []byte) error {
+	a.wlock.Lock()
+	defer a.wlock.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(agentDialTimeout))
+	_, err := conn.Write(body)
+	return err
+}
+
+func readPacketType(reader io.Reader) (int16, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return 0, err
+	}
+	return int16(binary.BigEndian.Uint16(buf)), nil
+}
+
+// readRequestBody 读取requestID(channelID)、长度和内容
+func readRequestBody(reader io.Reader, id *int, payload *[]byte) error {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return err
+	}
+	*id = int(binary.BigEndian.Uint32(buf[:4]))
+	*payload = make([]byte, binary.BigEndian.Uint32(buf[4:8]))
+	_, err := io.ReadFull(reader, *payload)
+	return err
+}
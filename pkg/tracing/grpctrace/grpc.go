@@ -0,0 +1,107 @@
+// Package grpctrace grpc拦截器，服务端生成GRPC_SERVER span，客户端生成GRPC_CLIENT event
+// 调用信息通过metadata传递，与http请求头一致
+package grpctrace
+
+import (
+	"context"
+	"strings"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// carrier grpc metadata适配tracing.Carrier，metadata的key都是小写
+type carrier metadata.MD
+
+func (c carrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c carrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+// UnaryServerInterceptor 服务端一元调用拦截器，rpc为grpc方法全名
+func UnaryServerInterceptor(t *tracing.Tracer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		span, ctx := startSpan(ctx, t, info.FullMethod)
+		defer span.End()
+
+		resp, err := handler(ctx, req)
+		span.SetError(err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor 服务端流式调用拦截器，整个流作为一个span
+func StreamServerInterceptor(t *tracing.Tracer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		span, ctx := startSpan(ss.Context(), t, info.FullMethod)
+		defer span.End()
+
+		err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		span.SetError(err)
+		return err
+	}
+}
+
+func startSpan(ctx context.Context, t *tracing.Tracer, method string) (*tracing.Span, context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	span, ctx := t.StartSpan(ctx, method, carrier(md))
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		addr := p.Addr.String()
+		if i := strings.LastIndex(addr, ":"); i > 0 {
+			addr = addr[:i]
+		}
+		span.SetRemoteAddr(addr)
+	}
+	if authority := carrier(md).Get(":authority"); len(authority) > 0 {
+		span.SetEndPoint(authority)
+	}
+	return span, ctx
+}
+
+// serverStream 替换流的context，handler中可以获取span
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// UnaryClientInterceptor 客户端一元调用拦截器，下游地址为cc.Target()
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		event, ctx := tracing.StartEvent(ctx, method, constant.GRPC_CLIENT)
+		if event == nil {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		defer event.End()
+
+		target := cc.Target()
+		event.SetDestination(target)
+		event.SetEndPoint(target)
+
+		md, ok := metadata.FromOutgoingContext(ctx)
+		if ok {
+			md = md.Copy()
+		} else {
+			md = metadata.MD{}
+		}
+		event.Inject(carrier(md), target)
+		ctx = metadata.NewOutgoingContext(ctx, md)
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		event.SetError(err)
+		return err
+	}
+}
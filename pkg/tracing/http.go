@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/bsed/trace/pkg/constant"
+)
+
+// Handler net/http中间件，每个请求生成一个入口span，rpc为请求路径
+func Handler(t *Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span, ctx := t.StartSpan(r.Context(), r.URL.Path, r.Header)
+		span.SetEndPoint(r.Host)
+		span.SetRemoteAddr(remoteIP(r))
+
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			span.SetStatusCode(rw.status)
+			if rw.status >= http.StatusInternalServerError {
+				span.SetError(fmt.Errorf("http status %d", rw.status))
+			}
+			span.End()
+		}()
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// responseWriter 记录应答状态码
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush 流式应答
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// remoteIP 请求方地址，经过代理时使用X-Forwarded-For
+func remoteIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Forwarded-For"); len(ip) > 0 {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Transport http客户端，请求生成HTTP_CLIENT_4 event并写入pinpoint请求头
+type Transport struct {
+	Base http.RoundTripper // 为空时使用http.DefaultTransport
+}
+
+// RoundTrip 实现http.RoundTripper，请求的context中没有span时直接发送
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	event, _ := StartEvent(r.Context(), "http.Client.Do", constant.HTTP_CLIENT_4)
+	if event == nil {
+		return base.RoundTrip(r)
+	}
+	defer event.End()
+
+	host := r.URL.Host
+	event.SetDestination(host)
+	event.SetEndPoint(host)
+	event.Annotate(stringAnnotation(constant.HTTP_URL, r.URL.String()))
+	event.Annotate(stringAnnotation(constant.HTTP_INTERNAL_DISPLAY, host))
+
+	// RoundTripper不能修改原请求，复制请求头后写入
+	header := make(http.Header, len(r.Header)+8)
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	r = r.WithContext(r.Context())
+	r.Header = header
+	event.Inject(header, host)
+
+	resp, err := base.RoundTrip(r)
+	if err != nil {
+		event.SetError(err)
+		return nil, err
+	}
+	event.Annotate(intAnnotation(constant.HTTP_STATUS_CODE, int32(resp.StatusCode)))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		event.SetError(fmt.Errorf("http status %d", resp.StatusCode))
+	}
+	return resp, nil
+}
@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+)
+
+// metaID 由内容计算api、sql、string的ID，第一次出现时通过tcp链接发送元数据
+// collector按服务名保存元数据，同一个服务的所有实例ID一致
+func (t *Tracer) metaID(metaType uint16, value string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	id := int32(h.Sum32() & 0x7fffffff)
+
+	key := fmt.Sprintf("%d:%d", metaType, id)
+	t.Lock()
+	_, ok := t.metas[key]
+	if !ok {
+		t.metas[key] = struct{}{}
+	}
+	t.Unlock()
+	if ok {
+		return id
+	}
+
+	var data []byte
+	switch metaType {
+	case constant.TypeOfAPIMetaData:
+		meta := trace.NewTApiMetaData()
+		meta.AgentId = t.conf.AgentID
+		meta.AgentStartTime = t.startTime
+		meta.ApiId = id
+		meta.ApiInfo = value
+		data = thrift.SerializeCopy(meta)
+		break
+	case constant.TypeOfSQLMetaData:
+		meta := trace.NewTSqlMetaData()
+		meta.AgentId = t.conf.AgentID
+		meta.AgentStartTime = t.startTime
+		meta.SqlId = id
+		meta.Sql = value
+		data = thrift.SerializeCopy(meta)
+		break
+	case constant.TypeOfStringMetaData:
+		meta := trace.NewTStringMetaData()
+		meta.AgentId = t.conf.AgentID
+		meta.AgentStartTime = t.startTime
+		meta.StringId = id
+		meta.StringValue = value
+		data = thrift.SerializeCopy(meta)
+		break
+	}
+
+	if !t.agent.request(data) {
+		// 发送队列已满，下次使用时重新发送
+		t.Lock()
+		delete(t.metas, key)
+		t.Unlock()
+	}
+	return id
+}
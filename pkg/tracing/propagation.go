@@ -0,0 +1,79 @@
+package tracing
+
+import (
+	"strconv"
+)
+
+// pinpoint请求头，与java agent一致
+const (
+	HeaderTraceID       = "Pinpoint-TraceID"
+	HeaderSpanID        = "Pinpoint-SpanID"
+	HeaderParentSpanID  = "Pinpoint-pSpanID"
+	HeaderFlags         = "Pinpoint-Flags"
+	HeaderParentAppName = "Pinpoint-pAppName"
+	HeaderParentAppType = "Pinpoint-pAppType"
+	HeaderHost          = "Pinpoint-Host"
+	HeaderSampled       = "Pinpoint-Sampled"
+)
+
+// Carrier 传递请求头，http.Header和grpc metadata通过适配实现
+type Carrier interface {
+	Get(key string) string
+	Set(key, value string)
+}
+
+// remote 上游服务通过请求头传递的调用信息
+type remote struct {
+	transactionID string
+	spanID        int64
+	parentSpanID  int64
+	flags         int16
+	appName       string
+	appType       int16
+	host          string
+}
+
+// extract 读取请求头，没有transactionId时返回nil
+func extract(carrier Carrier) *remote {
+	if carrier == nil {
+		return nil
+	}
+	transactionID := carrier.Get(HeaderTraceID)
+	if len(transactionID) == 0 {
+		return nil
+	}
+	spanID, err := strconv.ParseInt(carrier.Get(HeaderSpanID), 10, 64)
+	if err != nil {
+		return nil
+	}
+	r := &remote{
+		transactionID: transactionID,
+		spanID:        spanID,
+		parentSpanID:  -1,
+		appName:       carrier.Get(HeaderParentAppName),
+		host:          carrier.Get(HeaderHost),
+	}
+	if id, err := strconv.ParseInt(carrier.Get(HeaderParentSpanID), 10, 64); err == nil {
+		r.parentSpanID = id
+	}
+	if flags, err := strconv.ParseInt(carrier.Get(HeaderFlags), 10, 16); err == nil {
+		r.flags = int16(flags)
+	}
+	if appType, err := strconv.ParseInt(carrier.Get(HeaderParentAppType), 10, 16); err == nil {
+		r.appType = int16(appType)
+	}
+	return r
+}
+
+// inject 写入下游请求头，下游span的spanId为nextSpanID
+func (s *Span) inject(carrier Carrier, nextSpanID int64, host string) {
+	carrier.Set(HeaderTraceID, string(s.span.TransactionId))
+	carrier.Set(HeaderSpanID, strconv.FormatInt(nextSpanID, 10))
+	carrier.Set(HeaderParentSpanID, strconv.FormatInt(s.span.SpanId, 10))
+	carrier.Set(HeaderFlags, strconv.FormatInt(int64(s.span.Flag), 10))
+	carrier.Set(HeaderParentAppName, s.tracer.conf.AppName)
+	carrier.Set(HeaderParentAppType, strconv.FormatInt(int64(s.tracer.conf.ServiceType), 10))
+	if len(host) > 0 {
+		carrier.Set(HeaderHost, host)
+	}
+}
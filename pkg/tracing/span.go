@@ -0,0 +1,319 @@
+package tracing
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+)
+
+type contextKey struct{}
+
+// scope context中保存的当前span和event层级
+type scope struct {
+	span  *Span
+	depth int32
+}
+
+// Span 服务入口，对应一个TSpan，一次请求内的调用记录为Event
+type Span struct {
+	sync.Mutex
+	tracer   *Tracer
+	span     *trace.TSpan
+	start    time.Time
+	sequence int16
+	ended    bool
+}
+
+// StartSpan 开始一个入口span，carrier中有上游请求头时继续上游的调用链
+func (t *Tracer) StartSpan(ctx context.Context, rpc string, carrier Carrier) (*Span, context.Context) {
+	start := time.Now()
+	span := trace.NewTSpan()
+	span.AgentId = t.conf.AgentID
+	span.ApplicationName = t.conf.AppName
+	span.AgentStartTime = t.startTime
+	span.StartTime = start.UnixNano() / 1e6
+	span.ServiceType = t.conf.ServiceType
+	serviceType := t.conf.ServiceType
+	span.ApplicationServiceType = &serviceType
+	span.RPC = &rpc
+	apiID := t.metaID(constant.TypeOfAPIMetaData, rpc)
+	span.ApiId = &apiID
+
+	if r := extract(carrier); r != nil {
+		span.TransactionId = []byte(r.transactionID)
+		span.SpanId = r.spanID
+		span.ParentSpanId = r.parentSpanID
+		span.Flag = r.flags
+		if len(r.appName) > 0 {
+			span.ParentApplicationName = &r.appName
+			span.ParentApplicationType = &r.appType
+		}
+		if len(r.host) > 0 {
+			span.AcceptorHost = &r.host
+		}
+	} else {
+		span.TransactionId = []byte(t.newTransactionID())
+		span.SpanId = t.newSpanID()
+	}
+
+	s := &Span{
+		tracer: t,
+		span:   span,
+		start:  start,
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return s, context.WithValue(ctx, contextKey{}, &scope{span: s})
+}
+
+// SpanFromContext 获取context中的span
+func SpanFromContext(ctx context.Context) *Span {
+	if sc, ok := ctx.Value(contextKey{}).(*scope); ok {
+		return sc.span
+	}
+	return nil
+}
+
+// TransactionID pinpoint transactionId，可以用于日志关联
+func (s *Span) TransactionID() string {
+	if s == nil {
+		return ""
+	}
+	return string(s.span.TransactionId)
+}
+
+// SetEndPoint 服务地址
+func (s *Span) SetEndPoint(endPoint string) {
+	if s == nil || len(endPoint) == 0 {
+		return
+	}
+	s.Lock()
+	s.span.EndPoint = &endPoint
+	if s.span.AcceptorHost == nil {
+		s.span.AcceptorHost = &endPoint
+	}
+	s.Unlock()
+}
+
+// SetRemoteAddr 请求方地址
+func (s *Span) SetRemoteAddr(addr string) {
+	if s == nil || len(addr) == 0 {
+		return
+	}
+	s.Lock()
+	s.span.RemoteAddr = &addr
+	s.Unlock()
+}
+
+// SetStatusCode http状态码
+func (s *Span) SetStatusCode(code int) {
+	s.Annotate(intAnnotation(constant.HTTP_STATUS_CODE, int32(code)))
+}
+
+// SetURL 请求的完整url
+func (s *Span) SetURL(url string) {
+	s.Annotate(stringAnnotation(constant.HTTP_URL, url))
+}
+
+// Annotate 添加annotation
+func (s *Span) Annotate(annotation *trace.TAnnotation) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.span.Annotations = append(s.span.Annotations, annotation)
+	s.Unlock()
+}
+
+// SetError 请求失败
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	exception := s.tracer.exception(err)
+	isErr := int32(1)
+	s.Lock()
+	s.span.ExceptionInfo = exception
+	s.span.Err = &isErr
+	s.Unlock()
+}
+
+// End 结束span并上报，未结束的event以span结束时间为准
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.Elapsed = int32(time.Since(s.start) / time.Millisecond)
+	for _, event := range s.span.SpanEventList {
+		if event.EndElapsed < 0 {
+			event.EndElapsed = s.span.Elapsed - event.StartElapsed
+		}
+	}
+	span := s.span
+	s.Unlock()
+
+	s.tracer.send(span)
+}
+
+// Event 一次内部调用，例如http、数据库访问或者函数调用
+type Event struct {
+	span     *Span
+	event    *trace.TSpanEvent
+	start    time.Time
+	detached bool // span结束后开始的event，单独上报
+}
+
+// StartEvent 在context中的span下开始一个event，没有span时返回nil，nil Event的方法都可以安全调用
+func StartEvent(ctx context.Context, name string, serviceType int16) (*Event, context.Context) {
+	sc, ok := ctx.Value(contextKey{}).(*scope)
+	if !ok {
+		return nil, ctx
+	}
+	s := sc.span
+	start := time.Now()
+
+	event := trace.NewTSpanEvent()
+	event.ServiceType = serviceType
+	event.Depth = sc.depth + 1
+	event.StartElapsed = int32(start.Sub(s.start) / time.Millisecond)
+	// 结束前为-1，span结束时未结束的event以span结束时间为准
+	event.EndElapsed = -1
+	event.RPC = &name
+	apiID := s.tracer.metaID(constant.TypeOfAPIMetaData, name)
+	event.ApiId = &apiID
+
+	s.Lock()
+	event.Sequence = s.sequence
+	s.sequence++
+	detached := s.ended
+	if !detached {
+		s.span.SpanEventList = append(s.span.SpanEventList, event)
+	}
+	s.Unlock()
+
+	e := &Event{
+		span:     s,
+		event:    event,
+		start:    start,
+		detached: detached,
+	}
+	return e, context.WithValue(ctx, contextKey{}, &scope{span: s, depth: event.Depth})
+}
+
+// SetDestination 调用的目标，服务拓扑中的下游节点
+func (e *Event) SetDestination(destination string) {
+	if e == nil || len(destination) == 0 {
+		return
+	}
+	e.span.Lock()
+	e.event.DestinationId = &destination
+	e.span.Unlock()
+}
+
+// SetEndPoint 目标地址
+func (e *Event) SetEndPoint(endPoint string) {
+	if e == nil || len(endPoint) == 0 {
+		return
+	}
+	e.span.Lock()
+	e.event.EndPoint = &endPoint
+	e.span.Unlock()
+}
+
+// SetSQL 数据库语句，sql作为元数据发送，args为绑定参数
+func (e *Event) SetSQL(sql string, args string) {
+	if e == nil {
+		return
+	}
+	value := trace.NewTAnnotationValue()
+	value.IntStringStringValue = &trace.TIntStringStringValue{
+		IntValue: e.span.tracer.metaID(constant.TypeOfSQLMetaData, sql),
+	}
+	if len(args) > 0 {
+		value.IntStringStringValue.StringValue2 = &args
+	}
+	e.Annotate(&trace.TAnnotation{Key: constant.SQL_ID, Value: value})
+}
+
+// Annotate 添加annotation
+func (e *Event) Annotate(annotation *trace.TAnnotation) {
+	if e == nil {
+		return
+	}
+	e.span.Lock()
+	e.event.Annotations = append(e.event.Annotations, annotation)
+	e.span.Unlock()
+}
+
+// SetError 调用失败
+func (e *Event) SetError(err error) {
+	if e == nil || err == nil {
+		return
+	}
+	exception := e.span.tracer.exception(err)
+	e.span.Lock()
+	e.event.ExceptionInfo = exception
+	e.span.Unlock()
+}
+
+// Inject 远程调用写入请求头，下游服务的span作为该event的子节点
+func (e *Event) Inject(carrier Carrier, host string) {
+	if e == nil || carrier == nil {
+		return
+	}
+	nextSpanID := e.span.tracer.newSpanID()
+	e.span.Lock()
+	e.event.NextSpanId = nextSpanID
+	e.span.Unlock()
+	e.span.inject(carrier, nextSpanID, host)
+}
+
+// End 结束event，span结束后开始的event单独以TSpanChunk上报
+func (e *Event) End() {
+	if e == nil {
+		return
+	}
+	s := e.span
+	s.Lock()
+	if !s.ended || e.detached {
+		// span已经上报时耗时以span结束时间为准，不再修改
+		e.event.EndElapsed = int32(time.Since(e.start) / time.Millisecond)
+	}
+	s.Unlock()
+
+	if e.detached {
+		s.tracer.sendChunk(s.span, []*trace.TSpanEvent{e.event})
+	}
+}
+
+// exception 错误类型和内容，类型作为string元数据
+func (t *Tracer) exception(err error) *trace.TIntStringValue {
+	message := err.Error()
+	return &trace.TIntStringValue{
+		IntValue:    t.metaID(constant.TypeOfStringMetaData, reflect.TypeOf(err).String()),
+		StringValue: &message,
+	}
+}
+
+func stringAnnotation(key int32, value string) *trace.TAnnotation {
+	v := trace.NewTAnnotationValue()
+	v.StringValue = &value
+	return &trace.TAnnotation{Key: key, Value: v}
+}
+
+func intAnnotation(key int32, value int32) *trace.TAnnotation {
+	v := trace.NewTAnnotationValue()
+	v.IntValue = &value
+	return &trace.TAnnotation{Key: key, Value: v}
+}
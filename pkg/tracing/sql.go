@@ -0,0 +1,205 @@
+package tracing
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/bsed/trace/pkg/constant"
+)
+
+// WrapDriver database/sql驱动，语句执行生成数据库event，需要使用QueryContext/ExecContext传递context
+// dbType: mysql、mariadb、oracle、postgresql，destination为数据库名，在服务拓扑中展示
+// 使用方法: sql.Register("mysql-trace", tracing.WrapDriver(&mysql.MySQLDriver{}, "mysql", "order"))
+func WrapDriver(d driver.Driver, dbType string, destination string) driver.Driver {
+	return &tracingDriver{
+		Driver:      d,
+		serviceType: dbServiceType(dbType),
+		destination: destination,
+	}
+}
+
+// dbServiceType 数据库对应的ServiceType，与java agent一致
+func dbServiceType(dbType string) int16 {
+	switch strings.ToLower(dbType) {
+	case "mysql":
+		return constant.MYSQL_EXECUTE_QUERY
+	case "mariadb":
+		return constant.MARIADB_EXECUTE_QUERY
+	case "oracle":
+		return constant.ORACLE_EXECUTE_QUERY
+	case "postgres", "postgresql":
+		return constant.POSTGRESQL_EXECUTE_QUERY
+	}
+	return constant.MYSQL_EXECUTE_QUERY
+}
+
+type tracingDriver struct {
+	driver.Driver
+	serviceType int16
+	destination string
+}
+
+func (d *tracingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tracingConn{Conn: conn, driver: d}, nil
+}
+
+// startEvent 开始数据库event，没有span时返回nil
+func (d *tracingDriver) startEvent(ctx context.Context, method string, query string, args []driver.NamedValue) *Event {
+	event, _ := StartEvent(ctx, method, d.serviceType)
+	if event == nil {
+		return nil
+	}
+	event.SetDestination(d.destination)
+	event.SetEndPoint(d.destination)
+	event.SetSQL(query, bindValues(args))
+	return event
+}
+
+// bindValues 绑定参数，逗号分隔
+func bindValues(args []driver.NamedValue) string {
+	if len(args) == 0 {
+		return ""
+	}
+	values := make([]string, 0, len(args))
+	for _, arg := range args {
+		values = append(values, fmt.Sprint(arg.Value))
+	}
+	return strings.Join(values, ",")
+}
+
+type tracingConn struct {
+	driver.Conn
+	driver *tracingDriver
+}
+
+func (c *tracingConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *tracingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracingStmt{Stmt: stmt, driver: c.driver, query: query}, nil
+}
+
+func (c *tracingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *tracingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		// 驱动不支持时database/sql使用Prepare执行
+		return nil, driver.ErrSkip
+	}
+	event := c.driver.startEvent(ctx, "database/sql.Query", query, args)
+	defer event.End()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil && err != driver.ErrSkip {
+		event.SetError(err)
+	}
+	return rows, err
+}
+
+func (c *tracingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	event := c.driver.startEvent(ctx, "database/sql.Exec", query, args)
+	defer event.End()
+	result, err := execer.ExecContext(ctx, query, args)
+	if err != nil && err != driver.ErrSkip {
+		event.SetError(err)
+	}
+	return result, err
+}
+
+func (c *tracingConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracingConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracingConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+type tracingStmt struct {
+	driver.Stmt
+	driver *tracingDriver
+	query  string
+}
+
+func (s *tracingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	event := s.driver.startEvent(ctx, "database/sql.Stmt.Query", s.query, args)
+	defer event.End()
+
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedToValues(args))
+	}
+	event.SetError(err)
+	return rows, err
+}
+
+func (s *tracingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	event := s.driver.startEvent(ctx, "database/sql.Stmt.Exec", s.query, args)
+	defer event.End()
+
+	var result driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		result, err = s.Stmt.Exec(namedToValues(args))
+	}
+	event.SetError(err)
+	return result, err
+}
+
+func (s *tracingStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+func namedToValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
@@ -0,0 +1,183 @@
+// Package tracing go服务接入监控的sdk
+// 生成与pinpoint java agent一致的TSpan、TSpanEvent，通过本机agent的tcp端口握手注册，udp端口上报span
+// 请求头与pinpoint一致，go服务和java服务之间的调用链可以串联
+package tracing
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/pinpoint/proto"
+	"github.com/bsed/trace/pkg/pinpoint/thrift"
+	"github.com/bsed/trace/pkg/pinpoint/thrift/trace"
+)
+
+// Config sdk配置，地址与agent的pinpoint配置一致
+type Config struct {
+	AppName     string // 服务名
+	AgentID     string // 服务实例ID，为空时使用服务名@hostname
+	InfoAddr    string // agent tcp地址，默认127.0.0.1:9994
+	SpanAddr    string // agent span udp地址，默认127.0.0.1:9996
+	ServiceType int16  // 服务类型，默认GO_APP
+}
+
+// Tracer 链路追踪，一个进程通常只需要一个
+type Tracer struct {
+	sync.Mutex
+	conf      Config
+	hostName  string
+	ip        string
+	startTime int64               // agentStartTime，单位毫秒
+	sequence  int64               // transactionId序号
+	metas     map[string]struct{} // 已经生成的元数据，key为类型:ID
+	rand      *rand.Rand          // 生成spanID
+	agent     *agentConn          // agent tcp链接
+	spanConn  net.Conn            // agent span udp链接
+}
+
+// NewTracer 创建Tracer，后台链接agent，agent不可用时span直接丢弃，不影响业务
+func NewTracer(conf Config) (*Tracer, error) {
+	if len(conf.AppName) == 0 {
+		return nil, fmt.Errorf("tracing: app name is empty")
+	}
+	hostName, _ := os.Hostname()
+	if len(conf.AgentID) == 0 {
+		conf.AgentID = conf.AppName + "@" + hostName
+	}
+	if len(conf.InfoAddr) == 0 {
+		conf.InfoAddr = "127.0.0.1:9994"
+	}
+	if len(conf.SpanAddr) == 0 {
+		conf.SpanAddr = "127.0.0.1:9996"
+	}
+	if conf.ServiceType == 0 {
+		conf.ServiceType = constant.GO_APP
+	}
+
+	spanConn, err := net.Dial("udp", conf.SpanAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	t := &Tracer{
+		conf:      conf,
+		hostName:  hostName,
+		ip:        localIP(),
+		startTime: now.UnixNano() / 1e6,
+		metas:     make(map[string]struct{}),
+		rand:      rand.New(rand.NewSource(now.UnixNano())),
+		spanConn:  spanConn,
+	}
+	t.agent = newAgentConn(t)
+	go t.agent.run()
+	return t, nil
+}
+
+// Close 发送下线通知并断开agent链接
+func (t *Tracer) Close() error {
+	t.agent.close()
+	return t.spanConn.Close()
+}
+
+// AppName 服务名
+func (t *Tracer) AppName() string {
+	return t.conf.AppName
+}
+
+// AgentID 服务实例ID
+func (t *Tracer) AgentID() string {
+	return t.conf.AgentID
+}
+
+// newTransactionID 与pinpoint一致的transactionId: agentId^agentStartTime^序号
+func (t *Tracer) newTransactionID() string {
+	seq := atomic.AddInt64(&t.sequence, 1)
+	return fmt.Sprintf("%s^%d^%d", t.conf.AgentID, t.startTime, seq)
+}
+
+// newSpanID 随机spanID，-1表示没有父span，不能使用
+func (t *Tracer) newSpanID() int64 {
+	t.Lock()
+	defer t.Unlock()
+	for {
+		id := t.rand.Int63()
+		if t.rand.Intn(2) == 0 {
+			id = -id
+		}
+		if id != -1 && id != 0 {
+			return id
+		}
+	}
+}
+
+// send 发送span，超过udp报文长度时event拆分到TSpanChunk中发送
+func (t *Tracer) send(span *trace.TSpan) {
+	data := thrift.SerializeCopy(span)
+	if len(data) <= proto.UDP_MAX_PACKET_SIZE {
+		t.spanConn.Write(data)
+		return
+	}
+
+	events := span.SpanEventList
+	span.SpanEventList = nil
+	t.spanConn.Write(thrift.SerializeCopy(span))
+	t.sendChunk(span, events)
+}
+
+// sendChunk event按udp报文长度分批以TSpanChunk发送
+func (t *Tracer) sendChunk(span *trace.TSpan, events []*trace.TSpanEvent) {
+	chunk := trace.NewTSpanChunk()
+	chunk.AgentId = span.AgentId
+	chunk.ApplicationName = span.ApplicationName
+	chunk.AgentStartTime = span.AgentStartTime
+	chunk.ServiceType = span.ServiceType
+	chunk.TransactionId = span.TransactionId
+	chunk.SpanId = span.SpanId
+	chunk.EndPoint = span.EndPoint
+	chunk.ApplicationServiceType = span.ApplicationServiceType
+
+	var last []byte
+	for i := 0; i < len(events); i++ {
+		chunk.SpanEventList = append(chunk.SpanEventList, events[i])
+		data := thrift.SerializeCopy(chunk)
+		if len(data) <= proto.UDP_MAX_PACKET_SIZE {
+			last = data
+			continue
+		}
+		if len(chunk.SpanEventList) == 1 {
+			// 单个event超过报文长度，直接丢弃
+			chunk.SpanEventList = chunk.SpanEventList[:0]
+			last = nil
+			continue
+		}
+		// 发送之前的event，当前event放入下一个chunk
+		t.spanConn.Write(last)
+		chunk.SpanEventList = chunk.SpanEventList[:0]
+		last = nil
+		i--
+	}
+	if last != nil {
+		t.spanConn.Write(last)
+	}
+}
+
+// localIP 本机第一个非回环的ipv4地址
+func localIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,227 @@
+package zipkin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bsed/trace/pkg/otlp"
+)
+
+// Zipkin v2 JSON格式，时间单位为微秒，tag值都是字符串
+// 转换为OTLP模型后与opentelemetry数据使用同样的pinpoint转换
+
+// Endpoint ...
+type Endpoint struct {
+	ServiceName string `json:"serviceName"`
+	IPv4        string `json:"ipv4"`
+	IPv6        string `json:"ipv6"`
+	Port        int64  `json:"port"`
+}
+
+// Annotation 带时间的事件
+type Annotation struct {
+	Timestamp uint64 `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// Span zipkin v2 span
+type Span struct {
+	TraceID        string            `json:"traceId"`
+	ID             string            `json:"id"`
+	ParentID       string            `json:"parentId"`
+	Name           string            `json:"name"`
+	Kind           string            `json:"kind"`
+	Timestamp      uint64            `json:"timestamp"`
+	Duration       uint64            `json:"duration"`
+	LocalEndpoint  *Endpoint         `json:"localEndpoint"`
+	RemoteEndpoint *Endpoint         `json:"remoteEndpoint"`
+	Annotations    []*Annotation     `json:"annotations"`
+	Tags           map[string]string `json:"tags"`
+	Shared         bool              `json:"shared"`
+}
+
+// 远端服务名为数据库时，客户端span作为数据库调用
+var dbSystems = map[string]struct{}{
+	"mysql":      {},
+	"mariadb":    {},
+	"oracle":     {},
+	"postgresql": {},
+	"mssql":      {},
+	"cassandra":  {},
+	"redis":      {},
+}
+
+// Parse 解析zipkin v2 JSON，按localEndpoint分组为OTLP ResourceSpans
+func Parse(data []byte) (*otlp.ExportRequest, error) {
+	spans := make([]*Span, 0)
+	if err := json.Unmarshal(data, &spans); err != nil {
+		return nil, err
+	}
+
+	req := &otlp.ExportRequest{}
+	groups := make(map[string]*otlp.ResourceSpans)
+	for _, span := range spans {
+		if span == nil {
+			continue
+		}
+		ospan, err := span.convert()
+		if err != nil {
+			return nil, err
+		}
+
+		local := span.LocalEndpoint
+		if local == nil {
+			local = &Endpoint{}
+		}
+		key := local.ServiceName + "/" + local.IPv4 + "/" + local.IPv6
+		rs, ok := groups[key]
+		if !ok {
+			rs = &otlp.ResourceSpans{
+				Resource: resource(local),
+			}
+			groups[key] = rs
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+		}
+		rs.Spans = append(rs.Spans, ospan)
+	}
+	return req, nil
+}
+
+// resource localEndpoint转换为资源属性，以ip作为host.name区分服务实例
+func resource(local *Endpoint) otlp.Attributes {
+	attrs := make(otlp.Attributes)
+	if len(local.ServiceName) > 0 {
+		attrs["service.name"] = local.ServiceName
+	}
+	if ip := endpointIP(local); len(ip) > 0 {
+		attrs["host.name"] = ip
+		attrs["host.ip"] = ip
+	}
+	return attrs
+}
+
+func (s *Span) convert() (*otlp.Span, error) {
+	span := &otlp.Span{
+		Name:       s.Name,
+		StartTime:  s.Timestamp * 1000,
+		EndTime:    (s.Timestamp + s.Duration) * 1000,
+		Attributes: make(otlp.Attributes),
+	}
+	var err error
+	if span.TraceID, err = hexID(s.TraceID, 16); err != nil {
+		return nil, err
+	}
+	if span.SpanID, err = hexID(s.ID, 8); err != nil {
+		return nil, err
+	}
+	if span.ParentSpanID, err = hexID(s.ParentID, 8); err != nil {
+		return nil, err
+	}
+
+	switch s.Kind {
+	case "SERVER":
+		span.Kind = otlp.SpanKindServer
+		break
+	case "CLIENT":
+		span.Kind = otlp.SpanKindClient
+		break
+	case "PRODUCER":
+		span.Kind = otlp.SpanKindProducer
+		break
+	case "CONSUMER":
+		span.Kind = otlp.SpanKindConsumer
+		break
+	default:
+		span.Kind = otlp.SpanKindInternal
+		break
+	}
+	if s.Shared && span.Kind == otlp.SpanKindServer {
+		// 服务端与客户端共用spanID，pinpoint中服务端span的parentSpanId为客户端event的nextSpanId
+		span.ParentSpanID = span.SpanID
+	}
+
+	for key, value := range s.Tags {
+		span.Attributes[key] = value
+	}
+	attrs := span.Attributes
+	if msg, ok := s.Tags["error"]; ok {
+		span.Status.Code = otlp.StatusCodeError
+		span.Status.Message = msg
+	}
+	if path := s.Tags["http.path"]; len(path) > 0 && len(attrs.String("http.target")) == 0 {
+		attrs["http.target"] = path
+	}
+	if query := s.Tags["sql.query"]; len(query) > 0 && len(attrs.String("db.statement")) == 0 {
+		attrs["db.statement"] = query
+	}
+
+	if local := s.LocalEndpoint; local != nil && span.Kind == otlp.SpanKindServer {
+		if ip := endpointIP(local); len(ip) > 0 {
+			attrs["net.host.name"] = ip
+		}
+		if local.Port > 0 {
+			attrs["net.host.port"] = local.Port
+		}
+	}
+	if remote := s.RemoteEndpoint; remote != nil {
+		ip := endpointIP(remote)
+		switch span.Kind {
+		case otlp.SpanKindServer, otlp.SpanKindConsumer:
+			if len(ip) > 0 {
+				attrs["client.address"] = ip
+			}
+			break
+		case otlp.SpanKindClient, otlp.SpanKindProducer:
+			if len(remote.ServiceName) > 0 {
+				attrs["peer.service"] = remote.ServiceName
+				if _, ok := dbSystems[strings.ToLower(remote.ServiceName)]; ok && len(attrs.String("db.system")) == 0 {
+					attrs["db.system"] = strings.ToLower(remote.ServiceName)
+				}
+			}
+			if len(ip) > 0 {
+				attrs["net.peer.name"] = ip
+				attrs["net.peer.ip"] = ip
+			}
+			if remote.Port > 0 {
+				attrs["net.peer.port"] = remote.Port
+			}
+			break
+		}
+	}
+
+	for _, annotation := range s.Annotations {
+		if annotation == nil {
+			continue
+		}
+		span.Events = append(span.Events, &otlp.Event{
+			Time:       annotation.Timestamp * 1000,
+			Name:       annotation.Value,
+			Attributes: make(otlp.Attributes),
+		})
+	}
+	return span, nil
+}
+
+// hexID 解析hex格式的ID，长度不足时左侧补零，64位和128位traceId可以关联
+func hexID(s string, size int) ([]byte, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	id, err := hex.DecodeString(strings.Repeat("0", len(s)%2) + s)
+	if err != nil || len(id) > size {
+		return nil, fmt.Errorf("zipkin: invalid id %s", s)
+	}
+	if len(id) < size {
+		id = append(make([]byte, size-len(id)), id...)
+	}
+	return id, nil
+}
+
+func endpointIP(e *Endpoint) string {
+	if len(e.IPv4) > 0 {
+		return e.IPv4
+	}
+	return e.IPv6
+}
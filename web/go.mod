@@ -19,11 +19,13 @@ require (
 	github.com/mattn/go-colorable v0.1.1 // indirect
 	github.com/mattn/go-isatty v0.0.7 // indirect
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/nats-io/nats.go v1.8.1
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/spf13/cobra v0.0.3
 	github.com/spf13/viper v1.3.2
 	github.com/valyala/fasthttp v1.2.0
 	github.com/valyala/fasttemplate v1.0.1 // indirect
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	go.uber.org/zap v1.9.1
@@ -32,3 +34,5 @@ require (
 	gopkg.in/yaml.v2 v2.2.2
 	stathat.com/c/consistent v1.0.0 // indirect
 )
+
+replace github.com/bsed/trace => ../
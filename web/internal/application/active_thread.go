@@ -0,0 +1,70 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bsed/trace/web/internal/misc"
+	"github.com/imdevlab/g"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+)
+
+// ActiveThreadResult 实时活跃线程数，按响应时间分段
+type ActiveThreadResult struct {
+	Timeline     []string `json:"timeline"`
+	FastList     []int32  `json:"fast_list"`      // 1s以内
+	NormalList   []int32  `json:"normal_list"`    // 3s以内
+	SlowList     []int32  `json:"slow_list"`      // 5s以内
+	VerySlowList []int32  `json:"very_slow_list"` // 5s以上
+}
+
+// ActiveThread 查询agent的实时活跃线程数，需要先下发active_thread_stream指令
+// start为毫秒时间戳，默认返回最近一分钟的数据
+func ActiveThread(c echo.Context) error {
+	appName := c.FormValue("app_name")
+	agentID := c.FormValue("agent_id")
+	start, _ := strconv.ParseInt(c.FormValue("start"), 10, 64)
+	if start <= 0 {
+		start = time.Now().Add(-time.Minute).UnixNano() / 1e6
+	}
+
+	q := misc.TraceCql.Query(`SELECT input_date,counts FROM agent_active_thread WHERE app_name=? and agent_id=? and input_date > ?`, appName, agentID, start)
+	iter := q.Iter()
+
+	var inputDate int64
+	var counts []int32
+	dates := make([]int64, 0)
+	histograms := make([][]int32, 0)
+	for iter.Scan(&inputDate, &counts) {
+		dates = append(dates, inputDate)
+		histograms = append(histograms, counts)
+	}
+
+	if err := iter.Close(); err != nil {
+		g.L.Warn("access database error", zap.Error(err), zap.String("query", q.String()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusInternalServerError,
+			ErrCode: g.DatabaseC,
+			Message: g.DatabaseE,
+		})
+	}
+
+	// 数据按时间倒序存储，图表按时间正序展示
+	res := &ActiveThreadResult{}
+	for i := len(dates) - 1; i >= 0; i-- {
+		histogram := make([]int32, 4)
+		copy(histogram, histograms[i])
+		res.Timeline = append(res.Timeline, misc.Timestamp2TimeString(dates[i]))
+		res.FastList = append(res.FastList, histogram[0])
+		res.NormalList = append(res.NormalList, histogram[1])
+		res.SlowList = append(res.SlowList, histogram[2])
+		res.VerySlowList = append(res.VerySlowList, histogram[3])
+	}
+
+	return c.JSON(http.StatusOK, g.Result{
+		Status: http.StatusOK,
+		Data:   res,
+	})
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bsed/trace/web/internal/misc"
+	"github.com/imdevlab/g"
+	"github.com/labstack/echo"
+	"go.uber.org/zap"
+)
+
+// Apdex 应用或者api的apdex阈值，api为空时为应用默认值
+type Apdex struct {
+	API          string `json:"api"`
+	Satisfaction int    `json:"satisfaction"`
+	Tolerate     int    `json:"tolerate"`
+}
+
+// SetAppApdex 设置apdex阈值，collector定时加载，satisfaction为0时删除该阈值
+func SetAppApdex(c echo.Context) error {
+	appName := c.FormValue("app_name")
+	api := c.FormValue("api")
+	satisfaction, err1 := strconv.Atoi(c.FormValue("satisfaction"))
+	tolerate, err2 := strconv.Atoi(c.FormValue("tolerate"))
+	if appName == "" || err1 != nil || satisfaction < 0 || (err2 == nil && tolerate != 0 && tolerate < satisfaction) {
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusBadRequest,
+			ErrCode: g.ParamInvalidC,
+			Message: g.ParamInvalidE,
+		})
+	}
+
+	q := misc.StaticCql.Query(`INSERT INTO app_apdex (app_name,api,satisfaction,tolerate,update_date) VALUES (?,?,?,?,?)`,
+		appName, api, satisfaction, tolerate, time.Now().Unix())
+	if satisfaction == 0 {
+		q = misc.StaticCql.Query(`DELETE FROM app_apdex WHERE app_name=? and api=?`, appName, api)
+	}
+	if err := q.Exec(); err != nil {
+		g.L.Warn("access database error", zap.Error(err), zap.String("query", q.String()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusInternalServerError,
+			ErrCode: g.DatabaseC,
+			Message: g.DatabaseE,
+		})
+	}
+
+	return c.JSON(http.StatusOK, g.Result{
+		Status: http.StatusOK,
+	})
+}
+
+// AppApdex 查询应用的apdex阈值
+func AppApdex(c echo.Context) error {
+	appName := c.FormValue("app_name")
+
+	q := misc.StaticCql.Query(`SELECT api,satisfaction,tolerate FROM app_apdex WHERE app_name=?`, appName)
+	iter := q.Iter()
+
+	apdexs := make([]*Apdex, 0)
+	var api string
+	var satisfaction, tolerate int
+	for iter.Scan(&api, &satisfaction, &tolerate) {
+		apdexs = append(apdexs, &Apdex{
+			API:          api,
+			Satisfaction: satisfaction,
+			Tolerate:     tolerate,
+		})
+	}
+
+	if err := iter.Close(); err != nil {
+		g.L.Warn("access database error", zap.Error(err), zap.String("query", q.String()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusInternalServerError,
+			ErrCode: g.DatabaseC,
+			Message: g.DatabaseE,
+		})
+	}
+
+	return c.JSON(http.StatusOK, g.Result{
+		Status: http.StatusOK,
+		Data:   apdexs,
+	})
+}
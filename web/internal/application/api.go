@@ -9,6 +9,7 @@ import (
 	"github.com/imdevlab/g"
 	"github.com/imdevlab/g/utils"
 	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/stats"
 	"github.com/bsed/trace/web/internal/misc"
 	"github.com/labstack/echo"
 	"go.uber.org/zap"
@@ -21,6 +22,10 @@ type ApiStat struct {
 	Count          int     `json:"count"`
 	AverageElapsed float64 `json:"average_elapsed"`
 	ErrorCount     int     `json:"error_count"`
+	P50            int32   `json:"p50"`
+	P90            int32   `json:"p90"`
+	P99            int32   `json:"p99"`
+	histogram      *stats.Histogram
 }
 
 // type ApiStats []*ApiStat
@@ -48,17 +53,27 @@ func ApiStats(c echo.Context) error {
 	}
 
 	// 读取相应数据，按照时间填到对应的桶中
-	q := `SELECT api,max_duration,min_duration,duration, count,err_count FROM api_stats WHERE app_name = ? and input_date > ? and input_date < ? `
-	iter := misc.TraceCql.Query(q, appName, start.Unix(), end.Unix()).Iter()
+	q := `SELECT api,max_duration,min_duration,duration, count,err_count,histogram FROM %s WHERE app_name = ? and input_date > ? and input_date < ? `
+	iter := misc.NewStatsQuery(q, "api_stats", appName, start, end, appName).Iter()
 
 	// apps := make(map[string]*AppStat)
 	var maxElapsed, minElapsed, count, errCount, elapsed int
 	var api string
+	var histogram []byte
 	ass := make(map[string]*ApiStat)
-	for iter.Scan(&api, &maxElapsed, &minElapsed, &elapsed, &count, &errCount) {
+	for iter.Scan(&api, &maxElapsed, &minElapsed, &elapsed, &count, &errCount, &histogram) {
 		as, ok := ass[api]
 		if !ok {
-			ass[api] = &ApiStat{api, maxElapsed, minElapsed, count, utils.DecimalPrecision(float64(elapsed / count)), errCount}
+			as = &ApiStat{
+				API:            api,
+				MaxElapsed:     maxElapsed,
+				MinElapsed:     minElapsed,
+				Count:          count,
+				AverageElapsed: utils.DecimalPrecision(float64(elapsed / count)),
+				ErrorCount:     errCount,
+				histogram:      stats.NewHistogram(),
+			}
+			ass[api] = as
 		} else {
 			// 取最大值
 			if maxElapsed > as.MaxElapsed {
@@ -74,6 +89,9 @@ func ApiStats(c echo.Context) error {
 			// 平均 = 过去的平均 * 过去总次数  + 最新的平均 * 最新的次数/ (过去总次数 + 最新次数)
 			as.AverageElapsed = utils.DecimalPrecision((as.AverageElapsed*float64(as.Count) + float64(elapsed)) / float64((as.Count + count)))
 		}
+
+		// 合并每分钟的耗时直方图，计算整个时间段的分位耗时
+		mergeHistogram(as.histogram, histogram)
 	}
 
 	if err := iter.Close(); err != nil {
@@ -83,6 +101,7 @@ func ApiStats(c echo.Context) error {
 	// 对每个桶里的数据进行计算
 	apiStats := make([]*ApiStat, 0, len(ass))
 	for _, as := range ass {
+		as.P50, as.P90, as.P99 = as.histogram.Percentiles()
 		apiStats = append(apiStats, as)
 	}
 
@@ -129,8 +148,8 @@ func ApiDetail(c echo.Context) error {
 		})
 	}
 
-	q := `SELECT method_id,service_type,elapsed,max_elapsed,min_elapsed,count,err_count FROM method_stats WHERE app_name = ? and api = ? and input_date > ? and input_date < ? `
-	iter := misc.TraceCql.Query(q, appName, api, start.Unix(), end.Unix()).Iter()
+	q := `SELECT method_id,service_type,elapsed,max_elapsed,min_elapsed,count,err_count FROM %s WHERE app_name = ? and api = ? and input_date > ? and input_date < ? `
+	iter := misc.NewStatsQuery(q, "method_stats", appName, start, end, appName, api).Iter()
 
 	var apiID, serType, elapsed, maxE, minE, count, errCount int
 	var totalElapsed int
@@ -228,14 +247,16 @@ func ApiDashboard(c echo.Context) error {
 	}
 
 	// 读取相应数据，按照时间填到对应的桶中
-	q := misc.TraceCql.Query(`SELECT duration,count,err_count,input_date FROM api_stats WHERE app_name = ?  and api = ? and input_date > ? and input_date < ? `, appName, api, start.Unix(), end.Unix())
+	q := misc.NewStatsQuery(`SELECT duration,count,err_count,satisfaction,tolerate,histogram,input_date FROM %s WHERE app_name = ?  and api = ? and input_date > ? and input_date < ? `, "api_stats", appName, start, end, appName, api)
 	iter := q.Iter()
 
 	// apps := make(map[string]*AppStat)
 	var count int
-	var tElapsed, errCount int
+	var tElapsed, errCount, satisfaction, tolerate int
 	var inputDate int64
-	for iter.Scan(&tElapsed, &count, &errCount, &inputDate) {
+	var histogram []byte
+	histograms := make(map[string]*stats.Histogram)
+	for iter.Scan(&tElapsed, &count, &errCount, &satisfaction, &tolerate, &histogram, &inputDate) {
 		t := time.Unix(inputDate, 0)
 		// 计算该时间落在哪个时间桶里
 		i := int(t.Sub(start).Minutes()) / step
@@ -246,6 +267,15 @@ func ApiDashboard(c echo.Context) error {
 		app.Count += count
 		app.totalElapsed += float64(tElapsed)
 		app.errCount += float64(errCount)
+		app.satisfaction += float64(satisfaction)
+		app.tolerate += float64(tolerate)
+
+		h, ok := histograms[ts]
+		if !ok {
+			h = stats.NewHistogram()
+			histograms[ts] = h
+		}
+		mergeHistogram(h, histogram)
 	}
 
 	if err := iter.Close(); err != nil {
@@ -256,6 +286,7 @@ func ApiDashboard(c echo.Context) error {
 	for _, app := range timeBucks {
 		app.ErrorPercent = utils.DecimalPrecision(100 * app.errCount / float64(app.Count))
 		app.AverageElapsed = utils.DecimalPrecision(app.totalElapsed / float64(app.Count))
+		app.Apdex = utils.DecimalPrecision((app.satisfaction + app.tolerate/2) / float64(app.Count))
 		app.Count = app.Count / step
 	}
 
@@ -266,6 +297,12 @@ func ApiDashboard(c echo.Context) error {
 	elapsedList := make([]float64, 0)
 	//错误率列表
 	errorList := make([]float64, 0)
+	//apdex列表
+	apdexList := make([]float64, 0)
+	// 分位耗时列表
+	p50List := make([]int32, 0)
+	p90List := make([]int32, 0)
+	p99List := make([]int32, 0)
 
 	for _, ts := range timeline {
 		app := timeBucks[ts]
@@ -281,7 +318,13 @@ func ApiDashboard(c echo.Context) error {
 		countList = append(countList, app.Count)
 		elapsedList = append(elapsedList, app.AverageElapsed)
 		errorList = append(errorList, app.ErrorPercent)
+		apdexList = append(apdexList, app.Apdex)
 
+		// 没有数据的桶分位耗时为0
+		p50, p90, p99 := histograms[ts].Percentiles()
+		p50List = append(p50List, p50)
+		p90List = append(p90List, p90)
+		p99List = append(p99List, p99)
 	}
 
 	return c.JSON(http.StatusOK, g.Result{
@@ -291,6 +334,23 @@ func ApiDashboard(c echo.Context) error {
 			CountList:   countList,
 			ElapsedList: elapsedList,
 			ErrorList:   errorList,
+			ApdexList:   apdexList,
+			P50List:     p50List,
+			P90List:     p90List,
+			P99List:     p99List,
 		},
 	})
 }
+
+// mergeHistogram 合并数据库中的耗时直方图，升级前的数据没有直方图
+func mergeHistogram(h *stats.Histogram, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	other, err := stats.DecodeHistogram(data)
+	if err != nil {
+		g.L.Warn("decode histogram error", zap.Error(err))
+		return
+	}
+	h.Merge(other)
+}
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bsed/trace/pkg/constant"
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/web/internal/misc"
+	"github.com/gocql/gocql"
+	"github.com/imdevlab/g"
+	"github.com/labstack/echo"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+// 指令名和类型的对应关系
+var commandTypes = map[string]uint16{
+	"thread_dump":              constant.TypeOfThreadDump,
+	"active_thread_count":      constant.TypeOfActiveThreadCount,
+	"active_thread_dump":       constant.TypeOfActiveThreadDump,
+	"active_thread_light_dump": constant.TypeOfActiveThreadLightDump,
+	// 实时活跃线程数，需要在30秒内重复下发续期
+	"active_thread_stream": constant.TypeOfActiveThreadStream,
+}
+
+// CommandResult 指令执行结果
+type CommandResult struct {
+	ID        string `json:"id"`
+	Type      int    `json:"type"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	Result    string `json:"result"` // jvm返回结果，json格式
+	InputDate string `json:"input_date"`
+}
+
+// AgentCommand 下发线程dump、活跃线程等指令给pinpoint agent，返回指令ID用于查询结果
+func AgentCommand(c echo.Context) error {
+	appName := c.FormValue("app_name")
+	agentID := c.FormValue("agent_id")
+	cmdType, ok := commandTypes[c.FormValue("type")]
+	if appName == "" || agentID == "" || !ok {
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusBadRequest,
+			ErrCode: g.ParamInvalidC,
+			Message: g.ParamInvalidE,
+		})
+	}
+
+	cmd := network.NewCommand()
+	cmd.ID = gocql.TimeUUID().String()
+	cmd.Type = cmdType
+	cmd.AppName = appName
+	cmd.AgentID = agentID
+	cmd.Time = time.Now().UnixNano() / 1e6
+	if names := c.FormValue("thread_names"); names != "" {
+		cmd.ThreadNames = strings.Split(names, ",")
+	}
+	limit, _ := strconv.Atoi(c.FormValue("limit"))
+	cmd.Limit = int32(limit)
+
+	b, err := msgpack.Marshal(cmd)
+	if err != nil {
+		g.L.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusBadRequest,
+			ErrCode: g.ReqFailedC,
+			Message: g.ReqFailedE,
+		})
+	}
+
+	// 广播给所有collector，由agent所在的collector下发
+	if err := misc.MQ.Publish(commandTopic(), b); err != nil {
+		g.L.Warn("mq publish", zap.String("error", err.Error()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusBadRequest,
+			ErrCode: g.ReqFailedC,
+			Message: g.ReqFailedE,
+		})
+	}
+
+	return c.JSON(http.StatusOK, g.Result{
+		Status: http.StatusOK,
+		Data:   cmd.ID,
+	})
+}
+
+// AgentCommandResult 查询agent最近的指令结果，指定id时只返回该指令的结果
+func AgentCommandResult(c echo.Context) error {
+	appName := c.FormValue("app_name")
+	agentID := c.FormValue("agent_id")
+	id := c.FormValue("id")
+
+	q := misc.TraceCql.Query(`SELECT id,type,success,message,result,input_date FROM agent_command WHERE app_name=? and agent_id=? LIMIT 50`, appName, agentID)
+	iter := q.Iter()
+
+	var cmdID, message, result string
+	var cmdType int
+	var success bool
+	var inputDate int64
+	results := make([]*CommandResult, 0)
+	for iter.Scan(&cmdID, &cmdType, &success, &message, &result, &inputDate) {
+		if id != "" && id != cmdID {
+			continue
+		}
+		results = append(results, &CommandResult{
+			ID:        cmdID,
+			Type:      cmdType,
+			Success:   success,
+			Message:   message,
+			Result:    result,
+			InputDate: misc.Timestamp2TimeString(inputDate),
+		})
+	}
+
+	if err := iter.Close(); err != nil {
+		g.L.Warn("access database error", zap.Error(err), zap.String("query", q.String()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusInternalServerError,
+			ErrCode: g.DatabaseC,
+			Message: g.DatabaseE,
+		})
+	}
+
+	return c.JSON(http.StatusOK, g.Result{
+		Status: http.StatusOK,
+		Data:   results,
+	})
+}
+
+func commandTopic() string {
+	if misc.Conf.MQ.CommandTopic == "" {
+		return "tracing_command"
+	}
+	return misc.Conf.MQ.CommandTopic
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bsed/trace/pkg/network"
+	"github.com/bsed/trace/web/internal/misc"
+	"github.com/imdevlab/g"
+	"github.com/labstack/echo"
+	"github.com/vmihailenco/msgpack"
+	"go.uber.org/zap"
+)
+
+// AppConfigResult app配置和各agent的应用结果
+type AppConfigResult struct {
+	Config *network.AgentConfig `json:"config"`
+	Acks   []*ConfigAck         `json:"acks"`
+}
+
+// ConfigAck agent应用配置的结果
+type ConfigAck struct {
+	AgentID   string `json:"agent_id"`
+	Version   int64  `json:"version"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	InputDate string `json:"input_date"`
+}
+
+// SetAppConfig 设置app配置，由collector下发给agent，参数为空时使用agent.yaml中的配置
+func SetAppConfig(c echo.Context) error {
+	conf := network.NewAgentConfig()
+	conf.AppName = c.FormValue("app_name")
+	conf.Version = time.Now().UnixNano() / 1e6
+	conf.LogLevel = c.FormValue("log_level")
+	conf.SpanReportInterval, _ = strconv.Atoi(c.FormValue("span_report_interval"))
+	conf.SpanQueueLen, _ = strconv.Atoi(c.FormValue("span_queue_len"))
+	if rate := c.FormValue("sampling_rate"); rate != "" {
+		conf.Sampling = &network.SamplingConfig{}
+		conf.Sampling.Enable, _ = strconv.ParseBool(c.FormValue("sampling_enable"))
+		conf.Sampling.Rate, _ = strconv.ParseFloat(rate, 64)
+		slowThreshold, _ := strconv.Atoi(c.FormValue("slow_threshold"))
+		conf.Sampling.SlowThreshold = int32(slowThreshold)
+	}
+	if err := conf.Validate(); err != nil {
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusBadRequest,
+			ErrCode: g.ParamInvalidC,
+			Message: err.Error(),
+		})
+	}
+
+	b, _ := json.Marshal(conf)
+	q := misc.StaticCql.Query(`INSERT INTO app_config (app_name,version,config) VALUES (?,?,?)`, conf.AppName, conf.Version, string(b))
+	if err := q.Exec(); err != nil {
+		g.L.Warn("access database error", zap.Error(err), zap.String("query", q.String()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusInternalServerError,
+			ErrCode: g.DatabaseC,
+			Message: g.DatabaseE,
+		})
+	}
+
+	payload, err := msgpack.Marshal(conf)
+	if err != nil {
+		g.L.Warn("msgpack Marshal", zap.String("error", err.Error()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusBadRequest,
+			ErrCode: g.ReqFailedC,
+			Message: g.ReqFailedE,
+		})
+	}
+
+	// 广播给所有collector，由agent所在的collector下发
+	if err := misc.MQ.Publish(configTopic(), payload); err != nil {
+		g.L.Warn("mq publish", zap.String("error", err.Error()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusBadRequest,
+			ErrCode: g.ReqFailedC,
+			Message: g.ReqFailedE,
+		})
+	}
+
+	return c.JSON(http.StatusOK, g.Result{
+		Status: http.StatusOK,
+		Data:   conf.Version,
+	})
+}
+
+// AppConfig 查询app配置和各agent的应用结果
+func AppConfig(c echo.Context) error {
+	appName := c.FormValue("app_name")
+
+	res := &AppConfigResult{
+		Acks: make([]*ConfigAck, 0),
+	}
+	var config string
+	q := misc.StaticCql.Query(`SELECT config FROM app_config WHERE app_name=?`, appName)
+	if err := q.Scan(&config); err == nil {
+		res.Config = network.NewAgentConfig()
+		json.Unmarshal([]byte(config), res.Config)
+	}
+
+	q = misc.TraceCql.Query(`SELECT agent_id,version,success,message,input_date FROM agent_config_ack WHERE app_name=?`, appName)
+	iter := q.Iter()
+
+	var agentID, message string
+	var version, inputDate int64
+	var success bool
+	for iter.Scan(&agentID, &version, &success, &message, &inputDate) {
+		res.Acks = append(res.Acks, &ConfigAck{
+			AgentID:   agentID,
+			Version:   version,
+			Success:   success,
+			Message:   message,
+			InputDate: misc.Timestamp2TimeString(inputDate),
+		})
+	}
+
+	if err := iter.Close(); err != nil {
+		g.L.Warn("access database error", zap.Error(err), zap.String("query", q.String()))
+		return c.JSON(http.StatusOK, g.Result{
+			Status:  http.StatusInternalServerError,
+			ErrCode: g.DatabaseC,
+			Message: g.DatabaseE,
+		})
+	}
+
+	return c.JSON(http.StatusOK, g.Result{
+		Status: http.StatusOK,
+		Data:   res,
+	})
+}
+
+func configTopic() string {
+	if misc.Conf.MQ.ConfigTopic == "" {
+		return "tracing_config"
+	}
+	return misc.Conf.MQ.ConfigTopic
+}
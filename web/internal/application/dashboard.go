@@ -22,6 +22,9 @@ type DashResult struct {
 	ApdexList   []float64 `json:"apdex_list"`
 	ErrorList   []float64 `json:"error_list"`
 	ExList      []int     `json:"ex_list"`
+	P50List     []int32   `json:"p50_list,omitempty"` // 分位耗时，只有接口图表返回
+	P90List     []int32   `json:"p90_list,omitempty"`
+	P99List     []int32   `json:"p99_list,omitempty"`
 }
 
 func Dashboard(c echo.Context) error {
@@ -95,7 +98,7 @@ func dashboard(appName string, start, end time.Time) ([]string, map[string]*Stat
 
 	// 180分钟之内不做数据聚合，保持原始数据
 	if intv <= 180 {
-		q := misc.TraceCql.Query(`SELECT duration,count,err_count,satisfaction,tolerate,input_date FROM api_stats WHERE app_name = ? and input_date > ? and input_date < ? `, appName, start.Unix(), end.Unix())
+		q := misc.NewStatsQuery(`SELECT duration,count,err_count,satisfaction,tolerate,input_date FROM %s WHERE app_name = ? and input_date > ? and input_date < ? `, "api_stats", appName, start, end, appName)
 		iter := q.Iter()
 
 		if iter.NumRows() == 0 {
@@ -125,7 +128,7 @@ func dashboard(appName string, start, end time.Time) ([]string, map[string]*Stat
 		}
 
 		// 获取JVM异常率
-		q1 := misc.TraceCql.Query(`SELECT count,input_date  FROM exception_stats WHERE app_name=? and input_date > ? and input_date < ? `, appName, start.Unix(), end.Unix())
+		q1 := misc.NewStatsQuery(`SELECT count,input_date  FROM %s WHERE app_name=? and input_date > ? and input_date < ? `, "exception_stats", appName, start, end, appName)
 		iter1 := q1.Iter()
 
 		var count1 int
@@ -178,7 +181,7 @@ func dashboard(appName string, start, end time.Time) ([]string, map[string]*Stat
 		}
 
 		// 读取相应数据，按照时间填到对应的桶中
-		q := misc.TraceCql.Query(`SELECT duration,count,err_count,satisfaction,tolerate,input_date FROM api_stats WHERE app_name = ? and input_date > ? and input_date < ? `, appName, start.Unix(), end.Unix())
+		q := misc.NewStatsQuery(`SELECT duration,count,err_count,satisfaction,tolerate,input_date FROM %s WHERE app_name = ? and input_date > ? and input_date < ? `, "api_stats", appName, start, end, appName)
 		iter := q.Iter()
 
 		if iter.NumRows() == 0 {
@@ -210,7 +213,7 @@ func dashboard(appName string, start, end time.Time) ([]string, map[string]*Stat
 		}
 
 		// 读取JVM异常数据，按照时间填到对应的桶中
-		q1 := misc.TraceCql.Query(`SELECT count,input_date  FROM exception_stats WHERE app_name=? and input_date > ? and input_date < ? `, appName, start.Unix(), end.Unix())
+		q1 := misc.NewStatsQuery(`SELECT count,input_date  FROM %s WHERE app_name=? and input_date > ? and input_date < ? `, "exception_stats", appName, start, end, appName)
 		iter1 := q1.Iter()
 
 		// apps := make(map[string]*AppStat)
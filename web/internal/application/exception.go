@@ -47,7 +47,7 @@ func ExceptionStats(c echo.Context) error {
 		})
 	}
 
-	q := misc.TraceCql.Query(`SELECT method_id,class_id,service_type,total_elapsed,max_elapsed,min_elapsed,count  FROM exception_stats WHERE app_name = ? and input_date > ? and input_date < ? `, appName, start.Unix(), end.Unix())
+	q := misc.NewStatsQuery(`SELECT method_id,class_id,service_type,total_elapsed,max_elapsed,min_elapsed,count  FROM %s WHERE app_name = ? and input_date > ? and input_date < ? `, "exception_stats", appName, start, end, appName)
 	iter := q.Iter()
 
 	var methodID, exceptionID, serType, elapsed, maxE, minE, count int
@@ -169,7 +169,7 @@ func ExceptionDashboard(c echo.Context) error {
 	}
 
 	// 读取相应数据，按照时间填到对应的桶中
-	q := misc.TraceCql.Query(`SELECT total_elapsed,count,input_date FROM exception_stats WHERE app_name = ? and class_id = ?  and input_date > ? and input_date < ?  ALLOW FILTERING `, appName, eid, start.Unix(), end.Unix())
+	q := misc.NewStatsQuery(`SELECT total_elapsed,count,input_date FROM %s WHERE app_name = ? and class_id = ?  and input_date > ? and input_date < ?  ALLOW FILTERING `, "exception_stats", appName, start, end, appName, eid)
 	iter := q.Iter()
 
 	// apps := make(map[string]*AppStat)
@@ -32,7 +32,7 @@ func Methods(c echo.Context) error {
 		})
 	}
 
-	q := misc.TraceCql.Query(`SELECT method_id,api,service_type,elapsed,max_elapsed,min_elapsed,count,err_count FROM method_stats WHERE app_name = ? and input_date > ? and input_date < ? `, appName, start.Unix(), end.Unix())
+	q := misc.NewStatsQuery(`SELECT method_id,api,service_type,elapsed,max_elapsed,min_elapsed,count,err_count FROM %s WHERE app_name = ? and input_date > ? and input_date < ? `, "method_stats", appName, start, end, appName)
 	iter := q.Iter()
 
 	var apiID, serType, elapsed, maxE, minE, count, errCount int
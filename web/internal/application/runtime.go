@@ -55,13 +55,26 @@ func (a jvmMetrics) Less(i, j int) bool { // 重写 Less() 方法， 从大到
 }
 
 type RuntimeResult struct {
-	Timeline           []string  `json:"timeline"`
-	JvmCpuList         []float64 `json:"jvm_cpu_list"`
-	SysCpuList         []float64 `json:"sys_cpu_list"`
-	JvmHeapList        []int64   `json:"jvm_heap_list"`
-	HeapMaxList        []int64   `json:"heap_max_list"`
-	FullgcCountList    []int64   `json:"fullgc_count_list"`
-	FullgcDurationList []int64   `json:"fullgc_duration_list"`
+	Timeline           []string    `json:"timeline"`
+	JvmCpuList         []float64   `json:"jvm_cpu_list"`
+	SysCpuList         []float64   `json:"sys_cpu_list"`
+	JvmHeapList        []int64     `json:"jvm_heap_list"`
+	HeapMaxList        []int64     `json:"heap_max_list"`
+	FullgcCountList    []int64     `json:"fullgc_count_list"`
+	FullgcDurationList []int64     `json:"fullgc_duration_list"`
+	Host               *HostResult `json:"host"`
+}
+
+// HostResult agent所在主机的监控数据
+type HostResult struct {
+	Timeline     []string  `json:"timeline"`
+	CpuList      []float64 `json:"cpu_list"`       // 百分比
+	MemUsedList  []int64   `json:"mem_used_list"`  // MB
+	MemTotalList []int64   `json:"mem_total_list"` // MB
+	Load1List    []float64 `json:"load1_list"`
+	DiskUsedList []float64 `json:"disk_used_list"` // 百分比
+	NetRecvList  []float64 `json:"net_recv_list"`  // KB/s
+	NetSentList  []float64 `json:"net_sent_list"`  // KB/s
 }
 
 func RuntimeDashboard(c echo.Context) error {
@@ -159,5 +172,47 @@ func dashData(appName, agentID string, start, end int64) (*RuntimeResult, error)
 		return nil, err
 	}
 
-	return &RuntimeResult{timeline, jvmCPUList, sysCPUList, jvmHeapList, heapMaxList, fullgcCountList, fullgcDurationList}, nil
+	// 主机数据查询失败不影响jvm数据展示
+	host, err := hostData(appName, agentID, start, end)
+	if err != nil {
+		g.L.Warn("host data", zap.Error(err), zap.String("appName", appName), zap.String("agentID", agentID))
+		host = &HostResult{}
+	}
+
+	return &RuntimeResult{timeline, jvmCPUList, sysCPUList, jvmHeapList, heapMaxList, fullgcCountList, fullgcDurationList, host}, nil
+}
+
+// hostData 查询主机监控数据，按时间排序
+func hostData(appName, agentID string, start, end int64) (*HostResult, error) {
+	q := misc.TraceCql.Query(`SELECT input_date,metrics  FROM agent_system WHERE app_name = ?  and agent_id = ? and input_date > ? and input_date < ? `, appName, agentID, start, end)
+	iter := q.Iter()
+
+	host := &HostResult{}
+	var metrics string
+	var inputDate int64
+	for iter.Scan(&inputDate, &metrics) {
+		m := stats.NewSystemInfo()
+		json.Unmarshal([]byte(metrics), &m)
+
+		var diskUsed float64
+		if m.Disk.Total > 0 {
+			diskUsed = utils.DecimalPrecision(float64(m.Disk.Used) * 100 / float64(m.Disk.Total))
+		}
+
+		host.Timeline = append(host.Timeline, misc.TimeToChartString1(time.Unix(inputDate, 0)))
+		host.CpuList = append(host.CpuList, utils.DecimalPrecision(m.CPU.Used*100)) // 百分比
+		host.MemUsedList = append(host.MemUsedList, m.Memory.Used/(1024*1024))      // 字节 - > MB
+		host.MemTotalList = append(host.MemTotalList, m.Memory.Total/(1024*1024))   // 字节 - > MB
+		host.Load1List = append(host.Load1List, m.Load.Load1)
+		host.DiskUsedList = append(host.DiskUsedList, diskUsed)
+		host.NetRecvList = append(host.NetRecvList, utils.DecimalPrecision(m.Network.RecvBytes/1024)) // 字节 - > KB
+		host.NetSentList = append(host.NetSentList, utils.DecimalPrecision(m.Network.SentBytes/1024)) // 字节 - > KB
+	}
+
+	if err := iter.Close(); err != nil {
+		g.L.Warn("access database error", zap.Error(err), zap.String("query", q.String()))
+		return nil, err
+	}
+
+	return host, nil
 }
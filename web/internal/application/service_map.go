@@ -102,13 +102,13 @@ func QueryAPPServiceMap(c echo.Context) error {
 	}
 
 	// 获取当前APP的子应用信息
-	q = misc.TraceCql.Query(`SELECT target_name,target_type,access_count,access_err_count,access_duration FROM service_map WHERE source_name = ? and input_date > ? and input_date < ?`, tname, start.Unix(), end.Unix())
-	iter = q.Iter()
+	q1 := misc.NewStatsQuery(`SELECT target_name,target_type,access_count,access_err_count,access_duration FROM %s WHERE source_name = ? and input_date > ? and input_date < ?`, "service_map", tname, start, end, tname)
+	iter1 := q1.Iter()
 
 	// 当前应用变成了源应用
 	sname = tname
 	var ttype int16
-	for iter.Scan(&tname, &ttype, &accessCount, &accessErr, &accessDuration) {
+	for iter1.Scan(&tname, &ttype, &accessCount, &accessErr, &accessDuration) {
 		if ttype == constant.MYSQL_EXECUTE_QUERY {
 			tname = "MYSQL"
 		}
@@ -131,8 +131,8 @@ func QueryAPPServiceMap(c echo.Context) error {
 		}
 	}
 
-	if err := iter.Close(); err != nil {
-		g.L.Warn("access database error", zap.Error(err), zap.String("query", q.String()))
+	if err := iter1.Close(); err != nil {
+		g.L.Warn("access database error", zap.Error(err), zap.String("query", q1.String()))
 		return c.JSON(http.StatusOK, g.Result{
 			Status:  http.StatusInternalServerError,
 			ErrCode: g.DatabaseC,
@@ -57,7 +57,7 @@ func SqlStats(c echo.Context) error {
 		})
 	}
 
-	q := misc.TraceCql.Query(`SELECT sql,max_elapsed,min_elapsed,elapsed,count,err_count FROM sql_stats WHERE app_name = ? and input_date > ? and input_date < ? `, appName, start.Unix(), end.Unix())
+	q := misc.NewStatsQuery(`SELECT sql,max_elapsed,min_elapsed,elapsed,count,err_count FROM %s WHERE app_name = ? and input_date > ? and input_date < ? `, "sql_stats", appName, start, end, appName)
 	iter := q.Iter()
 
 	var sqlID, maxE, minE, count, errCount, elapsed int
@@ -125,7 +125,7 @@ func SqlDashboard(c echo.Context) error {
 	timeline := make([]string, 0)
 
 	// 读取相应数据，按照时间填到对应的桶中
-	q := misc.TraceCql.Query(`SELECT elapsed,count,err_count,input_date FROM sql_stats WHERE app_name = ?  and sql = ? and input_date > ? and input_date < ?`, appName, sqlID, start.Unix(), end.Unix())
+	q := misc.NewStatsQuery(`SELECT elapsed,count,err_count,input_date FROM %s WHERE app_name = ?  and sql = ? and input_date > ? and input_date < ?`, "sql_stats", appName, start, end, appName, sqlID)
 	iter := q.Iter()
 
 	// apps := make(map[string]*AppStat)
@@ -29,6 +29,12 @@ type Config struct {
 	Web struct {
 		Addr string
 	}
+
+	MQ struct {
+		Addrs        []string // mq地址
+		CommandTopic string   // 下发pinpoint指令的主题
+		ConfigTopic  string   // 修改app配置的主题
+	}
 }
 
 // Conf ...
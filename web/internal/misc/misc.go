@@ -6,6 +6,7 @@ import (
 
 	"github.com/imdevlab/g"
 
+	"github.com/bsed/trace/pkg/mq"
 	"github.com/gocql/gocql"
 	"github.com/imdevlab/g/utils"
 	"github.com/labstack/echo"
@@ -14,6 +15,9 @@ import (
 var StaticCql *gocql.Session
 var TraceCql *gocql.Session
 
+// MQ 用于向collector下发指令
+var MQ *mq.Nats
+
 // 获取开始和截止日期
 func StartEndDate(c echo.Context) (start time.Time, end time.Time, err error) {
 	startRaw := c.FormValue("start")
@@ -0,0 +1,150 @@
+package misc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bsed/trace/pkg/stats"
+	"github.com/gocql/gocql"
+)
+
+// 查询范围内至少有这么多个汇总窗口时才使用该精度，和图表的30个点对应
+const minRollupPoints = 30
+
+// statsSegment 一段查询时间范围和对应的统计表，不包含start和end
+type statsSegment struct {
+	table string
+	start int64
+	end   int64
+}
+
+// StatsQuery 统计表查询，根据时间范围选择分钟表或者汇总表
+type StatsQuery struct {
+	stmt     string
+	values   []interface{}
+	segments []statsSegment
+}
+
+// NewStatsQuery stmt中的表名用%s代替，最后两个参数为input_date > ? and input_date < ?，
+// values为时间以外的参数，appName为分区key，用来查询汇总进度
+func NewStatsQuery(stmt, table, appName string, start, end time.Time, values ...interface{}) *StatsQuery {
+	return &StatsQuery{
+		stmt:     stmt,
+		values:   values,
+		segments: statsSegments(table, appName, start.Unix(), end.Unix()),
+	}
+}
+
+// statsSegments 选择查询范围内至少有minRollupPoints个窗口的最粗精度，
+// 已经汇总的完整窗口查询汇总表，开头和汇总进度之后的部分查询分钟表
+func statsSegments(table, appName string, start, end int64) []statsSegment {
+	segments := []statsSegment{{table, start, end}}
+
+	var rollup *stats.Rollup
+	for _, r := range stats.Rollups {
+		if end-start >= minRollupPoints*r.Interval {
+			rollup = r
+		}
+	}
+	if rollup == nil {
+		return segments
+	}
+
+	var progress int64
+	if err := TraceCql.Query(`SELECT input_date FROM stats_rollup WHERE app_name=? AND resolution=?`, appName, rollup.Interval).Scan(&progress); err != nil {
+		return segments
+	}
+
+	first := rollup.Align(start) + rollup.Interval
+	last := rollup.Align(end)
+	if progress < last {
+		last = progress
+	}
+	if first >= last {
+		return segments
+	}
+
+	return []statsSegment{
+		{table, start, first},
+		{rollup.Table(table), first - 1, last},
+		{table, last - 1, end},
+	}
+}
+
+// Iter 依次查询各段
+func (q *StatsQuery) Iter() *StatsIter {
+	return &StatsIter{query: q}
+}
+
+// String 查询语句，用于日志
+func (q *StatsQuery) String() string {
+	tables := make([]string, 0, len(q.segments))
+	for _, seg := range q.segments {
+		tables = append(tables, fmt.Sprintf("%s(%d,%d)", seg.table, seg.start, seg.end))
+	}
+	return fmt.Sprintf("%s %v %s", q.stmt, q.values, strings.Join(tables, ","))
+}
+
+// StatsIter 多段查询的结果，Scan、Close的用法和gocql.Iter一致
+type StatsIter struct {
+	query *StatsQuery
+	index int
+	iter  *gocql.Iter
+	err   error
+}
+
+// next 打开下一段查询，没有更多时返回false
+func (i *StatsIter) next() bool {
+	if i.iter != nil {
+		if err := i.iter.Close(); err != nil && i.err == nil {
+			i.err = err
+		}
+		i.iter = nil
+	}
+	if i.index >= len(i.query.segments) {
+		return false
+	}
+	seg := i.query.segments[i.index]
+	i.index++
+	values := append(append([]interface{}{}, i.query.values...), seg.start, seg.end)
+	i.iter = TraceCql.Query(fmt.Sprintf(i.query.stmt, seg.table), values...).Iter()
+	return true
+}
+
+// Scan 读取下一行，当前段读完后继续查询下一段
+func (i *StatsIter) Scan(dest ...interface{}) bool {
+	if i.iter == nil && !i.next() {
+		return false
+	}
+	for !i.iter.Scan(dest...) {
+		if !i.next() {
+			return false
+		}
+	}
+	return true
+}
+
+// NumRows 当前段的行数，当前段为空时继续查询下一段，所有段都为空时返回0
+func (i *StatsIter) NumRows() int {
+	if i.iter == nil && !i.next() {
+		return 0
+	}
+	for i.iter.NumRows() == 0 {
+		if !i.next() {
+			return 0
+		}
+	}
+	return i.iter.NumRows()
+}
+
+// Close 关闭查询，返回第一个错误
+func (i *StatsIter) Close() error {
+	if i.iter != nil {
+		if err := i.iter.Close(); err != nil && i.err == nil {
+			i.err = err
+		}
+		i.iter = nil
+	}
+	return i.err
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/bsed/trace/pkg/mq"
 	"github.com/gocql/gocql"
 	"github.com/imdevlab/g"
 	"github.com/bsed/trace/web/internal/admin"
@@ -32,6 +33,9 @@ func (s *Web) Start() error {
 	// 初始化Cql连接
 	s.initCql()
 
+	// 初始化mq连接
+	s.initMQ()
+
 	// 初始化超级管理员
 	admin.InitSuperAdmin()
 
@@ -93,6 +97,18 @@ func (s *Web) Start() error {
 		//查询所有服务器名
 		e.GET("/web/agentList", app.QueryAgents, s.checkLogin)
 
+		// pinpoint agent指令，线程dump、活跃线程
+		e.POST("/web/agentCommand", app.AgentCommand, s.checkLogin)
+		e.GET("/web/agentCommandResult", app.AgentCommandResult, s.checkLogin)
+		// 实时活跃线程数
+		e.GET("/web/activeThread", app.ActiveThread, s.checkLogin)
+		// app配置，由collector下发给agent
+		e.POST("/web/setAppConfig", app.SetAppConfig, s.checkLogin)
+		e.GET("/web/appConfig", app.AppConfig, s.checkLogin)
+		// apdex阈值，由collector定时加载
+		e.POST("/web/setAppApdex", app.SetAppApdex, s.checkLogin)
+		e.GET("/web/appApdex", app.AppApdex, s.checkLogin)
+
 		// 应用拓扑图
 		e.GET("/web/appServiceMap", app.QueryAPPServiceMap, s.checkLogin)
 		// 应用地图
@@ -179,6 +195,14 @@ func (web *Web) checkLogin(f echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+func (web *Web) initMQ() {
+	nats := mq.NewNats(g.L)
+	if err := nats.Start(misc.Conf.MQ.Addrs); err != nil {
+		g.L.Fatal("Init web mq error", zap.String("error", err.Error()))
+	}
+	misc.MQ = nats
+}
+
 func (web *Web) initCql() {
 	cqlCluster := gocql.NewCluster(misc.Conf.Storage.Cluster...)
 	cqlCluster.Keyspace = "tracing_static"